@@ -0,0 +1,175 @@
+package run
+
+/*
+ * The functions in this file bring k3s containers created without k3d (manually or by other tools) under the
+ * management of k3d (`k3d adopt`). Labels of docker containers can't be changed, so the containers are recreated
+ * with the labels of k3d, keeping their names, volumes and networks.
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/urfave/cli"
+)
+
+// k3sAPIPort is the port the API server of k3s listens on unless --https-listen-port is set
+const k3sAPIPort = "6443"
+
+// adoptedLabel marks the nodes of adopted clusters. Their server and network don't have the names k3d gives them,
+// so workers created by k3d couldn't join these clusters.
+const adoptedLabel = "adopted"
+
+// checkNotAdopted refuses to add workers to an adopted cluster
+func checkNotAdopted(cl cluster) error {
+	if cl.server.Labels[adoptedLabel] == "true" {
+		return fmt.Errorf("ERROR: cluster %s was adopted from existing containers, k3d can't add workers to it (they'd join a server and network that don't exist under the names k3d uses)", cl.name)
+	}
+	return nil
+}
+
+// adoptedNode is a k3s container to be adopted into a cluster
+type adoptedNode struct {
+	inspect types.ContainerJSON
+	role    string // server or worker
+	labels  map[string]string
+}
+
+// getAdoptedNode inspects a container and checks that it runs k3s in the expected role and isn't managed by k3d yet
+func getAdoptedNode(ctx context.Context, docker *client.Client, name, role string) (adoptedNode, error) {
+	logDebugf("ContainerInspect %s", name)
+	inspect, err := docker.ContainerInspect(ctx, name)
+	if err != nil {
+		return adoptedNode{}, checkDockerError(fmt.Errorf("ERROR: couldn't inspect container %s\n%w", name, err))
+	}
+	if inspect.Config.Labels["app"] == "k3d" {
+		return adoptedNode{}, fmt.Errorf("ERROR: container %s already belongs to k3d cluster %s", name, inspect.Config.Labels["cluster"])
+	}
+
+	command := "agent"
+	if role == "server" {
+		command = "server"
+	}
+	if len(inspect.Config.Cmd) == 0 || inspect.Config.Cmd[0] != command {
+		return adoptedNode{}, fmt.Errorf("ERROR: container %s doesn't run `k3s %s`, so it can't be adopted as %s (command: %v)", name, command, role, inspect.Config.Cmd)
+	}
+	return adoptedNode{inspect: inspect, role: role}, nil
+}
+
+// getAdoptedAPIPort returns the port the API server of a k3s server container listens on
+func getAdoptedAPIPort(server types.ContainerJSON) string {
+	args := server.Config.Cmd
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "--https-listen-port" {
+			return args[i+1]
+		}
+	}
+	return k3sAPIPort
+}
+
+// Adopt brings existing k3s containers under the management of k3d:
+// `k3d adopt --name <cluster> <server-container> [worker-container...]`.
+// The containers are recreated with the labels of k3d, so list, start, stop and delete work on them afterwards.
+func Adopt(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("ERROR: please specify the server container and the worker containers to adopt")
+	}
+	name := c.String("name")
+	if err := CheckClusterName(name); err != nil {
+		return err
+	}
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return err
+	}
+	if _, exists := clusters[name]; exists {
+		return fmt.Errorf("ERROR: cluster %s already exists", name)
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	// check all containers before touching any of them
+	nodes := []adoptedNode{}
+	for i, containerName := range c.Args() {
+		role := "worker"
+		if i == 0 {
+			role = "server"
+		}
+		node, err := getAdoptedNode(ctx, docker, containerName, role)
+		if err != nil {
+			return err
+		}
+		node.labels = map[string]string{
+			"app":        "k3d",
+			"prefix":     containerNamePrefix,
+			"component":  role,
+			"created":    labelTimestamp(),
+			"cluster":    name,
+			adoptedLabel: "true",
+		}
+		if role == "server" {
+			node.labels["apiPort"] = getAdoptedAPIPort(node.inspect)
+		} else {
+			node.labels["index"] = strconv.Itoa(i - 1)
+		}
+		nodes = append(nodes, node)
+	}
+
+	// the server first, so that the workers find it when they come up again
+	for _, node := range nodes {
+		containerName := strings.TrimPrefix(node.inspect.Name, "/")
+		log.Printf("Adopting %s as %s of cluster %s", containerName, node.role, name)
+		labels := node.labels
+		if _, err := recreateNode(ctx, docker, node.inspect.ID, func(config *container.Config) {
+			if config.Labels == nil {
+				config.Labels = map[string]string{}
+			}
+			for k, v := range labels {
+				config.Labels[k] = v
+			}
+		}); err != nil {
+			return fmt.Errorf("ERROR: couldn't adopt %s into cluster %s, the nodes before it were adopted already\n%w", containerName, name, err)
+		}
+	}
+
+	// store the spec and metadata of a cluster created by k3d
+	createClusterDir(name)
+	clusters, err = getClusters(false, name)
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[name]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, name)
+	}
+	if spec, err := exportClusterSpec(ctx, docker, cl); err != nil {
+		logWarningf("couldn't derive the spec of cluster %s\n%+v", name, err)
+	} else if err := writeClusterSpec(spec); err != nil {
+		logWarningf("couldn't store cluster spec\n%+v", err)
+	}
+	if err := writeClusterMetadata(name); err != nil {
+		logWarningf("couldn't store cluster metadata\n%+v", err)
+	}
+
+	if cl.server.NetworkSettings != nil {
+		for networkName := range cl.server.NetworkSettings.Networks {
+			logInfof("network %s wasn't created by k3d, so it's kept when cluster %s is deleted", networkName, name)
+		}
+	}
+	logSuccessf("Adopted %d node(s) into cluster [%s]", len(nodes), name)
+	log.Printf(`You can now use the cluster with:
+	export KUBECONFIG="$(%s get-kubeconfig --name='%s')"
+	kubectl cluster-info`, os.Args[0], name)
+	return nil
+}
@@ -0,0 +1,409 @@
+package run
+
+/*
+ * The functions in this file converge an existing cluster towards a declarative cluster spec (`k3d apply`).
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"github.com/urfave/cli"
+)
+
+// nodeConfig contains the settings of a node container that can only be changed by recreating it
+type nodeConfig struct {
+	image   string
+	cmd     []string
+	env     []string
+	volumes []string
+	ports   []string
+	storage nodeStorageOptions
+}
+
+// applyChange is a single step required to converge a cluster towards its spec
+type applyChange struct {
+	action  string // create, recreate, add, remove
+	target  string
+	cluster bool // the change affects the whole cluster instead of a single worker
+	index   int  // worker index for worker changes
+	reasons []string
+}
+
+func (c applyChange) String() string {
+	symbols := map[string]string{"create": "+", "add": "+", "remove": "-", "recreate": "~"}
+	s := fmt.Sprintf("  %s %s %s", symbols[c.action], c.action, c.target)
+	if len(c.reasons) > 0 {
+		s += fmt.Sprintf(" (%s)", strings.Join(c.reasons, "; "))
+	}
+	return s
+}
+
+// k3dManagedEnv are environment variables set by k3d itself, which are not part of the spec
+var k3dManagedEnv = []string{"K3S_KUBECONFIG_OUTPUT", "K3S_CLUSTER_SECRET", "K3S_TOKEN", "K3S_URL"}
+
+// normalizePortBindings renders port bindings as sorted list of hostIP:hostPort:containerPort/protocol
+func normalizePortBindings(bindings nat.PortMap) []string {
+	ports := []string{}
+	for port, portBindings := range bindings {
+		for _, binding := range portBindings {
+			ports = append(ports, fmt.Sprintf("%s:%s:%s", binding.HostIP, binding.HostPort, port))
+		}
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// sortedCopy returns a sorted copy of a string slice, treating nil like an empty slice
+func sortedCopy(s []string) []string {
+	c := append([]string{}, s...)
+	sort.Strings(c)
+	return c
+}
+
+// desiredServerConfig returns the node config the server of a cluster described by spec will have
+func desiredServerConfig(spec *clusterSpec, portmap map[string][]string) (nodeConfig, error) {
+	ports, err := getServerPublishedPorts(portmap, GetContainerName("server", spec.Name, -1), spec.apiPortString())
+	if err != nil {
+		return nodeConfig{}, err
+	}
+	cmd := append([]string{"server"}, spec.k3sServerArgs()...)
+	return nodeConfig{
+		image:   spec.nodeImage("server", -1),
+		cmd:     cmd,
+		env:     sortedCopy(spec.Env),
+		volumes: sortedCopy(spec.Volumes),
+		ports:   normalizePortBindings(ports.PortBindings),
+		storage: spec.storageOptions("server", GetContainerName("server", spec.Name, -1)),
+	}, nil
+}
+
+// desiredWorkerConfig returns the node config of the worker with the given index in a cluster described by spec
+func desiredWorkerConfig(spec *clusterSpec, index int, portmap map[string][]string) (nodeConfig, error) {
+	ports, err := getWorkerPublishedPorts(portmap, GetContainerName("worker", spec.Name, index), index, spec.PortAutoOffset)
+	if err != nil {
+		return nodeConfig{}, err
+	}
+	return nodeConfig{
+		image:   spec.nodeImage("worker", index),
+		cmd:     append([]string{"agent"}, spec.k3sAgentArgs(index)...),
+		env:     sortedCopy(spec.Env),
+		volumes: sortedCopy(spec.Volumes),
+		ports:   normalizePortBindings(ports.PortBindings),
+		storage: spec.storageOptions("worker", GetContainerName("worker", spec.Name, index)),
+	}, nil
+}
+
+// actualNodeConfig inspects a node container and returns its node config.
+// Environment variables inherited from the image or managed by k3d are filtered out.
+func actualNodeConfig(ctx context.Context, docker *client.Client, ID string) (nodeConfig, error) {
+	logDebugf("ContainerInspect %s", ID)
+	inspect, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return nodeConfig{}, fmt.Errorf("ERROR: couldn't inspect container %s\n%w", ID, err)
+	}
+
+	imageEnv := map[string]bool{}
+	if img, _, err := docker.ImageInspectWithRaw(ctx, inspect.Image); err == nil && img.Config != nil {
+		for _, e := range img.Config.Env {
+			imageEnv[e] = true
+		}
+	}
+
+	// passed through host variables aren't part of the spec, only their patterns
+	passthrough := getEnvPassthrough(inspect.Config.Labels)
+	env := []string{}
+	for _, e := range inspect.Config.Env {
+		key := strings.SplitN(e, "=", 2)[0]
+		managed := matchesEnvPassthrough(passthrough, key)
+		for _, m := range k3dManagedEnv {
+			if key == m {
+				managed = true
+			}
+		}
+		if !managed && !imageEnv[e] {
+			env = append(env, e)
+		}
+	}
+
+	// the bind mount of the kubeconfig output is managed by k3d as well
+	volumes := []string{}
+	outputDir, _ := getClusterKubeConfigOutputDir(inspect.Config.Labels["cluster"])
+	for _, bind := range inspect.HostConfig.Binds {
+		if !strings.HasPrefix(bind, outputDir+":") && !isResolvConfBind(bind) {
+			volumes = append(volumes, bind)
+		}
+	}
+
+	// the tmpfs mounts for /run and /var/run (and the home of rootless nodes) are managed by k3d
+	tmpfs := []string{}
+	for path, options := range inspect.HostConfig.Tmpfs {
+		if containsString(managedTmpfsPaths, path) {
+			continue
+		}
+		if options != "" {
+			path = fmt.Sprintf("%s:%s", path, options)
+		}
+		tmpfs = append(tmpfs, path)
+	}
+	sort.Strings(tmpfs)
+
+	return nodeConfig{
+		image:   inspect.Config.Image,
+		cmd:     inspect.Config.Cmd,
+		env:     sortedCopy(env),
+		volumes: sortedCopy(volumes),
+		ports:   normalizePortBindings(inspect.HostConfig.PortBindings),
+		storage: nodeStorageOptions{
+			tmpfsSize:   strings.TrimPrefix(inspect.HostConfig.Tmpfs["/run"], "size="),
+			storageSize: inspect.HostConfig.StorageOpt["size"],
+			tmpfs:       tmpfs,
+			readOnly:    inspect.HostConfig.ReadonlyRootfs,
+		},
+	}, nil
+}
+
+// diffNodeConfig returns human readable reasons why the actual node config differs from the desired one
+func diffNodeConfig(desired, actual nodeConfig) []string {
+	reasons := []string{}
+	if desired.image != actual.image {
+		reasons = append(reasons, fmt.Sprintf("image %s -> %s", actual.image, desired.image))
+	}
+	if desired.cmd != nil && strings.Join(desired.cmd, " ") != strings.Join(actual.cmd, " ") {
+		reasons = append(reasons, fmt.Sprintf("args %v -> %v", actual.cmd, desired.cmd))
+	}
+	if strings.Join(desired.env, ",") != strings.Join(actual.env, ",") {
+		reasons = append(reasons, "env changed")
+	}
+	if strings.Join(desired.volumes, ",") != strings.Join(actual.volumes, ",") {
+		reasons = append(reasons, fmt.Sprintf("volumes %v -> %v", actual.volumes, desired.volumes))
+	}
+	if strings.Join(desired.ports, ",") != strings.Join(actual.ports, ",") {
+		reasons = append(reasons, fmt.Sprintf("ports %v -> %v", actual.ports, desired.ports))
+	}
+	if !desired.storage.equal(actual.storage) {
+		reasons = append(reasons, fmt.Sprintf("storage limits %+v -> %+v", actual.storage, desired.storage))
+	}
+	return reasons
+}
+
+// getWorkerIndex returns the index of a worker from its index label, or for workers created before
+// the label was introduced from its container name (k3d-<cluster>-worker-<index>)
+func getWorkerIndex(worker types.Container) (int, error) {
+	if index, ok := worker.Labels["index"]; ok {
+		return strconv.Atoi(index)
+	}
+	for _, name := range worker.Names {
+		i := strings.LastIndex(name, "-worker-")
+		if i < 0 {
+			continue
+		}
+		return strconv.Atoi(name[i+len("-worker-"):])
+	}
+	return -1, fmt.Errorf("ERROR: couldn't determine the index of worker %v", worker.Names)
+}
+
+// getClusterTokenEnv returns the environment variables that let a new worker join the cluster.
+// Clusters created without workers don't have a k3d generated secret, so the token generated by k3s is used instead.
+func getClusterTokenEnv(ctx context.Context, docker *client.Client, server types.Container) ([]string, error) {
+	logDebugf("ContainerInspect %s", server.ID)
+	inspect, err := docker.ContainerInspect(ctx, server.ID)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't inspect server container %s\n%w", server.ID, err)
+	}
+
+	tokenEnv := []string{}
+	for _, e := range inspect.Config.Env {
+		if strings.HasPrefix(e, "K3S_CLUSTER_SECRET=") || strings.HasPrefix(e, "K3S_TOKEN=") {
+			tokenEnv = append(tokenEnv, e)
+		}
+	}
+	if len(tokenEnv) > 0 {
+		return tokenEnv, nil
+	}
+
+	output, exitCode, err := execInContainer(ctx, docker, server.ID, []string{"cat", "/var/lib/rancher/k3s/server/node-token"})
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		return nil, fmt.Errorf("ERROR: couldn't read the node token from server container %s\n%s", server.ID, output)
+	}
+	return []string{fmt.Sprintf("K3S_TOKEN=%s", strings.TrimSpace(output))}, nil
+}
+
+// planApply computes the changes required to converge an existing cluster towards its spec
+func planApply(ctx context.Context, docker *client.Client, spec *clusterSpec, cl cluster, portmap map[string][]string) ([]applyChange, error) {
+	desiredServer, err := desiredServerConfig(spec, portmap)
+	if err != nil {
+		return nil, err
+	}
+	actualServer, err := actualNodeConfig(ctx, docker, cl.server.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the server can't be replaced without losing the cluster state, so the whole cluster gets recreated
+	if reasons := diffNodeConfig(desiredServer, actualServer); len(reasons) > 0 {
+		return []applyChange{{action: "recreate", target: fmt.Sprintf("cluster %s", spec.Name), cluster: true, reasons: reasons}}, nil
+	}
+
+	changes := []applyChange{}
+	existing := map[int]bool{}
+	for _, worker := range cl.workers {
+		index, err := getWorkerIndex(worker)
+		if err != nil {
+			return nil, err
+		}
+		existing[index] = true
+		target := GetContainerName("worker", spec.Name, index)
+
+		if index >= spec.Workers {
+			changes = append(changes, applyChange{action: "remove", target: target, index: index})
+			continue
+		}
+
+		desired, err := desiredWorkerConfig(spec, index, portmap)
+		if err != nil {
+			return nil, err
+		}
+		actual, err := actualNodeConfig(ctx, docker, worker.ID)
+		if err != nil {
+			return nil, err
+		}
+		if reasons := diffNodeConfig(desired, actual); len(reasons) > 0 {
+			changes = append(changes, applyChange{action: "recreate", target: target, index: index, reasons: reasons})
+		}
+	}
+
+	for index := 0; index < spec.Workers; index++ {
+		if !existing[index] {
+			changes = append(changes, applyChange{action: "add", target: GetContainerName("worker", spec.Name, index), index: index})
+		}
+	}
+
+	return changes, nil
+}
+
+// Apply converges a cluster towards the spec in a file: it creates missing clusters,
+// adds and removes workers and recreates nodes whose immutable settings changed
+func Apply(c *cli.Context) error {
+	if c.String("file") == "" {
+		return fmt.Errorf("ERROR: please specify a cluster spec file with --file/-f")
+	}
+	spec, err := loadClusterSpec(c.String("file"))
+	if err != nil {
+		return err
+	}
+
+	clusters, err := getClusters(false, spec.Name)
+	if err != nil {
+		return err
+	}
+	cl, exists := clusters[spec.Name]
+
+	if !exists {
+		fmt.Printf("Changes for cluster [%s]:\n%s\n", spec.Name, applyChange{action: "create", target: fmt.Sprintf("cluster %s", spec.Name), cluster: true})
+		if c.Bool("dry-run") {
+			return nil
+		}
+		return createCluster(spec, createOptions{diagnosticsLines: defaultDiagnosticsLogLines})
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	portmap, err := mapNodesToPortSpecs(spec.Ports, GetAllContainerNames(spec.Name, defaultServerCount, spec.Workers))
+	if err != nil {
+		return err
+	}
+	if err := spec.checkHostPortConflicts(portmap); err != nil {
+		return err
+	}
+
+	changes, err := planApply(ctx, docker, spec, cl, portmap)
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 {
+		fmt.Printf("Cluster [%s] is up to date\n", spec.Name)
+		return nil
+	}
+	fmt.Printf("Changes for cluster [%s]:\n", spec.Name)
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if c.Bool("dry-run") {
+		return nil
+	}
+
+	if changes[0].cluster {
+		if err := checkClusterProtection(cl, false); err != nil {
+			return fmt.Errorf("%w\nThe changes require recreating the cluster", err)
+		}
+		if err := deleteCluster(cl); err != nil {
+			return err
+		}
+		return createCluster(spec, createOptions{diagnosticsLines: defaultDiagnosticsLogLines})
+	}
+
+	for _, change := range changes {
+		if change.action == "add" || change.action == "recreate" {
+			if err := checkNotAdopted(cl); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	tokenEnv, err := getClusterTokenEnv(ctx, docker, cl.server)
+	if err != nil {
+		return err
+	}
+
+	workers := map[int]types.Container{}
+	for _, worker := range cl.workers {
+		if index, err := getWorkerIndex(worker); err == nil {
+			workers[index] = worker
+		}
+	}
+
+	for _, change := range changes {
+		log.Printf("Applying: %s", strings.TrimSpace(change.String()))
+		if change.action == "remove" || change.action == "recreate" {
+			if err := removeContainer(workers[change.index].ID); err != nil {
+				return err
+			}
+		}
+		if change.action == "add" || change.action == "recreate" {
+			if _, err := createClusterWorker(spec, change.index, portmap, tokenEnv); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := syncContainerdProxies(spec); err != nil {
+		logWarningf("couldn't expose containerd of cluster %s\n%+v", spec.Name, err)
+	}
+
+	if err := writeClusterSpec(spec); err != nil {
+		logWarningf("couldn't store cluster spec\n%+v", err)
+	}
+	if err := writeClusterMetadata(spec.Name); err != nil {
+		logWarningf("couldn't store cluster metadata\n%+v", err)
+	}
+
+	logSuccessf("applied spec to cluster [%s]", spec.Name)
+	return nil
+}
@@ -0,0 +1,222 @@
+package run
+
+/*
+ * The functions in this file look up registry credentials for image pulls,
+ * the same way the docker CLI does: ~/.docker/config.json and credential helpers.
+ */
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli"
+)
+
+// dockerHubAuthKey is the key used for Docker Hub in the docker config file
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// dockerConfigAuth is a single entry of the auths section of the docker config file
+type dockerConfigAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// dockerConfigFile is the subset of ~/.docker/config.json relevant for registry authentication
+type dockerConfigFile struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+// registryCredentialsOverride replaces the credentials from the docker config for pulls from its ServerAddress, if set
+var registryCredentialsOverride *registry.AuthConfig
+
+// SetRegistryCredentials overrides the credentials used for image pulls from a registry (e.g. in CI, where there's
+// no docker config). server is the registry host (e.g. ghcr.io), images of other registries are pulled as before.
+func SetRegistryCredentials(server, username, password string) {
+	registryCredentialsOverride = &registry.AuthConfig{
+		Username:      username,
+		Password:      password,
+		ServerAddress: getRegistryServerAddress(server),
+	}
+}
+
+// setRegistryCredentialsFromFlags applies --registry-username and --registry-password-stdin, if given.
+// They are used for the registry of --registry-server, or of the k3s image by default.
+func setRegistryCredentialsFromFlags(c *cli.Context, image string) error {
+	if !c.IsSet("registry-username") {
+		if c.Bool("registry-password-stdin") {
+			return fmt.Errorf("ERROR: --registry-password-stdin requires --registry-username")
+		}
+		if c.IsSet("registry-server") {
+			return fmt.Errorf("ERROR: --registry-server requires --registry-username")
+		}
+		return nil
+	}
+
+	server := c.String("registry-server")
+	if server == "" {
+		named, err := reference.ParseNormalizedNamed(image)
+		if err != nil {
+			return fmt.Errorf("ERROR: couldn't parse image %s\n%w", image, err)
+		}
+		server = reference.Domain(named)
+	}
+
+	password := ""
+	if c.Bool("registry-password-stdin") {
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("ERROR: couldn't read registry password from stdin\n%w", err)
+		}
+		password = strings.TrimRight(string(content), "\r\n")
+	}
+	SetRegistryCredentials(server, c.String("registry-username"), password)
+	return nil
+}
+
+// getRegistryServerAddress returns the key of a registry host in the docker config,
+// which differs from the host for Docker Hub
+func getRegistryServerAddress(domain string) string {
+	if domain == "docker.io" || domain == "index.docker.io" {
+		return dockerHubAuthKey
+	}
+	return domain
+}
+
+// getDockerConfigPath returns the path of the docker config file, honoring $DOCKER_CONFIG
+func getDockerConfigPath() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return path.Join(dir, "config.json"), nil
+	}
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(homeDir, ".docker", "config.json"), nil
+}
+
+// loadDockerConfig reads the docker config file. A missing file is not an error.
+func loadDockerConfig() (*dockerConfigFile, error) {
+	config := &dockerConfigFile{}
+	configPath, err := getDockerConfigPath()
+	if err != nil {
+		return config, nil
+	}
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, fmt.Errorf("ERROR: couldn't read docker config %s\n%w", configPath, err)
+	}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't parse docker config %s\n%w", configPath, err)
+	}
+	return config, nil
+}
+
+// getCredentialsFromHelper runs docker-credential-<helper> to get the credentials for a registry
+func getCredentialsFromHelper(helper, serverAddress string) (*registry.AuthConfig, error) {
+	logDebugf("docker-credential-%s get %s", helper, serverAddress)
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverAddress)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		// helpers report missing credentials as error, that's fine for public images
+		if strings.Contains(string(output)+stderr.String(), "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("ERROR: credential helper docker-credential-%s failed for %s\n%+v %s", helper, serverAddress, err, stderr.String())
+	}
+
+	creds := struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}{}
+	if err := json.Unmarshal(output, &creds); err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't parse output of docker-credential-%s\n%w", helper, err)
+	}
+
+	// helpers return identity tokens with the magic username <token>
+	if creds.Username == "<token>" {
+		return &registry.AuthConfig{IdentityToken: creds.Secret, ServerAddress: serverAddress}, nil
+	}
+	return &registry.AuthConfig{Username: creds.Username, Password: creds.Secret, ServerAddress: serverAddress}, nil
+}
+
+// getRegistryCredentials returns the credentials for the registry of an image, or nil if there are none
+func getRegistryCredentials(image string) (*registry.AuthConfig, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, err
+	}
+	serverAddress := getRegistryServerAddress(reference.Domain(named))
+
+	// the override is only sent to its own registry, not e.g. to Docker Hub for the helper images
+	if registryCredentialsOverride != nil && registryCredentialsOverride.ServerAddress == serverAddress {
+		return registryCredentialsOverride, nil
+	}
+
+	config, err := loadDockerConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// credential helpers take precedence over the static auths
+	if helper, ok := config.CredHelpers[serverAddress]; ok {
+		return getCredentialsFromHelper(helper, serverAddress)
+	}
+	if config.CredsStore != "" {
+		return getCredentialsFromHelper(config.CredsStore, serverAddress)
+	}
+
+	for _, key := range []string{serverAddress, "https://" + serverAddress, "http://" + serverAddress} {
+		auth, ok := config.Auths[key]
+		if !ok {
+			continue
+		}
+		authConfig := &registry.AuthConfig{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			IdentityToken: auth.IdentityToken,
+			ServerAddress: serverAddress,
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("ERROR: invalid auth for %s in docker config\n%w", key, err)
+			}
+			if userPass := strings.SplitN(string(decoded), ":", 2); len(userPass) == 2 {
+				authConfig.Username, authConfig.Password = userPass[0], userPass[1]
+			}
+		}
+		return authConfig, nil
+	}
+
+	return nil, nil
+}
+
+// getRegistryAuth returns the encoded registry auth header value for pulling an image ("" for anonymous pulls)
+func getRegistryAuth(image string) (string, error) {
+	authConfig, err := getRegistryCredentials(image)
+	if err != nil || authConfig == nil {
+		return "", err
+	}
+	logDebugf("using credentials of user %s for %s", authConfig.Username, image)
+	return registry.EncodeAuthConfig(*authConfig)
+}
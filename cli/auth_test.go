@@ -0,0 +1,32 @@
+package run
+
+import "testing"
+
+// the credentials of --registry-username are only sent to their own registry
+func TestGetRegistryCredentialsOverride(t *testing.T) {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	defer func() { registryCredentialsOverride = nil }()
+
+	tests := []struct {
+		server string
+		image  string
+		want   bool
+	}{
+		{server: "registry.example.com", image: "registry.example.com/k3s:v1.30.0-k3s1", want: true},
+		{server: "registry.example.com", image: "nicolaka/netshoot"},
+		{server: "registry.example.com", image: "registry.example.com:5000/k3s"},
+		{server: "docker.io", image: "rancher/k3s:v1.30.0-k3s1", want: true},
+		{server: "docker.io", image: "docker.io/library/alpine", want: true},
+		{server: "docker.io", image: "ghcr.io/rancher/k3s"},
+	}
+	for _, tt := range tests {
+		SetRegistryCredentials(tt.server, "user", "secret")
+		got, err := getRegistryCredentials(tt.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got != nil) != tt.want {
+			t.Errorf("getRegistryCredentials(%q) with credentials for %s = %+v, want credentials %t", tt.image, tt.server, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package run
+
+/*
+ * The functions in this file archive a cluster into a portable bundle (`k3d backup`) and recreate it
+ * from the bundle, e.g. on another machine (`k3d restore`). The bundle contains the spec, the labels and the
+ * cluster directory with the kubeconfig, but not the data of the nodes (see `k3d commit` for that).
+ */
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Minhaz00/k3d/version"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// backupManifestName and backupSpecName are the files at the root of a bundle,
+	// the cluster directory is archived below backupFilesDir
+	backupManifestName = "manifest.json"
+	backupSpecName     = "spec.yaml"
+	backupFilesDir     = "files"
+
+	backupFormatVersion = 1
+)
+
+// backupManifest describes the cluster a bundle was created from
+type backupManifest struct {
+	FormatVersion int               `json:"formatVersion"`
+	K3dVersion    string            `json:"k3dVersion"`
+	Cluster       string            `json:"cluster"`
+	Created       string            `json:"created"`
+	Labels        map[string]string `json:"labels"`
+}
+
+// backupSkippedFiles are files of the cluster directory which only make sense on this machine
+var backupSkippedFiles = []string{activityFileName, portForwardPIDFile, portForwardLogFile, containerdSocketsDir}
+
+// writeBackupFile adds a file with the given content to a bundle
+func writeBackupFile(tw *tar.Writer, name string, content []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+// writeBackupDir adds the regular files of the cluster directory to a bundle, sockets and the files of
+// backupSkippedFiles are left out
+func writeBackupDir(tw *tar.Writer, clusterDir string) error {
+	return filepath.WalkDir(clusterDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(clusterDir, filePath)
+		if err != nil {
+			return err
+		}
+		if containsString(backupSkippedFiles, relPath) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(backupFilesDir, filepath.ToSlash(relPath))
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// Backup archives the spec, the labels and the cluster directory of a cluster into a bundle:
+// `k3d backup [cluster] [--output <file>]`
+func Backup(c *cli.Context) error {
+	name := DefaultK3sClusterName
+	if c.NArg() > 0 {
+		name = c.Args().First()
+	}
+	output := c.String("output")
+	if output == "" {
+		output = fmt.Sprintf("k3d-%s-backup.tar.gz", name)
+	}
+
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[name]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, name)
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+	spec, err := exportClusterSpec(ctx, docker, cl)
+	if err != nil {
+		return err
+	}
+	if spec.Commit != "" {
+		logWarningf("cluster %s was created from commit %s, its images have to be available where the bundle is restored", name, spec.Commit)
+	}
+	specContent, err := yaml.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't serialize cluster spec\n%w", err)
+	}
+	manifest, err := json.MarshalIndent(backupManifest{
+		FormatVersion: backupFormatVersion,
+		K3dVersion:    version.GetVersion(),
+		Cluster:       name,
+		Created:       time.Now().UTC().Format(time.RFC3339),
+		Labels:        cl.server.Labels,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't serialize backup manifest\n%w", err)
+	}
+	clusterDir, err := getClusterDir(name)
+	if err != nil {
+		return err
+	}
+
+	// the bundle contains the kubeconfig, so it's only readable by the owner
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create backup %s\n%w", output, err)
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	if err := writeBackupFile(tw, backupManifestName, manifest); err != nil {
+		return fmt.Errorf("ERROR: couldn't write backup %s\n%w", output, err)
+	}
+	if err := writeBackupFile(tw, backupSpecName, specContent); err != nil {
+		return fmt.Errorf("ERROR: couldn't write backup %s\n%w", output, err)
+	}
+	if _, err := os.Stat(clusterDir); err == nil {
+		if err := writeBackupDir(tw, clusterDir); err != nil {
+			return fmt.Errorf("ERROR: couldn't archive cluster directory %s\n%w", clusterDir, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("ERROR: couldn't write backup %s\n%w", output, err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("ERROR: couldn't write backup %s\n%w", output, err)
+	}
+
+	logSuccessf("Backed up cluster [%s] to %s (node data isn't included, use `k3d commit` for that)", name, output)
+	return nil
+}
+
+// readBackup reads the manifest, the spec and the files of the cluster directory from a bundle
+func readBackup(bundlePath string) (*backupManifest, *clusterSpec, map[string][]byte, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("ERROR: couldn't open backup %s\n%w", bundlePath, err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("ERROR: %s is not a k3d backup\n%w", bundlePath, err)
+	}
+	defer gr.Close()
+
+	var manifest *backupManifest
+	var spec *clusterSpec
+	files := map[string][]byte{}
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("ERROR: couldn't read backup %s\n%w", bundlePath, err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("ERROR: couldn't read backup %s\n%w", bundlePath, err)
+		}
+
+		switch name := path.Clean(header.Name); {
+		case name == backupManifestName:
+			manifest = &backupManifest{}
+			if err := json.Unmarshal(content, manifest); err != nil {
+				return nil, nil, nil, fmt.Errorf("ERROR: couldn't parse manifest of backup %s\n%w", bundlePath, err)
+			}
+		case name == backupSpecName:
+			spec = &clusterSpec{}
+			if err := yaml.Unmarshal(content, spec); err != nil {
+				return nil, nil, nil, fmt.Errorf("ERROR: couldn't parse spec of backup %s\n%w", bundlePath, err)
+			}
+		case strings.HasPrefix(name, backupFilesDir+"/") && header.Typeflag == tar.TypeReg:
+			relPath := strings.TrimPrefix(name, backupFilesDir+"/")
+			// don't let a crafted bundle write outside of the cluster directory
+			if !filepath.IsLocal(relPath) {
+				return nil, nil, nil, fmt.Errorf("ERROR: backup %s contains invalid path %s", bundlePath, header.Name)
+			}
+			files[relPath] = content
+		}
+	}
+
+	if manifest == nil || spec == nil {
+		return nil, nil, nil, fmt.Errorf("ERROR: %s is not a k3d backup (no manifest or spec)", bundlePath)
+	}
+	if manifest.FormatVersion > backupFormatVersion {
+		return nil, nil, nil, fmt.Errorf("ERROR: backup %s was created by a newer k3d (%s), please update k3d", bundlePath, manifest.K3dVersion)
+	}
+	return manifest, spec, files, nil
+}
+
+// applyBackupLabels sets the fields of a spec which k3d keeps in the labels of the nodes (see clusterLabels) from the
+// labels of the backed up cluster, unless the spec of the bundle sets them itself, so that the restored cluster gets them too
+func applyBackupLabels(spec *clusterSpec, labels map[string]string) {
+	if spec.Group == "" {
+		spec.Group = labels[groupLabel]
+	}
+	if spec.TTL == "" {
+		spec.TTL = labels[ttlLabel]
+	}
+	if spec.NodeNameTemplate == "" {
+		spec.NodeNameTemplate = labels["nodeNameTemplate"]
+	}
+	if labels[protectedLabel] == "true" {
+		spec.Protected = true
+	}
+	if labels[inNetworkKubeconfigLabel] == "true" {
+		spec.InNetworkKubeconfig = true
+	}
+	if len(spec.EnvPassthrough) == 0 {
+		spec.EnvPassthrough = getEnvPassthrough(labels)
+	}
+	if len(spec.Ports) == 0 && labels[portSpecsLabel] != "" {
+		spec.Ports = strings.Split(labels[portSpecsLabel], portSpecsLabelSeparator)
+	}
+	if offset, err := strconv.Atoi(labels[portAutoOffsetLabel]); err == nil && spec.PortAutoOffset == 0 {
+		spec.PortAutoOffset = offset
+	}
+}
+
+// Restore recreates a cluster from a bundle created by `k3d backup`: `k3d restore <bundle> [--name <name>]`.
+// Files of the cluster directory the new cluster created itself (e.g. its kubeconfig) are kept.
+func Restore(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("ERROR: please specify the backup to restore")
+	}
+	manifest, spec, files, err := readBackup(c.Args().First())
+	if err != nil {
+		return err
+	}
+	if c.String("name") != "" {
+		spec.Name = c.String("name")
+	}
+	applyBackupLabels(spec, manifest.Labels)
+	dropUntrustedHooks(spec, c.Bool("allow-hooks"), "the backup")
+	log.Printf("Restoring cluster [%s] from backup of cluster [%s] created %s with k3d %s", spec.Name, manifest.Cluster, manifest.Created, manifest.K3dVersion)
+
+	if err := createCluster(spec, createOptions{diagnosticsLines: defaultDiagnosticsLogLines}); err != nil {
+		return err
+	}
+
+	clusterDir, err := getClusterDir(spec.Name)
+	if err != nil {
+		return err
+	}
+	for relPath, content := range files {
+		filePath := filepath.Join(clusterDir, relPath)
+		if _, err := os.Stat(filePath); err == nil {
+			logDebugf("keeping %s of the new cluster", filePath)
+			continue
+		}
+		if err := createDirIfNotExists(filepath.Dir(filePath)); err != nil {
+			return fmt.Errorf("ERROR: couldn't create directory for %s\n%w", filePath, err)
+		}
+		if err := os.WriteFile(filePath, content, 0600); err != nil {
+			return fmt.Errorf("ERROR: couldn't restore %s\n%w", filePath, err)
+		}
+		logDebugf("restored %s", filePath)
+	}
+
+	logSuccessf("Restored cluster [%s] from backup", spec.Name)
+	return nil
+}
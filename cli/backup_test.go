@@ -0,0 +1,39 @@
+package run
+
+import (
+	"reflect"
+	"testing"
+)
+
+// the labels of a backed up cluster carry over to the restored one, unless its spec sets the fields itself
+func TestApplyBackupLabels(t *testing.T) {
+	labels := map[string]string{
+		"app":                    "k3d",
+		groupLabel:               "workshop",
+		ttlLabel:                 "8h",
+		protectedLabel:           "true",
+		inNetworkKubeconfigLabel: "true",
+		envPassthroughLabel:      "AWS_,GITHUB_TOKEN",
+		portSpecsLabel:           "8080:80@server;9090:90@workers",
+		portAutoOffsetLabel:      "10",
+	}
+
+	spec := &clusterSpec{Name: "dev", TTL: "1h"}
+	applyBackupLabels(spec, labels)
+	want := &clusterSpec{
+		Name:                "dev",
+		Group:               "workshop",
+		TTL:                 "1h",
+		Protected:           true,
+		InNetworkKubeconfig: true,
+		EnvPassthrough:      []string{"AWS_", "GITHUB_TOKEN"},
+		Ports:               []string{"8080:80@server", "9090:90@workers"},
+		PortAutoOffset:      10,
+	}
+	if !reflect.DeepEqual(spec, want) {
+		t.Errorf("applyBackupLabels() = %+v, want %+v", spec, want)
+	}
+	if spec.clusterLabels()[groupLabel] != labels[groupLabel] {
+		t.Errorf("restored cluster has group label %q, want %q", spec.clusterLabels()[groupLabel], labels[groupLabel])
+	}
+}
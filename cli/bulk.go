@@ -0,0 +1,115 @@
+package run
+
+/*
+ * The functions in this file create multiple identical clusters at once (`k3d create --count N`).
+ */
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// bulkResult is the outcome of creating one of multiple clusters
+type bulkResult struct {
+	name    string
+	apiPort int
+	err     error
+}
+
+// isHostPortFree checks whether a TCP port can be bound on all host interfaces
+func isHostPortFree(port int) bool {
+	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// assignAPIPorts returns count free host ports, starting the search at base
+func assignAPIPorts(base, count int) ([]int, error) {
+	ports := []int{}
+	for port := base; len(ports) < count; port++ {
+		if port > 65535 {
+			return nil, fmt.Errorf("ERROR: couldn't find %d free API ports starting at %d", count, base)
+		}
+		if isHostPortFree(port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// createClusters creates count clusters named <name>-1..<name>-<count> from the same spec,
+// running at most parallel creations at the same time
+func createClusters(spec *clusterSpec, opts createOptions, count, parallel int) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+	if opts.switchContext {
+		logWarningf("the current context isn't switched with --count %d, the contexts of the clusters are merged only", count)
+		opts.switchContext = false
+	}
+	if len(spec.Ports) > 0 {
+		logWarningf("--publish is used with --count %d: make sure the host ports don't collide between the clusters", count)
+	}
+
+	apiPorts, err := assignAPIPorts(spec.APIPort, count)
+	if err != nil {
+		return err
+	}
+
+	// validate all names up front, so that we don't stop halfway
+	specs := make([]*clusterSpec, count)
+	for i := 0; i < count; i++ {
+		s := *spec
+		s.Name = fmt.Sprintf("%s-%d", spec.Name, i+1)
+		s.APIPort = apiPorts[i]
+		if err := CheckClusterName(s.Name); err != nil {
+			return err
+		}
+		specs[i] = &s
+	}
+
+	results := make([]bulkResult, count)
+	semaphore := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for i := range specs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			err := createCluster(specs[i], opts)
+			results[i] = bulkResult{name: specs[i].Name, apiPort: specs[i].APIPort, err: err}
+		}(i)
+	}
+	wg.Wait()
+
+	// summary
+	failed := 0
+	table := newTable([]string{"NAME", "API PORT", "RESULT", "KUBECONFIG"})
+	for _, result := range results {
+		status := "created"
+		kubeConfig := "-"
+		if result.err != nil {
+			failed++
+			status = "failed"
+			logErrorf("creating cluster %s failed\n%+v", result.name, result.err)
+		} else if path, err := getKubeConfig(result.name); err == nil {
+			kubeConfig = path
+		} else {
+			kubeConfig = "not ready yet"
+		}
+		table.Append([]string{result.name, strconv.Itoa(result.apiPort), status, kubeConfig})
+	}
+	table.Render()
+
+	if failed > 0 {
+		return fmt.Errorf("ERROR: %d of %d clusters couldn't be created", failed, count)
+	}
+	return nil
+}
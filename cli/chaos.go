@@ -0,0 +1,249 @@
+package run
+
+/*
+ * The functions in this file inject faults into the nodes of a cluster (`k3d chaos`),
+ * for testing how workloads cope with failing or degraded nodes.
+ */
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/urfave/cli"
+)
+
+// getChaosCluster returns the cluster given as first argument (default: k3s-default)
+func getChaosCluster(c *cli.Context) (cluster, error) {
+	name := DefaultK3sClusterName
+	if c.NArg() > 0 {
+		name = c.Args().First()
+	}
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return cluster{}, err
+	}
+	cl, ok := clusters[name]
+	if !ok {
+		return cluster{}, fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, name)
+	}
+	return cl, nil
+}
+
+// chaosDurationContext returns a context that is done after the duration of a fault or on interrupt,
+// so that the fault is always reverted
+func chaosDurationContext(d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithTimeout(ctx, d)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// runHelperContainer runs a command in a short-lived helper container sharing the network namespace of a node
+func runHelperContainer(ctx context.Context, docker *client.Client, image, nodeID string, cmd []string) error {
+	if err := ensureImage(ctx, docker, image); err != nil {
+		return err
+	}
+
+	config := &container.Config{
+		Image: image,
+		Cmd:   cmd,
+		Labels: map[string]string{
+			"app":       "k3d",
+			"prefix":    containerNamePrefix,
+			"component": "chaos",
+		},
+	}
+	hostConfig := &container.HostConfig{
+		NetworkMode: container.NetworkMode("container:" + nodeID),
+		CapAdd:      []string{"NET_ADMIN"},
+	}
+	logContainerConfig("chaos helper", config, hostConfig)
+	resp, err := docker.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create helper container\n%w", err)
+	}
+	defer func() {
+		logDebugf("ContainerRemove %s", resp.ID)
+		if err := docker.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{Force: true}); err != nil {
+			logWarningf("couldn't remove helper container %s\n%+v", resp.ID, err)
+		}
+	}()
+
+	waitCh, errCh := docker.ContainerWait(ctx, resp.ID, container.WaitConditionNextExit)
+	logDebugf("ContainerStart %s", resp.ID)
+	if err := docker.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("ERROR: couldn't start helper container\n%w", err)
+	}
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("ERROR: couldn't wait for helper container\n%w", err)
+	case result := <-waitCh:
+		if result.StatusCode == 0 {
+			return nil
+		}
+		output := new(bytes.Buffer)
+		if out, err := docker.ContainerLogs(ctx, resp.ID, container.LogsOptions{ShowStdout: true, ShowStderr: true}); err == nil {
+			stdcopy.StdCopy(output, output, out)
+			out.Close()
+		}
+		return fmt.Errorf("ERROR: %v failed with exit code %d\n%s", cmd, result.StatusCode, output.String())
+	}
+}
+
+// ChaosKillWorker kills a random running worker of a cluster: `k3d chaos kill-worker [cluster]`.
+// The choice is reproducible with --seed.
+func ChaosKillWorker(c *cli.Context) error {
+	cl, err := getChaosCluster(c)
+	if err != nil {
+		return err
+	}
+
+	running := []types.Container{}
+	for _, worker := range cl.workers {
+		if worker.State == "running" {
+			running = append(running, worker)
+		}
+	}
+	if len(running) == 0 {
+		return fmt.Errorf("ERROR: cluster %s has no running workers", cl.name)
+	}
+
+	seed := c.Int64("seed")
+	if !c.IsSet("seed") {
+		seed = time.Now().UnixNano()
+	}
+	victim := running[rand.New(rand.NewSource(seed)).Intn(len(running))]
+	logInfof("Killing worker %s (seed %d, repeat with --seed %d)", getContainerShortName(victim), seed, seed)
+
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+	logDebugf("ContainerKill %s", victim.ID)
+	if err := docker.ContainerKill(context.Background(), victim.ID, "SIGKILL"); err != nil {
+		return fmt.Errorf("ERROR: couldn't kill worker %s\n%w", getContainerShortName(victim), err)
+	}
+	logSuccessf("killed worker %s of cluster %s", getContainerShortName(victim), cl.name)
+	return nil
+}
+
+// ChaosLatency adds latency to the network interface of the nodes of a cluster for a while:
+// `k3d chaos latency [cluster]`. The delay is removed again afterwards or on interrupt.
+func ChaosLatency(c *cli.Context) error {
+	cl, err := getChaosCluster(c)
+	if err != nil {
+		return err
+	}
+	delay, jitter, duration := c.Duration("delay"), c.Duration("jitter"), c.Duration("duration")
+	if delay <= 0 || jitter < 0 || duration <= 0 {
+		return fmt.Errorf("ERROR: --delay and --duration must be positive, --jitter must not be negative")
+	}
+
+	nodes := append([]types.Container{cl.server}, cl.workers...)
+	if selected := c.StringSlice("node"); len(selected) > 0 {
+		byName := map[string]types.Container{}
+		possible := []string{}
+		for _, node := range nodes {
+			byName[getContainerShortName(node)] = node
+			possible = append(possible, getContainerShortName(node))
+		}
+		nodes = []types.Container{}
+		for _, name := range selected {
+			node, ok := byName[name]
+			if !ok {
+				if suggestion := closestString(name, possible); suggestion != "" {
+					return fmt.Errorf("ERROR: no node %s in cluster %s, did you mean %s?", name, cl.name, suggestion)
+				}
+				return fmt.Errorf("ERROR: no node %s in cluster %s", name, cl.name)
+			}
+			nodes = append(nodes, node)
+		}
+	}
+
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+	image := c.String("helper-image")
+	netem := []string{"tc", "qdisc", "add", "dev", "eth0", "root", "netem", "delay", delay.String()}
+	if jitter > 0 {
+		netem = append(netem, jitter.String())
+	}
+
+	ctx := context.Background()
+	delayed := []types.Container{}
+	defer func() {
+		for _, node := range delayed {
+			if err := runHelperContainer(ctx, docker, image, node.ID, []string{"tc", "qdisc", "del", "dev", "eth0", "root"}); err != nil {
+				logWarningf("couldn't remove latency from node %s\n%+v", getContainerShortName(node), err)
+			}
+		}
+	}()
+	for _, node := range nodes {
+		if node.State != "running" {
+			logWarningf("node %s is not running, skipping it", getContainerShortName(node))
+			continue
+		}
+		if err := runHelperContainer(ctx, docker, image, node.ID, netem); err != nil {
+			return fmt.Errorf("ERROR: couldn't add latency to node %s\n%w", getContainerShortName(node), err)
+		}
+		delayed = append(delayed, node)
+	}
+
+	logInfof("Added %s latency (jitter %s) to %d nodes of cluster %s for %s", delay, jitter, len(delayed), cl.name, duration)
+	waitCtx, cancel := chaosDurationContext(duration)
+	defer cancel()
+	<-waitCtx.Done()
+	logInfof("Removing latency from cluster %s", cl.name)
+	return nil
+}
+
+// ChaosPauseServer freezes the server of a cluster for a while: `k3d chaos pause-server [cluster]`.
+// The server is unpaused again afterwards or on interrupt.
+func ChaosPauseServer(c *cli.Context) error {
+	cl, err := getChaosCluster(c)
+	if err != nil {
+		return err
+	}
+	duration := c.Duration("duration")
+	if duration <= 0 {
+		return fmt.Errorf("ERROR: --duration must be positive")
+	}
+	if cl.server.State != "running" {
+		return fmt.Errorf("ERROR: server of cluster %s is not running (state: %s)", cl.name, cl.server.State)
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+	logDebugf("ContainerPause %s", cl.server.ID)
+	if err := docker.ContainerPause(ctx, cl.server.ID); err != nil {
+		return fmt.Errorf("ERROR: couldn't pause server of cluster %s\n%w", cl.name, err)
+	}
+	logInfof("Paused server of cluster %s for %s", cl.name, duration)
+
+	waitCtx, cancel := chaosDurationContext(duration)
+	defer cancel()
+	<-waitCtx.Done()
+
+	logDebugf("ContainerUnpause %s", cl.server.ID)
+	if err := docker.ContainerUnpause(ctx, cl.server.ID); err != nil {
+		return fmt.Errorf("ERROR: couldn't unpause server of cluster %s\n%w", cl.name, err)
+	}
+	logSuccessf("unpaused server of cluster %s", cl.name)
+	return nil
+}
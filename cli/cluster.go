@@ -3,23 +3,37 @@ package run
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"path"
+	"sort"
 	"strconv"
-
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	k3dcluster "github.com/Minhaz00/k3d/pkg/cluster"
+	k3dtypes "github.com/Minhaz00/k3d/pkg/types"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
 	"github.com/mitchellh/go-homedir"
-	"github.com/olekukonko/tablewriter"
 )
 
 const (
 	defaultContainerNamePrefix = "k3d"
+	// DefaultK3sClusterName is the cluster commands work on if none is given
+	DefaultK3sClusterName = "k3s-default"
 )
 
 type cluster struct {
@@ -31,21 +45,103 @@ type cluster struct {
 	workers     []types.Container
 }
 
-// GetContainerName generates the container names
+// nodeNameData is passed to node name templates
+type nodeNameData struct {
+	Prefix  string
+	Cluster string
+	Role    string
+	Index   int
+}
+
+// nodeNameTemplates holds the custom node name templates of clusters [clusterName -> template],
+// registered on creation from the spec and for existing clusters from the labels of the server
+var (
+	nodeNameTemplates     = map[string]*template.Template{}
+	nodeNameTemplateTexts = map[string]string{}
+	nodeNameTemplatesLock sync.RWMutex
+)
+
+// parseNodeNameTemplate parses a node name template and checks that it renders unique, valid hostnames
+func parseNodeNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("node-name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Invalid node name template [%s]\n%w", text, err)
+	}
+
+	seen := map[string]bool{}
+	for _, data := range []nodeNameData{{Role: "server"}, {Role: "worker", Index: 0}, {Role: "worker", Index: 1}} {
+		data.Prefix, data.Cluster = containerNamePrefix, "cluster"
+		var name bytes.Buffer
+		if err := tmpl.Execute(&name, data); err != nil {
+			return nil, fmt.Errorf("ERROR: Invalid node name template [%s]\n%w", text, err)
+		}
+		if err := ValidateHostname(name.String()); err != nil {
+			return nil, fmt.Errorf("ERROR: Node name template [%s] renders invalid name [%s]\n%w", text, name.String(), err)
+		}
+		if seen[name.String()] {
+			return nil, fmt.Errorf("ERROR: Node name template [%s] doesn't render unique names, use .Role and .Index", text)
+		}
+		seen[name.String()] = true
+	}
+	return tmpl, nil
+}
+
+// setNodeNameTemplate registers the node name template of a cluster, an empty template restores the default naming
+func setNodeNameTemplate(clusterName, text string) error {
+	nodeNameTemplatesLock.Lock()
+	defer nodeNameTemplatesLock.Unlock()
+	if text == "" {
+		delete(nodeNameTemplates, clusterName)
+		delete(nodeNameTemplateTexts, clusterName)
+		return nil
+	}
+	tmpl, err := parseNodeNameTemplate(text)
+	if err != nil {
+		return err
+	}
+	nodeNameTemplates[clusterName] = tmpl
+	nodeNameTemplateTexts[clusterName] = text
+	return nil
+}
+
+// getNodeNameTemplate returns the text of the node name template of a cluster, empty for the default naming
+func getNodeNameTemplate(clusterName string) string {
+	nodeNameTemplatesLock.RLock()
+	defer nodeNameTemplatesLock.RUnlock()
+	return nodeNameTemplateTexts[clusterName]
+}
+
+// GetContainerName generates the container names, which are also used as hostnames and k3s node names.
+// The server has the postfix -1, which is rendered as index 0 by custom node name templates.
 func GetContainerName(role, clusterName string, postfix int) string {
+	nodeNameTemplatesLock.RLock()
+	tmpl, ok := nodeNameTemplates[clusterName]
+	nodeNameTemplatesLock.RUnlock()
+	if ok {
+		data := nodeNameData{Prefix: containerNamePrefix, Cluster: clusterName, Role: role, Index: postfix}
+		if postfix < 0 {
+			data.Index = 0
+		}
+		var name bytes.Buffer
+		if err := tmpl.Execute(&name, data); err == nil {
+			return name.String()
+		}
+	}
+
 	if postfix >= 0 {
-		return fmt.Sprintf("%s-%s-%s-%d", defaultContainerNamePrefix, clusterName, role, postfix)
+		return fmt.Sprintf("%s-%s-%s-%d", containerNamePrefix, clusterName, role, postfix)
 	}
 
 	// for server
-	return fmt.Sprintf("%s-%s-%s", defaultContainerNamePrefix, clusterName, role)
+	return fmt.Sprintf("%s-%s-%s", containerNamePrefix, clusterName, role)
 }
 
 // GetAllContainerNames returns a list of all containernames that will be created
 func GetAllContainerNames(clusterName string, serverCount, workerCount int) []string {
 	names := []string{}
+	// there's only a single server, which has no index in its name (see createServer)
 	for postfix := 0; postfix < serverCount; postfix++ {
-		names = append(names, GetContainerName("server", clusterName, postfix))
+		names = append(names, GetContainerName("server", clusterName, -1))
 	}
 	for postfix := 0; postfix < workerCount; postfix++ {
 		names = append(names, GetContainerName("worker", clusterName, postfix))
@@ -75,7 +171,7 @@ func createClusterDir(name string) {
 func deleteClusterDir(name string) {
 	clusterPath, _ := getClusterDir(name)
 	if err := os.RemoveAll(clusterPath); err != nil {
-		log.Printf("WARNING: couldn't delete cluster directory [%s]. You might want to delete it manually.", clusterPath)
+		logWarningf("couldn't delete cluster directory [%s]. You might want to delete it manually.", clusterPath)
 	}
 }
 
@@ -84,11 +180,11 @@ func getClusterDir(name string) (string, error) {
 	//getting the home directory
 	homeDir, err := homedir.Dir()
 	if err != nil {
-		log.Printf("ERROR: Couldn't get user's home directory")
+		logErrorf("Couldn't get user's home directory")
 		return "", err
 	}
-	// $HOME/.config/k3d/<cluster_name>
-	return path.Join(homeDir, ".config", "k3d", name), nil
+	// $HOME/.config/k3d/<cluster_name>, or $HOME/.config/k3d/<prefix>-<cluster_name> for a custom prefix
+	return path.Join(homeDir, ".config", "k3d", getClusterNetworkName(name)), nil
 }
 
 func getClusterKubeConfigPath(cluster string) (string, error) {
@@ -96,9 +192,72 @@ func getClusterKubeConfigPath(cluster string) (string, error) {
 	return path.Join(clusterDir, "kubeconfig.yaml"), err
 }
 
+// inNetworkKubeconfigLabel marks clusters which get a kubeconfig for containers in the cluster network
+const inNetworkKubeconfigLabel = "inNetworkKubeconfig"
+
+// getInNetworkKubeConfigPath returns the path of the kubeconfig for containers in the cluster network,
+// which reaches the API by the name of the server container
+func getInNetworkKubeConfigPath(cluster string) (string, error) {
+	clusterDir, err := getClusterDir(cluster)
+	return path.Join(clusterDir, "kubeconfig-in-network.yaml"), err
+}
+
+// getClusterKubeConfigOutputDir returns the directory in the cluster directory the kubeconfig output of the server is bind-mounted to
+func getClusterKubeConfigOutputDir(cluster string) (string, error) {
+	clusterDir, err := getClusterDir(cluster)
+	return path.Join(clusterDir, "output"), err
+}
+
+// getServerKubeConfigLocation returns the path of the kubeconfig in the server container and, if its directory
+// is bind-mounted, the path of the file on the host. Servers without K3S_KUBECONFIG_OUTPUT only have the k3s default.
+func getServerKubeConfigLocation(ctx context.Context, docker *client.Client, ID string) (string, string, error) {
+	logDebugf("ContainerInspect %s", ID)
+	inspect, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return "", "", fmt.Errorf("ERROR: couldn't inspect server container %s\n%w", ID, err)
+	}
+
+	containerPath := k3sKubeconfigPath
+	for _, e := range inspect.Config.Env {
+		if strings.HasPrefix(e, "K3S_KUBECONFIG_OUTPUT=") {
+			containerPath = path.Clean(strings.TrimPrefix(e, "K3S_KUBECONFIG_OUTPUT="))
+		}
+	}
+
+	hostPath := ""
+	for _, m := range inspect.Mounts {
+		if m.Type == mount.TypeBind && path.Clean(m.Destination) == path.Dir(containerPath) {
+			hostPath = path.Join(m.Source, path.Base(containerPath))
+		}
+	}
+	return containerPath, hostPath, nil
+}
+
+// copyKubeConfigFromContainer copies the kubeconfig out of the server container, which also works for stopped containers
+func copyKubeConfigFromContainer(ctx context.Context, docker *client.Client, ID, containerPath string) ([]byte, error) {
+	logDebugf("CopyFromContainer %s:%s", ID, containerPath)
+	reader, _, err := docker.CopyFromContainer(ctx, ID, containerPath)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't copy %s from server container %s\n%w", containerPath, ID, err)
+	}
+	defer reader.Close()
+
+	// read contents of that file
+	readBytes, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't read kubeconfig from container\n%w", err)
+	}
+	if len(readBytes) < 512 {
+		return nil, fmt.Errorf("ERROR: couldn't read kubeconfig from container: unexpected archive size")
+	}
+
+	// skip the first 512 bytes which contain file metadata and trim any NULL characters
+	return bytes.Trim(readBytes[512:], "\x00"), nil
+}
+
 func createKubeConfigFile(cluster string) error {
 	ctx := context.Background()
-	docker, err := client.NewClientWithOpts()
+	docker, err := newDockerClient()
 	if err != nil {
 		return err
 	}
@@ -107,28 +266,59 @@ func createKubeConfigFile(cluster string) error {
 	filters.Add("label", "app=k3d")
 	filters.Add("label", fmt.Sprintf("cluster=%s", cluster))
 	filters.Add("label", "component=server")
-	server, err := docker.ContainerList(ctx, container.ListOptions{
+	addPrefixFilter(filters)
+	logDebugf("ContainerList filters=%s", filtersString(filters))
+	servers, err := docker.ContainerList(ctx, container.ListOptions{
+		All:     true,
 		Filters: filters,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to get server container for cluster %s\n%+v", cluster, err)
+		return fmt.Errorf("failed to get server container for cluster %s\n%w", cluster, err)
 	}
 
+	// the default prefix can't be filtered by label, so drop servers of other prefixes here
+	server := []types.Container{}
+	for _, s := range servers {
+		if hasContainerNamePrefix(s.Labels) {
+			server = append(server, s)
+		}
+	}
 	if len(server) == 0 {
 		return fmt.Errorf("no server container for cluster %s", cluster)
 	}
 
-	// get kubeconfig file from container
-	reader, _, err := docker.CopyFromContainer(ctx, server[0].ID, "/output/kubeconfig.yaml")
+	containerPath, hostPath, err := getServerKubeConfigLocation(ctx, docker, server[0].ID)
 	if err != nil {
-		return fmt.Errorf("ERROR: couldn't copy kubeconfig.yaml from server container %s\n%+v", server[0].ID, err)
+		return err
 	}
-	defer reader.Close()
 
-	// read contents of that file
-	readBytes, err := io.ReadAll(reader)
-	if err != nil {
-		return fmt.Errorf("ERROR: couldn't read kubeconfig from container\n%+v", err)
+	// prefer the bind-mounted kubeconfig, it may not be readable though (k3s writes it with mode 0600 as root)
+	var kubeconfig []byte
+	if hostPath != "" {
+		kubeconfig, err = os.ReadFile(hostPath)
+		if err != nil {
+			logDebugf("couldn't read bind-mounted kubeconfig %s, copying it from the container: %+v", hostPath, err)
+		}
+	}
+	if kubeconfig == nil {
+		kubeconfig, err = copyKubeConfigFromContainer(ctx, docker, server[0].ID, containerPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// containers in the cluster network reach the API with the name of the server and the port it listens on
+	if server[0].Labels[inNetworkKubeconfigLabel] == "true" {
+		if err := writeInNetworkKubeConfig(cluster, server[0], kubeconfig); err != nil {
+			return err
+		}
+	}
+
+	// clients on other hosts have to reach the API with the advertised address instead of 127.0.0.1
+	if address := server[0].Labels["apiServerAddress"]; address != "" {
+		if kubeconfig, err = setKubeConfigServerHost(kubeconfig, address, ""); err != nil {
+			return err
+		}
 	}
 
 	// create destination kubeconfig file
@@ -137,18 +327,26 @@ func createKubeConfigFile(cluster string) error {
 		return err
 	}
 
-	kubeconfigfile, err := os.Create(destPath)
-	if err != nil {
-		return fmt.Errorf("ERROR: couldn't create kubeconfig.yaml in %s\n%+v", destPath, err)
+	if err := writeKubeConfigFile(destPath, kubeconfig); err != nil {
+		return fmt.Errorf("ERROR: couldn't write kubeconfig.yaml in %s\n%w", destPath, err)
 	}
-	defer kubeconfigfile.Close()
 
-	// write to file, skipping the first 512 bytes which contain file metadata and trimming any NULL characters
-	_, err = kubeconfigfile.Write(bytes.Trim(readBytes[512:], "\x00"))
+	return nil
+}
+
+// writeInNetworkKubeConfig writes the kubeconfig for containers in the cluster network to the cluster directory
+func writeInNetworkKubeConfig(cluster string, server types.Container, kubeconfig []byte) error {
+	content, err := setKubeConfigServerHost(kubeconfig, getContainerShortName(server), server.Labels["apiPort"])
 	if err != nil {
-		return fmt.Errorf("ERROR: couldn't write to kubeconfig.yaml\n%+v", err)
+		return err
+	}
+	destPath, err := getInNetworkKubeConfigPath(cluster)
+	if err != nil {
+		return err
+	}
+	if err := writeKubeConfigFile(destPath, content); err != nil {
+		return fmt.Errorf("ERROR: couldn't write in-network kubeconfig in %s\n%w", destPath, err)
 	}
-
 	return nil
 }
 
@@ -162,7 +360,7 @@ func getKubeConfig(cluster string) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		return "", fmt.Errorf("ERROR: Cluster %s does not exist", cluster)
+		return "", fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, cluster)
 	}
 
 	// If kubeconfi.yaml has not been created, generate it now
@@ -175,18 +373,76 @@ func getKubeConfig(cluster string) (string, error) {
 			return "", err
 		}
 	}
+	markClusterActive(cluster)
 
 	return kubeConfigPath, nil
 
 }
 
-// printClusters prints the names of existing clusters
-func printClusters() {
+// getImageVersion returns the tag of an image reference, e.g. the k3s version of rancher/k3s:v1.29.1-k3s1,
+// or "-" if the image is only referenced by digest
+func getImageVersion(image string) string {
+	image = strings.SplitN(image, "@", 2)[0]
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[i+1:]
+	}
+	return "-"
+}
+
+// describeClusterImages returns the image (or version) of the server, followed by the ones of workers running other
+// images, e.g. "v1.29.1-k3s1 (workers: v1.28.5-k3s1)". server is cluster.image or getImageVersion(cluster.image).
+func describeClusterImages(cl cluster, server string) string {
+	workers := []string{}
+	for _, worker := range cl.workers {
+		if worker.Image == cl.image {
+			continue
+		}
+		image := worker.Image
+		if server != cl.image {
+			image = getImageVersion(worker.Image)
+		}
+		if !containsString(workers, image) {
+			workers = append(workers, image)
+		}
+	}
+	if len(workers) == 0 {
+		return server
+	}
+	return fmt.Sprintf("%s (workers: %s)", server, strings.Join(workers, ", "))
+}
+
+// getClusterAPIEndpoint returns the host:port the API server of a cluster is published on
+func getClusterAPIEndpoint(cl cluster) string {
+	if apiPort, ok := cl.server.Labels["apiPort"]; ok {
+		if address := cl.server.Labels["apiServerAddress"]; address != "" {
+			return net.JoinHostPort(address, apiPort)
+		}
+		return fmt.Sprintf("localhost:%s", apiPort)
+	}
+	return "-"
+}
+
+// getClusterNetworks returns the names of the docker networks the server of a cluster is attached to
+func getClusterNetworks(cl cluster) string {
+	if cl.server.NetworkSettings == nil || len(cl.server.NetworkSettings.Networks) == 0 {
+		return getClusterNetworkName(cl.name)
+	}
+	networks := []string{}
+	for name := range cl.server.NetworkSettings.Networks {
+		networks = append(networks, name)
+	}
+	sort.Strings(networks)
+	return strings.Join(networks, ",")
+}
+
+// printClusters prints the existing clusters selected by filter, with more columns if wide is set
+func printClusters(filter clusterFilter, wide bool) {
 	// Retrieve the list of cluster names using getClusterNames
 	clusters, err := getClusters(true, "")
 	if err != nil {
 		log.Fatalf("ERROR: Couldn't list clusters\n %+v", err)
 	}
+	clusters = filterClusters(clusters, filter)
 
 	if len(clusters) == 0 {
 		log.Printf("No clusters found!")
@@ -194,9 +450,11 @@ func printClusters() {
 	}
 
 	// Initialize a new tablewriter instance to create a formatted table for displaying cluster information.
-	table := tablewriter.NewWriter(os.Stdout)
-	table.SetAlignment(tablewriter.ALIGN_CENTER)
-	table.SetHeader([]string{"NAME", "IMAGE", "STATUS", "WORKERS"})
+	header := []string{"NAME", "IMAGE", "STATUS", "WORKERS"}
+	if wide {
+		header = append(header, "VERSION", "API", "NETWORK", "GROUP", "KUBECONFIG")
+	}
+	table := newTable(header)
 
 	for _, cluster := range clusters {
 		workersRunning := 0
@@ -206,7 +464,18 @@ func printClusters() {
 			}
 		}
 		workerData := fmt.Sprintf("%d/%d", workersRunning, len(cluster.workers))
-		clusterData := []string{cluster.name, cluster.image, cluster.status, workerData}
+		clusterData := []string{cluster.name, describeClusterImages(cluster, cluster.image), cluster.status, workerData}
+		if wide {
+			kubeConfigPath, err := getClusterKubeConfigPath(cluster.name)
+			if _, statErr := os.Stat(kubeConfigPath); err != nil || statErr != nil {
+				kubeConfigPath = "-"
+			}
+			group := cluster.server.Labels[groupLabel]
+			if group == "" {
+				group = "-"
+			}
+			clusterData = append(clusterData, describeClusterImages(cluster, getImageVersion(cluster.image)), getClusterAPIEndpoint(cluster), getClusterNetworks(cluster), group, kubeConfigPath)
+		}
 		table.Append(clusterData)
 	}
 
@@ -215,6 +484,89 @@ func printClusters() {
 
 }
 
+// exportCluster returns a cluster as the type of the library API, with the spec it was created with
+func exportCluster(cl cluster) k3dtypes.Cluster {
+	exported := k3dcluster.FromContainers(cl.name, append([]types.Container{cl.server}, cl.workers...))
+	if spec, err := getStoredClusterSpec(cl); err == nil {
+		exported.Spec = (*k3dtypes.ClusterSpec)(spec)
+	} else {
+		logDebugf("couldn't get spec of cluster %s: %+v", cl.name, err)
+	}
+	return exported
+}
+
+// printClustersJSON prints the clusters selected by the filter as a JSON array sorted by name
+func printClustersJSON(filter clusterFilter) error {
+	clusters, err := getClusters(true, "")
+	if err != nil {
+		return err
+	}
+	exported := []k3dtypes.Cluster{}
+	for _, cl := range filterClusters(clusters, filter) {
+		exported = append(exported, exportCluster(cl))
+	}
+	sort.Slice(exported, func(i, j int) bool { return exported[i].Name < exported[j].Name })
+
+	content, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't serialize clusters\n%w", err)
+	}
+	fmt.Println(string(content))
+	return nil
+}
+
+// watchClusters prints the clusters again whenever a k3d container changes and at least every interval,
+// until k3d is interrupted
+func watchClusters(filter clusterFilter, wide bool, interval time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	filters := filters.NewArgs()
+	filters.Add("type", "container")
+	filters.Add("label", "app=k3d")
+	logDebugf("Events filters=%s", filtersString(filters))
+	messages, errs := docker.Events(ctx, types.EventsOptions{Filters: filters})
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		clearScreen()
+		printClusters(filter, wide)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("ERROR: couldn't watch docker events\n%w", err)
+		case <-messages:
+			// a cluster operation changes several containers at once, render once they settled a bit
+			if err := sleepContext(ctx, 200*time.Millisecond); err != nil {
+				return nil
+			}
+			drainEvents(messages)
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainEvents discards the events that are already waiting to be received
+func drainEvents(messages <-chan events.Message) {
+	for {
+		select {
+		case <-messages:
+		default:
+			return
+		}
+	}
+}
+
 // When 'all' is true, 'cluster' contains all clusters found from the docker daemon
 // When 'all' is false, 'cluster' contains up to one cluster whose name matches 'name'. 'cluster' can
 // be empty if no matching cluster is found.
@@ -222,89 +574,60 @@ func getClusters(all bool, name string) (map[string]cluster, error) {
 
 	// Creates a background context and initializes a Docker client
 	ctx := context.Background()
-	docker, err := client.NewClientWithOpts()
+	docker, err := newDockerClient()
 	if err != nil {
-		return nil, fmt.Errorf("ERROR: couldn't create docker client\n%+v", err)
+		return nil, fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
 	}
 
-	// Sets up Docker API filters (filters) to find containers with specific labels
-	filters := filters.NewArgs()
-	filters.Add("label", "app=k3d")
-	filters.Add("label", "component=server")
-
-	// List Server Containers (K3d Servers)
-	k3dServers, err := docker.ContainerList(ctx, container.ListOptions{
-		All:     true,
-		Filters: filters,
-	})
+	// list servers and workers of all clusters in a single call, grouped by cluster
+	listName := name
+	if all {
+		listName = ""
+	}
+	logDebugf("ContainerList cluster=%q", listName)
+	containersByCluster, err := k3dcluster.ListContainers(ctx, docker, containerNamePrefix, listName)
 	if err != nil {
-		return nil, fmt.Errorf("WARNING: couldn't list server containers\n%+v", err)
+		return nil, checkDockerError(fmt.Errorf("WARNING: couldn't list k3d containers\n%w", err))
 	}
 
 	// map for cluster [clusterName -> cluster struct]
 	clusters := make(map[string]cluster)
 
-	// don't filter for servers but for workers now
-	filters.Del("label", "component=server")
-	filters.Add("label", "component=worker")
-
-	// for all servers created by k3d, get workers and cluster information
-	for _, server := range k3dServers {
-		clusterName := server.Labels["cluster"]
-
-		// Skip the cluster if we don't want all of them, and
-		// the cluster name does not match.
-		if all || name == clusterName {
-			// Add the cluster
-			filters.Add("label", fmt.Sprintf("cluster=%s", clusterName))
-
-			// retrieve a list of worker containers (workers)
-			workers, err := docker.ContainerList(ctx, container.ListOptions{
-				All:     true,
-				Filters: filters,
-			})
-			if err != nil {
-				log.Printf("WARNING: couldn't get worker containers for cluster %s\n%+v", clusterName, err)
+	for clusterName, containers := range containersByCluster {
+		var server *types.Container
+		workers := []types.Container{}
+		for i, c := range containers {
+			switch c.Labels["component"] {
+			case "server":
+				server = &containers[i]
+			case "worker":
+				workers = append(workers, c)
 			}
-
-			// Extract server ports (serverPorts) from container port mappings (server.Ports)
-			serverPorts := []string{}
-			for _, port := range server.Ports {
-				serverPorts = append(serverPorts, strconv.Itoa(int(port.PublicPort)))
-			}
-
-			// Populate cluster information (cluster) with relevant attributes
-			clusters[clusterName] = cluster{
-				name:        clusterName,
-				image:       server.Image,
-				status:      getClusterStatus(server, workers),
-				serverPorts: serverPorts,
-				server:      server,
-				workers:     workers,
-			}
-
-			// clear label filters before searching for next cluster
-			filters.Del("label", fmt.Sprintf("cluster=%s", clusterName))
 		}
-	}
-
-	return clusters, nil
-}
+		// containers without a server (e.g. external workers) don't form a k3d cluster
+		if server == nil {
+			continue
+		}
+		if err := setNodeNameTemplate(clusterName, server.Labels["nodeNameTemplate"]); err != nil {
+			logWarningf("ignoring node name template of cluster %s\n%+v", clusterName, err)
+		}
 
-// Classify cluster state: Running, Stopped or Abnormal
-func getClusterStatus(server types.Container, workers []types.Container) string {
-	// The cluster is in the abnromal state when server state and the worker states don't agree
-	for _, w := range workers {
-		if w.State != server.State {
-			return "unhealthy"
+		// Extract server ports (serverPorts) from container port mappings (server.Ports)
+		serverPorts := []string{}
+		for _, port := range server.Ports {
+			serverPorts = append(serverPorts, strconv.Itoa(int(port.PublicPort)))
 		}
-	}
 
-	switch server.State {
-	// All containers in this state are most likely as the result of running the "k3d stop" command
-	case "exited":
-		return "stopped"
+		// Populate cluster information (cluster) with relevant attributes
+		clusters[clusterName] = cluster{
+			name:        clusterName,
+			image:       server.Image,
+			status:      k3dcluster.FromContainers(clusterName, containers).Status,
+			serverPorts: serverPorts,
+			server:      *server,
+			workers:     workers,
+		}
 	}
 
-	return server.State
+	return clusters, nil
 }
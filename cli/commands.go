@@ -5,23 +5,28 @@ package run
  */
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	k3dcluster "github.com/Minhaz00/k3d/pkg/cluster"
+	k3dtypes "github.com/Minhaz00/k3d/pkg/types"
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/urfave/cli"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/yaml.v3"
 )
 
 const (
-	defaultRegistry    = "docker.io"
 	defaultServerCount = 1
 )
 
@@ -30,7 +35,7 @@ func CheckTools(c *cli.Context) error {
 	log.Print("Checking docker...")
 
 	ctx := context.Background()
-	docker, err := client.NewClientWithOpts()
+	docker, err := newDockerClient()
 	if err != nil {
 		return err
 	}
@@ -38,38 +43,23 @@ func CheckTools(c *cli.Context) error {
 	// Ping the Docker daemon to check its availability
 	ping, err := docker.Ping(ctx)
 	if err != nil {
-		return fmt.Errorf("ERROR: checking docker failed\n%+v", err)
+		return checkDockerError(fmt.Errorf("ERROR: checking docker failed\n%w", err))
 	}
 
 	// Log the success message with Docker API version
-	log.Printf("SUCCESS: Checking docker succeeded (API: v%s)\n", ping.APIVersion)
+	logSuccessf("Checking docker succeeded (API: v%s)\n", ping.APIVersion)
+
+	// clusters with several nodes don't fit into the default limits of Docker Desktop
+	logDebugf("Info")
+	if info, err := docker.Info(ctx); err == nil {
+		log.Printf("Docker host resources: %s", describeDockerResources(info))
+	}
 	return nil
 }
 
 // CreateCluster creates a new single-node cluster container and initializes the cluster directory
 func CreateCluster(c *cli.Context) error {
 
-	// On Error delete the cluster.  If there createCluster() encounter any error,
-	// call this function to remove all resources allocated for the cluster so far
-	// so that they don't linger around.
-	deleteCluster := func() {
-		if err := DeleteCluster(c); err != nil {
-			log.Printf("Error: Failed to delete cluster %s", c.String("name"))
-		}
-	}
-
-	if err := CheckClusterName(c.String("name")); err != nil {
-		return err
-	}
-
-	// Check for cluster existence before using a name to create a new cluster
-	if cluster, err := getClusters(false, c.String("name")); err != nil {
-		return err
-	} else if len(cluster) != 0 {
-		// A cluster exists with the same name. Return with an error.
-		return fmt.Errorf("ERROR: Cluster %s already exists", c.String("name"))
-	}
-
 	// define image
 	image := c.String("image")
 	if c.IsSet("version") {
@@ -80,273 +70,825 @@ func CreateCluster(c *cli.Context) error {
 			log.Fatalln("[ERROR] Please use `--image <image>:<version>` instead of --image and --version")
 		} else {
 			// version specified, default image = ok (until deprecation of version flag)
-			image = fmt.Sprintf("%s:%s", strings.Split(image, ":")[0], c.String("version"))
+			// a digest pins the image independently of the tag (e.g. for reproducible multi-arch setups)
+			if strings.HasPrefix(c.String("version"), "sha256:") {
+				image = fmt.Sprintf("%s@%s", defaultK3sImageRepo, c.String("version"))
+			} else {
+				image = fmt.Sprintf("%s:%s", defaultK3sImageRepo, c.String("version"))
+			}
+		}
+	}
+
+	// TODO: --port will soon be --api-port since we want to re-use --port for arbitrary port mappings
+	if c.IsSet("port") {
+		logInfof("As of v2.0.0 --port will be used for arbitrary port mapping. Please use --api-port/-a instead for configuring the Api Port")
+	}
+
+	waitTimeout := c.Duration("wait")
+	if c.IsSet("timeout") {
+		if c.IsSet("wait") {
+			logWarningf("--timeout is deprecated and ignored, since --wait is set")
+		} else {
+			logWarningf("--timeout is deprecated, use --wait %ds instead", c.Int("timeout"))
+			waitTimeout = time.Duration(c.Int("timeout")) * time.Second
+		}
+	}
+
+	if err := setRegistryCredentialsFromFlags(c, image); err != nil {
+		return err
+	}
+	SetImagePullTimeout(c.Duration("pull-timeout"))
+	if err := setKubeConfigMode(c.String("kubeconfig-mode")); err != nil {
+		return err
+	}
+
+	spec := &clusterSpec{
+		Name:           c.String("name"),
+		Image:          image,
+		AgentImage:     c.String("agent-image"),
+		APIPort:        c.Int("api-port"),
+		Workers:        c.Int("workers"),
+		Ports:          c.StringSlice("publish"),
+		PortAutoOffset: c.Int("port-auto-offset"),
+		Volumes:        c.StringSlice("volume"),
+		Env:            c.StringSlice("env"),
+		EnvPassthrough: c.StringSlice("env-passthrough"),
+		AutoRestart:    c.Bool("auto-restart"),
+		TmpfsSize:      c.String("tmpfs-size"),
+		Tmpfs:          c.StringSlice("tmpfs"),
+		ReadOnly:       c.Bool("read-only"),
+		StorageSize:    c.String("storage-size"),
+		Taints:         c.StringSlice("taint"),
+
+		NoServerWorkloads: c.Bool("no-server-workloads"),
+		Rootless:          c.Bool("k3s-rootless"),
+		NoPrivileged:      c.Bool("no-privileged"),
+		NodeNameTemplate:  c.String("node-name-template"),
+		Group:             c.String("group"),
+		Protected:         c.Bool("protect"),
+		TTL:               c.String("ttl"),
+		ExposeContainerd:  c.Bool("expose-containerd"),
+		ContainerdPort:    c.Int("expose-containerd-port"),
+		APIServerAddress:  c.String("api-server-address"),
+		PauseImage:        c.String("pause-image"),
+		DefaultRuntime:    c.String("default-runtime"),
+		Snapshotter:       c.String("snapshotter"),
+		ClusterDomain:     c.String("cluster-domain"),
+		ClusterDNS:        c.String("cluster-dns"),
+		ClusterCIDR:       c.String("cluster-cidr"),
+		ServiceCIDR:       c.String("service-cidr"),
+		NetworkDriver:     c.String("network-driver"),
+		NetworkOptions:    c.StringSlice("network-opt"),
+		NetworkSubnet:     c.String("network-subnet"),
+		NetworkGateway:    c.String("network-gateway"),
+		DNS:               c.StringSlice("dns"),
+		DNSSearch:         c.StringSlice("dns-search"),
+		DNSCoreDNSForward: c.Bool("dns-coredns-forward"),
+
+		KubeconfigOutput:   c.String("kubeconfig-output"),
+		NoKubeconfigOutput: c.Bool("no-kubeconfig-output"),
+
+		WriteKubeconfigMode: c.String("write-kubeconfig-mode"),
+		InNetworkKubeconfig: c.Bool("kubeconfig-in-network"),
+	}
+	if c.Bool("normalize-name") {
+		spec.Name = NormalizeClusterName(spec.Name)
+	}
+	if c.IsSet("server-arg") || c.IsSet("x") {
+		spec.ServerArgs = c.StringSlice("server-arg")
+	}
+
+	// a commit brings its own spec, only the name and the API port can be changed
+	token := ""
+	if commit := c.String("from-commit"); commit != "" {
+		commitSpec, commitToken, err := loadCommitSpec(commit)
+		if err != nil {
+			return err
 		}
+		if commitSpec.Name != spec.Name {
+			logWarningf("the nodes of committed cluster %s will show up as NotReady in cluster %s, since their names change", commitSpec.Name, spec.Name)
+		}
+		commitSpec.Name = spec.Name
+		dropUntrustedHooks(commitSpec, c.Bool("allow-hooks"), "commit "+commit)
+		if c.IsSet("api-port") {
+			commitSpec.APIPort = spec.APIPort
+		}
+		spec, token = commitSpec, commitToken
 	}
-	if len(strings.Split(image, "/")) <= 2 {
-		// fallback to default registry
-		image = fmt.Sprintf("%s/%s", defaultRegistry, image)
+
+	// only show the nodes the cluster would have, e.g. to compose @node specifiers in scripts
+	if c.Bool("print-nodes") {
+		return printNodeNames(spec)
 	}
 
-	// create cluster network
-	networkID, err := createClusterNetwork(c.String("name"))
+	opts := createOptions{
+		forceNetwork: c.Bool("force-network"),
+		replace:      c.Bool("replace"),
+		wait:         c.IsSet("wait") || c.IsSet("timeout"),
+		timeout:      waitTimeout,
+		waitFor:      c.String("wait-for"),
+		summary:      c.String("summary"),
+		token:        token,
+
+		diagnosticsLines: c.Int("diagnostics-lines"),
+		readyLogPattern:  c.String("ready-log-pattern"),
+		createHostPaths:  c.Bool("create-host-paths"),
+
+		ignoreCgroupCheck: c.Bool("ignore-cgroup-check"),
+		noImagePull:       c.Bool("no-image-pull"),
+	}
+	if c.Bool("events") {
+		opts.events = &jsonEventSink{w: os.Stderr}
+	}
+
+	// the user config provides the defaults of the kubeconfig flags
+	userConfig, err := loadUserConfig()
 	if err != nil {
 		return err
 	}
-	log.Printf("Created cluster network with ID %s", networkID)
+	opts.mergeKubeconfig = userConfig.Kubeconfig.Merge
+	opts.switchContext = userConfig.Kubeconfig.SwitchContext
+	if c.IsSet("kubeconfig-merge") {
+		opts.mergeKubeconfig = c.Bool("kubeconfig-merge")
+	}
+	if c.IsSet("kubeconfig-switch-context") {
+		opts.switchContext = c.Bool("kubeconfig-switch-context")
+	}
+	if opts.switchContext {
+		opts.mergeKubeconfig = true
+	}
 
-	// environment variables
-	env := []string{"K3S_KUBECONFIG_OUTPUT=/output/kubeconfig.yaml"}
-	env = append(env, c.StringSlice("env")...)
+	if opts.replace {
+		if c.Int("count") > 1 {
+			return fmt.Errorf("ERROR: --replace can't be combined with --count")
+		}
+		if err := confirmReplace(spec.Name, c.Bool("force")); err != nil {
+			return err
+		}
+	}
 
-	k3sClusterSecret := ""
-	k3sToken := ""
-	if c.Int("workers") > 0 {
-		k3sClusterSecret = fmt.Sprintf("K3S_CLUSTER_SECRET=%s", GenerateRandomString(20))
-		env = append(env, k3sClusterSecret)
+	if c.Int("count") > 1 {
+		return createClusters(spec, opts, c.Int("count"), c.Int("parallel"))
+	}
+	return createCluster(spec, opts)
+}
 
-		k3sToken = fmt.Sprintf("K3S_TOKEN=%s", GenerateRandomString(20))
-		env = append(env, k3sToken)
+// printNodeNames prints the names of the nodes a cluster described by spec will have, one per line
+func printNodeNames(spec *clusterSpec) error {
+	if err := setNodeNameTemplate(spec.Name, spec.NodeNameTemplate); err != nil {
+		return err
 	}
+	for _, name := range GetAllContainerNames(spec.Name, defaultServerCount, spec.Workers) {
+		fmt.Println(name)
+	}
+	return nil
+}
 
-	// k3s server arguments
-	// TODO: --port will soon be --api-port since we want to re-use --port for arbitrary port mappings
-	if c.IsSet("port") {
-		log.Println("INFO: As of v2.0.0 --port will be used for arbitrary port mapping. Please use --api-port/-a instead for configuring the Api Port")
+// confirmReplace asks for confirmation if a cluster would be replaced, unless force is set.
+// Protected clusters are refused before asking, since they can't be replaced anyway.
+func confirmReplace(name string, force bool) error {
+	clusters, err := getClusters(false, name)
+	if err != nil || len(clusters) == 0 {
+		return err
+	}
+	if cl, ok := clusters[name]; ok {
+		if err := checkClusterProtection(cl, false); err != nil {
+			return err
+		}
+	}
+	ok, err := confirm(fmt.Sprintf("Replace existing cluster %s?", name), force)
+	if err != nil {
+		return err
 	}
+	if !ok {
+		return fmt.Errorf("ERROR: replacing cluster %s aborted", name)
+	}
+	return nil
+}
 
-	k3sServerArgs := []string{"--https-listen-port", c.String("api-port")}
+// saveReplacedClusterSpec writes the spec of a cluster which is about to be replaced to a temporary file,
+// so that it can be restored with `k3d apply -f` if creating the new cluster fails
+func saveReplacedClusterSpec(cl cluster) (string, error) {
+	docker, err := newDockerClient()
+	if err != nil {
+		return "", fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+	spec, err := exportClusterSpec(context.Background(), docker, cl)
+	if err != nil {
+		return "", err
+	}
+	content, err := yaml.Marshal(spec)
+	if err != nil {
+		return "", fmt.Errorf("ERROR: couldn't serialize cluster spec\n%w", err)
+	}
+	file, err := os.CreateTemp("", fmt.Sprintf("k3d-%s-*.yaml", cl.name))
+	if err != nil {
+		return "", fmt.Errorf("ERROR: couldn't create file for the spec of cluster %s\n%w", cl.name, err)
+	}
+	defer file.Close()
+	if _, err := file.Write(content); err != nil {
+		return "", fmt.Errorf("ERROR: couldn't write spec of cluster %s to %s\n%w", cl.name, file.Name(), err)
+	}
+	return file.Name(), nil
+}
 
-	if c.IsSet("server-arg") || c.IsSet("x") {
-		k3sServerArgs = append(k3sServerArgs, c.StringSlice("server-arg")...)
+// createCluster creates a cluster as described by the spec
+func createCluster(spec *clusterSpec, opts createOptions) (err error) {
+
+	// On Error delete the cluster.  If there createCluster() encounter any error,
+	// call this function to remove all resources allocated for the cluster so far
+	// so that they don't linger around.
+	rollback := func() {
+		if err := rollbackCluster(spec.Name); err != nil {
+			logErrorf("Failed to delete cluster %s", spec.Name)
+		}
+	}
+
+	timings := newCreationTimings(spec.Name)
+	events := k3dcluster.EventEmitter{Sink: opts.events, Cluster: spec.Name}
+	defer func() {
+		if err != nil {
+			emitCreateError(events, err)
+		}
+	}()
+
+	spec.setDefaults()
+	if err := spec.validate(); err != nil {
+		return withStep("validate", spec.Name, err)
+	}
+	if err := validateSummaryFormat(opts.summary); err != nil {
+		return withStep("validate", spec.Name, err)
+	}
+	volumes, err := normalizeVolumeSpecs(spec.Volumes, opts.createHostPaths)
+	if err != nil {
+		return withStep("validate", spec.Name, err)
+	}
+	spec.Volumes = volumes
+
+	// Check for cluster existence before using a name to create a new cluster
+	existing, err := getClusters(false, spec.Name)
+	if err != nil {
+		return withStep("validate", spec.Name, err)
+	} else if len(existing) != 0 && !opts.replace {
+		// A cluster exists with the same name. Return with an error.
+		return withStep("validate", spec.Name, fmt.Errorf("ERROR: %w: %s", ErrClusterExists, spec.Name))
+	} else if cl, ok := existing[spec.Name]; ok {
+		if err := checkClusterProtection(cl, false); err != nil {
+			return withStep("validate", spec.Name, err)
+		}
+	}
+
+	// registered after looking up existing clusters, which registers the templates of those
+	if err := setNodeNameTemplate(spec.Name, spec.NodeNameTemplate); err != nil {
+		return withStep("validate", spec.Name, err)
+	}
+
+	// validate readiness options before creating anything
+	switch opts.waitFor {
+	case "":
+	case "core":
+		if !opts.wait {
+			return withStep("validate", spec.Name, fmt.Errorf("ERROR: --wait-for requires --wait to be set"))
+		}
+	default:
+		return withStep("validate", spec.Name, fmt.Errorf("ERROR: unknown value [%s] for --wait-for (supported: core)", opts.waitFor))
+	}
+	readyLogPattern, err := compileReadyLogPattern(opts.readyLogPattern, spec.nodeImage("server", -1))
+	if err != nil {
+		return withStep("validate", spec.Name, err)
+	}
+	if opts.readyLogPattern != "" && !opts.wait {
+		return withStep("validate", spec.Name, fmt.Errorf("ERROR: --ready-log-pattern requires --wait to be set"))
 	}
 
 	// new port map
 	// protmap ==> map[string][]string  ==> key: node-name, value: slice of portSpec
-	portmap, err := mapNodesToPortSpecs(c.StringSlice("publish"), GetAllContainerNames(c.String("name"), defaultServerCount, c.Int("workers")))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// createServer creates a container and returns the container Id
-	log.Printf("Creating cluster [%s]", c.String("name"))
-	dockerID, err := createServer(
-		c.GlobalBool("verbose"),
-		image,
-		c.String("api-port"),
-		k3sServerArgs,
-		env,
-		c.String("name"),
-		c.StringSlice("volume"),
-		portmap,
-		c.Bool("auto-restart"),
-	)
+	portmap, err := mapNodesToPortSpecs(spec.Ports, GetAllContainerNames(spec.Name, defaultServerCount, spec.Workers))
 	if err != nil {
-		deleteCluster()
+		return withStep("validate", spec.Name, err)
+	}
+	if err := spec.checkHostPortConflicts(portmap); err != nil {
+		return withStep("validate", spec.Name, err)
+	}
+	nodeImages := []string{spec.Image}
+	if spec.Workers > 0 && spec.workerImage() != spec.Image {
+		nodeImages = append(nodeImages, spec.workerImage())
+	}
+	for _, image := range nodeImages {
+		if err := checkCgroupV2Support(image); err != nil {
+			if !opts.ignoreCgroupCheck {
+				return withStep("validate", spec.Name, fmt.Errorf("%w\nUse a newer image or --ignore-cgroup-check to try anyway", err))
+			}
+			logWarningf("%s", strings.TrimPrefix(err.Error(), "ERROR: "))
+		}
+	}
+	checkDockerResources(spec.Workers)
+	// fail before creating anything if an image is missing, instead of rolling back a partially created cluster
+	if opts.noImagePull {
+		if err := verifyLocalImages(spec.requiredImages()); err != nil {
+			return withStep("validate", spec.Name, err)
+		}
+	}
+
+	// everything has been validated, so the existing cluster can be replaced now. Replacing isn't atomic:
+	// the old cluster is deleted before the new one is created, so its spec is kept to restore it on failure.
+	if cl, ok := existing[spec.Name]; ok {
+		log.Printf("Replacing existing cluster [%s]", spec.Name)
+		previousSpecPath, err := saveReplacedClusterSpec(cl)
+		if err != nil {
+			return withStep("replace", spec.Name, err)
+		}
+		if err := deleteCluster(cl); err != nil {
+			return withStep("replace", spec.Name, err)
+		}
+		defer func() {
+			if err != nil {
+				logErrorf("the previous cluster %s was deleted, restore it with `k3d apply -f %s`", spec.Name, previousSpecPath)
+			} else {
+				os.Remove(previousSpecPath)
+			}
+		}()
+	}
+
+	spec.logEnvPassthrough()
+
+	// the token of a commit has to be reused, since the datastore is encrypted with it
+	tokenEnv := []string{}
+	if opts.token != "" {
+		tokenEnv = append(tokenEnv, fmt.Sprintf("K3S_TOKEN=%s", opts.token))
+	} else if spec.Workers > 0 {
+		tokenEnv = append(tokenEnv, fmt.Sprintf("K3S_CLUSTER_SECRET=%s", GenerateRandomString(20)))
+		tokenEnv = append(tokenEnv, fmt.Sprintf("K3S_TOKEN=%s", GenerateRandomString(20)))
+	}
+
+	if spec.NoServerWorkloads && spec.Workers == 0 {
+		logWarningf("--no-server-workloads without workers: your workloads won't be scheduled anywhere")
+	}
+	if spec.Workers > 0 && spec.workerImage() != spec.Image {
+		logWarningf("workers with another image than the server are experimental, they run %s and the server %s", spec.workerImage(), spec.Image)
+	}
+	if spec.Rootless {
+		logWarningf("rootless mode is experimental, it requires cgroup v2 on the host and an image with rootlesskit support")
+	}
+	if spec.NoPrivileged && !spec.Rootless {
+		if err := checkUnprivilegedSupport(); err != nil {
+			logWarningf("falling back to privileged node containers, unprivileged nodes are not supported by this docker daemon\n%+v", err)
+			spec.NoPrivileged = false
+		}
+	}
+
+	// prepare the cluster concurrently, the network and the cluster directory are set up while the image is pulled.
+	// Rolling back waits for all steps, so that nothing is created after the cluster was deleted.
+	phaseStart := time.Now()
+	serverImage := spec.nodeImage("server", -1)
+	if serverImage != spec.Image {
+		markImageAvailable(serverImage)
+	}
+	prepare := new(errgroup.Group)
+	prepare.Go(func() error {
+		// pull the image once for all nodes, committed nodes use local images
+		events.Emit(k3dtypes.Event{Type: k3dtypes.EventStepStarted, Step: "pull"})
+		if spec.Commit == "" || spec.Workers > spec.CommitWorkers {
+			if err := pullClusterImage(spec.Image); err != nil {
+				return withStep("pull", spec.Name, err)
+			}
+			if spec.workerImage() != spec.Image && spec.Workers > spec.CommitWorkers {
+				if err := pullClusterImage(spec.workerImage()); err != nil {
+					return withStep("pull", spec.Name, err)
+				}
+			}
+		}
+		timings.track("image pull", phaseStart)
+		events.Emit(k3dtypes.Event{Type: k3dtypes.EventStepCompleted, Step: "pull"})
+		return nil
+	})
+	prepare.Go(func() error {
+		events.Emit(k3dtypes.Event{Type: k3dtypes.EventStepStarted, Step: "network"})
+		networkID, err := createClusterNetwork(spec, opts.forceNetwork)
+		if err != nil {
+			return withStep("network", spec.Name, err)
+		}
+		log.Printf("Created cluster network with ID %s", networkID)
+		clusterCIDR, serviceCIDR := spec.clusterCIDRs()
+		if err := checkNetworkSubnetOverlap(networkID, clusterCIDR, serviceCIDR); err != nil {
+			return withStep("network", spec.Name, err)
+		}
+		events.Emit(k3dtypes.Event{Type: k3dtypes.EventStepCompleted, Step: "network"})
+		return nil
+	})
+	prepare.Go(func() error {
+		// create the cluster directory, which the kubeconfig output directory of the server is bind-mounted to.
+		// It has to exist before the server is created, otherwise docker creates it owned by root.
+		createClusterDir(spec.Name)
+		if err := writeResolvConf(spec); err != nil {
+			return withStep("dns", spec.Name, err)
+		}
+		if spec.NoKubeconfigOutput {
+			return nil
+		}
+		outputDir, err := getClusterKubeConfigOutputDir(spec.Name)
+		if err == nil {
+			err = createDirIfNotExists(outputDir)
+		}
+		if err != nil {
+			return withStep("server", spec.Name, fmt.Errorf("ERROR: couldn't create kubeconfig output directory\n%w", err))
+		}
+		return nil
+	})
+	if err := prepare.Wait(); err != nil {
+		rollback()
 		return err
 	}
 
-	ctx := context.Background()
-	docker, err := client.NewClientWithOpts()
+	// create the server container from the spec and return its ID
+	log.Printf("Creating cluster [%s]", spec.Name)
+	phaseStart = time.Now()
+	events.Emit(k3dtypes.Event{Type: k3dtypes.EventStepStarted, Step: "server"})
+	log.Printf("Creating server using %s...\n", serverImage)
+	server, err := spec.serverNode(portmap, tokenEnv)
 	if err != nil {
-		return fmt.Errorf("ERROR: couldn't create docker client\n%+v", err)
+		rollback()
+		return withStep("server", spec.Name, err)
 	}
-
-	if c.IsSet("timeout") {
-		log.Println("[Warning] The --timeout flag is deprecated. use '--wait <timeout>' instead")
+	dockerID, err := createNode(server)
+	if err != nil {
+		rollback()
+		return withStep("server", spec.Name, err)
 	}
 
 	// Wait for k3s to be up and running if wanted.
-	// We're simply scanning the container logs for a line that tells us that everything's up and running
-	// TODO: also wait for worker nodes
-	start := time.Now()
-	// Retrieve the timeout duration from the command-line flags and convert it to a time.Duration
-	timeout := time.Duration(c.Int("wait")) * time.Second
-	// Loop continues as long as the "wait" flag is set in the command-line context (c)
-	for c.IsSet("wait") {
-		// not running after timeout exceeded? Rollback and delete everything.
-		if timeout != 0 && !time.Now().After(start.Add(timeout)) {
-			// If timeout is reached, attempt to delete the cluster and handle any error
-			deleteCluster()
-			return errors.New("cluster creation exceeded specified timeout")
-		}
-
-		// scan container logs for a line that tells us that the required services are up and running
-		out, err := docker.ContainerLogs(ctx, dockerID, container.LogsOptions{
-			ShowStdout: true,
-			ShowStderr: true,
-		})
+	// The deadline covers the whole readiness phase of the server and the workers, image pulls have their own
+	// timeout (--pull-timeout). An interrupt aborts the wait and deletes the cluster.
+	waitCtx, cancelWait := context.Background(), context.CancelFunc(func() {})
+	if opts.wait {
+		waitCtx, cancelWait = newInterruptibleWaitContext(opts.timeout)
+	}
+	defer cancelWait()
+	if opts.wait {
+		// We're simply following the container logs until a line tells us that everything's up and running,
+		// they're written to the cluster directory on the way, so they can be followed with `tail -f` as well
+		var logOutput io.Writer
+		logFile, err := openServerLogFile(spec.Name)
 		if err != nil {
-			out.Close()
-			return fmt.Errorf("ERROR: couldn't get docker logs for %s\n%+v", c.String("name"), err)
+			logWarningf("%+v", err)
+		} else {
+			defer logFile.Close()
+			logOutput = logFile
+			logDebugf("writing the logs of the server to %s", logFile.Name())
+		}
+		err = waitForLogLine(waitCtx, dockerID, readyLogPattern, logOutput)
+		if err == nil {
+			events.Emit(k3dtypes.Event{Type: k3dtypes.EventNodeReady, Step: "server", Node: GetContainerName("server", spec.Name, -1)})
 		}
 
-		// Read logs into a buffer and close the log stream
-		buf := new(bytes.Buffer)
-		nRead, _ := buf.ReadFrom(out)
-		out.Close()
-		output := buf.String()
-
-		// Check if logs contain "Running kubelet" indicating the cluster is up
-		if nRead > 0 && strings.Contains(string(output), "Running kubelet") {
-			break
+		// optionally wait for more than just the kubelet
+		if err == nil && opts.waitFor == "core" {
+			err = waitForCore(waitCtx, spec.Name, dockerID)
 		}
 
-		// Sleep for 1 second before checking logs again
-		time.Sleep(1 * time.Second)
+		if err != nil {
+			// show what went wrong, then attempt to delete the cluster
+			dumpClusterDiagnostics(spec.Name, opts.diagnosticsLines)
+			rollback()
+			if errors.Is(err, context.DeadlineExceeded) {
+				return withStep("wait", spec.Name, errors.New("cluster creation exceeded specified timeout"))
+			}
+			if errors.Is(err, context.Canceled) {
+				return withStep("wait", spec.Name, errors.New("cluster creation was interrupted"))
+			}
+			return withStep("wait", spec.Name, err)
+		}
 	}
 
-	// create the directory where we will put the kubeconfig file by default (when running `k3d get-config`)
-	// TODO: this can probably be moved to `k3d get-config` or be removed in a different approach
-	createClusterDir(c.String("name"))
+	timings.track("server ready", phaseStart)
+	events.Emit(k3dtypes.Event{Type: k3dtypes.EventStepCompleted, Step: "server"})
 
 	// spin up the worker nodes
 	// TODO: do this concurrently in different goroutines
-	if c.Int("workers") > 0 {
-		k3sWorkerArgs := []string{}
-		env := []string{k3sClusterSecret, k3sToken}
-		env = append(env, c.StringSlice("env")...)
-		log.Printf("Booting %s workers for cluster %s", strconv.Itoa(c.Int("workers")), c.String("name"))
-		for i := 0; i < c.Int("workers"); i++ {
-			workerID, err := createWorker(
-				c.GlobalBool("verbose"),
-				image,
-				k3sWorkerArgs,
-				env,
-				c.String("name"),
-				c.StringSlice("volume"),
-				i,
-				c.String("api-port"),
-				portmap,
-				c.Int("port-auto-offset"),
-				c.Bool("auto-restart"),
-			)
+	if spec.Workers > 0 {
+		phaseStart = time.Now()
+		events.Emit(k3dtypes.Event{Type: k3dtypes.EventStepStarted, Step: "workers"})
+		log.Printf("Booting %s workers for cluster %s", strconv.Itoa(spec.Workers), spec.Name)
+		workers := map[string]string{}
+		for i := 0; i < spec.Workers; i++ {
+			workerID, err := createClusterWorker(spec, i, portmap, tokenEnv)
 			if err != nil {
-				log.Printf("ERROR: failed to create worker node for cluster %s\n%+v", c.String("name"), err)
+				logErrorf("failed to create worker node for cluster %s\n%+v", spec.Name, err)
 				// clean up all the resources that are already allocated by deleting the cluster
-				deleteCluster()
-				return err
+				rollback()
+				return withStep("workers", spec.Name, err)
 			}
 			log.Printf("Created worker with ID %s\n", workerID)
+			workers[GetContainerName("worker", spec.Name, i)] = workerID
+		}
+
+		// the workers only count as up once their kubelet registered with the server
+		if opts.wait {
+			onReady := func(name string) {
+				events.Emit(k3dtypes.Event{Type: k3dtypes.EventNodeReady, Step: "workers", Node: name})
+			}
+			if err := waitForWorkers(waitCtx, spec.Name, dockerID, workers, onReady); err != nil {
+				dumpClusterDiagnostics(spec.Name, opts.diagnosticsLines)
+				rollback()
+				return withStep("wait", spec.Name, err)
+			}
 		}
+		timings.track("workers", phaseStart)
+		events.Emit(k3dtypes.Event{Type: k3dtypes.EventStepCompleted, Step: "workers"})
+	}
+	// interrupts end k3d again once the cluster is ready
+	cancelWait()
+
+	if err := syncContainerdProxies(spec); err != nil {
+		logWarningf("couldn't expose containerd of cluster %s\n%+v", spec.Name, err)
+	}
+
+	// remember the spec for later `k3d apply` runs
+	if err := writeClusterSpec(spec); err != nil {
+		logWarningf("couldn't store cluster spec\n%+v", err)
+	}
+	if err := writeClusterMetadata(spec.Name); err != nil {
+		logWarningf("couldn't store cluster metadata\n%+v", err)
 	}
 
-	log.Printf("SUCCESS: created cluster [%s]", c.String("name"))
-	log.Printf(`You can now use the cluster with: 
+	logSuccessf("created cluster [%s]", spec.Name)
+	merged := false
+	if opts.mergeKubeconfig {
+		if err := mergeNewClusterKubeConfig(spec.Name, opts.switchContext); err != nil {
+			logWarningf("couldn't merge the kubeconfig of cluster %s, use `%s kubeconfig merge --name %s` later on\n%+v", spec.Name, os.Args[0], spec.Name, err)
+		} else {
+			merged = true
+		}
+	}
+	if merged {
+		log.Printf(`You can now use the cluster with:
+	kubectl --context %s cluster-info`, kubeConfigContextName(spec.Name))
+	} else {
+		log.Printf(`You can now use the cluster with: 
 	export KUBECONFIG="$(%s get-kubeconfig --name='%s')" 
-	kubectl cluster-info`, os.Args[0], c.String("name"))
+	kubectl cluster-info`, os.Args[0], spec.Name)
+	}
+	runHooks(hookPostCreate, spec.Hooks.PostCreate, spec.Name)
 
+	timings.print(opts.summary)
 	return nil
 }
 
+// createClusterWorker creates the worker with the given index for a cluster described by spec.
+// tokenEnv contains the environment variables needed to join the cluster.
+func createClusterWorker(spec *clusterSpec, index int, portmap map[string][]string, tokenEnv []string) (string, error) {
+	if image := spec.nodeImage("worker", index); image != spec.workerImage() {
+		markImageAvailable(image)
+	}
+	n, err := spec.workerNode(index, portmap, tokenEnv)
+	if err != nil {
+		return "", err
+	}
+	return createNode(n)
+}
+
 // DeleteCluster removes the containers belonging to a cluster and its local directory
 func DeleteCluster(c *cli.Context) error {
 
-	clusters, err := getClusters(c.Bool("all"), c.String("name"))
-
+	clusters, err := getSelectedClusters(c)
 	if err != nil {
 		return err
 	}
 
+	// deleting more than the named cluster is easy to get wrong, so ask first
+	if c.Bool("all") || c.String("selector") != "" || c.String("group") != "" {
+		clusters = dropProtectedClusters(clusters, c.Bool("force-protected"))
+		if len(clusters) == 0 {
+			log.Println("No clusters to delete")
+			return nil
+		}
+		names := []string{}
+		for name := range clusters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		ok, err := confirm(fmt.Sprintf("Delete %d cluster(s): %s?", len(names), strings.Join(names, ", ")), c.Bool("yes"))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("ERROR: deleting clusters aborted")
+		}
+	} else {
+		for _, cl := range clusters {
+			if err := checkClusterProtection(cl, c.Bool("force-protected")); err != nil {
+				return err
+			}
+		}
+	}
+
+	// hand the deletion over to a background job, which `k3d jobs` reports on
+	if c.Bool("async") {
+		names := []string{}
+		for name := range clusters {
+			names = append(names, name)
+		}
+		j, err := startJob(jobDelete, names, c.Bool("keep-kubeconfig-context"))
+		if err != nil {
+			return err
+		}
+		logSuccessf("Deleting %d cluster(s) in the background, follow job %s with `%s jobs`", len(names), j.ID, os.Args[0])
+		return nil
+	}
+
 	// remove clusters one by one instead of appending all names to the docker command
 	// this allows for more granular error handling and logging
+	keepContext := c.Bool("keep-kubeconfig-context")
+	kubeConfigPath := ""
+	if !keepContext {
+		if kubeConfigPath, err = getDefaultKubeConfigPath(); err != nil {
+			return err
+		}
+	}
 	for _, cluster := range clusters {
-		log.Printf("Removing cluster [%s]", cluster.name)
-
-		// delete the workers of the cluster fisrt
-		if len(cluster.workers) > 0 {
-			// TODO: this could be done in goroutines
-			log.Printf("...Removing %d workers\n", len(cluster.workers))
-			for _, worker := range cluster.workers {
-				if err := removeContainer(worker.ID); err != nil {
-					log.Println(err)
-					continue
-				}
-			}
+		if err := deleteClusterAndContext(cluster, kubeConfigPath, keepContext); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		log.Println("...Removing server")
-		deleteClusterDir(cluster.name)
-		if err := removeContainer(cluster.server.ID); err != nil {
-			return fmt.Errorf("ERROR: Couldn't remove server for cluster %s\n%+v", cluster.name, err)
-		}
+// deleteClusterAndContext deletes a cluster and, unless keepContext is set, its context in the merged kubeconfig
+func deleteClusterAndContext(cluster cluster, kubeConfigPath string, keepContext bool) error {
+	if err := deleteCluster(cluster); err != nil {
+		return withStep("delete", cluster.name, err)
+	}
+
+	// merged contexts of deleted clusters only get in the way
+	if keepContext {
+		return nil
+	}
+	// background jobs delete clusters concurrently
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	if removed, err := removeMergedKubeConfig(kubeConfigPath, cluster.name); err != nil {
+		logWarningf("couldn't remove context %s from %s\n%+v", kubeConfigContextName(cluster.name), kubeConfigPath, err)
+	} else if removed {
+		log.Printf("Removed context %s from %s", kubeConfigContextName(cluster.name), kubeConfigPath)
+	}
+	return nil
+}
 
-		// delete the corresponding cluster network
-		if err := deleteClusterNetwork(cluster.name); err != nil {
-			log.Printf("WARNING: couldn't delete cluster network for cluster %s\n%+v", cluster.name, err)
+// deleteCluster removes the containers, network and directory of a single cluster
+func deleteCluster(cluster cluster) error {
+	if spec, err := getStoredClusterSpec(cluster); err == nil {
+		runHooks(hookPreDelete, spec.Hooks.PreDelete, cluster.name)
+	}
+	log.Printf("Removing cluster [%s]", cluster.name)
+
+	// delete the workers of the cluster fisrt
+	if len(cluster.workers) > 0 {
+		// TODO: this could be done in goroutines
+		log.Printf("...Removing %d workers\n", len(cluster.workers))
+		for _, worker := range cluster.workers {
+			if err := removeContainer(worker.ID); err != nil {
+				log.Println(err)
+				continue
+			}
 		}
+	}
+
+	log.Println("...Removing server")
+	stopPortForwardSupervisor(cluster.name)
+	removeContainerdProxies(cluster.name)
+	deleteClusterDir(cluster.name)
+	if err := removeContainer(cluster.server.ID); err != nil {
+		return fmt.Errorf("ERROR: Couldn't remove server for cluster %s\n%w", cluster.name, err)
+	}
 
-		log.Printf("SUCCESS: removed cluster [%s]", cluster.name)
+	// delete the corresponding cluster network
+	if err := deleteClusterNetwork(cluster.name); err != nil {
+		logWarningf("couldn't delete cluster network for cluster %s\n%+v", cluster.name, err)
 	}
+
+	logSuccessf("removed cluster [%s]", cluster.name)
 	return nil
 }
 
+// rollbackCluster removes everything that may have been created for a cluster so far,
+// including the network and directory if the server container was never created
+func rollbackCluster(name string) error {
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return err
+	}
+	if cluster, ok := clusters[name]; ok {
+		return deleteCluster(cluster)
+	}
+
+	deleteClusterDir(name)
+	return deleteClusterNetwork(name)
+}
+
 // StopCluster stops a running cluster container (restartable)
 func StopCluster(c *cli.Context) error {
 
-	clusters, err := getClusters(c.Bool("all"), c.String("name"))
-
+	clusters, err := getSelectedClusters(c)
 	if err != nil {
 		return err
 	}
 
 	ctx := context.Background()
-	docker, err := client.NewClientWithOpts()
+	docker, err := newDockerClient()
 	if err != nil {
-		return fmt.Errorf("ERROR: couldn't create docker client\n%+v", err)
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	// only stop the selected clusters that haven't been used for a while
+	if c.IsSet("idle-since") {
+		checker, err := newIdleChecker(c)
+		if err != nil {
+			return err
+		}
+		if clusters, err = checker.filterIdleClusters(ctx, docker, clusters); err != nil {
+			return err
+		}
+		if len(clusters) == 0 {
+			log.Printf("No cluster has been idle for more than %s", checker.idleSince)
+		}
 	}
 
 	// stop clusters one by one instead of appending all names to the docker command
 	// this allows for more granular error handling and logging
 	for _, cluster := range clusters {
-		log.Printf("Stopping cluster [%s]", cluster.name)
-		if len(cluster.workers) > 0 {
-			log.Printf("...Stopping %d workers\n", len(cluster.workers))
-			for _, worker := range cluster.workers {
-				if err := docker.ContainerStop(ctx, worker.ID, container.StopOptions{}); err != nil {
-					log.Println(err)
-					continue
-				}
-			}
-		}
-		log.Println("...Stopping server")
-		if err := docker.ContainerStop(ctx, cluster.server.ID, container.StopOptions{}); err != nil {
-			return fmt.Errorf("ERROR: Couldn't stop server for cluster %s\n%+v", cluster.name, err)
+		if err := stopCluster(ctx, docker, cluster); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		log.Printf("SUCCESS: Stopped cluster [%s]", cluster.name)
+// stopCluster stops the workers and the server of a cluster
+func stopCluster(ctx context.Context, docker *client.Client, cluster cluster) error {
+	log.Printf("Stopping cluster [%s]", cluster.name)
+	if len(cluster.workers) > 0 {
+		log.Printf("...Stopping %d workers\n", len(cluster.workers))
+		for _, worker := range cluster.workers {
+			logDebugf("ContainerStop %s (ID %s)", worker.Names, worker.ID)
+			if err := docker.ContainerStop(ctx, worker.ID, container.StopOptions{}); err != nil {
+				log.Println(err)
+				continue
+			}
+		}
+	}
+	log.Println("...Stopping server")
+	logDebugf("ContainerStop %s (ID %s)", cluster.server.Names, cluster.server.ID)
+	if err := docker.ContainerStop(ctx, cluster.server.ID, container.StopOptions{}); err != nil {
+		return fmt.Errorf("ERROR: Couldn't stop server for cluster %s\n%w", cluster.name, err)
 	}
+
+	stopPortForwardSupervisor(cluster.name)
+
+	logSuccessf("Stopped cluster [%s]", cluster.name)
 	return nil
 }
 
 // StartCluster starts a stopped cluster container
 func StartCluster(c *cli.Context) error {
+	if err := setKubeConfigMode(c.String("kubeconfig-mode")); err != nil {
+		return err
+	}
 
-	clusters, err := getClusters(c.Bool("all"), c.String("name"))
-
+	clusters, err := getSelectedClusters(c)
 	if err != nil {
 		return err
 	}
 
 	ctx := context.Background()
-	docker, err := client.NewClientWithOpts()
+	docker, err := newDockerClient()
 	if err != nil {
-		return fmt.Errorf("ERROR: couldn't create docker client\n%+v", err)
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
 	}
 
 	// start clusters one by one instead of appending all names to the docker command
 	// this allows for more granular error handling and logging
 	for _, cluster := range clusters {
 		log.Printf("Starting cluster [%s]", cluster.name)
+		nodes := append([]types.Container{cluster.server}, cluster.workers...)
+
+		// docker keeps the restart counts across starts, only restarts from now on count as flapping
+		restartsBefore := map[string]int{}
+		for _, node := range nodes {
+			if status, err := getNodeStatus(ctx, docker, cluster.name, node); err == nil {
+				restartsBefore[node.ID] = status.restartCount
+			}
+		}
 
 		log.Println("...Starting server")
+		logDebugf("ContainerStart %s (ID %s)", cluster.server.Names, cluster.server.ID)
 		if err := docker.ContainerStart(ctx, cluster.server.ID, container.StartOptions{}); err != nil {
-			return fmt.Errorf("ERROR: Couldn't start server for cluster %s\n%+v", cluster.name, err)
+			return fmt.Errorf("ERROR: Couldn't start server for cluster %s\n%w", cluster.name, err)
 		}
 
 		if len(cluster.workers) > 0 {
 			log.Printf("...Starting %d workers\n", len(cluster.workers))
 			for _, worker := range cluster.workers {
+				logDebugf("ContainerStart %s (ID %s)", worker.Names, worker.ID)
 				if err := docker.ContainerStart(ctx, worker.ID, container.StartOptions{}); err != nil {
 					log.Println(err)
 					continue
@@ -354,33 +896,203 @@ func StartCluster(c *cli.Context) error {
 			}
 		}
 
-		log.Printf("SUCCESS: Started cluster [%s]", cluster.name)
+		// restore the port forwards of the cluster
+		if err := startPortForwardSupervisor(cluster.name); err != nil {
+			logWarningf("couldn't start port forwards for cluster %s\n%+v", cluster.name, err)
+		}
+
+		// the containerd proxies stopped with the nodes
+		spec, err := getStoredClusterSpec(cluster)
+		if err != nil {
+			logWarningf("couldn't load the spec of cluster %s\n%+v", cluster.name, err)
+		} else if err := syncContainerdProxies(spec); err != nil {
+			logWarningf("couldn't expose containerd of cluster %s\n%+v", cluster.name, err)
+		}
+
+		// the published API port and the certificates may have changed while the cluster was stopped
+		if err := refreshStartedKubeConfigs(cluster.name); err != nil {
+			logWarningf("couldn't refresh the kubeconfig of cluster %s, run `k3d kubeconfig refresh` once it is up\n%+v", cluster.name, err)
+		}
+
+		// nodes short on memory are usually restarted by the time the kubeconfig is refreshed
+		for _, node := range nodes {
+			if status, err := getNodeStatus(ctx, docker, cluster.name, node); err == nil {
+				warnFlappingNode(status, restartsBefore[node.ID])
+			}
+		}
+
+		logSuccessf("Started cluster [%s]", cluster.name)
+		if spec != nil {
+			runHooks(hookPostStart, spec.Hooks.PostStart, cluster.name)
+		}
 	}
 	return nil
 }
 
+// refreshStartedKubeConfigs refreshes the kubeconfigs of a cluster that was just started,
+// the cluster is looked up again since the published ports are only known once it runs
+func refreshStartedKubeConfigs(name string) error {
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[name]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, name)
+	}
+	mergedKubeConfigPath, err := getDefaultKubeConfigPath()
+	if err != nil {
+		return err
+	}
+	return refreshKubeConfigs(cl, mergedKubeConfigPath)
+}
+
 // ListClusters prints a list of created clusters
 func ListClusters(c *cli.Context) error {
 	if c.IsSet("all") {
-		log.Println("INFO: --all is on by default, thus no longer required. This option will be removed in v2.0.0")
+		logInfof("--all is on by default, thus no longer required. This option will be removed in v2.0.0")
+	}
+	filter := clusterFilter{name: c.String("name"), status: c.String("status"), group: c.String("group")}
+	if err := filter.validate(); err != nil {
+		return err
+	}
+	wide := false
+	switch c.String("output") {
+	case "":
+	case "wide":
+		wide = true
+	case "json":
+		if c.Bool("watch") {
+			return fmt.Errorf("ERROR: --watch doesn't support json output")
+		}
+		return printClustersJSON(filter)
+	default:
+		return fmt.Errorf("ERROR: unknown output format [%s] (supported: wide, json)", c.String("output"))
 	}
-	printClusters()
+	if c.Bool("watch") {
+		if c.Duration("interval") <= 0 {
+			return fmt.Errorf("ERROR: --interval must be positive")
+		}
+		return watchClusters(filter, wide, c.Duration("interval"))
+	}
+	printClusters(filter, wide)
 	return nil
 }
 
-// getKubeConfig grabs the kubeconfig from the running cluster and prints the path to stdout
+// getKubeConfig grabs the kubeconfig from the cluster (running or stopped) and prints the path to stdout
 func GetKubeConfig(c *cli.Context) error {
+	if err := setKubeConfigMode(c.String("kubeconfig-mode")); err != nil {
+		return err
+	}
 	cluster := c.String("name")
 	kubeConfigPath, err := getKubeConfig(cluster)
 	if err != nil {
 		return err
 	}
+	if c.Bool("in-network") {
+		if kubeConfigPath, err = getInNetworkKubeConfigPath(cluster); err != nil {
+			return err
+		}
+		if _, err := os.Stat(kubeConfigPath); err != nil {
+			return fmt.Errorf("ERROR: cluster %s has no in-network kubeconfig, it has to be created with --kubeconfig-in-network", cluster)
+		}
+	}
 
 	// output kubeconfig file path to stdout
 	fmt.Println(kubeConfigPath)
 	return nil
 }
 
+// MergeKubeConfig merges the kubeconfigs of one or all running clusters into a single kubeconfig file
+func MergeKubeConfig(c *cli.Context) error {
+	if err := setKubeConfigMode(c.String("kubeconfig-mode")); err != nil {
+		return err
+	}
+	clusters, err := getClusters(c.Bool("all"), c.String("name"))
+	if err != nil {
+		return err
+	}
+	if !c.Bool("all") && len(clusters) == 0 {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, c.String("name"))
+	}
+
+	output := c.String("output")
+	if output == "" {
+		if output, err = getDefaultKubeConfigPath(); err != nil {
+			return err
+		}
+	}
+
+	merged, err := loadKubeConfig(output)
+	if err != nil {
+		return err
+	}
+
+	for _, cluster := range clusters {
+		if cluster.status != "running" {
+			logWarningf("skipping cluster %s which is not running (status: %s)", cluster.name, cluster.status)
+			continue
+		}
+
+		config, err := refreshClusterKubeConfig(cluster)
+		if err != nil {
+			return err
+		}
+		if err := mergeClusterKubeConfig(merged, config, cluster.name); err != nil {
+			return err
+		}
+		log.Printf("Merged context %s for cluster %s", kubeConfigContextName(cluster.name), cluster.name)
+	}
+
+	if c.Bool("switch-context") && !c.Bool("all") {
+		if err := switchKubeConfigContext(merged, kubeConfigContextName(c.String("name"))); err != nil {
+			return err
+		}
+	}
+
+	if err := writeKubeConfig(merged, output); err != nil {
+		return err
+	}
+
+	// output kubeconfig file path to stdout
+	fmt.Println(output)
+	return nil
+}
+
+// RefreshKubeConfig re-extracts the kubeconfig of one or all running clusters and updates their contexts
+// in the merged kubeconfig, e.g. after the certificates were rotated or the API port changed
+func RefreshKubeConfig(c *cli.Context) error {
+	if err := setKubeConfigMode(c.String("kubeconfig-mode")); err != nil {
+		return err
+	}
+	clusters, err := getClusters(c.Bool("all"), c.String("name"))
+	if err != nil {
+		return err
+	}
+	if !c.Bool("all") && len(clusters) == 0 {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, c.String("name"))
+	}
+
+	kubeConfigPath := c.String("kubeconfig")
+	if kubeConfigPath == "" {
+		if kubeConfigPath, err = getDefaultKubeConfigPath(); err != nil {
+			return err
+		}
+	}
+
+	for _, cluster := range clusters {
+		if cluster.status != "running" {
+			logWarningf("skipping cluster %s which is not running (status: %s)", cluster.name, cluster.status)
+			continue
+		}
+		if err := refreshKubeConfigs(cluster, kubeConfigPath); err != nil {
+			return err
+		}
+		logSuccessf("Refreshed kubeconfig of cluster %s", cluster.name)
+	}
+	return nil
+}
+
 // Shell starts a new subshell with the KUBECONFIG pointing to the selected cluster
 func Shell(c *cli.Context) error {
 	return shell(c.String("name"), c.String("shell"), c.String("command"))
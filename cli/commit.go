@@ -0,0 +1,380 @@
+package run
+
+/*
+ * The functions in this file freeze a cluster into images (`k3d commit`),
+ * which `k3d create --from-commit` creates pre-warmed clusters from.
+ */
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// k3sDataDir is the data directory of k3s (images, datastore, manifests). It's a volume in the k3s image,
+// so it isn't part of a committed image and has to be added on top.
+const k3sDataDir = "/var/lib/rancher/k3s"
+
+// commitSpecLabel of the server image of a commit carries the spec needed to recreate the cluster
+const commitSpecLabel = "k3d.commit.spec"
+
+// commitTokenLabel held the token of commits made by earlier versions, it's only read for those
+const commitTokenLabel = "k3d.commit.token"
+
+// commitTokensDirName is the directory of the tokens of commits in the k3d config directory, which can't be the
+// directory of a cluster (see jobsDirName). The token of a commit is a secret, so it isn't part of the image.
+const commitTokensDirName = ".commits"
+
+// getCommitTokenPath returns the file the token of a commit is kept in, keyed by the ID of its server image
+func getCommitTokenPath(imageID string) (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("ERROR: couldn't get home directory\n%w", err)
+	}
+	return path.Join(homeDir, ".config", "k3d", commitTokensDirName, strings.TrimPrefix(imageID, "sha256:")+".token"), nil
+}
+
+// writeCommitToken stores the token of a commit, readable only by the user
+func writeCommitToken(imageID, token string) error {
+	tokenPath, err := getCommitTokenPath(imageID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(tokenPath), 0700); err != nil {
+		return fmt.Errorf("ERROR: couldn't create directory %s\n%w", path.Dir(tokenPath), err)
+	}
+	if err := os.WriteFile(tokenPath, []byte(token), 0600); err != nil {
+		return fmt.Errorf("ERROR: couldn't write token of commit to %s\n%w", tokenPath, err)
+	}
+	return nil
+}
+
+// readCommitToken returns the token of a commit, for commits of earlier versions from the label of the server image
+func readCommitToken(inspect types.ImageInspect, commit string) (string, error) {
+	if token := inspect.Config.Labels[commitTokenLabel]; token != "" {
+		return token, nil
+	}
+	tokenPath, err := getCommitTokenPath(inspect.ID)
+	if err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(tokenPath)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("ERROR: token of commit %s not found at %s, clusters can only be created from a commit on the machine it was made on (or with its token file copied there)", commit, tokenPath)
+	}
+	if err != nil {
+		return "", fmt.Errorf("ERROR: couldn't read token of commit %s from %s\n%w", commit, tokenPath, err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// commitNodeImage returns the image a node is committed to: <repository>:<tag>-server or <repository>:<tag>-worker-<index>
+func commitNodeImage(commit, role string, index int) (string, error) {
+	named, err := reference.ParseNormalizedNamed(commit)
+	if err != nil {
+		return "", fmt.Errorf("ERROR: invalid commit reference [%s]\n%w", commit, err)
+	}
+	tagged, ok := reference.TagNameOnly(named).(reference.NamedTagged)
+	if !ok {
+		return "", fmt.Errorf("ERROR: invalid commit reference [%s]: digests are not supported, use a tag", commit)
+	}
+	suffix := role
+	if role == "worker" {
+		suffix = "worker-" + strconv.Itoa(index)
+	}
+	return fmt.Sprintf("%s:%s-%s", tagged.Name(), tagged.Tag(), suffix), nil
+}
+
+// commitSecretEnv are the environment variables of the nodes holding secrets, which committed images mustn't carry.
+// The token of a commit is kept in a file of the user instead (see getCommitTokenPath).
+var commitSecretEnv = []string{"K3S_TOKEN", "K3S_CLUSTER_SECRET"}
+
+// commitEnv returns the environment of a committed node image, with the values of secrets and of the variables
+// passed through from the host blanked. The daemon keeps all variables of the container which aren't overridden,
+// so they can't be removed, but the nodes created from the image get their values anew.
+func commitEnv(env, passthrough []string) []string {
+	blanked := []string{}
+	for _, e := range env {
+		key := strings.SplitN(e, "=", 2)[0]
+		if containsString(commitSecretEnv, key) || matchesEnvPassthrough(passthrough, key) {
+			blanked = append(blanked, key+"=")
+		}
+	}
+	return blanked
+}
+
+// commitNode commits a node container including its k3s data directory to an image
+func commitNode(ctx context.Context, docker *client.Client, ID, image string, labels map[string]string) error {
+	logDebugf("ContainerInspect %s", ID)
+	inspect, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't inspect container %s\n%w", ID, err)
+	}
+	options := container.CommitOptions{Pause: true}
+	if env := commitEnv(inspect.Config.Env, getEnvPassthrough(inspect.Config.Labels)); len(env) > 0 {
+		options.Config = &container.Config{Env: env}
+	}
+
+	logDebugf("ContainerCommit %s", ID)
+	committed, err := docker.ContainerCommit(ctx, ID, options)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't commit container %s\n%w", ID, err)
+	}
+
+	// the archive is buffered in a file, since its size has to be known for the build context
+	logDebugf("CopyFromContainer %s:%s", ID, k3sDataDir)
+	reader, _, err := docker.CopyFromContainer(ctx, ID, k3sDataDir)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't copy %s from container %s\n%w", k3sDataDir, ID, err)
+	}
+	defer reader.Close()
+	data, err := os.CreateTemp("", "k3d-commit-*.tar")
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create temporary file\n%w", err)
+	}
+	defer os.Remove(data.Name())
+	defer data.Close()
+	if err := copyCommitData(data, reader); err != nil {
+		return fmt.Errorf("ERROR: couldn't copy %s from container %s\n%w", k3sDataDir, ID, err)
+	}
+	size, err := data.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't get size of %s\n%w", data.Name(), err)
+	}
+
+	// build the final image on top of the committed one, ADD extracts the archive into the data directory
+	dockerfile := fmt.Sprintf("FROM %s\nADD k3s-data.tar %s/\n", committed.ID, path.Dir(k3sDataDir))
+	buildContext, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeCommitBuildContext(writer, dockerfile, data, size))
+	}()
+
+	logDebugf("ImageBuild %s", image)
+	resp, err := docker.ImageBuild(ctx, buildContext, types.ImageBuildOptions{
+		Tags:        []string{image},
+		Labels:      labels,
+		Remove:      true,
+		ForceRemove: true,
+	})
+	if err != nil {
+		buildContext.Close()
+		return fmt.Errorf("ERROR: couldn't build image %s\n%w", image, err)
+	}
+	defer resp.Body.Close()
+
+	output := io.Discard
+	if verbose {
+		output = os.Stdout
+	}
+	if err := jsonmessage.DisplayJSONMessagesStream(resp.Body, output, 0, false, nil); err != nil {
+		return fmt.Errorf("ERROR: couldn't build image %s\n%w", image, err)
+	}
+	return nil
+}
+
+// commitSecretFiles are the files of the k3s data directory holding the token, relative to its parent directory.
+// k3s writes them anew from K3S_TOKEN when a node of a commit starts.
+var commitSecretFiles = []string{"k3s/server/token", "k3s/server/node-token", "k3s/server/agent-token"}
+
+// copyCommitData copies the tar archive of the k3s data directory of a node, without the files holding the token
+func copyCommitData(w io.Writer, r io.Reader) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if containsString(commitSecretFiles, strings.TrimPrefix(path.Clean(header.Name), "/")) {
+			logDebugf("leaving %s out of the commit", header.Name)
+			continue
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeCommitBuildContext writes the build context of a node image: the Dockerfile and the archive of the data directory
+func writeCommitBuildContext(w io.Writer, dockerfile string, data *os.File, size int64) error {
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerfile))}); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(tw, dockerfile); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "k3s-data.tar", Mode: 0644, Size: size}); err != nil {
+		return err
+	}
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, data); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Commit freezes the nodes of a cluster including their data into images: `k3d commit [cluster]`.
+// The nodes are stopped for a consistent snapshot and started again afterwards.
+func Commit(c *cli.Context) error {
+	name := DefaultK3sClusterName
+	if c.NArg() > 0 {
+		name = c.Args().First()
+	}
+	commit := c.String("tag")
+	if commit == "" {
+		commit = fmt.Sprintf("k3d-%s-commit:latest", name)
+	}
+	serverImage, err := commitNodeImage(commit, "server", -1)
+	if err != nil {
+		return err
+	}
+
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[name]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, name)
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	// the spec and token are captured while the server is still running, the token may have to be read from it
+	spec, err := exportClusterSpec(ctx, docker, cl)
+	if err != nil {
+		return err
+	}
+	if stored, err := getStoredClusterSpec(cl); err == nil {
+		// the image of clusters created from a commit is the original k3s image, not the committed one
+		spec.Image = stored.Image
+	}
+	token, err := getClusterToken(ctx, docker, cl.server)
+	if err != nil {
+		return err
+	}
+	specYAML, err := yaml.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't serialize cluster spec\n%w", err)
+	}
+
+	// stop the workers before the server, and start them in reverse order
+	nodes := append(append([]types.Container{}, cl.workers...), cl.server)
+	running := []types.Container{}
+	for _, node := range nodes {
+		if node.State != "running" {
+			continue
+		}
+		logDebugf("ContainerStop %s", node.ID)
+		if err := docker.ContainerStop(ctx, node.ID, container.StopOptions{}); err != nil {
+			return fmt.Errorf("ERROR: couldn't stop node %s\n%w", getContainerShortName(node), err)
+		}
+		running = append(running, node)
+	}
+	defer func() {
+		for i := len(running) - 1; i >= 0; i-- {
+			logDebugf("ContainerStart %s", running[i].ID)
+			if err := docker.ContainerStart(ctx, running[i].ID, container.StartOptions{}); err != nil {
+				logWarningf("couldn't start node %s again\n%+v", getContainerShortName(running[i]), err)
+			}
+		}
+	}()
+
+	// the labels reset the node name template, which committed images would otherwise pass on to new clusters
+	logInfof("Committing server of cluster %s to %s", name, serverImage)
+	if err := commitNode(ctx, docker, cl.server.ID, serverImage, map[string]string{
+		"nodeNameTemplate": "",
+		commitSpecLabel:    string(specYAML),
+	}); err != nil {
+		return err
+	}
+	logDebugf("ImageInspectWithRaw %s", serverImage)
+	inspect, _, err := docker.ImageInspectWithRaw(ctx, serverImage)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't inspect image %s\n%w", serverImage, err)
+	}
+	if err := writeCommitToken(inspect.ID, token); err != nil {
+		return err
+	}
+	tokenPath, _ := getCommitTokenPath(inspect.ID)
+	logInfof("Kept the token of the commit in %s, it's needed to create clusters from the images on another machine", tokenPath)
+	for _, worker := range cl.workers {
+		index, err := getWorkerIndex(worker)
+		if err != nil {
+			return err
+		}
+		workerImage, err := commitNodeImage(commit, "worker", index)
+		if err != nil {
+			return err
+		}
+		logInfof("Committing worker %s to %s", getContainerShortName(worker), workerImage)
+		if err := commitNode(ctx, docker, worker.ID, workerImage, map[string]string{"nodeNameTemplate": ""}); err != nil {
+			return err
+		}
+	}
+
+	logSuccessf("committed cluster %s to %s. Create clusters from it with `%s create --from-commit %s`", name, commit, os.Args[0], commit)
+	return nil
+}
+
+// loadCommitSpec returns the spec and token of a committed cluster from the labels of its server image and the token file
+func loadCommitSpec(commit string) (*clusterSpec, string, error) {
+	serverImage, err := commitNodeImage(commit, "server", -1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return nil, "", fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+	logDebugf("ImageInspectWithRaw %s", serverImage)
+	inspect, _, err := docker.ImageInspectWithRaw(ctx, serverImage)
+	if err != nil {
+		return nil, "", checkDockerError(fmt.Errorf("ERROR: couldn't find image %s of commit %s\n%w", serverImage, commit, err))
+	}
+	if inspect.Config == nil || inspect.Config.Labels[commitSpecLabel] == "" {
+		return nil, "", fmt.Errorf("ERROR: image %s is not a k3d commit", serverImage)
+	}
+
+	spec := &clusterSpec{}
+	if err := yaml.Unmarshal([]byte(inspect.Config.Labels[commitSpecLabel]), spec); err != nil {
+		return nil, "", fmt.Errorf("ERROR: couldn't parse cluster spec of commit %s\n%w", commit, err)
+	}
+	token, err := readCommitToken(inspect, commit)
+	if err != nil {
+		return nil, "", err
+	}
+	spec.Commit = commit
+	spec.CommitWorkers = spec.Workers
+	return spec, token, nil
+}
@@ -0,0 +1,63 @@
+package run
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// the files holding the token are left out of the data of committed images
+func TestCopyCommitData(t *testing.T) {
+	files := map[string]string{
+		"k3s/server/token":           "secret",
+		"k3s/server/node-token":      "secret",
+		"k3s/server/agent-token":     "secret",
+		"k3s/server/db/state.db":     "data",
+		"k3s/agent/images/pause.tar": "image",
+	}
+	src := new(bytes.Buffer)
+	tw := tar.NewWriter(src)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := new(bytes.Buffer)
+	if err := copyCommitData(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	copied := map[string]string{}
+	tr := tar.NewReader(dst)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copied[header.Name] = string(content)
+	}
+
+	for name, content := range files {
+		_, got := copied[name]
+		want := content != "secret"
+		if got != want {
+			t.Errorf("%s copied = %t, want %t", name, got, want)
+		} else if got && copied[name] != content {
+			t.Errorf("content of %s = %q, want %q", name, copied[name], content)
+		}
+	}
+}
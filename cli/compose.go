@@ -0,0 +1,183 @@
+package run
+
+/*
+ * The functions in this file link clusters to Docker Compose projects (`k3d compose-link`),
+ * so that workloads in the cluster can reach the services of a compose stack by their service name.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/urfave/cli"
+)
+
+// labels docker compose sets on the networks and containers of a project
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+// getComposeNetworks returns the networks of a compose project, optionally only the one with the given name
+func getComposeNetworks(ctx context.Context, docker *client.Client, project, name string) ([]types.NetworkResource, error) {
+	filters := filters.NewArgs()
+	filters.Add("label", fmt.Sprintf("%s=%s", composeProjectLabel, project))
+	logDebugf("NetworkList filters=%s", filtersString(filters))
+	networks, err := docker.NetworkList(ctx, types.NetworkListOptions{Filters: filters})
+	if err != nil {
+		return nil, checkDockerError(fmt.Errorf("ERROR: couldn't list networks of compose project %s\n%w", project, err))
+	}
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("ERROR: no networks found for compose project %s (is it up?)", project)
+	}
+	if name == "" {
+		return networks, nil
+	}
+
+	names := []string{}
+	for _, network := range networks {
+		// compose prefixes the network names with the project name
+		if network.Name == name || network.Name == fmt.Sprintf("%s_%s", project, name) {
+			return []types.NetworkResource{network}, nil
+		}
+		names = append(names, network.Name)
+	}
+	return nil, fmt.Errorf("ERROR: compose project %s has no network %s (networks: %s)", project, name, strings.Join(names, ", "))
+}
+
+// getComposeHosts returns the hosts entries (IP and names) of the service containers of a compose project
+// in the given networks: the service name and the container name
+func getComposeHosts(ctx context.Context, docker *client.Client, project string, networks []types.NetworkResource) ([]string, error) {
+	filters := filters.NewArgs()
+	filters.Add("label", fmt.Sprintf("%s=%s", composeProjectLabel, project))
+	logDebugf("ContainerList filters=%s", filtersString(filters))
+	containers, err := docker.ContainerList(ctx, container.ListOptions{Filters: filters})
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't list containers of compose project %s\n%w", project, err)
+	}
+
+	hosts := []string{}
+	for _, c := range containers {
+		if c.NetworkSettings == nil {
+			continue
+		}
+		for _, network := range networks {
+			endpoint, ok := c.NetworkSettings.Networks[network.Name]
+			if !ok || endpoint.IPAddress == "" {
+				continue
+			}
+			hosts = append(hosts, fmt.Sprintf("%s %s %s", endpoint.IPAddress, c.Labels[composeServiceLabel], getContainerShortName(c)))
+			break
+		}
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// updateCoreDNSHosts replaces the entries of a compose project in the NodeHosts of CoreDNS,
+// which k3s keeps the node entries in. The entries are marked with the project, so that linking again replaces them.
+func updateCoreDNSHosts(ctx context.Context, docker *client.Client, serverID, project string, hosts []string) error {
+	output, exitCode, err := execInContainer(ctx, docker, serverID, []string{"kubectl", "--namespace", "kube-system", "get", "configmap", "coredns", "--output", "jsonpath={.data.NodeHosts}"})
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("ERROR: couldn't get the CoreDNS config (is the cluster up?)\n%s", strings.TrimSpace(output))
+	}
+
+	marker := fmt.Sprintf("# k3d compose-link %s", project)
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if line != "" && !strings.HasSuffix(line, marker) {
+			lines = append(lines, line)
+		}
+	}
+	for _, host := range hosts {
+		lines = append(lines, fmt.Sprintf("%s %s", host, marker))
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"data": map[string]string{"NodeHosts": strings.Join(lines, "\n") + "\n"},
+	})
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't serialize CoreDNS config patch\n%w", err)
+	}
+	output, exitCode, err = execInContainer(ctx, docker, serverID, []string{"kubectl", "--namespace", "kube-system", "patch", "configmap", "coredns", "--type", "merge", "--patch", string(patch)})
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("ERROR: couldn't update the CoreDNS config\n%s", strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// ComposeLink connects the nodes of a cluster to the networks of a compose project and makes the services
+// resolvable in the cluster: `k3d compose-link <cluster> <compose-project>`
+func ComposeLink(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("ERROR: please specify a cluster and a compose project")
+	}
+	name, project := c.Args().Get(0), c.Args().Get(1)
+
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[name]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, name)
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+	networks, err := getComposeNetworks(ctx, docker, project, c.String("network"))
+	if err != nil {
+		return err
+	}
+
+	nodes := []types.Container{cl.server}
+	if !c.Bool("server-only") {
+		nodes = append(nodes, cl.workers...)
+	}
+	for _, network := range networks {
+		for _, node := range nodes {
+			if node.NetworkSettings != nil {
+				if _, connected := node.NetworkSettings.Networks[network.Name]; connected {
+					logDebugf("node %s is already connected to network %s", getContainerShortName(node), network.Name)
+					continue
+				}
+			}
+			logDebugf("NetworkConnect %s %s", network.ID, node.ID)
+			if err := docker.NetworkConnect(ctx, network.ID, node.ID, nil); err != nil {
+				return fmt.Errorf("ERROR: couldn't connect node %s to network %s\n%w", getContainerShortName(node), network.Name, err)
+			}
+			log.Printf("Connected node %s to network %s", getContainerShortName(node), network.Name)
+		}
+	}
+
+	if !c.Bool("no-dns") {
+		hosts, err := getComposeHosts(ctx, docker, project, networks)
+		if err != nil {
+			return err
+		}
+		if err := updateCoreDNSHosts(ctx, docker, cl.server.ID, project, hosts); err != nil {
+			return err
+		}
+		logInfof("Added %d services of compose project %s to CoreDNS (it picks them up within 15 seconds)", len(hosts), project)
+	}
+
+	logSuccessf("linked cluster %s to compose project %s", name, project)
+	return nil
+}
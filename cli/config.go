@@ -0,0 +1,186 @@
+package run
+
+/*
+ * The functions in this file check cluster spec files (`k3d config validate`)
+ * and provide their JSON schema for editors (`k3d config schema`).
+ */
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// clusterSpecSchema is the JSON schema of cluster spec files, it has to be kept in sync with types.ClusterSpec
+//
+//go:embed clusterspec.schema.json
+var clusterSpecSchema []byte
+
+// specError is a problem in a cluster spec file. The line is 0 if the problem can't be attributed to a line,
+// e.g. if fields contradict each other.
+type specError struct {
+	line  int
+	field string
+	msg   string
+}
+
+// format returns the error as file:line: field: message
+func (e specError) format(file string) string {
+	location := file
+	if e.line > 0 {
+		location = fmt.Sprintf("%s:%d", file, e.line)
+	}
+	if e.field != "" {
+		return fmt.Sprintf("%s: %s: %s", location, e.field, e.msg)
+	}
+	return fmt.Sprintf("%s: %s", location, e.msg)
+}
+
+// formatSpecErrors returns the errors of a spec file, one per line
+func formatSpecErrors(file string, errs []specError) string {
+	lines := []string{}
+	for _, e := range errs {
+		lines = append(lines, e.format(file))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// specFields returns the types of the fields of a spec struct by their YAML key
+func specFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if key != "" && key != "-" {
+			fields[key] = t.Field(i).Type
+		}
+	}
+	return fields
+}
+
+// describeSpecType returns how a value of a spec field has to look, for error messages
+func describeSpecType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Int:
+		return "an integer"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Slice:
+		return "a list of " + strings.TrimPrefix(strings.TrimPrefix(describeSpecType(t.Elem()), "a "), "an ") + "s"
+	case reflect.Struct:
+		return "a mapping"
+	}
+	return t.String()
+}
+
+// checkSpecMapping reports unknown fields, fields defined more than once and values of the wrong type
+// in a mapping of spec fields, nested mappings (e.g. hooks) are checked as well. It returns the fields it has seen.
+func checkSpecMapping(mapping *yaml.Node, t reflect.Type, prefix string) ([]specError, map[string]bool) {
+	fields := specFields(t)
+	keys := []string{}
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	errs := []specError{}
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], mapping.Content[i+1]
+		field := prefix + key.Value
+		t, ok := fields[key.Value]
+		switch {
+		case !ok:
+			msg := "unknown field"
+			if suggestion := closestString(key.Value, keys); suggestion != "" {
+				msg = fmt.Sprintf("unknown field, did you mean %s?", suggestion)
+			}
+			errs = append(errs, specError{line: key.Line, field: field, msg: msg})
+		case seen[key.Value]:
+			errs = append(errs, specError{line: key.Line, field: field, msg: "defined more than once"})
+		case t.Kind() == reflect.Struct && value.Kind == yaml.MappingNode:
+			nestedErrs, _ := checkSpecMapping(value, t, field+".")
+			errs = append(errs, nestedErrs...)
+		default:
+			if err := value.Decode(reflect.New(t).Interface()); err != nil {
+				errs = append(errs, specError{line: value.Line, field: field, msg: fmt.Sprintf("expected %s", describeSpecType(t))})
+			}
+		}
+		seen[key.Value] = true
+	}
+	return errs, seen
+}
+
+// parseClusterSpec parses and validates a cluster spec. Unknown fields and values of the wrong type are all reported
+// with their line, the checks of the spec values only run if the file is well-formed.
+func parseClusterSpec(content []byte) (*clusterSpec, []specError) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(content, doc); err != nil {
+		return nil, []specError{{msg: strings.TrimPrefix(err.Error(), "yaml: ")}}
+	}
+	if len(doc.Content) == 0 {
+		return nil, []specError{{msg: "the file is empty"}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, []specError{{line: root.Line, msg: "expected a mapping of cluster spec fields"}}
+	}
+
+	errs, seen := checkSpecMapping(root, reflect.TypeOf(clusterSpec{}), "")
+	if !seen["name"] {
+		errs = append(errs, specError{line: root.Line, field: "name", msg: "required field is missing"})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	spec := &clusterSpec{}
+	if err := root.Decode(spec); err != nil {
+		return nil, []specError{{msg: strings.TrimPrefix(err.Error(), "yaml: ")}}
+	}
+	spec.setDefaults()
+	if err := spec.validate(); err != nil {
+		return nil, []specError{{msg: strings.TrimPrefix(err.Error(), "ERROR: ")}}
+	}
+	return spec, nil
+}
+
+// ValidateConfig checks a cluster spec file without creating anything: `k3d config validate <file|->`
+func ValidateConfig(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("ERROR: expected exactly one cluster spec file (or - for stdin)")
+	}
+	file := c.Args().First()
+
+	var content []byte
+	var err error
+	if file == "-" {
+		content, err = io.ReadAll(os.Stdin)
+	} else {
+		content, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't read cluster spec %s\n%w", file, err)
+	}
+
+	if _, errs := parseClusterSpec(content); len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, formatSpecErrors(file, errs))
+		return fmt.Errorf("ERROR: cluster spec %s is invalid (%d problems)", file, len(errs))
+	}
+	logSuccessf("%s is a valid cluster spec", file)
+	return nil
+}
+
+// PrintConfigSchema prints the JSON schema of cluster spec files: `k3d config schema`
+func PrintConfigSchema(c *cli.Context) error {
+	_, err := os.Stdout.Write(clusterSpecSchema)
+	return err
+}
@@ -6,49 +6,217 @@ package run
  */
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-units"
 )
 
-func startContainer(verbose bool, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (string, error) {
+// imagePullTimeout limits the time a single image pull may take (0 = no limit).
+// It's independent of the readiness timeout of --wait, since pulls are much slower on a cold cache.
+var imagePullTimeout time.Duration
 
+// SetImagePullTimeout sets the time limit for image pulls
+func SetImagePullTimeout(timeout time.Duration) {
+	imagePullTimeout = timeout
+}
+
+// normalizeImage turns an image reference into its fully qualified form, i.e. adds the default registry
+// (and library/ namespace) if no registry is given and the latest tag if neither tag nor digest is given.
+// Registries with ports (myreg.local:5000/k3s:v1.28), nested paths and digests are preserved.
+func normalizeImage(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("ERROR: invalid image reference [%s]\n%w", image, err)
+	}
+	return reference.TagNameOnly(named).String(), nil
+}
+
+// dockerArchitectures maps the kernel architecture reported by the docker daemon to the image architecture naming
+var dockerArchitectures = map[string]string{
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"armv7l":  "arm",
+	"armv6l":  "arm",
+}
+
+// checkImagePlatform warns if the pulled image doesn't match the architecture of the docker host.
+// This happens when a single-arch tag or a digest of a single platform image is used instead of a multi-arch manifest list.
+func checkImagePlatform(ctx context.Context, docker *client.Client, image string) {
+	info, err := docker.Info(ctx)
+	if err != nil {
+		logDebugf("couldn't get docker info to check the image platform: %+v", err)
+		return
+	}
+	inspect, _, err := docker.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		logDebugf("couldn't inspect image %s to check its platform: %+v", image, err)
+		return
+	}
+
+	hostArch := info.Architecture
+	if arch, ok := dockerArchitectures[hostArch]; ok {
+		hostArch = arch
+	}
+	if inspect.Architecture != "" && inspect.Architecture != hostArch {
+		logWarningf("image %s is built for %s/%s, but the docker host runs on %s/%s. Use a multi-arch tag or a digest matching the host platform.", image, inspect.Os, inspect.Architecture, info.OSType, hostArch)
+	}
+}
+
+// imagePull is a pull of an image, which may be in progress
+type imagePull struct {
+	done chan struct{}
+	err  error
+}
+
+// imagePulls deduplicates pulls of the same image, e.g. for the server and all workers of a cluster [image -> pull]
+var (
+	imagePulls     = map[string]*imagePull{}
+	imagePullsLock sync.Mutex
+)
+
+// ensureImage pulls an image once per run of k3d: concurrent callers wait for the pull in progress,
+// later callers return immediately. Failed pulls are forgotten, so they can be retried.
+func ensureImage(ctx context.Context, docker *client.Client, imageName string) error {
+	imagePullsLock.Lock()
+	if pull, ok := imagePulls[imageName]; ok {
+		imagePullsLock.Unlock()
+		logDebugf("image %s already pulled (or being pulled), skipping pull", imageName)
+		<-pull.done
+		return pull.err
+	}
+	pull := &imagePull{done: make(chan struct{})}
+	imagePulls[imageName] = pull
+	imagePullsLock.Unlock()
+
+	pull.err = pullImage(ctx, docker, imageName)
+	if pull.err != nil {
+		imagePullsLock.Lock()
+		delete(imagePulls, imageName)
+		imagePullsLock.Unlock()
+	}
+	close(pull.done)
+	return pull.err
+}
+
+// markImageAvailable registers an image as pulled, for local images which can't be pulled (e.g. committed nodes)
+func markImageAvailable(imageName string) {
+	imagePullsLock.Lock()
+	defer imagePullsLock.Unlock()
+	if _, ok := imagePulls[imageName]; !ok {
+		pull := &imagePull{done: make(chan struct{})}
+		close(pull.done)
+		imagePulls[imageName] = pull
+	}
+}
+
+// verifyLocalImages checks that all images exist locally, e.g. for air-gapped setups where nothing can be pulled.
+// The images are registered as available, so that they aren't pulled later on.
+func verifyLocalImages(images []string) error {
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	missing := []string{}
+	for _, image := range images {
+		logDebugf("ImageInspectWithRaw %s", image)
+		if _, _, err := docker.ImageInspectWithRaw(ctx, image); err != nil {
+			if !client.IsErrNotFound(err) {
+				return checkDockerError(fmt.Errorf("ERROR: couldn't inspect image %s\n%w", image, err))
+			}
+			missing = append(missing, image)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("ERROR: %d required images don't exist locally, load them (e.g. docker load) or create the cluster without --no-image-pull:\n  %s", len(missing), strings.Join(missing, "\n  "))
+	}
+	for _, image := range images {
+		markImageAvailable(image)
+	}
+	return nil
+}
+
+// pullClusterImage pulls the image of a cluster before the nodes are created
+func pullClusterImage(imageName string) error {
 	ctx := context.Background()
-	docker, err := client.NewClientWithOpts()
+	docker, err := newDockerClient()
 	if err != nil {
-		return "", fmt.Errorf("ERROR: couldn't create docker client\n%+v", err)
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
 	}
+	return ensureImage(ctx, docker, imageName)
+}
+
+// pullImage pulls an image with the registry credentials for it, respecting the pull timeout
+func pullImage(ctx context.Context, docker *client.Client, imageName string) error {
+	pullCtx, cancel := context.WithCancel(ctx)
+	if imagePullTimeout > 0 {
+		pullCtx, cancel = context.WithTimeout(ctx, imagePullTimeout)
+	}
+	defer cancel()
 
-	log.Printf("Pulling image %s...\n", config.Image)
-	reader, err := docker.ImagePull(ctx, config.Image, image.PullOptions{})
+	log.Printf("Pulling image %s...\n", imageName)
+	logDebugf("ImagePull %s", imageName)
+	registryAuth, err := getRegistryAuth(imageName)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't get registry credentials for image %s\n%w", imageName, err)
+	}
+	reader, err := docker.ImagePull(pullCtx, imageName, image.PullOptions{RegistryAuth: registryAuth})
 	if err != nil {
-		return "", fmt.Errorf("ERROR: couldn't pull image %s\n%+v", config.Image, err)
+		return fmt.Errorf("ERROR: couldn't pull image %s\n%w", imageName, err)
 	}
 	defer reader.Close()
-	if verbose {
-		_, err := io.Copy(os.Stdout, reader)
-		if err != nil {
-			log.Printf("WARNING: couldn't get docker output\n%+v", err)
-		}
-	} else {
-		_, err := io.Copy(io.Discard, reader)
-		if err != nil {
-			log.Printf("WARNING: couldn't get docker output\n%+v", err)
-		}
+	err = displayPullProgress(reader, imageName)
+	if errors.Is(pullCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("ERROR: pulling image %s exceeded the timeout of %s", imageName, imagePullTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't pull image %s\n%w", imageName, err)
+	}
+
+	checkImagePlatform(ctx, docker, imageName)
+	return nil
+}
+
+func startContainer(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (string, error) {
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return "", fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	if err := ensureImage(ctx, docker, config.Image); err != nil {
+		return "", err
 	}
 
+	logContainerConfig(containerName, config, hostConfig)
 	resp, err := docker.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, containerName)
 	if err != nil {
-		return "", fmt.Errorf("ERROR: couldn't create container after pull %s\n%+v", containerName, err)
+		if hostConfig.StorageOpt != nil && strings.Contains(err.Error(), "storage-opt") {
+			return "", fmt.Errorf("ERROR: couldn't create container %s: the docker storage driver doesn't support storage size limits (e.g. overlay2 requires xfs with pquota)\n%w", containerName, err)
+		}
+		return "", fmt.Errorf("ERROR: couldn't create container after pull %s\n%w", containerName, err)
 	}
+	logDebugf("Created container [%s] with ID %s", containerName, resp.ID)
 
 	if err := docker.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
 		return "", err
@@ -56,96 +224,215 @@ func startContainer(verbose bool, config *container.Config, hostConfig *containe
 	return resp.ID, nil
 }
 
-// This function create and start Docker containers for clusters
-func createServer(verbose bool, image string, apiPort string, args []string, env []string, name string, volumes []string, nodeToPortSpecMap map[string][]string, autoRestart bool) (string, error) {
-	log.Printf("Creating server using %s...\n", image)
+// nodeStorageOptions limit the memory and disk space a node container may use for its filesystems
+type nodeStorageOptions struct {
+	tmpfsSize   string   // size of the tmpfs mounts for /run and /var/run, e.g. 64m (empty = unlimited)
+	storageSize string   // size limit of the container's writable layer, e.g. 10G (empty = unlimited)
+	tmpfs       []string // additional tmpfs mounts in the format path[:options]
+	readOnly    bool     // read-only root filesystem, k3s can only write to volumes and tmpfs mounts
+}
 
-	// containerLabels sets metadata labels for the container
-	containerLabels := make(map[string]string)
-	containerLabels["app"] = "k3d"
-	containerLabels["component"] = "server"
-	containerLabels["created"] = time.Now().Format("2006-01-02 15:04:05")
-	containerLabels["cluster"] = name
+// validate checks the sizes for valid human readable values
+func (o nodeStorageOptions) validate() error {
+	if o.tmpfsSize != "" {
+		if _, err := units.RAMInBytes(o.tmpfsSize); err != nil {
+			return fmt.Errorf("ERROR: invalid tmpfs size [%s]\n%w", o.tmpfsSize, err)
+		}
+	}
+	if o.storageSize != "" {
+		if _, err := units.RAMInBytes(o.storageSize); err != nil {
+			return fmt.Errorf("ERROR: invalid storage size [%s]\n%w", o.storageSize, err)
+		}
+	}
+	return nil
+}
 
-	containerName := GetContainerName("server", name, -1)
+// apply sets up the tmpfs mounts and the storage quota in a container's host config
+func (o nodeStorageOptions) apply(hostConfig *container.HostConfig) {
+	tmpfsOptions := ""
+	if o.tmpfsSize != "" {
+		tmpfsOptions = "size=" + o.tmpfsSize
+	}
+	hostConfig.Tmpfs = map[string]string{
+		"/run":     tmpfsOptions,
+		"/var/run": tmpfsOptions,
+	}
+	if o.storageSize != "" {
+		// only supported by some storage drivers, e.g. overlay2 on xfs with pquota
+		hostConfig.StorageOpt = map[string]string{"size": o.storageSize}
+	}
+	for path, options := range o.tmpfsMounts() {
+		hostConfig.Tmpfs[path] = options
+	}
+	hostConfig.ReadonlyRootfs = o.readOnly
+}
 
-	// ports to be assigned to the server belong to roles
-	// all, server or <server-container-name>
-	serverPorts, err := MergePortSpecs(nodeToPortSpecMap, "server", containerName)
-	if err != nil {
-		return "", err
+// tmpfsMounts returns the additional tmpfs mounts [path -> options], including the ones
+// k3s needs to write to outside of its volumes if the root filesystem is read-only
+func (o nodeStorageOptions) tmpfsMounts() map[string]string {
+	mounts := map[string]string{}
+	if o.readOnly {
+		for _, path := range readOnlyTmpfsPaths {
+			mounts[path] = ""
+		}
+	}
+	for _, tmpfs := range o.tmpfs {
+		path, options, _ := strings.Cut(tmpfs, ":")
+		mounts[path] = options
 	}
+	return mounts
+}
 
-	apiPortSpec := fmt.Sprintf("0.0.0.0:%s:%s/tcp", apiPort, apiPort)
+// equal reports whether two storage options result in the same filesystems
+func (o nodeStorageOptions) equal(other nodeStorageOptions) bool {
+	return o.tmpfsSize == other.tmpfsSize && o.storageSize == other.storageSize && o.readOnly == other.readOnly &&
+		reflect.DeepEqual(o.tmpfsMounts(), other.tmpfsMounts())
+}
 
-	serverPorts = append(serverPorts, apiPortSpec)
+// rootlessUser is the user k3s runs as in rootless node containers
+const rootlessUser = "1000:1000"
 
-	serverPublishedPorts, err := CreatePublishedPorts(serverPorts)
-	if err != nil {
-		log.Fatalf("Error: failed to parse port specs %+v \n%+v", serverPorts, err)
+// unprivilegedCapabilities are the capabilities k3s needs in a node container without --privileged
+var unprivilegedCapabilities = []string{"SYS_ADMIN", "NET_ADMIN", "NET_RAW", "SYS_PTRACE", "SYS_RESOURCE"}
+
+// minUnprivilegedAPIVersion is the first docker API version supporting cgroup namespace modes
+const minUnprivilegedAPIVersion = "1.41"
+
+// nodeSecurityOptions control the privileges of a node container
+type nodeSecurityOptions struct {
+	rootless     bool // experimental: run k3s rootless in an unprivileged container
+	noPrivileged bool // grant a baseline of capabilities and security options instead of --privileged
+}
+
+// apply sets up the privileges in a container's config and host config.
+// Rootless nodes run as unprivileged user with a private cgroup namespace (cgroup v2 delegation),
+// k3s sets up its own user namespace with rootlesskit, which requires relaxed security profiles.
+func (o nodeSecurityOptions) apply(config *container.Config, hostConfig *container.HostConfig) {
+	if o.noPrivileged && !o.rootless {
+		hostConfig.CapAdd = unprivilegedCapabilities
+		hostConfig.SecurityOpt = []string{"seccomp=unconfined", "apparmor=unconfined"}
+		hostConfig.CgroupnsMode = container.CgroupnsModeHost
+		hostConfig.Devices = []container.DeviceMapping{
+			{PathOnHost: "/dev/kmsg", PathInContainer: "/dev/kmsg", CgroupPermissions: "rwm"},
+		}
+		return
+	}
+	if !o.rootless {
+		hostConfig.Privileged = true
+		return
 	}
 
-	hostConfig := &container.HostConfig{
-		PortBindings: serverPublishedPorts.PortBindings,
-		Privileged:   true,
+	config.User = rootlessUser
+	config.Env = append(config.Env, "HOME=/home/k3s")
+	hostConfig.SecurityOpt = []string{"seccomp=unconfined", "apparmor=unconfined", "systempaths=unconfined"}
+	hostConfig.CgroupnsMode = container.CgroupnsModePrivate
+	hostConfig.Devices = []container.DeviceMapping{
+		{PathOnHost: "/dev/fuse", PathInContainer: "/dev/fuse", CgroupPermissions: "rwm"},
+		{PathOnHost: "/dev/net/tun", PathInContainer: "/dev/net/tun", CgroupPermissions: "rwm"},
 	}
+	if hostConfig.Tmpfs == nil {
+		hostConfig.Tmpfs = map[string]string{}
+	}
+	hostConfig.Tmpfs["/home/k3s"] = "uid=1000,gid=1000"
+}
 
-	if autoRestart {
-		hostConfig.RestartPolicy.Name = "unless-stopped"
+// checkUnprivilegedSupport checks whether the docker daemon supports the options used for unprivileged nodes
+func checkUnprivilegedSupport() error {
+	ctx := context.Background()
+	docker, err := newDockerClient(client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
 	}
 
-	if len(volumes) > 0 && volumes[0] != "" {
-		hostConfig.Binds = volumes
+	logDebugf("ServerVersion")
+	serverVersion, err := docker.ServerVersion(ctx)
+	if err != nil {
+		return checkDockerError(fmt.Errorf("ERROR: couldn't get docker version\n%w", err))
 	}
+	if versions.LessThan(serverVersion.APIVersion, minUnprivilegedAPIVersion) {
+		return fmt.Errorf("ERROR: docker API %s doesn't support cgroup namespace modes (requires %s, Docker 20.10)", serverVersion.APIVersion, minUnprivilegedAPIVersion)
+	}
+	return nil
+}
 
-	networkingConfig := &network.NetworkingConfig{
-		EndpointsConfig: map[string]*network.EndpointSettings{
-			name: {
-				Aliases: []string{containerName},
-			},
-		},
+// getK3sImageVersion returns the k3s version of a k3s image tagged with its version, e.g. v1.29.1-k3s1 of rancher/k3s:v1.29.1-k3s1.
+// It reports false for other images and tags (e.g. latest or digests).
+func getK3sImageVersion(image string) (string, bool) {
+	version := getImageVersion(image)
+	repository := strings.TrimSuffix(strings.SplitN(image, "@", 2)[0], ":"+version)
+	if !strings.HasSuffix(repository, "/k3s") || !strings.HasPrefix(version, "v") {
+		return "", false
 	}
+	return version, true
+}
 
-	containerConfig := &container.Config{
-		Hostname:     containerName,
-		Image:        image,
-		Cmd:          append([]string{"server"}, args...), // sets the command to be executed in the container
-		ExposedPorts: serverPublishedPorts.ExposedPorts,
-		Env:          env,
-		Labels:       containerLabels,
+// minCgroupV2K3sVersion is the first k3s release that runs on hosts with cgroup v2 only
+const minCgroupV2K3sVersion = "v1.20.4"
+
+// checkCgroupV2Support checks whether the k3s version of an image runs on the docker host: older k3s releases fail
+// with cryptic errors on cgroup v2 hosts. Images without a k3s version tag (e.g. latest or digests) aren't checked.
+func checkCgroupV2Support(image string) error {
+	version, ok := getK3sImageVersion(image)
+	if !ok {
+		logDebugf("can't determine the k3s version of image %s, skipping the cgroup v2 check", image)
+		return nil
 	}
 
-	id, err := startContainer(verbose, containerConfig, hostConfig, networkingConfig, containerName)
+	ctx := context.Background()
+	docker, err := newDockerClient()
 	if err != nil {
-		return "", fmt.Errorf("ERROR: couldn't start container %s\n%+v", containerName, err)
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+	logDebugf("Info")
+	info, err := docker.Info(ctx)
+	if err != nil {
+		return checkDockerError(fmt.Errorf("ERROR: couldn't get docker info\n%w", err))
+	}
+	if info.CgroupVersion != "2" {
+		return nil
 	}
 
-	return id, nil
-
+	// only the release numbers count, the -k3sN suffix isn't a pre-release
+	numbers, _ := parseVersion(version)
+	minNumbers, _ := parseVersion(minCgroupV2K3sVersion)
+	for i := range numbers {
+		if numbers[i] != minNumbers[i] {
+			if numbers[i] < minNumbers[i] {
+				return fmt.Errorf("ERROR: the docker host uses cgroup v2, which k3s %s doesn't support (requires %s or newer)", version, minCgroupV2K3sVersion)
+			}
+			break
+		}
+	}
+	return nil
 }
 
-// This function create and start Docker containers for workers
-func createWorker(verbose bool, image string, args []string, env []string, name string, volumes []string, postfix int, serverPort string, nodeToPortSpecMap map[string][]string, portAutoOffset int, autoRestart bool) (string, error) {
+// getServerPublishedPorts returns the ports published by the server container, including the API port
+func getServerPublishedPorts(nodeToPortSpecMap map[string][]string, containerName string, apiPort string) (*PublishedPorts, error) {
+	// ports to be assigned to the server belong to roles
+	// all, server or <server-container-name>
+	serverPorts, err := MergePortSpecs(nodeToPortSpecMap, "server", containerName)
+	if err != nil {
+		return nil, err
+	}
 
-	containerLabels := make(map[string]string)
-	containerLabels["app"] = "k3d"
-	containerLabels["component"] = "worker"
-	containerLabels["created"] = time.Now().Format("2006-01-02 15:04:05")
-	containerLabels["cluster"] = name
+	apiPortSpec := fmt.Sprintf("0.0.0.0:%s:%s/tcp", apiPort, apiPort)
 
-	containerName := GetContainerName("worker", name, postfix)
+	serverPorts = append(serverPorts, apiPortSpec)
 
-	env = append(env, fmt.Sprintf("K3S_URL=https://k3d-%s-server:%s", name, serverPort))
+	return CreatePublishedPorts(serverPorts)
+}
 
-	// ports to be assigned to the server belong to roles
-	// all, server or <server-container-name>
+// getWorkerPublishedPorts returns the ports published by the worker container with the given index
+func getWorkerPublishedPorts(nodeToPortSpecMap map[string][]string, containerName string, postfix int, portAutoOffset int) (*PublishedPorts, error) {
+	// ports to be assigned to the worker belong to roles
+	// all, workers or <worker-container-name>
 	workerPorts, err := MergePortSpecs(nodeToPortSpecMap, "worker", containerName)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	workerPublishedPorts, err := CreatePublishedPorts(workerPorts)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if portAutoOffset > 0 {
@@ -153,54 +440,202 @@ func createWorker(verbose bool, image string, args []string, env []string, name
 		// to the same host port without a offset
 		workerPublishedPorts = workerPublishedPorts.Offset(postfix + portAutoOffset)
 	}
+	return workerPublishedPorts, nil
+}
+
+// nodeSpec describes a node container of a cluster
+type nodeSpec struct {
+	role        string // server or worker
+	name        string // container name, which is also used as hostname
+	clusterName string // empty for external workers, which don't belong to a k3d cluster
+	network     string // network to attach to instead of the cluster network, e.g. of an external worker
+	image       string
+	args        []string // arguments of `k3s server` or `k3s agent`
+	env         []string
+	volumes     []string
+	labels      map[string]string // labels in addition to the common ones, e.g. the API port of the server
+	ports       *PublishedPorts
+	autoRestart bool
+	storage     nodeStorageOptions
+	security    nodeSecurityOptions
+	dns         nodeDNSOptions
+}
+
+// containerLabels returns the labels of the node container: the common k3d labels and the node specific ones
+func (n nodeSpec) containerLabels() map[string]string {
+	labels := map[string]string{
+		"app":       "k3d",
+		"prefix":    containerNamePrefix,
+		"component": n.role,
+		"created":   labelTimestamp(),
+	}
+	if n.clusterName != "" {
+		labels["cluster"] = n.clusterName
+	}
+	for k, v := range n.labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// containerConfigs returns the docker configs the node container is created with
+func (n nodeSpec) containerConfigs() (*container.Config, *container.HostConfig, *network.NetworkingConfig) {
+	command := "agent"
+	if n.role == "server" {
+		command = "server"
+	}
 
+	ports := n.ports
+	if ports == nil {
+		ports = &PublishedPorts{}
+	}
 	hostConfig := &container.HostConfig{
-		Tmpfs: map[string]string{
-			"/run":     "",
-			"/var/run": "",
-		},
-		PortBindings: workerPublishedPorts.PortBindings,
-		Privileged:   true,
+		PortBindings: ports.PortBindings,
 	}
+	n.storage.apply(hostConfig)
+	n.dns.apply(hostConfig)
 
-	if autoRestart {
+	if n.autoRestart {
 		hostConfig.RestartPolicy.Name = "unless-stopped"
 	}
 
-	if len(volumes) > 0 && volumes[0] != "" {
-		hostConfig.Binds = volumes
+	if len(n.volumes) > 0 && n.volumes[0] != "" {
+		hostConfig.Binds = n.volumes
 	}
 
-	networkingConfig := &network.NetworkingConfig{
-		EndpointsConfig: map[string]*network.EndpointSettings{
-			name: {
-				Aliases: []string{containerName},
+	var networkingConfig *network.NetworkingConfig
+	switch {
+	case n.network != "":
+		hostConfig.NetworkMode = container.NetworkMode(n.network)
+	case n.clusterName != "":
+		networkingConfig = &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				getClusterNetworkName(n.clusterName): {
+					Aliases: []string{n.name},
+				},
 			},
-		},
+		}
 	}
 
 	containerConfig := &container.Config{
-		Hostname:     containerName,
-		Image:        image,
-		Env:          env,
-		Labels:       containerLabels,
-		ExposedPorts: workerPublishedPorts.ExposedPorts,
+		Hostname:     n.name,
+		Image:        n.image,
+		Cmd:          append([]string{command}, n.args...), // sets the command to be executed in the container
+		ExposedPorts: ports.ExposedPorts,
+		Env:          n.env,
+		Labels:       n.containerLabels(),
 	}
+	n.security.apply(containerConfig, hostConfig)
 
-	id, err := startContainer(verbose, containerConfig, hostConfig, networkingConfig, containerName)
+	return containerConfig, hostConfig, networkingConfig
+}
+
+// createNode creates and starts a node container
+func createNode(n nodeSpec) (string, error) {
+	containerConfig, hostConfig, networkingConfig := n.containerConfigs()
+	id, err := startContainer(containerConfig, hostConfig, networkingConfig, n.name)
 	if err != nil {
-		return "", fmt.Errorf("ERROR: couldn't start container %s\n%+v", containerName, err)
+		return "", fmt.Errorf("ERROR: couldn't start container %s\n%w", n.name, err)
 	}
-
 	return id, nil
 }
 
+// serverVolumes returns the volumes of the server: the volumes of the cluster, the resolv.conf managed by k3d
+// and the directory of the kubeconfig output in the cluster directory
+func (s *clusterSpec) serverVolumes() ([]string, error) {
+	volumes := append(append([]string{}, s.Volumes...), s.resolvConfVolumes()...)
+	if s.NoKubeconfigOutput {
+		return volumes, nil
+	}
+	outputDir, err := getClusterKubeConfigOutputDir(s.Name)
+	if err != nil {
+		return nil, err
+	}
+	return append(volumes, fmt.Sprintf("%s:%s", outputDir, path.Dir(s.kubeconfigOutputPath()))), nil
+}
+
+// serverNode returns the spec of the server container of the cluster. portmap contains the port specs by node,
+// tokenEnv the environment variables with the token of the cluster.
+func (s *clusterSpec) serverNode(portmap map[string][]string, tokenEnv []string) (nodeSpec, error) {
+	containerName := GetContainerName("server", s.Name, -1)
+	serverPublishedPorts, err := getServerPublishedPorts(portmap, containerName, s.apiPortString())
+	if err != nil {
+		return nodeSpec{}, fmt.Errorf("ERROR: failed to parse port specs\n%w", err)
+	}
+	volumes, err := s.serverVolumes()
+	if err != nil {
+		return nodeSpec{}, err
+	}
+
+	env := append(s.kubeconfigEnv(), s.nodeEnv()...)
+	env = append(env, tokenEnv...)
+	labels := map[string]string{"apiPort": s.apiPortString()}
+	for k, v := range s.clusterLabels() {
+		labels[k] = v
+	}
+	if s.APIServerAddress != "" {
+		labels["apiServerAddress"] = s.APIServerAddress
+	}
+	if nodeNameTemplate := getNodeNameTemplate(s.Name); nodeNameTemplate != "" {
+		labels["nodeNameTemplate"] = nodeNameTemplate
+	}
+
+	return nodeSpec{
+		role:        "server",
+		name:        containerName,
+		clusterName: s.Name,
+		image:       s.nodeImage("server", -1),
+		args:        s.k3sServerArgs(),
+		env:         env,
+		volumes:     volumes,
+		labels:      labels,
+		ports:       serverPublishedPorts,
+		autoRestart: s.AutoRestart,
+		storage:     s.storageOptions("server", containerName),
+		security:    s.securityOptions(),
+		dns:         s.dnsOptions(),
+	}, nil
+}
+
+// workerNode returns the spec of the worker container with the given index, which joins the server of the cluster.
+// portmap contains the port specs by node, tokenEnv the environment variables with the token of the cluster.
+func (s *clusterSpec) workerNode(index int, portmap map[string][]string, tokenEnv []string) (nodeSpec, error) {
+	containerName := GetContainerName("worker", s.Name, index)
+	workerPublishedPorts, err := getWorkerPublishedPorts(portmap, containerName, index, s.PortAutoOffset)
+	if err != nil {
+		return nodeSpec{}, err
+	}
+
+	env := append(append([]string{}, tokenEnv...), s.nodeEnv()...)
+	env = append(env, fmt.Sprintf("K3S_URL=https://%s:%s", GetContainerName("server", s.Name, -1), s.apiPortString()))
+	labels := map[string]string{"index": strconv.Itoa(index)}
+	for k, v := range s.clusterLabels() {
+		labels[k] = v
+	}
+
+	return nodeSpec{
+		role:        "worker",
+		name:        containerName,
+		clusterName: s.Name,
+		image:       s.nodeImage("worker", index),
+		args:        s.k3sAgentArgs(index),
+		env:         env,
+		volumes:     append(append([]string{}, s.Volumes...), s.resolvConfVolumes()...),
+		labels:      labels,
+		ports:       workerPublishedPorts,
+		autoRestart: s.AutoRestart,
+		storage:     s.storageOptions("worker", containerName),
+		security:    s.securityOptions(),
+		dns:         s.dnsOptions(),
+	}, nil
+}
+
 // removeContainer tries to rm a container, selected by Docker ID, and does a rm -f if it fails (e.g. if container is still running)
 func removeContainer(ID string) error {
 	ctx := context.Background()
-	docker, err := client.NewClientWithOpts()
+	docker, err := newDockerClient()
 	if err != nil {
-		return fmt.Errorf("ERROR: couldn't create docker client\n%+v", err)
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
 	}
 
 	options := container.RemoveOptions{
@@ -209,9 +644,42 @@ func removeContainer(ID string) error {
 	}
 
 	// always force delete
+	logDebugf("ContainerRemove %s", ID)
 	if err := docker.ContainerRemove(ctx, ID, options); err != nil {
-		return fmt.Errorf("FAILURE: couldn't delete container [%s] -> %+v", ID, err)
+		return fmt.Errorf("FAILURE: couldn't delete container [%s] -> %w", ID, err)
 	}
 
 	return nil
 }
+
+// execInContainer runs a command inside of a running container (non-interactive) and returns its combined output and exit code
+func execInContainer(ctx context.Context, docker *client.Client, ID string, cmd []string) (string, int, error) {
+	logDebugf("ContainerExecCreate %s: %v", ID, cmd)
+	exec, err := docker.ContainerExecCreate(ctx, ID, types.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return "", -1, fmt.Errorf("ERROR: couldn't create exec in container %s\n%w", ID, err)
+	}
+
+	resp, err := docker.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return "", -1, fmt.Errorf("ERROR: couldn't attach to exec in container %s\n%w", ID, err)
+	}
+	defer resp.Close()
+
+	// the output is multiplexed, so we have to split it up again
+	output := new(bytes.Buffer)
+	if _, err := stdcopy.StdCopy(output, output, resp.Reader); err != nil {
+		return "", -1, fmt.Errorf("ERROR: couldn't read exec output from container %s\n%w", ID, err)
+	}
+
+	inspect, err := docker.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return output.String(), -1, fmt.Errorf("ERROR: couldn't inspect exec in container %s\n%w", ID, err)
+	}
+
+	return output.String(), inspect.ExitCode, nil
+}
@@ -0,0 +1,204 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+)
+
+func TestNormalizeImage(t *testing.T) {
+	digest := "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		image   string
+		want    string
+		wantErr bool
+	}{
+		{image: "rancher/k3s", want: "docker.io/rancher/k3s:latest"},
+		{image: "rancher/k3s:v1.28.5-k3s1", want: "docker.io/rancher/k3s:v1.28.5-k3s1"},
+		{image: "busybox", want: "docker.io/library/busybox:latest"},
+		{image: "docker.io/rancher/k3s:v1.28.5-k3s1", want: "docker.io/rancher/k3s:v1.28.5-k3s1"},
+		{image: "myreg.local:5000/k3s", want: "myreg.local:5000/k3s:latest"},
+		{image: "myreg.local:5000/team/k3s:v1.28", want: "myreg.local:5000/team/k3s:v1.28"},
+		{image: "localhost:5000/k3s:dev", want: "localhost:5000/k3s:dev"},
+		{image: "rancher/k3s@" + digest, want: "docker.io/rancher/k3s@" + digest},
+		{image: "rancher/k3s:v1.28.5-k3s1@" + digest, want: "docker.io/rancher/k3s:v1.28.5-k3s1@" + digest},
+		{image: "", wantErr: true},
+		{image: "rancher/K3s", wantErr: true},
+		{image: "rancher/k3s:", wantErr: true},
+		{image: "rancher/k3s@sha256:short", wantErr: true},
+		{image: "rancher/k3s:v1 2", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeImage(tt.image)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeImage(%q) = %q, want an error", tt.image, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeImage(%q) returned error %v", tt.image, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeImage(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestNodeSpecContainerLabels(t *testing.T) {
+	n := nodeSpec{role: "worker", clusterName: "dev", labels: map[string]string{"index": "1", "group": "workshop"}}
+	labels := n.containerLabels()
+	want := map[string]string{"app": "k3d", "prefix": containerNamePrefix, "component": "worker", "cluster": "dev", "index": "1", "group": "workshop"}
+	for k, v := range want {
+		if labels[k] != v {
+			t.Errorf("label %s = %q, want %q", k, labels[k], v)
+		}
+	}
+	if labels["created"] == "" {
+		t.Errorf("label created is missing")
+	}
+
+	// external workers don't belong to a k3d cluster
+	n = nodeSpec{role: "worker"}
+	if _, ok := n.containerLabels()["cluster"]; ok {
+		t.Errorf("node without cluster has a cluster label")
+	}
+}
+
+func TestServerNode(t *testing.T) {
+	portmap, err := mapNodesToPortSpecs([]string{"8080:80@server"}, GetAllContainerNames("dev", 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &clusterSpec{
+		Name:             "dev",
+		Image:            "docker.io/rancher/k3s:v1.28.5-k3s1",
+		APIPort:          6550,
+		APIServerAddress: "10.0.0.1",
+		Workers:          1,
+		ServerArgs:       []string{"--disable", "traefik"},
+		Volumes:          []string{"/src:/dst"},
+		AutoRestart:      true,
+		Group:            "workshop",
+		DNS:              []string{"1.1.1.1"},
+	}
+	n, err := spec.serverNode(portmap, []string{"K3S_TOKEN=secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, hostConfig, networkingConfig := n.containerConfigs()
+
+	name := GetContainerName("server", "dev", -1)
+	if config.Hostname != name {
+		t.Errorf("hostname = %q, want %q", config.Hostname, name)
+	}
+	if got, want := strings.Join(config.Cmd, " "), "server --https-listen-port 6550 --tls-san 10.0.0.1 --disable traefik"; got != want {
+		t.Errorf("command = %q, want %q", got, want)
+	}
+	if !containsString(config.Env, "K3S_TOKEN=secret") || !containsString(config.Env, "K3S_KUBECONFIG_OUTPUT="+defaultKubeconfigOutput) {
+		t.Errorf("env = %v, want the token and the kubeconfig output", config.Env)
+	}
+	for k, v := range map[string]string{"component": "server", "cluster": "dev", "apiPort": "6550", "apiServerAddress": "10.0.0.1", groupLabel: "workshop"} {
+		if config.Labels[k] != v {
+			t.Errorf("label %s = %q, want %q", k, config.Labels[k], v)
+		}
+	}
+	for _, port := range []nat.Port{"6550/tcp", "80/tcp"} {
+		if _, ok := config.ExposedPorts[port]; !ok {
+			t.Errorf("port %s isn't exposed (exposed: %v)", port, config.ExposedPorts)
+		}
+		if len(hostConfig.PortBindings[port]) == 0 {
+			t.Errorf("port %s isn't published (published: %v)", port, hostConfig.PortBindings)
+		}
+	}
+	if hostConfig.RestartPolicy.Name != "unless-stopped" {
+		t.Errorf("restart policy = %q, want unless-stopped", hostConfig.RestartPolicy.Name)
+	}
+	if len(hostConfig.Binds) != 2 || hostConfig.Binds[0] != "/src:/dst" || !strings.HasSuffix(hostConfig.Binds[1], ":/output") {
+		t.Errorf("binds = %v, want /src:/dst and the kubeconfig output directory", hostConfig.Binds)
+	}
+	if !hostConfig.Privileged {
+		t.Errorf("server isn't privileged")
+	}
+	if len(hostConfig.DNS) != 1 || hostConfig.DNS[0] != "1.1.1.1" {
+		t.Errorf("DNS = %v, want [1.1.1.1]", hostConfig.DNS)
+	}
+	endpoint, ok := networkingConfig.EndpointsConfig[getClusterNetworkName("dev")]
+	if !ok || len(endpoint.Aliases) != 1 || endpoint.Aliases[0] != name {
+		t.Errorf("networking config = %+v, want the cluster network with alias %s", networkingConfig.EndpointsConfig, name)
+	}
+}
+
+func TestWorkerNode(t *testing.T) {
+	portmap, err := mapNodesToPortSpecs([]string{"8080:80@server", "9090:90@workers"}, GetAllContainerNames("dev", 1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &clusterSpec{Name: "dev", Image: "docker.io/rancher/k3s:v1.28.5-k3s1", APIPort: 6550, Workers: 2}
+	n, err := spec.workerNode(1, portmap, []string{"K3S_TOKEN=secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, hostConfig, networkingConfig := n.containerConfigs()
+
+	if got := strings.Join(config.Cmd, " "); got != "agent" {
+		t.Errorf("command = %q, want agent", got)
+	}
+	serverURL := fmt.Sprintf("K3S_URL=https://%s:6550", GetContainerName("server", "dev", -1))
+	if !containsString(config.Env, serverURL) {
+		t.Errorf("env = %v, want %s", config.Env, serverURL)
+	}
+	if config.Labels["index"] != "1" || config.Labels["component"] != "worker" {
+		t.Errorf("labels = %v, want index 1 and component worker", config.Labels)
+	}
+	if _, ok := config.ExposedPorts["90/tcp"]; !ok {
+		t.Errorf("port of the workers isn't exposed (exposed: %v)", config.ExposedPorts)
+	}
+	if _, ok := config.ExposedPorts["80/tcp"]; ok {
+		t.Errorf("port of the server is exposed on a worker")
+	}
+	if hostConfig.RestartPolicy.Name != "" || hostConfig.Binds != nil {
+		t.Errorf("restart policy %q and binds %v, want none", hostConfig.RestartPolicy.Name, hostConfig.Binds)
+	}
+	if _, ok := networkingConfig.EndpointsConfig[getClusterNetworkName("dev")]; !ok {
+		t.Errorf("worker isn't attached to the cluster network")
+	}
+}
+
+func TestNewExternalWorkerNodeSpec(t *testing.T) {
+	tests := []struct {
+		network         string
+		wantNetworkMode string
+	}{
+		{network: "", wantNetworkMode: ""},
+		{network: "lab", wantNetworkMode: "lab"},
+	}
+	for _, tt := range tests {
+		n := newExternalWorkerNodeSpec("k3d-external-abc", "docker.io/rancher/k3s:v1.28.5-k3s1", "https://10.0.0.1:6443", "secret", []string{"FOO=bar"}, nil, tt.network)
+		config, hostConfig, networkingConfig := n.containerConfigs()
+
+		if networkingConfig != nil {
+			t.Errorf("network %q: networking config = %+v, want none", tt.network, networkingConfig)
+		}
+		if string(hostConfig.NetworkMode) != tt.wantNetworkMode {
+			t.Errorf("network %q: network mode = %q, want %q", tt.network, hostConfig.NetworkMode, tt.wantNetworkMode)
+		}
+		for _, e := range []string{"FOO=bar", "K3S_URL=https://10.0.0.1:6443", "K3S_TOKEN=secret"} {
+			if !containsString(config.Env, e) {
+				t.Errorf("env = %v, want %s", config.Env, e)
+			}
+		}
+		if config.Labels["externalJoin"] != "true" || config.Labels["clusterURL"] != "https://10.0.0.1:6443" {
+			t.Errorf("labels = %v, want externalJoin and clusterURL", config.Labels)
+		}
+		if _, ok := config.Labels["cluster"]; ok {
+			t.Errorf("external worker has a cluster label")
+		}
+		if config.Hostname != "k3d-external-abc" || !hostConfig.Privileged {
+			t.Errorf("hostname %q, privileged %t, want k3d-external-abc and privileged", config.Hostname, hostConfig.Privileged)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package run
+
+/*
+ * The functions in this file expose the containerd sockets of the nodes on the host (--expose-containerd),
+ * so that e.g. `nerdctl build` puts images directly into a node. Each node gets a socat proxy container,
+ * which reaches the socket through the PID namespace of the node.
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+)
+
+const (
+	// containerdProxyImage is the image of the proxy containers, it needs a shell and socat
+	containerdProxyImage = "alpine/socat:1.7.4.4"
+	// containerdProxyComponent is the component label of the proxy containers
+	containerdProxyComponent = "containerd-proxy"
+	// nodeContainerdSocket is the containerd socket of k3s in the node, reached via the root of its init process
+	nodeContainerdSocket = "/proc/1/root/run/k3s/containerd/containerd.sock"
+	// containerdSocketsDir is the directory in the cluster directory the sockets are exposed in
+	containerdSocketsDir = "containerd"
+)
+
+// getContainerdSocketPath returns the host path the containerd socket of a node is exposed at
+func getContainerdSocketPath(clusterName, nodeName string) (string, error) {
+	clusterDir, err := getClusterDir(clusterName)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(clusterDir, containerdSocketsDir, nodeName+".sock"), nil
+}
+
+// exposesContainerd reports whether the containerd sockets of the nodes are exposed
+func (s *clusterSpec) exposesContainerd() bool {
+	return s.ExposeContainerd || s.ContainerdPort > 0
+}
+
+// containerdProxyPort returns the host port the containerd socket of a node is exposed at with --expose-containerd-port:
+// the port itself for the server and the following ports for the workers by index (0 = not exposed)
+func (s *clusterSpec) containerdProxyPort(node types.Container) int {
+	if s.ContainerdPort == 0 {
+		return 0
+	}
+	if node.Labels["component"] == "server" {
+		return s.ContainerdPort
+	}
+	index, err := getWorkerIndex(node)
+	if err != nil {
+		return 0
+	}
+	return s.ContainerdPort + 1 + index
+}
+
+// containerdProxyCommand returns the shell command of the proxy of a node, one socat per exposed endpoint
+func (s *clusterSpec) containerdProxyCommand(nodeName string, port int) string {
+	listeners := []string{}
+	if s.ExposeContainerd {
+		// the socket belongs to the user running k3d, so that nerdctl doesn't need root
+		listeners = append(listeners, fmt.Sprintf("UNIX-LISTEN:/sockets/%s.sock,fork,unlink-early,user=%d,mode=600", nodeName, os.Getuid()))
+	}
+	if port > 0 {
+		listeners = append(listeners, fmt.Sprintf("TCP-LISTEN:%d,fork,reuseaddr", port))
+	}
+	commands := []string{}
+	for _, listener := range listeners {
+		commands = append(commands, fmt.Sprintf("socat %s UNIX-CONNECT:%s", listener, nodeContainerdSocket))
+	}
+	// the last socat replaces the shell, so that the proxy stops with it
+	last := len(commands) - 1
+	commands[last] = "exec " + commands[last]
+	return strings.Join(commands, " & ")
+}
+
+// getContainerdProxies returns the proxy containers of a cluster by the name of their node
+func getContainerdProxies(ctx context.Context, docker *client.Client, clusterName string) (map[string]types.Container, error) {
+	filters := filters.NewArgs()
+	filters.Add("label", "app=k3d")
+	filters.Add("label", fmt.Sprintf("cluster=%s", clusterName))
+	filters.Add("label", fmt.Sprintf("component=%s", containerdProxyComponent))
+	addPrefixFilter(filters)
+	logDebugf("ContainerList filters=%s", filtersString(filters))
+	containers, err := docker.ContainerList(ctx, container.ListOptions{All: true, Filters: filters})
+	if err != nil {
+		return nil, checkDockerError(fmt.Errorf("ERROR: couldn't list containerd proxies of cluster %s\n%w", clusterName, err))
+	}
+	proxies := map[string]types.Container{}
+	for _, c := range containers {
+		if hasContainerNamePrefix(c.Labels) {
+			proxies[c.Labels["node"]] = c
+		}
+	}
+	return proxies, nil
+}
+
+// createContainerdProxy creates the proxy container of a node
+func createContainerdProxy(ctx context.Context, docker *client.Client, spec *clusterSpec, node types.Container) (string, error) {
+	nodeName := getContainerShortName(node)
+	port := spec.containerdProxyPort(node)
+
+	clusterDir, err := getClusterDir(spec.Name)
+	if err != nil {
+		return "", err
+	}
+	socketsDir := path.Join(clusterDir, containerdSocketsDir)
+	if err := createDirIfNotExists(socketsDir); err != nil {
+		return "", fmt.Errorf("ERROR: couldn't create directory for containerd sockets\n%w", err)
+	}
+
+	command := spec.containerdProxyCommand(nodeName, port)
+	config := &container.Config{
+		Image:      containerdProxyImage,
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Cmd:        []string{command},
+		// the node ID and the command tell whether the proxy is still up to date
+		Labels: map[string]string{
+			"app":          "k3d",
+			"prefix":       containerNamePrefix,
+			"component":    containerdProxyComponent,
+			"cluster":      spec.Name,
+			"node":         nodeName,
+			"nodeID":       node.ID,
+			"proxyCommand": command,
+		},
+	}
+	hostConfig := &container.HostConfig{
+		// the socket is only reachable through the root of the processes of the node
+		PidMode:    container.PidMode("container:" + node.ID),
+		Privileged: true,
+		Binds:      []string{fmt.Sprintf("%s:/sockets", socketsDir)},
+	}
+	if port > 0 {
+		containerPort := nat.Port(fmt.Sprintf("%d/tcp", port))
+		config.ExposedPorts = nat.PortSet{containerPort: struct{}{}}
+		hostConfig.PortBindings = nat.PortMap{containerPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: strconv.Itoa(port)}}}
+	}
+
+	if err := ensureImage(ctx, docker, containerdProxyImage); err != nil {
+		return "", err
+	}
+	logContainerConfig("containerd proxy", config, hostConfig)
+	resp, err := docker.ContainerCreate(ctx, config, hostConfig, nil, nil, nodeName+"-containerd")
+	if err != nil {
+		return "", fmt.Errorf("ERROR: couldn't create containerd proxy for node %s\n%w", nodeName, err)
+	}
+	return resp.ID, nil
+}
+
+// syncContainerdProxies makes sure that the containerd socket of every running node of a cluster is exposed
+// as configured in the spec. Proxies of nodes which were started again are restarted, proxies of removed
+// or recreated nodes and proxies which aren't configured anymore are removed.
+func syncContainerdProxies(spec *clusterSpec) error {
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+	proxies, err := getContainerdProxies(ctx, docker, spec.Name)
+	if err != nil {
+		return err
+	}
+	if !spec.ExposeContainerd && spec.ContainerdPort == 0 && len(proxies) == 0 {
+		return nil
+	}
+
+	clusters, err := getClusters(false, spec.Name)
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[spec.Name]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, spec.Name)
+	}
+	nodes := map[string]types.Container{}
+	for _, node := range append([]types.Container{cl.server}, cl.workers...) {
+		nodes[getContainerShortName(node)] = node
+	}
+
+	for nodeName, proxy := range proxies {
+		node, ok := nodes[nodeName]
+		if ok && spec.exposesContainerd() && proxy.Labels["nodeID"] == node.ID &&
+			proxy.Labels["proxyCommand"] == spec.containerdProxyCommand(nodeName, spec.containerdProxyPort(node)) {
+			continue
+		}
+		logDebugf("removing outdated containerd proxy of node %s", nodeName)
+		if err := removeContainer(proxy.ID); err != nil {
+			return fmt.Errorf("ERROR: couldn't remove containerd proxy of node %s\n%w", nodeName, err)
+		}
+		delete(proxies, nodeName)
+	}
+	if !spec.exposesContainerd() {
+		return nil
+	}
+
+	for nodeName, node := range nodes {
+		if node.State != "running" {
+			continue
+		}
+		proxyID := ""
+		if proxy, ok := proxies[nodeName]; ok {
+			if proxy.State == "running" {
+				continue
+			}
+			proxyID = proxy.ID
+		} else if proxyID, err = createContainerdProxy(ctx, docker, spec, node); err != nil {
+			return err
+		}
+		logDebugf("ContainerStart %s", proxyID)
+		if err := docker.ContainerStart(ctx, proxyID, container.StartOptions{}); err != nil {
+			return fmt.Errorf("ERROR: couldn't start containerd proxy for node %s\n%w", nodeName, err)
+		}
+		if spec.ExposeContainerd {
+			socketPath, _ := getContainerdSocketPath(spec.Name, nodeName)
+			log.Printf("Exposed containerd of node %s at %s (e.g. nerdctl --address %s --namespace k8s.io build .)", nodeName, socketPath, socketPath)
+		}
+		if port := spec.containerdProxyPort(node); port > 0 {
+			log.Printf("Exposed containerd of node %s at 127.0.0.1:%d", nodeName, port)
+		}
+	}
+	return nil
+}
+
+// removeContainerdProxies removes the proxy containers of a cluster, before its nodes are removed
+func removeContainerdProxies(clusterName string) {
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		logWarningf("couldn't create docker client\n%+v", err)
+		return
+	}
+	proxies, err := getContainerdProxies(ctx, docker, clusterName)
+	if err != nil {
+		logWarningf("%+v", err)
+		return
+	}
+	for nodeName, proxy := range proxies {
+		if err := removeContainer(proxy.ID); err != nil {
+			logWarningf("couldn't remove containerd proxy of node %s\n%+v", nodeName, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package run
+
+import (
+	"log"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// verbose enables debug output, e.g. of the requests we send to the docker daemon.
+// It's set once via the global --verbose flag.
+var verbose bool
+
+// SetVerbose enables or disables debug output for all commands
+func SetVerbose(v bool) {
+	verbose = v
+}
+
+// logDebugf prints a log message only if verbose output is enabled
+func logDebugf(format string, v ...interface{}) {
+	if verbose {
+		log.Printf(levelDebug.prefix()+format, v...)
+	}
+}
+
+// filtersString renders docker filters in a compact way for debug output
+func filtersString(args filters.Args) string {
+	s, err := filters.ToJSON(args)
+	if err != nil {
+		return "<invalid filters>"
+	}
+	return s
+}
+
+// redactEnv hides the values of environment variables that may contain secrets
+func redactEnv(env []string) []string {
+	redacted := make([]string, 0, len(env))
+	for _, e := range env {
+		key := strings.SplitN(e, "=", 2)[0]
+		if strings.Contains(key, "SECRET") || strings.Contains(key, "TOKEN") || strings.Contains(key, "PASSWORD") {
+			e = key + "=<redacted>"
+		}
+		redacted = append(redacted, e)
+	}
+	return redacted
+}
+
+// logContainerConfig prints a summary of the configuration a container is created with
+func logContainerConfig(name string, config *container.Config, hostConfig *container.HostConfig) {
+	if !verbose {
+		return
+	}
+	ports := []string{}
+	for port, bindings := range hostConfig.PortBindings {
+		for _, binding := range bindings {
+			ports = append(ports, binding.HostIP+":"+binding.HostPort+"->"+string(port))
+		}
+	}
+	logDebugf("Container [%s]: image=%s cmd=%v env=%v labels=%v", name, config.Image, config.Cmd, redactEnv(config.Env), config.Labels)
+	logDebugf("Container [%s]: ports=%v binds=%v tmpfs=%v privileged=%t restart=%s", name, ports, hostConfig.Binds, hostConfig.Tmpfs, hostConfig.Privileged, hostConfig.RestartPolicy.Name)
+}
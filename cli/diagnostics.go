@@ -0,0 +1,86 @@
+package run
+
+/*
+ * The functions in this file collect information about failed clusters,
+ * so that users get more than a plain timeout error.
+ */
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// defaultDiagnosticsLogLines is the number of log lines per node printed when a cluster fails to come up
+const defaultDiagnosticsLogLines = 25
+
+// dumpNodeDiagnostics prints the state and the last log lines of a node container
+func dumpNodeDiagnostics(ctx context.Context, docker *client.Client, node types.Container, lines int) {
+	name := strings.TrimPrefix(node.Names[0], "/")
+
+	inspect, err := docker.ContainerInspect(ctx, node.ID)
+	if err != nil {
+		logWarningf("couldn't inspect node %s\n%+v", name, err)
+		return
+	}
+	state := inspect.State
+	log.Printf("Node %s: state=%s exit-code=%d oom-killed=%t restarts=%d", name, state.Status, state.ExitCode, state.OOMKilled, inspect.RestartCount)
+	if state.Error != "" {
+		log.Printf("Node %s: error=%s", name, state.Error)
+	}
+
+	out, err := docker.ContainerLogs(ctx, node.ID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.Itoa(lines),
+	})
+	if err != nil {
+		logWarningf("couldn't get logs of node %s\n%+v", name, err)
+		return
+	}
+	defer out.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := stdcopy.StdCopy(buf, buf, out); err != nil {
+		logWarningf("couldn't read logs of node %s\n%+v", name, err)
+		return
+	}
+	log.Printf("Last %d log lines of node %s:\n%s", lines, name, buf.String())
+}
+
+// dumpClusterDiagnostics prints the state and the last log lines of all nodes of a cluster
+func dumpClusterDiagnostics(clusterName string, lines int) {
+	if lines <= 0 {
+		return
+	}
+
+	clusters, err := getClusters(false, clusterName)
+	if err != nil {
+		logWarningf("couldn't collect diagnostics for cluster %s\n%+v", clusterName, err)
+		return
+	}
+	cl, ok := clusters[clusterName]
+	if !ok {
+		return
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		logWarningf("couldn't create docker client\n%+v", err)
+		return
+	}
+
+	log.Printf("===== Diagnostics for cluster %s =====", clusterName)
+	for _, node := range append([]types.Container{cl.server}, cl.workers...) {
+		dumpNodeDiagnostics(ctx, docker, node, lines)
+	}
+	log.Printf("===== End of diagnostics for cluster %s =====", clusterName)
+}
@@ -0,0 +1,217 @@
+package run
+
+/*
+ * The functions in this file report the disk space used by clusters (`k3d disk-usage`)
+ * and reclaim the space of leftover k3d images and volumes.
+ */
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/go-units"
+	"github.com/urfave/cli"
+)
+
+// clusterDiskUsage is the disk space used by a cluster. Images may be shared with other clusters.
+type clusterDiskUsage struct {
+	name       string
+	containers int64 // writable layers of the nodes
+	volumes    int64
+	images     int64
+	imageIDs   map[string]bool
+	volumeIDs  map[string]bool
+}
+
+// newClusterDiskUsage returns an empty disk usage
+func newClusterDiskUsage(name string) *clusterDiskUsage {
+	return &clusterDiskUsage{name: name, imageIDs: map[string]bool{}, volumeIDs: map[string]bool{}}
+}
+
+// add accounts the disk usage of a node container, images and volumes are only counted once
+func (u *clusterDiskUsage) add(c *types.Container, imageSizes, volumeSizes map[string]int64) {
+	u.containers += c.SizeRw
+	if !u.imageIDs[c.ImageID] {
+		u.imageIDs[c.ImageID] = true
+		u.images += imageSizes[c.ImageID]
+	}
+	for _, m := range c.Mounts {
+		if m.Type == "volume" && !u.volumeIDs[m.Name] {
+			u.volumeIDs[m.Name] = true
+			u.volumes += volumeSizes[m.Name]
+		}
+	}
+}
+
+// row returns the table row of the disk usage
+func (u *clusterDiskUsage) row() []string {
+	return []string{
+		u.name,
+		units.HumanSize(float64(u.containers)),
+		units.HumanSize(float64(u.volumes)),
+		units.HumanSize(float64(u.images)),
+		units.HumanSize(float64(u.containers + u.volumes + u.images)),
+	}
+}
+
+// isK3dImage reports whether an image is a node image: a k3s image (also if it's only left by digest) or a commit
+func isK3dImage(img *image.Summary) bool {
+	if img.Labels[commitSpecLabel] != "" {
+		return true
+	}
+	for _, ref := range append(append([]string{}, img.RepoTags...), img.RepoDigests...) {
+		if named, err := reference.ParseNormalizedNamed(ref); err == nil && named.Name() == defaultK3sImageRepo {
+			return true
+		}
+	}
+	return false
+}
+
+// isDanglingImage reports whether an image has no tags anymore, e.g. after the tag was pulled again or committed to again
+func isDanglingImage(img *image.Summary) bool {
+	for _, tag := range img.RepoTags {
+		if tag != "<none>:<none>" {
+			return false
+		}
+	}
+	return true
+}
+
+// reclaimableImages returns the k3d images without tags that aren't used by any container
+func reclaimableImages(usage types.DiskUsage) []*image.Summary {
+	reclaimable := []*image.Summary{}
+	for _, img := range usage.Images {
+		if img.Containers == 0 && isDanglingImage(img) && isK3dImage(img) {
+			reclaimable = append(reclaimable, img)
+		}
+	}
+	return reclaimable
+}
+
+// reclaimableVolumes returns the volumes created by k3d that aren't used by any container
+func reclaimableVolumes(usage types.DiskUsage) []*volume.Volume {
+	reclaimable := []*volume.Volume{}
+	for _, v := range usage.Volumes {
+		if v.Labels["app"] != "k3d" || !hasContainerNamePrefix(v.Labels) {
+			continue
+		}
+		if v.UsageData != nil && v.UsageData.RefCount == 0 {
+			reclaimable = append(reclaimable, v)
+		}
+	}
+	return reclaimable
+}
+
+// getClusterDiskUsage groups the disk usage reported by docker by cluster.
+// The total counts images and volumes shared by clusters only once.
+func getClusterDiskUsage(usage types.DiskUsage) ([]*clusterDiskUsage, *clusterDiskUsage) {
+	imageSizes := map[string]int64{}
+	for _, img := range usage.Images {
+		imageSizes[img.ID] = img.Size
+	}
+	volumeSizes := map[string]int64{}
+	for _, v := range usage.Volumes {
+		if v.UsageData != nil && v.UsageData.Size > 0 {
+			volumeSizes[v.Name] = v.UsageData.Size
+		}
+	}
+
+	clusters := map[string]*clusterDiskUsage{}
+	total := newClusterDiskUsage("total")
+	for _, c := range usage.Containers {
+		name := c.Labels["cluster"]
+		if c.Labels["app"] != "k3d" || name == "" || !hasContainerNamePrefix(c.Labels) {
+			continue
+		}
+		cl, ok := clusters[name]
+		if !ok {
+			cl = newClusterDiskUsage(name)
+			clusters[name] = cl
+		}
+		cl.add(c, imageSizes, volumeSizes)
+		total.add(c, imageSizes, volumeSizes)
+	}
+
+	sorted := []*clusterDiskUsage{}
+	for _, cl := range clusters {
+		sorted = append(sorted, cl)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	return sorted, total
+}
+
+// DiskUsage prints the disk space used by each cluster: `k3d disk-usage [--reclaim]`.
+// With --reclaim, k3d images without tags and unused k3d volumes are removed.
+func DiskUsage(c *cli.Context) error {
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	logDebugf("DiskUsage")
+	usage, err := docker.DiskUsage(ctx, types.DiskUsageOptions{})
+	if err != nil {
+		return checkDockerError(fmt.Errorf("ERROR: couldn't get disk usage\n%w", err))
+	}
+
+	clusters, total := getClusterDiskUsage(usage)
+	table := newTable([]string{"CLUSTER", "NODES", "VOLUMES", "IMAGES", "TOTAL"})
+	for _, cl := range clusters {
+		table.Append(cl.row())
+	}
+	table.SetFooter(total.row())
+	table.Render()
+
+	images, volumes := reclaimableImages(usage), reclaimableVolumes(usage)
+	var reclaimable int64
+	for _, img := range images {
+		reclaimable += img.Size - img.SharedSize
+	}
+	for _, v := range volumes {
+		if v.UsageData.Size > 0 {
+			reclaimable += v.UsageData.Size
+		}
+	}
+	if len(images) == 0 && len(volumes) == 0 {
+		return nil
+	}
+	if !c.Bool("reclaim") {
+		logInfof("%d images and %d volumes left by k3d can be removed (%s), use --reclaim to remove them", len(images), len(volumes), units.HumanSize(float64(reclaimable)))
+		return nil
+	}
+
+	ok, err := confirm(fmt.Sprintf("Remove %d images and %d volumes left by k3d (%s)?", len(images), len(volumes), units.HumanSize(float64(reclaimable))), c.Bool("yes"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	failed := []string{}
+	for _, img := range images {
+		logDebugf("ImageRemove %s", img.ID)
+		if _, err := docker.ImageRemove(ctx, img.ID, image.RemoveOptions{PruneChildren: true}); err != nil {
+			logWarningf("couldn't remove image %s\n%+v", img.ID, err)
+			failed = append(failed, img.ID)
+		}
+	}
+	for _, v := range volumes {
+		logDebugf("VolumeRemove %s", v.Name)
+		if err := docker.VolumeRemove(ctx, v.Name, false); err != nil {
+			logWarningf("couldn't remove volume %s\n%+v", v.Name, err)
+			failed = append(failed, v.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("ERROR: couldn't remove %s", strings.Join(failed, ", "))
+	}
+	logSuccessf("reclaimed %s", units.HumanSize(float64(reclaimable)))
+	return nil
+}
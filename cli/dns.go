@@ -0,0 +1,110 @@
+package run
+
+/*
+ * The functions in this file set the DNS servers and search domains of the nodes (--dns, --dns-search),
+ * e.g. to resolve internal registries in VPN or corporate environments. Optionally CoreDNS forwards to them as well.
+ */
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+const (
+	// resolvConfFileName is the resolv.conf in the cluster directory listing the DNS servers of the spec,
+	// it's bind-mounted to nodeResolvConfPath and passed to k3s as --resolv-conf, which CoreDNS forwards to
+	resolvConfFileName = "resolv.conf"
+	nodeResolvConfPath = "/etc/k3d/resolv.conf"
+)
+
+// nodeDNSOptions are the DNS servers and search domains of a node container
+type nodeDNSOptions struct {
+	servers []string
+	search  []string
+}
+
+// apply sets the DNS servers and search domains in a container's host config,
+// on the cluster network docker's embedded DNS forwards to them
+func (o nodeDNSOptions) apply(hostConfig *container.HostConfig) {
+	hostConfig.DNS = o.servers
+	hostConfig.DNSSearch = o.search
+}
+
+// dnsOptions returns the DNS settings of the node containers
+func (s *clusterSpec) dnsOptions() nodeDNSOptions {
+	return nodeDNSOptions{servers: s.DNS, search: s.DNSSearch}
+}
+
+// validateDNS checks the DNS server IPs and the search domains
+func (s *clusterSpec) validateDNS() error {
+	for _, server := range s.DNS {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("ERROR: invalid DNS server IP [%s]", server)
+		}
+	}
+	for _, domain := range s.DNSSearch {
+		for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+			if err := ValidateHostname(label); err != nil {
+				return fmt.Errorf("ERROR: invalid DNS search domain [%s]\n%w", domain, err)
+			}
+		}
+	}
+	if s.DNSCoreDNSForward && len(s.DNS) == 0 {
+		return fmt.Errorf("ERROR: CoreDNS can only forward to the DNS servers of the nodes if there are some, please use --dns")
+	}
+	return nil
+}
+
+// resolvConfArgs returns the k3s arguments letting CoreDNS forward to the DNS servers of the spec.
+// By default CoreDNS forwards to the nameservers of the node, which is docker's embedded DNS on the loopback
+// interface, so k3s falls back to public DNS servers.
+func (s *clusterSpec) resolvConfArgs() []string {
+	if !s.DNSCoreDNSForward {
+		return nil
+	}
+	return []string{"--resolv-conf", nodeResolvConfPath}
+}
+
+// resolvConfVolumes returns the bind mount of the resolv.conf CoreDNS forwards to, if any
+func (s *clusterSpec) resolvConfVolumes() []string {
+	if !s.DNSCoreDNSForward {
+		return nil
+	}
+	clusterDir, err := getClusterDir(s.Name)
+	if err != nil {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s:%s:ro", path.Join(clusterDir, resolvConfFileName), nodeResolvConfPath)}
+}
+
+// isResolvConfBind reports whether a bind mount of a node is the resolv.conf managed by k3d
+func isResolvConfBind(bind string) bool {
+	return strings.HasSuffix(bind, ":"+nodeResolvConfPath+":ro")
+}
+
+// writeResolvConf writes the resolv.conf CoreDNS forwards to into the cluster directory
+func writeResolvConf(s *clusterSpec) error {
+	if !s.DNSCoreDNSForward {
+		return nil
+	}
+	clusterDir, err := getClusterDir(s.Name)
+	if err != nil {
+		return err
+	}
+	content := ""
+	for _, server := range s.DNS {
+		content += fmt.Sprintf("nameserver %s\n", server)
+	}
+	if len(s.DNSSearch) > 0 {
+		content += fmt.Sprintf("search %s\n", strings.Join(s.DNSSearch, " "))
+	}
+	if err := os.WriteFile(path.Join(clusterDir, resolvConfFileName), []byte(content), 0644); err != nil {
+		return fmt.Errorf("ERROR: couldn't write resolv.conf for CoreDNS\n%w", err)
+	}
+	return nil
+}
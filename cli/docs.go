@@ -0,0 +1,138 @@
+package run
+
+/*
+ * The functions in this file generate shell completions and man pages from the command definitions,
+ * so that package managers can ship them (`k3d completion`, `k3d man`).
+ */
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli"
+)
+
+// bashCompletion is the bash completion script of urfave/cli, asking k3d for completions via --generate-bash-completion
+const bashCompletion = `_k3d_bash_autocomplete() {
+  if [[ "${COMP_WORDS[0]}" != "source" ]]; then
+    local cur opts
+    COMPREPLY=()
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    if [[ "$cur" == "-"* ]]; then
+      opts=$( ${COMP_WORDS[@]:0:$COMP_CWORD} ${cur} --generate-bash-completion )
+    else
+      opts=$( ${COMP_WORDS[@]:0:$COMP_CWORD} --generate-bash-completion )
+    fi
+    COMPREPLY=( $(compgen -W "${opts}" -- ${cur}) )
+    return 0
+  fi
+}
+
+complete -o bashdefault -o default -o nospace -F _k3d_bash_autocomplete k3d
+`
+
+// zshCompletion is the zsh completion script of urfave/cli
+const zshCompletion = `#compdef k3d
+
+_k3d_zsh_autocomplete() {
+  local -a opts
+  local cur
+  cur=${words[-1]}
+  if [[ "$cur" == "-"* ]]; then
+    opts=("${(@f)$(_CLI_ZSH_AUTOCOMPLETE_HACK=1 ${words[@]:0:#words[@]-1} ${cur} --generate-bash-completion)}")
+  else
+    opts=("${(@f)$(_CLI_ZSH_AUTOCOMPLETE_HACK=1 ${words[@]:0:#words[@]-1} --generate-bash-completion)}")
+  fi
+
+  if [[ "${opts[1]}" != "" ]]; then
+    _describe 'values' opts
+  else
+    _files
+  fi
+}
+
+compdef _k3d_zsh_autocomplete k3d
+`
+
+// completionFiles are the default install locations of completions per shell, relative to the home directory
+var completionFiles = map[string]string{
+	"bash": ".local/share/bash-completion/completions/k3d",
+	"zsh":  ".zsh/completions/_k3d",
+	"fish": ".config/fish/completions/k3d.fish",
+}
+
+// getCompletionScript returns the completion script for a shell
+func getCompletionScript(app *cli.App, shell string) (string, error) {
+	switch shell {
+	case "bash":
+		return bashCompletion, nil
+	case "zsh":
+		return zshCompletion, nil
+	case "fish":
+		script, err := app.ToFishCompletion()
+		if err != nil {
+			return "", fmt.Errorf("ERROR: couldn't generate fish completion\n%w", err)
+		}
+		return script, nil
+	}
+	return "", fmt.Errorf("ERROR: unsupported shell [%s] (supported: bash, zsh, fish)", shell)
+}
+
+// writeDocFile writes generated content to a file, creating the directory if needed
+func writeDocFile(filePath, content string) error {
+	if err := createDirIfNotExists(path.Dir(filePath)); err != nil {
+		return fmt.Errorf("ERROR: couldn't create directory for %s\n%w", filePath, err)
+	}
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("ERROR: couldn't write %s\n%w", filePath, err)
+	}
+	fmt.Printf("Wrote %s\n", filePath)
+	return nil
+}
+
+// Completion prints or installs the completion script for a shell: `k3d completion [--install] [--dir DIR] <shell>`
+func Completion(c *cli.Context) error {
+	shell := c.Args().First()
+	if shell == "" {
+		return fmt.Errorf("ERROR: please specify a shell (bash, zsh, fish)")
+	}
+
+	script, err := getCompletionScript(c.App, shell)
+	if err != nil {
+		return err
+	}
+
+	if !c.Bool("install") {
+		fmt.Print(script)
+		return nil
+	}
+
+	// package managers install into their prefix via --dir, users into their home directory
+	var filePath string
+	if c.String("dir") != "" {
+		filePath = path.Join(c.String("dir"), path.Base(completionFiles[shell]))
+	} else {
+		homeDir, err := homedir.Dir()
+		if err != nil {
+			return fmt.Errorf("ERROR: couldn't get home directory\n%w", err)
+		}
+		filePath = path.Join(homeDir, completionFiles[shell])
+	}
+	return writeDocFile(filePath, script)
+}
+
+// Man prints the man page of k3d or writes it as k3d.8 to a directory: `k3d man [--dir DIR]`
+func Man(c *cli.Context) error {
+	man, err := c.App.ToMan()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't generate man page\n%w", err)
+	}
+
+	if c.String("dir") == "" {
+		fmt.Print(man)
+		return nil
+	}
+	return writeDocFile(path.Join(c.String("dir"), "k3d.8"), man)
+}
@@ -0,0 +1,119 @@
+package run
+
+/*
+ * The functions in this file pass host environment variables to the nodes (--env-passthrough),
+ * e.g. AWS_* for testing against Localstack. Only the patterns are stored in the spec and the node labels,
+ * the values are read from the host environment whenever a node is created. They are part of the environment
+ * of the node containers (visible with `docker inspect`), but blanked in committed images.
+ */
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// envPassthroughLabel is the label of the node containers listing the passthrough patterns, comma separated
+const envPassthroughLabel = "envPassthrough"
+
+// minEnvPassthroughPrefix is the minimum length of the literal prefix of a passthrough pattern,
+// shorter ones (e.g. P or X*) match lots of unrelated variables
+const minEnvPassthroughPrefix = 2
+
+// reservedEnvVars are never passed through, the host values would break the nodes (PATH, HOME, ...) or k3s (K3S_URL, ...)
+var reservedEnvVars = []string{
+	"PATH", "HOME", "HOSTNAME", "USER", "SHELL", "PWD", "TERM", "LANG", "TMPDIR",
+	"K3S_TOKEN", "K3S_CLUSTER_SECRET", "K3S_URL", "K3S_KUBECONFIG_OUTPUT",
+}
+
+// validateEnvPassthrough checks the passthrough patterns: prefixes (AWS_) or globs (AWS_*).
+// Patterns matching every variable, too generic ones and ones matching reserved variables are rejected,
+// so that the host environment isn't leaked by accident.
+func validateEnvPassthrough(patterns []string) error {
+	for _, pattern := range patterns {
+		if strings.Trim(pattern, "*?") == "" {
+			return fmt.Errorf("ERROR: env passthrough pattern [%s] would pass the whole host environment, use a prefix like AWS_", pattern)
+		}
+		if strings.Contains(pattern, ",") || strings.Contains(pattern, "=") {
+			return fmt.Errorf("ERROR: invalid env passthrough pattern [%s], it must not contain ',' or '='", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("ERROR: invalid env passthrough pattern [%s]\n%w", pattern, err)
+		}
+		prefix := pattern
+		if i := strings.IndexAny(pattern, "*?["); i >= 0 {
+			prefix = pattern[:i]
+		}
+		if len(prefix) < minEnvPassthroughPrefix {
+			return fmt.Errorf("ERROR: env passthrough pattern [%s] is too generic, it has to start with at least %d characters like AWS_", pattern, minEnvPassthroughPrefix)
+		}
+		for _, key := range reservedEnvVars {
+			if matchesEnvPassthrough([]string{pattern}, key) {
+				return fmt.Errorf("ERROR: env passthrough pattern [%s] matches %s, which can't be passed to the nodes", pattern, key)
+			}
+		}
+	}
+	return nil
+}
+
+// matchesEnvPassthrough reports whether the name of an environment variable matches one of the patterns,
+// patterns without wildcards are prefixes
+func matchesEnvPassthrough(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if !strings.ContainsAny(pattern, "*?[") {
+			if strings.HasPrefix(key, pattern) {
+				return true
+			}
+		} else if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveEnvPassthrough returns the host environment variables matching the patterns, sorted by name
+func resolveEnvPassthrough(patterns []string) []string {
+	env := []string{}
+	if len(patterns) == 0 {
+		return env
+	}
+	for _, e := range os.Environ() {
+		if matchesEnvPassthrough(patterns, strings.SplitN(e, "=", 2)[0]) {
+			env = append(env, e)
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+// nodeEnv returns the environment variables of the nodes: the passed through host variables and the ones of the spec,
+// which take precedence
+func (s *clusterSpec) nodeEnv() []string {
+	return append(resolveEnvPassthrough(s.EnvPassthrough), s.Env...)
+}
+
+// logEnvPassthrough prints which host environment variables are passed to the nodes, without their values
+func (s *clusterSpec) logEnvPassthrough() {
+	if len(s.EnvPassthrough) == 0 {
+		return
+	}
+	names := []string{}
+	for _, e := range resolveEnvPassthrough(s.EnvPassthrough) {
+		names = append(names, strings.SplitN(e, "=", 2)[0]+"=<redacted>")
+	}
+	if len(names) == 0 {
+		logWarningf("no host environment variables match the env passthrough patterns %s", strings.Join(s.EnvPassthrough, ", "))
+		return
+	}
+	logInfof("Passing %d host environment variables to the nodes: %s", len(names), strings.Join(names, ", "))
+}
+
+// getEnvPassthrough returns the passthrough patterns a node was created with
+func getEnvPassthrough(labels map[string]string) []string {
+	if labels[envPassthroughLabel] == "" {
+		return nil
+	}
+	return strings.Split(labels[envPassthroughLabel], ",")
+}
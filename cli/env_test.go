@@ -0,0 +1,63 @@
+package run
+
+import "testing"
+
+func TestValidateEnvPassthrough(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr bool
+	}{
+		{pattern: "AWS_"},
+		{pattern: "AWS_*"},
+		{pattern: "GO*"},
+		{pattern: "HTTP?_PROXY"},
+		{pattern: "*", wantErr: true},
+		{pattern: "?*", wantErr: true},
+		{pattern: "P", wantErr: true},
+		{pattern: "H", wantErr: true},
+		{pattern: "X*", wantErr: true},
+		{pattern: "A?S_*", wantErr: true},
+		{pattern: "PA", wantErr: true},
+		{pattern: "HOME", wantErr: true},
+		{pattern: "K3S_", wantErr: true},
+		{pattern: "K3S_T*", wantErr: true},
+		{pattern: "AWS_,GCP_", wantErr: true},
+		{pattern: "AWS_=x", wantErr: true},
+		{pattern: "AWS_[", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := validateEnvPassthrough([]string{tt.pattern})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateEnvPassthrough(%q) = %v, want error %t", tt.pattern, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMatchesEnvPassthrough(t *testing.T) {
+	patterns := []string{"AWS_", "GCP_*_KEY"}
+	for key, want := range map[string]bool{
+		"AWS_ACCESS_KEY_ID":  true,
+		"AWS":                false,
+		"GCP_SERVICE_KEY":    true,
+		"GCP_SERVICE_SECRET": false,
+		"PATH":               false,
+	} {
+		if got := matchesEnvPassthrough(patterns, key); got != want {
+			t.Errorf("matchesEnvPassthrough(%v, %q) = %t, want %t", patterns, key, got, want)
+		}
+	}
+}
+
+func TestCommitEnv(t *testing.T) {
+	env := []string{"PATH=/bin", "K3S_TOKEN=secret", "K3S_CLUSTER_SECRET=secret", "AWS_SECRET_ACCESS_KEY=secret", "FOO=bar"}
+	got := commitEnv(env, []string{"AWS_"})
+	want := []string{"K3S_TOKEN=", "K3S_CLUSTER_SECRET=", "AWS_SECRET_ACCESS_KEY="}
+	if len(got) != len(want) {
+		t.Fatalf("commitEnv() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("commitEnv() = %v, want %v", got, want)
+		}
+	}
+}
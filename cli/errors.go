@@ -0,0 +1,129 @@
+package run
+
+/*
+ * The functions in this file report errors of commands, optionally in a machine readable way.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	k3dcluster "github.com/Minhaz00/k3d/pkg/cluster"
+	"github.com/docker/docker/client"
+)
+
+var (
+	// ErrClusterNotFound is returned if no cluster with the requested name exists
+	ErrClusterNotFound = k3dcluster.ErrClusterNotFound
+	// ErrClusterExists is returned if a cluster with the requested name already exists
+	ErrClusterExists = errors.New("cluster already exists")
+	// ErrDockerUnavailable is returned if the docker daemon can't be reached
+	ErrDockerUnavailable = errors.New("docker daemon is unavailable")
+)
+
+// exit codes of k3d for the typed errors, all other errors exit with 1
+const (
+	exitCodeClusterNotFound   = 3
+	exitCodeClusterExists     = 4
+	exitCodeDockerUnavailable = 5
+)
+
+// checkDockerError marks errors caused by an unreachable docker daemon with ErrDockerUnavailable
+func checkDockerError(err error) error {
+	if err != nil && client.IsErrConnectionFailed(err) && !errors.Is(err, ErrDockerUnavailable) {
+		return fmt.Errorf("ERROR: %w\n%w", ErrDockerUnavailable, err)
+	}
+	return err
+}
+
+// stepError annotates an error with the step of a command that failed and the affected cluster
+type stepError struct {
+	step    string
+	cluster string
+	err     error
+}
+
+func (e *stepError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stepError) Unwrap() error {
+	return e.err
+}
+
+// withStep annotates err with the failed step and cluster (nil stays nil)
+func withStep(step, cluster string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stepError{step: step, cluster: cluster, err: err}
+}
+
+// jsonErrors enables reporting the final error of a command as JSON object, set via the global --json flag
+var jsonErrors bool
+
+// SetJSONErrors enables or disables JSON error output
+func SetJSONErrors(enabled bool) {
+	jsonErrors = enabled
+}
+
+// jsonError is the structure of errors reported with --json
+type jsonError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Step    string `json:"step,omitempty"`
+	Cluster string `json:"cluster,omitempty"`
+}
+
+// errorCode returns a stable, machine readable code for an error
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrClusterNotFound):
+		return "cluster_not_found"
+	case errors.Is(err, ErrClusterExists):
+		return "cluster_exists"
+	case errors.Is(err, ErrDockerUnavailable), client.IsErrConnectionFailed(err):
+		return "docker_unavailable"
+	}
+	return "unknown"
+}
+
+// ExitCode returns the exit code k3d terminates with after err
+func ExitCode(err error) int {
+	switch errorCode(err) {
+	case "cluster_not_found":
+		return exitCodeClusterNotFound
+	case "cluster_exists":
+		return exitCodeClusterExists
+	case "docker_unavailable":
+		return exitCodeDockerUnavailable
+	}
+	return 1
+}
+
+// ReportError prints the final error of a command: as JSON object on stderr with --json, as log message otherwise
+func ReportError(err error) {
+	if !jsonErrors {
+		log.Println(formatErrorMessage(err.Error()))
+		return
+	}
+
+	report := jsonError{
+		Code: errorCode(err),
+		// our messages still carry log style prefixes, which are just noise in a structured error
+		Message: strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(err.Error(), "ERROR: "), "[ERROR] ")),
+	}
+	var se *stepError
+	if errors.As(err, &se) {
+		report.Step = se.step
+		report.Cluster = se.cluster
+	}
+
+	if err := json.NewEncoder(os.Stderr).Encode(report); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,52 @@
+package run
+
+/*
+ * The functions in this file report the progress of creating a cluster as events of the library API (create --events),
+ * so that UIs wrapping the k3d binary don't have to parse its logs.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	k3dcluster "github.com/Minhaz00/k3d/pkg/cluster"
+	k3dtypes "github.com/Minhaz00/k3d/pkg/types"
+)
+
+// jsonEventSink writes events as JSON lines. The steps of creating a cluster partly run concurrently,
+// so the events are serialized.
+type jsonEventSink struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// HandleEvent writes an event as a line of JSON, with the message of the error of Error events
+func (s *jsonEventSink) HandleEvent(event k3dtypes.Event) {
+	line := struct {
+		k3dtypes.Event
+		Error string `json:"error,omitempty"`
+	}{Event: event}
+	if event.Err != nil {
+		line.Error = event.Err.Error()
+	}
+	content, err := json.Marshal(line)
+	if err != nil {
+		logDebugf("couldn't serialize event: %+v", err)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.w.Write(append(content, '\n'))
+}
+
+// emitCreateError sends the Error event of a failed creation, for the step the error was reported by
+func emitCreateError(events k3dcluster.EventEmitter, err error) {
+	event := k3dtypes.Event{Type: k3dtypes.EventError, Err: err}
+	var stepErr *stepError
+	if errors.As(err, &stepErr) {
+		event.Step = stepErr.step
+	}
+	events.Emit(event)
+}
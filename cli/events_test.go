@@ -0,0 +1,29 @@
+package run
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	k3dcluster "github.com/Minhaz00/k3d/pkg/cluster"
+	k3dtypes "github.com/Minhaz00/k3d/pkg/types"
+)
+
+// a failed creation is reported as Error event of the step that failed, with the message of the error
+func TestEmitCreateError(t *testing.T) {
+	out := new(bytes.Buffer)
+	events := k3dcluster.EventEmitter{Sink: &jsonEventSink{w: out}, Cluster: "dev"}
+	emitCreateError(events, withStep("workers", "dev", errors.New("ERROR: worker crashed")))
+
+	got := map[string]interface{}{}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("event %q is not JSON: %v", out.String(), err)
+	}
+	want := map[string]string{"type": string(k3dtypes.EventError), "cluster": "dev", "step": "workers", "error": "ERROR: worker crashed"}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s of event = %v, want %s", key, got[key], value)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package run
+
+/*
+ * The functions in this file derive a cluster spec from a running cluster (`k3d export-spec`).
+ */
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// exportPortSpec turns a normalized port binding (hostIP:hostPort:containerPort/protocol) into a port spec for a node
+func exportPortSpec(binding, node string) string {
+	return fmt.Sprintf("%s@%s", strings.TrimPrefix(binding, ":"), node)
+}
+
+// getContainerShortName returns the name of a container without the leading slash
+func getContainerShortName(c types.Container) string {
+	if len(c.Names) == 0 {
+		return c.ID
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// exportTmpfs returns the additional tmpfs mounts of a node, without the ones added for a read-only root filesystem
+func exportTmpfs(storage nodeStorageOptions) []string {
+	tmpfs := []string{}
+	for _, mount := range storage.tmpfs {
+		if storage.readOnly && containsString(readOnlyTmpfsPaths, mount) {
+			continue
+		}
+		tmpfs = append(tmpfs, mount)
+	}
+	return tmpfs
+}
+
+// exportClusterSpec inspects the containers of a cluster and returns a spec that recreates it
+func exportClusterSpec(ctx context.Context, docker *client.Client, cl cluster) (*clusterSpec, error) {
+	server, err := actualNodeConfig(ctx, docker, cl.server.ID)
+	if err != nil {
+		return nil, err
+	}
+	logDebugf("ContainerInspect %s", cl.server.ID)
+	serverInspect, err := docker.ContainerInspect(ctx, cl.server.ID)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't inspect server container %s\n%w", cl.server.ID, err)
+	}
+
+	spec := &clusterSpec{
+		Name:        cl.name,
+		Image:       server.image,
+		Workers:     len(cl.workers),
+		Volumes:     server.volumes,
+		Env:         server.env,
+		AutoRestart: serverInspect.HostConfig.RestartPolicy.Name == "unless-stopped",
+		TmpfsSize:   server.storage.tmpfsSize,
+		StorageSize: server.storage.storageSize,
+		ReadOnly:    server.storage.readOnly,
+
+		NodeNameTemplate: cl.server.Labels["nodeNameTemplate"],
+		Group:            cl.server.Labels[groupLabel],
+		Protected:        isProtected(cl),
+		TTL:              cl.server.Labels[ttlLabel],
+		EnvPassthrough:   getEnvPassthrough(cl.server.Labels),
+
+		DNS:       serverInspect.HostConfig.DNS,
+		DNSSearch: serverInspect.HostConfig.DNSSearch,
+	}
+	if apiPort, err := strconv.Atoi(cl.server.Labels["apiPort"]); err == nil {
+		spec.APIPort = apiPort
+	}
+	if len(cl.workers) > 0 && cl.workers[0].Image != cl.server.Image {
+		spec.AgentImage = cl.workers[0].Image
+	}
+
+	// the kubeconfig output is set by k3d, so it's only in the spec if customized or disabled
+	spec.NoKubeconfigOutput = true
+	for _, e := range serverInspect.Config.Env {
+		if strings.HasPrefix(e, "K3S_KUBECONFIG_OUTPUT=") {
+			spec.NoKubeconfigOutput = false
+			if output := strings.TrimPrefix(e, "K3S_KUBECONFIG_OUTPUT="); output != defaultKubeconfigOutput {
+				spec.KubeconfigOutput = output
+			}
+		}
+	}
+
+	// split the server command into the parts managed by k3d and additional server args
+	args := server.cmd
+	if len(args) > 0 && args[0] == "server" {
+		args = args[1:]
+	}
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--https-listen-port" && i+1 < len(args):
+			if apiPort, err := strconv.Atoi(args[i+1]); err == nil {
+				spec.APIPort = apiPort
+			}
+			i++
+		case args[i] == "--tls-san" && i+1 < len(args) && args[i+1] == cl.server.Labels["apiServerAddress"]:
+			spec.APIServerAddress = args[i+1]
+			i++
+		case args[i] == "--tls-san" && i+1 < len(args) && args[i+1] == getContainerShortName(cl.server) && cl.server.Labels[inNetworkKubeconfigLabel] == "true":
+			spec.InNetworkKubeconfig = true
+			i++
+		case args[i] == "--write-kubeconfig-mode" && i+1 < len(args):
+			spec.WriteKubeconfigMode = args[i+1]
+			i++
+		case args[i] == "--resolv-conf" && i+1 < len(args) && args[i+1] == nodeResolvConfPath:
+			spec.DNSCoreDNSForward = true
+			i++
+		case args[i] == "--cluster-domain" && i+1 < len(args):
+			spec.ClusterDomain = args[i+1]
+			i++
+		case args[i] == "--cluster-dns" && i+1 < len(args):
+			spec.ClusterDNS = args[i+1]
+			i++
+		case args[i] == "--cluster-cidr" && i+1 < len(args):
+			spec.ClusterCIDR = args[i+1]
+			i++
+		case args[i] == "--service-cidr" && i+1 < len(args):
+			spec.ServiceCIDR = args[i+1]
+			i++
+		case args[i] == "--node-name" && i+1 < len(args):
+			// derived from the node name template
+			i++
+		case args[i] == "--node-taint" && i+1 < len(args):
+			if args[i+1] == noServerWorkloadsTaint {
+				spec.NoServerWorkloads = true
+			} else {
+				spec.Taints = append(spec.Taints, fmt.Sprintf("%s@server", args[i+1]))
+			}
+			i++
+		default:
+			spec.ServerArgs = append(spec.ServerArgs, args[i])
+		}
+	}
+
+	apiBinding := fmt.Sprintf(":%d:%d/tcp", spec.APIPort, spec.APIPort)
+	for _, binding := range server.ports {
+		if strings.HasSuffix(binding, apiBinding) {
+			continue
+		}
+		spec.Ports = append(spec.Ports, exportPortSpec(binding, "server"))
+	}
+	for _, tmpfs := range exportTmpfs(server.storage) {
+		spec.Tmpfs = append(spec.Tmpfs, fmt.Sprintf("%s@server", tmpfs))
+	}
+
+	// worker taints present on all workers are exported for the workers role, all others per node
+	workerTaints := map[string][]string{}
+	for _, worker := range cl.workers {
+		config, err := actualNodeConfig(ctx, docker, worker.ID)
+		if err != nil {
+			return nil, err
+		}
+		name := getContainerShortName(worker)
+		for _, binding := range config.ports {
+			spec.Ports = append(spec.Ports, exportPortSpec(binding, name))
+		}
+		for _, tmpfs := range exportTmpfs(config.storage) {
+			spec.Tmpfs = append(spec.Tmpfs, fmt.Sprintf("%s@%s", tmpfs, name))
+		}
+		for i := 0; i+1 < len(config.cmd); i++ {
+			if config.cmd[i] == "--node-taint" {
+				workerTaints[config.cmd[i+1]] = append(workerTaints[config.cmd[i+1]], name)
+				i++
+			}
+		}
+	}
+	taints := make([]string, 0, len(workerTaints))
+	for taint := range workerTaints {
+		taints = append(taints, taint)
+	}
+	sort.Strings(taints)
+	for _, taint := range taints {
+		if len(workerTaints[taint]) == len(cl.workers) {
+			spec.Taints = append(spec.Taints, fmt.Sprintf("%s@workers", taint))
+			continue
+		}
+		for _, name := range workerTaints[taint] {
+			spec.Taints = append(spec.Taints, fmt.Sprintf("%s@%s", taint, name))
+		}
+	}
+
+	// the network settings are only exported if they differ from a default bridge network
+	if network, err := getNetworkByName(ctx, docker, getClusterNetworkName(cl.name)); err == nil && network != nil {
+		if network.Driver != "bridge" {
+			spec.NetworkDriver = network.Driver
+			if len(network.IPAM.Config) > 0 {
+				spec.NetworkSubnet = network.IPAM.Config[0].Subnet
+				spec.NetworkGateway = network.IPAM.Config[0].Gateway
+			}
+		}
+		for key, value := range network.Options {
+			spec.NetworkOptions = append(spec.NetworkOptions, fmt.Sprintf("%s=%s", key, value))
+		}
+		sort.Strings(spec.NetworkOptions)
+	}
+
+	// hooks only run on the host, so they're only known from the stored spec
+	if stored, err := getStoredClusterSpec(cl); err == nil {
+		spec.Hooks = stored.Hooks
+	}
+
+	return spec, nil
+}
+
+// ExportSpec prints the spec of an existing cluster, which can be used with `k3d apply -f`
+func ExportSpec(c *cli.Context) error {
+	clusters, err := getClusters(false, c.String("name"))
+	if err != nil {
+		return err
+	}
+	cl, exists := clusters[c.String("name")]
+	if !exists {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, c.String("name"))
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	spec, err := exportClusterSpec(ctx, docker, cl)
+	if err != nil {
+		return err
+	}
+
+	content, err := yaml.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't serialize cluster spec\n%w", err)
+	}
+
+	if c.String("output") == "" || c.String("output") == "-" {
+		fmt.Print(string(content))
+		return nil
+	}
+	if err := os.WriteFile(c.String("output"), content, 0644); err != nil {
+		return fmt.Errorf("ERROR: couldn't write cluster spec %s\n%w", c.String("output"), err)
+	}
+	fmt.Printf("Wrote spec of cluster [%s] to %s\n", cl.name, c.String("output"))
+	return nil
+}
@@ -0,0 +1,144 @@
+package run
+
+/*
+ * The functions in this file select clusters by name pattern, status and group,
+ * used by `k3d list` and the --selector and --group flags of `k3d start/stop/delete`.
+ */
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// groupLabel is the label of the node containers holding the group of a cluster
+const groupLabel = "group"
+
+// groupNameRegexp matches valid group names, which are docker label values that are easy to type
+var groupNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_.-]{0,61}[a-zA-Z0-9])?$`)
+
+// validateGroupName checks that a group name only consists of alphanumerics, '-', '_' and '.'
+func validateGroupName(group string) error {
+	if !groupNameRegexp.MatchString(group) {
+		return fmt.Errorf("ERROR: Invalid group name [%s], only alphanumerics, '-', '_' and '.' are allowed (max. 63 characters)", group)
+	}
+	return nil
+}
+
+// clusterFilter selects clusters by name, status and group, empty fields match everything
+type clusterFilter struct {
+	name   string // glob (e.g. ci-*) or regular expression enclosed in slashes (e.g. /^ci-[0-9]+$/)
+	status string
+	group  string
+}
+
+// parseSelector parses a selector in the format key=value[,key=value], supported keys are name, status and group
+func parseSelector(selector string) (clusterFilter, error) {
+	filter := clusterFilter{}
+	for _, term := range strings.Split(selector, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(term), "=")
+		if !found || value == "" {
+			return filter, fmt.Errorf("ERROR: Invalid selector term [%s], expected key=value", term)
+		}
+		switch key {
+		case "name":
+			filter.name = value
+		case "status":
+			filter.status = value
+		case "group":
+			filter.group = value
+		default:
+			return filter, fmt.Errorf("ERROR: Unknown selector key [%s] (supported: name, status, group)", key)
+		}
+	}
+	return filter, filter.validate()
+}
+
+// nameRegexp returns the compiled name pattern if it is a regular expression, nil for globs
+func (f clusterFilter) nameRegexp() (*regexp.Regexp, error) {
+	if len(f.name) < 2 || !strings.HasPrefix(f.name, "/") || !strings.HasSuffix(f.name, "/") {
+		return nil, nil
+	}
+	re, err := regexp.Compile(f.name[1 : len(f.name)-1])
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Invalid name pattern [%s]\n%w", f.name, err)
+	}
+	return re, nil
+}
+
+// validate checks that the name pattern is a valid glob or regular expression
+func (f clusterFilter) validate() error {
+	if re, err := f.nameRegexp(); err != nil || re != nil {
+		return err
+	}
+	if _, err := path.Match(f.name, ""); err != nil {
+		return fmt.Errorf("ERROR: Invalid name pattern [%s]\n%w", f.name, err)
+	}
+	return nil
+}
+
+// matches reports whether a cluster is selected by the filter, the pattern has to be valid
+func (f clusterFilter) matches(cl cluster) bool {
+	if f.status != "" && !strings.EqualFold(f.status, cl.status) {
+		return false
+	}
+	if f.group != "" && f.group != cl.server.Labels[groupLabel] {
+		return false
+	}
+	if f.name == "" {
+		return true
+	}
+	if re, _ := f.nameRegexp(); re != nil {
+		return re.MatchString(cl.name)
+	}
+	matched, _ := path.Match(f.name, cl.name)
+	return matched
+}
+
+// filterClusters returns the clusters selected by the filter
+func filterClusters(clusters map[string]cluster, f clusterFilter) map[string]cluster {
+	filtered := make(map[string]cluster)
+	for name, cl := range clusters {
+		if f.matches(cl) {
+			filtered[name] = cl
+		}
+	}
+	return filtered
+}
+
+// getSelectedClusters returns the clusters a command acts on: all clusters matching --selector or in the --group
+// if set, otherwise the cluster given by --name or all clusters with --all
+func getSelectedClusters(c *cli.Context) (map[string]cluster, error) {
+	if c.String("selector") != "" || c.String("group") != "" {
+		filter := clusterFilter{}
+		if c.String("selector") != "" {
+			var err error
+			if filter, err = parseSelector(c.String("selector")); err != nil {
+				return nil, err
+			}
+		}
+		if group := c.String("group"); group != "" {
+			if filter.group != "" && filter.group != group {
+				return nil, fmt.Errorf("ERROR: --group %s contradicts the group of the selector (%s)", group, filter.group)
+			}
+			filter.group = group
+		}
+		clusters, err := getClusters(true, "")
+		if err != nil {
+			return nil, err
+		}
+		return filterClusters(clusters, filter), nil
+	}
+
+	clusters, err := getClusters(c.Bool("all"), c.String("name"))
+	if err != nil {
+		return nil, err
+	}
+	if !c.Bool("all") && len(clusters) == 0 {
+		return nil, fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, c.String("name"))
+	}
+	return clusters, nil
+}
@@ -0,0 +1,387 @@
+package run
+
+/*
+ * The functions in this file collect the garbage of k3d on shared hosts (`k3d gc [--watch]`): they delete clusters
+ * whose TTL (created with --ttl) expired, remove resources left behind by deleted clusters or crashed helpers and
+ * optionally stop idle clusters. Every action is logged, with --log-format json as one JSON object per line on stdout.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli"
+)
+
+// ttlLabel holds the TTL of a cluster, counted from the creation of its server container. The created label
+// can't be used, --seed fixes it for reproducible clusters.
+const ttlLabel = "ttl"
+
+// orphanGracePeriod is how old a resource without cluster has to be before it's removed,
+// networks and directories are created before the nodes of a new cluster
+const orphanGracePeriod = 10 * time.Minute
+
+// supported values of `gc --log-format`
+var gcLogFormats = []string{"text", "json"}
+
+// actions and kinds of resources in the log of the garbage collection
+const (
+	gcDelete = "delete"
+	gcStop   = "stop"
+	gcRemove = "remove"
+	gcSkip   = "skip"
+	gcError  = "error"
+
+	gcCluster   = "cluster"
+	gcContainer = "container"
+	gcNetwork   = "network"
+	gcDirectory = "directory"
+)
+
+// parseClusterTTL parses the TTL of a cluster, e.g. 8h
+func parseClusterTTL(ttl string) (time.Duration, error) {
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, fmt.Errorf("ERROR: invalid TTL [%s], expected a duration like 8h\n%w", ttl, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("ERROR: TTL must be positive (got %s)", ttl)
+	}
+	return d, nil
+}
+
+// getClusterExpiry returns when the TTL of a cluster expires, if it has one
+func getClusterExpiry(cl cluster) (time.Time, bool) {
+	ttl, err := parseClusterTTL(cl.server.Labels[ttlLabel])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(cl.server.Created, 0).Add(ttl), true
+}
+
+// orphanedContainerReason returns why a container is garbage at the time now, or "" if it's kept:
+// exited helper containers (tools, chaos) and containerd proxies of deleted clusters are
+func orphanedContainerReason(c types.Container, clusters map[string]cluster, now time.Time) string {
+	if !hasContainerNamePrefix(c.Labels) || now.Sub(time.Unix(c.Created, 0)) < orphanGracePeriod {
+		return ""
+	}
+	switch component := c.Labels["component"]; component {
+	case "tools", "chaos":
+		if c.State != "running" {
+			return fmt.Sprintf("%s helper container is %s", component, c.State)
+		}
+	case containerdProxyComponent:
+		if _, ok := clusters[c.Labels["cluster"]]; !ok {
+			return fmt.Sprintf("containerd proxy of deleted cluster %s", c.Labels["cluster"])
+		}
+	}
+	return ""
+}
+
+// isOrphanedNetwork reports whether a network belongs to a deleted cluster at the time now.
+// The network list doesn't include the attached containers, they have to be checked separately.
+func isOrphanedNetwork(network types.NetworkResource, clusters map[string]cluster, now time.Time) bool {
+	if _, ok := clusters[network.Labels["cluster"]]; ok {
+		return false
+	}
+	return hasContainerNamePrefix(network.Labels) && now.Sub(network.Created) >= orphanGracePeriod
+}
+
+// isOrphanedClusterDir reports whether clusterDir is the directory of a deleted cluster at the time now, given
+// its cluster.json and when that was written. Only directories at the path of their cluster are considered.
+func isOrphanedClusterDir(clusterDir string, metadata clusterMetadata, modTime time.Time, clusters map[string]cluster, now time.Time) bool {
+	if now.Sub(modTime) < orphanGracePeriod || metadata.Name == "" || !hasContainerNamePrefix(metadata.Labels) {
+		return false
+	}
+	if _, ok := clusters[metadata.Name]; ok {
+		return false
+	}
+	expected, err := getClusterDir(metadata.Name)
+	return err == nil && expected == clusterDir
+}
+
+// gcEvent is an action of the garbage collection, printed as log line or JSON object
+type gcEvent struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Kind    string    `json:"kind"`
+	Name    string    `json:"name"`
+	Cluster string    `json:"cluster,omitempty"`
+	Reason  string    `json:"reason"`
+	DryRun  bool      `json:"dryRun,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// garbageCollector runs the passes of `k3d gc`
+type garbageCollector struct {
+	docker         *client.Client
+	kubeConfigPath string
+	idle           *idleChecker // nil unless idle clusters are stopped
+	dryRun         bool
+	logFormat      string
+
+	failed  int             // failed actions of the current pass
+	skipped map[string]bool // protected clusters already reported as expired
+}
+
+// report logs an action of the garbage collection
+func (g *garbageCollector) report(e gcEvent) {
+	e.Time = time.Now()
+	e.DryRun = g.dryRun
+	if e.Action == gcError {
+		g.failed++
+	}
+	if g.logFormat == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(e); err != nil {
+			logWarningf("couldn't print garbage collection event\n%+v", err)
+		}
+		return
+	}
+
+	message := fmt.Sprintf("%s %s %s: %s", e.Action, e.Kind, e.Name, e.Reason)
+	if g.dryRun {
+		message = "[dry-run] " + message
+	}
+	switch e.Action {
+	case gcError:
+		logErrorf("%s\n%s", message, e.Error)
+	case gcSkip:
+		logInfof("%s", message)
+	default:
+		log.Print(message)
+	}
+}
+
+// act runs an action unless it's a dry run and reports it, or the error it failed with
+func (g *garbageCollector) act(e gcEvent, action func() error) bool {
+	if !g.dryRun {
+		if err := action(); err != nil {
+			e.Action, e.Error = gcError, err.Error()
+			g.report(e)
+			return false
+		}
+	}
+	g.report(e)
+	return true
+}
+
+// collect runs a single pass of the garbage collection
+func (g *garbageCollector) collect(ctx context.Context) error {
+	g.failed = 0
+	clusters, err := getClusters(true, "")
+	if err != nil {
+		g.report(gcEvent{Action: gcError, Kind: gcCluster, Reason: "couldn't list clusters", Error: err.Error()})
+		return err
+	}
+
+	g.deleteExpiredClusters(clusters)
+	if g.idle != nil {
+		g.stopIdleClusters(ctx, clusters)
+	}
+	g.removeOrphanedContainers(ctx, clusters)
+	g.removeOrphanedNetworks(ctx, clusters)
+	g.removeOrphanedClusterDirs(clusters)
+
+	if g.failed > 0 {
+		return fmt.Errorf("ERROR: %d garbage collection action(s) failed", g.failed)
+	}
+	return nil
+}
+
+// deleteExpiredClusters deletes the clusters whose TTL expired, protected clusters are kept.
+// The deleted clusters are removed from clusters.
+func (g *garbageCollector) deleteExpiredClusters(clusters map[string]cluster) {
+	for name, cl := range clusters {
+		expiry, ok := getClusterExpiry(cl)
+		if !ok || time.Now().Before(expiry) {
+			continue
+		}
+		reason := fmt.Sprintf("TTL %s expired %s ago", cl.server.Labels[ttlLabel], units.HumanDuration(time.Since(expiry)))
+		if isProtected(cl) {
+			if !g.skipped[name] {
+				g.report(gcEvent{Action: gcSkip, Kind: gcCluster, Name: name, Cluster: name, Reason: reason + ", but the cluster is protected"})
+				g.skipped[name] = true
+			}
+			continue
+		}
+		if g.act(gcEvent{Action: gcDelete, Kind: gcCluster, Name: name, Cluster: name, Reason: reason}, func() error {
+			return deleteClusterAndContext(cl, g.kubeConfigPath, false)
+		}) {
+			delete(clusters, name)
+		}
+	}
+}
+
+// stopIdleClusters stops the running clusters that have been idle for long enough
+func (g *garbageCollector) stopIdleClusters(ctx context.Context, clusters map[string]cluster) {
+	idle, err := g.idle.filterIdleClusters(ctx, g.docker, clusters)
+	if err != nil {
+		g.report(gcEvent{Action: gcError, Kind: gcCluster, Reason: "couldn't check for idle clusters", Error: err.Error()})
+		return
+	}
+	for name, cl := range idle {
+		g.act(gcEvent{Action: gcStop, Kind: gcCluster, Name: name, Cluster: name, Reason: fmt.Sprintf("idle for more than %s", g.idle.idleSince)}, func() error {
+			return stopCluster(ctx, g.docker, cl)
+		})
+	}
+}
+
+// removeOrphanedContainers removes exited helper containers (tools, chaos) and containerd proxies of deleted clusters
+func (g *garbageCollector) removeOrphanedContainers(ctx context.Context, clusters map[string]cluster) {
+	filters := filters.NewArgs()
+	filters.Add("label", "app=k3d")
+	addPrefixFilter(filters)
+	logDebugf("ContainerList filters=%s", filtersString(filters))
+	containers, err := g.docker.ContainerList(ctx, container.ListOptions{All: true, Filters: filters})
+	if err != nil {
+		g.report(gcEvent{Action: gcError, Kind: gcContainer, Reason: "couldn't list containers", Error: err.Error()})
+		return
+	}
+
+	now := time.Now()
+	for _, c := range containers {
+		reason := orphanedContainerReason(c, clusters, now)
+		if reason == "" {
+			continue
+		}
+		id := c.ID
+		g.act(gcEvent{Action: gcRemove, Kind: gcContainer, Name: getContainerShortName(c), Cluster: c.Labels["cluster"], Reason: reason}, func() error {
+			logDebugf("ContainerRemove %s", id)
+			return g.docker.ContainerRemove(ctx, id, container.RemoveOptions{Force: true})
+		})
+	}
+}
+
+// removeOrphanedNetworks removes the networks of deleted clusters without containers attached
+func (g *garbageCollector) removeOrphanedNetworks(ctx context.Context, clusters map[string]cluster) {
+	filters := filters.NewArgs()
+	filters.Add("label", "app=k3d")
+	addPrefixFilter(filters)
+	logDebugf("NetworkList filters=%s", filtersString(filters))
+	networks, err := g.docker.NetworkList(ctx, types.NetworkListOptions{Filters: filters})
+	if err != nil {
+		g.report(gcEvent{Action: gcError, Kind: gcNetwork, Reason: "couldn't list networks", Error: err.Error()})
+		return
+	}
+
+	now := time.Now()
+	for _, network := range networks {
+		if !isOrphanedNetwork(network, clusters, now) {
+			continue
+		}
+		clusterName := network.Labels["cluster"]
+		logDebugf("NetworkInspect %s", network.ID)
+		inspect, err := g.docker.NetworkInspect(ctx, network.ID, types.NetworkInspectOptions{})
+		if err != nil || len(inspect.Containers) > 0 {
+			continue
+		}
+		id := network.ID
+		g.act(gcEvent{Action: gcRemove, Kind: gcNetwork, Name: network.Name, Cluster: clusterName, Reason: fmt.Sprintf("network of deleted cluster %s", clusterName)}, func() error {
+			logDebugf("NetworkRemove %s (ID %s)", network.Name, id)
+			return g.docker.NetworkRemove(ctx, id)
+		})
+	}
+}
+
+// removeOrphanedClusterDirs removes the directories of deleted clusters. Only directories with a cluster.json
+// of the current prefix are considered, so that nothing else in the k3d config directory is touched.
+func (g *garbageCollector) removeOrphanedClusterDirs(clusters map[string]cluster) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		g.report(gcEvent{Action: gcError, Kind: gcDirectory, Reason: "couldn't get home directory", Error: err.Error()})
+		return
+	}
+	configDir := path.Join(homeDir, ".config", "k3d")
+	entries, err := os.ReadDir(configDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			g.report(gcEvent{Action: gcError, Kind: gcDirectory, Name: configDir, Reason: "couldn't read k3d config directory", Error: err.Error()})
+		}
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		clusterDir := path.Join(configDir, entry.Name())
+		metadataPath := path.Join(clusterDir, clusterMetadataFileName)
+		info, err := os.Stat(metadataPath)
+		if err != nil {
+			continue
+		}
+		content, err := os.ReadFile(metadataPath)
+		if err != nil {
+			continue
+		}
+		metadata := clusterMetadata{}
+		if err := json.Unmarshal(content, &metadata); err != nil || !isOrphanedClusterDir(clusterDir, metadata, info.ModTime(), clusters, now) {
+			continue
+		}
+		g.act(gcEvent{Action: gcRemove, Kind: gcDirectory, Name: clusterDir, Cluster: metadata.Name, Reason: fmt.Sprintf("directory of deleted cluster %s", metadata.Name)}, func() error {
+			return os.RemoveAll(clusterDir)
+		})
+	}
+}
+
+// GC collects the garbage of k3d: `k3d gc [--watch] [--stop-idle-since 2h] [--dry-run] [--log-format json]`.
+// With --watch, it runs periodically until it's interrupted, e.g. as user service on a shared host.
+func GC(c *cli.Context) error {
+	logFormat := c.String("log-format")
+	if !containsString(gcLogFormats, logFormat) {
+		return fmt.Errorf("ERROR: unknown log format [%s] (supported: %s)", logFormat, strings.Join(gcLogFormats, ", "))
+	}
+	interval := c.Duration("interval")
+	if c.Bool("watch") && interval <= 0 {
+		return fmt.Errorf("ERROR: --interval must be positive")
+	}
+
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+	kubeConfigPath, err := getDefaultKubeConfigPath()
+	if err != nil {
+		return err
+	}
+	g := &garbageCollector{
+		docker:         docker,
+		kubeConfigPath: kubeConfigPath,
+		dryRun:         c.Bool("dry-run"),
+		logFormat:      logFormat,
+		skipped:        map[string]bool{},
+	}
+	if idleSince := c.Duration("stop-idle-since"); idleSince > 0 {
+		g.idle = &idleChecker{idleSince: idleSince, cpuThreshold: c.Float64("idle-cpu")}
+		if g.idle.cpuThreshold < 0 {
+			return fmt.Errorf("ERROR: --idle-cpu must not be negative")
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for {
+		if err := g.collect(ctx); !c.Bool("watch") {
+			return err
+		}
+		// the failures are reported already, a failed pass (e.g. docker restarting) is retried with the next one
+		if sleepContext(ctx, interval) != nil {
+			return nil
+		}
+	}
+}
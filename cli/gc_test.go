@@ -0,0 +1,232 @@
+package run
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestParseClusterTTL(t *testing.T) {
+	tests := []struct {
+		ttl     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{ttl: "8h", want: 8 * time.Hour},
+		{ttl: "90m", want: 90 * time.Minute},
+		{ttl: "1h30m", want: 90 * time.Minute},
+		{ttl: "", wantErr: true},
+		{ttl: "8", wantErr: true},
+		{ttl: "1d", wantErr: true},
+		{ttl: "0s", wantErr: true},
+		{ttl: "-1h", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseClusterTTL(tt.ttl)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseClusterTTL(%q) error = %v, wantErr %v", tt.ttl, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseClusterTTL(%q) = %s, want %s", tt.ttl, got, tt.want)
+		}
+	}
+}
+
+func TestGetClusterExpiry(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   time.Time
+		wantOK bool
+	}{
+		{
+			name:   "ttl",
+			labels: map[string]string{ttlLabel: "8h"},
+			want:   created.Add(8 * time.Hour),
+			wantOK: true,
+		},
+		{
+			// --seed fixes the created label, the TTL counts from the creation of the container
+			name:   "seeded created label",
+			labels: map[string]string{ttlLabel: "8h", "created": "2000-01-01 00:00:00"},
+			want:   created.Add(8 * time.Hour),
+			wantOK: true,
+		},
+		{
+			name:   "no ttl",
+			labels: map[string]string{"created": "2024-05-01 12:00:00"},
+		},
+		{
+			name:   "invalid ttl",
+			labels: map[string]string{ttlLabel: "forever"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := cluster{name: "dev", server: types.Container{Labels: tt.labels, Created: created.Unix()}}
+			got, ok := getClusterExpiry(cl)
+			if ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Errorf("getClusterExpiry() = %s, %t, want %s, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestOrphanedContainerReason(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-time.Hour).Unix()
+	clusters := map[string]cluster{"dev": {name: "dev"}}
+	tests := []struct {
+		name       string
+		container  types.Container
+		wantReason bool
+	}{
+		{
+			name:       "exited tools container",
+			container:  types.Container{Labels: map[string]string{"app": "k3d", "component": "tools"}, State: "exited", Created: old},
+			wantReason: true,
+		},
+		{
+			name:       "dead chaos container",
+			container:  types.Container{Labels: map[string]string{"app": "k3d", "component": "chaos"}, State: "dead", Created: old},
+			wantReason: true,
+		},
+		{
+			name:      "running tools container",
+			container: types.Container{Labels: map[string]string{"app": "k3d", "component": "tools"}, State: "running", Created: old},
+		},
+		{
+			name:      "exited tools container within the grace period",
+			container: types.Container{Labels: map[string]string{"app": "k3d", "component": "tools"}, State: "exited", Created: now.Add(-time.Minute).Unix()},
+		},
+		{
+			name:       "containerd proxy of a deleted cluster",
+			container:  types.Container{Labels: map[string]string{"app": "k3d", "component": containerdProxyComponent, "cluster": "gone"}, State: "running", Created: old},
+			wantReason: true,
+		},
+		{
+			name:      "containerd proxy of an existing cluster",
+			container: types.Container{Labels: map[string]string{"app": "k3d", "component": containerdProxyComponent, "cluster": "dev"}, State: "running", Created: old},
+		},
+		{
+			name:      "stopped worker",
+			container: types.Container{Labels: map[string]string{"app": "k3d", "component": "worker", "cluster": "gone"}, State: "exited", Created: old},
+		},
+		{
+			name:      "other prefix",
+			container: types.Container{Labels: map[string]string{"app": "k3d", "component": "tools", "prefix": "other"}, State: "exited", Created: old},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reason := orphanedContainerReason(tt.container, clusters, now); (reason != "") != tt.wantReason {
+				t.Errorf("orphanedContainerReason() = %q, want a reason: %t", reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestIsOrphanedNetwork(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clusters := map[string]cluster{"dev": {name: "dev"}}
+	tests := []struct {
+		name    string
+		network types.NetworkResource
+		want    bool
+	}{
+		{
+			name:    "network of a deleted cluster",
+			network: types.NetworkResource{Labels: map[string]string{"app": "k3d", "cluster": "gone"}, Created: now.Add(-time.Hour)},
+			want:    true,
+		},
+		{
+			name:    "network of an existing cluster",
+			network: types.NetworkResource{Labels: map[string]string{"app": "k3d", "cluster": "dev"}, Created: now.Add(-time.Hour)},
+		},
+		{
+			name:    "network within the grace period",
+			network: types.NetworkResource{Labels: map[string]string{"app": "k3d", "cluster": "gone"}, Created: now.Add(-time.Minute)},
+		},
+		{
+			name:    "other prefix",
+			network: types.NetworkResource{Labels: map[string]string{"app": "k3d", "cluster": "gone", "prefix": "other"}, Created: now.Add(-time.Hour)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isOrphanedNetwork(tt.network, clusters, now); got != tt.want {
+				t.Errorf("isOrphanedNetwork() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsOrphanedClusterDir(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clusters := map[string]cluster{"dev": {name: "dev"}}
+	goneDir, err := getClusterDir("gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devDir, err := getClusterDir("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"app": "k3d"}
+	tests := []struct {
+		name       string
+		clusterDir string
+		metadata   clusterMetadata
+		modTime    time.Time
+		want       bool
+	}{
+		{
+			name:       "directory of a deleted cluster",
+			clusterDir: goneDir,
+			metadata:   clusterMetadata{Name: "gone", Labels: labels},
+			modTime:    now.Add(-time.Hour),
+			want:       true,
+		},
+		{
+			name:       "directory of an existing cluster",
+			clusterDir: devDir,
+			metadata:   clusterMetadata{Name: "dev", Labels: labels},
+			modTime:    now.Add(-time.Hour),
+		},
+		{
+			name:       "directory within the grace period",
+			clusterDir: goneDir,
+			metadata:   clusterMetadata{Name: "gone", Labels: labels},
+			modTime:    now.Add(-time.Minute),
+		},
+		{
+			name:       "metadata without name",
+			clusterDir: goneDir,
+			metadata:   clusterMetadata{Labels: labels},
+			modTime:    now.Add(-time.Hour),
+		},
+		{
+			name:       "other prefix",
+			clusterDir: goneDir,
+			metadata:   clusterMetadata{Name: "gone", Labels: map[string]string{"app": "k3d", "prefix": "other"}},
+			modTime:    now.Add(-time.Hour),
+		},
+		{
+			name:       "directory at another path",
+			clusterDir: path.Join(path.Dir(goneDir), "backup"),
+			metadata:   clusterMetadata{Name: "gone", Labels: labels},
+			modTime:    now.Add(-time.Hour),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isOrphanedClusterDir(tt.clusterDir, tt.metadata, tt.modTime, clusters, now); got != tt.want {
+				t.Errorf("isOrphanedClusterDir() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
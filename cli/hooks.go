@@ -0,0 +1,83 @@
+package run
+
+/*
+ * The functions in this file run the hooks of a cluster spec: host commands run on lifecycle events
+ * of the cluster, e.g. to trust its certificates or to set up DNS or VPN routes.
+ */
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/Minhaz00/k3d/pkg/types"
+)
+
+// lifecycle events hooks can be declared for
+const (
+	hookPostCreate = "postCreate"
+	hookPostStart  = "postStart"
+	hookPreDelete  = "preDelete"
+)
+
+// dropUntrustedHooks removes the hooks of a spec taken from a bundle or image, e.g. of someone else, unless they're
+// allowed explicitly (--allow-hooks), since they run arbitrary commands on the host
+func dropUntrustedHooks(spec *clusterSpec, allow bool, source string) {
+	hooks := spec.Hooks
+	if allow || len(hooks.PostCreate)+len(hooks.PostStart)+len(hooks.PreDelete) == 0 {
+		return
+	}
+	logWarningf("ignoring the hooks of %s, they run commands on this machine: review them and use --allow-hooks to keep them\n%s",
+		source, describeHooks(hooks))
+	spec.Hooks = types.ClusterHooks{}
+}
+
+// describeHooks lists the commands of the hooks by event
+func describeHooks(hooks types.ClusterHooks) string {
+	lines := []string{}
+	for _, event := range []struct {
+		name     string
+		commands []string
+	}{{hookPostCreate, hooks.PostCreate}, {hookPostStart, hooks.PostStart}, {hookPreDelete, hooks.PreDelete}} {
+		for _, command := range event.commands {
+			lines = append(lines, fmt.Sprintf("  %s: %s", event.name, command))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runHooks runs the commands of a lifecycle event of a cluster one after the other with `sh -c`.
+// A failing hook doesn't stop the lifecycle operation, it's only reported.
+func runHooks(event string, commands []string, clusterName string) {
+	if len(commands) == 0 {
+		return
+	}
+
+	// the kubeconfig may not have been extracted from the server yet
+	kubeConfigPath, err := getKubeConfig(clusterName)
+	if err != nil {
+		logDebugf("couldn't get kubeconfig of cluster %s for the %s hooks: %+v", clusterName, event, err)
+		kubeConfigPath, _ = getClusterKubeConfigPath(clusterName)
+	}
+	clusterDir, _ := getClusterDir(clusterName)
+	env := append(os.Environ(),
+		"K3D_CLUSTER="+clusterName,
+		"K3D_CLUSTER_DIR="+clusterDir,
+		"K3D_EVENT="+event,
+		"KUBECONFIG="+kubeConfigPath,
+	)
+
+	for _, command := range commands {
+		log.Printf("Running %s hook of cluster %s: %s", event, clusterName, command)
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = env
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			logWarningf("%s hook of cluster %s failed: %s\n%+v", event, clusterName, command, err)
+		}
+	}
+}
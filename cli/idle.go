@@ -0,0 +1,160 @@
+package run
+
+/*
+ * The functions in this file detect idle clusters and stop them (`k3d stop --idle-since`, `k3d autostop`).
+ * A cluster is active while it was used through k3d (e.g. its kubeconfig was fetched) or its nodes use CPU.
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/urfave/cli"
+)
+
+// activityFileName is the file in the cluster directory whose modification time is the last activity of a cluster
+const activityFileName = "activity"
+
+// markClusterActive records that a cluster was just used
+func markClusterActive(name string) {
+	clusterDir, err := getClusterDir(name)
+	if err != nil {
+		return
+	}
+	activityPath := path.Join(clusterDir, activityFileName)
+	now := time.Now()
+	if err := os.Chtimes(activityPath, now, now); err == nil {
+		return
+	}
+	if err := os.WriteFile(activityPath, nil, 0644); err != nil {
+		logDebugf("couldn't record activity of cluster %s: %+v", name, err)
+	}
+}
+
+// getClusterLastActivity returns when a cluster was used last: the recorded activity or the start of its server
+func getClusterLastActivity(ctx context.Context, docker *client.Client, cl cluster) (time.Time, error) {
+	logDebugf("ContainerInspect %s", cl.server.ID)
+	inspect, err := docker.ContainerInspect(ctx, cl.server.ID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("ERROR: couldn't inspect server of cluster %s\n%w", cl.name, err)
+	}
+	last, _ := time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+
+	if clusterDir, err := getClusterDir(cl.name); err == nil {
+		if info, err := os.Stat(path.Join(clusterDir, activityFileName)); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// idleChecker decides whether running clusters are idle
+type idleChecker struct {
+	idleSince    time.Duration // how long a cluster has to be inactive
+	cpuThreshold float64       // CPU usage of all nodes in percent of one CPU, above which a cluster is active
+}
+
+// isIdle reports whether a cluster has been idle for long enough, a cluster using CPU is marked as active
+func (i idleChecker) isIdle(ctx context.Context, docker *client.Client, cl cluster) (bool, error) {
+	if cl.status != "running" {
+		return false, nil
+	}
+
+	var cpu float64
+	for _, node := range append([]types.Container{cl.server}, cl.workers...) {
+		stats, err := getNodeStats(ctx, docker, cl.name, node)
+		if err != nil {
+			return false, err
+		}
+		cpu += stats.cpu
+	}
+	if cpu > i.cpuThreshold {
+		logDebugf("cluster %s is active (CPU usage %.1f%% > %.1f%%)", cl.name, cpu, i.cpuThreshold)
+		markClusterActive(cl.name)
+		return false, nil
+	}
+
+	last, err := getClusterLastActivity(ctx, docker, cl)
+	if err != nil {
+		return false, err
+	}
+	logDebugf("cluster %s was last active at %s (CPU usage %.1f%%)", cl.name, last.Format(time.RFC3339), cpu)
+	return time.Since(last) > i.idleSince, nil
+}
+
+// filterIdleClusters returns the clusters that have been idle for long enough
+func (i idleChecker) filterIdleClusters(ctx context.Context, docker *client.Client, clusters map[string]cluster) (map[string]cluster, error) {
+	idle := map[string]cluster{}
+	for name, cl := range clusters {
+		isIdle, err := i.isIdle(ctx, docker, cl)
+		if err != nil {
+			return nil, err
+		}
+		if isIdle {
+			idle[name] = cl
+		}
+	}
+	return idle, nil
+}
+
+// newIdleChecker returns the idle checker configured by the --idle-since and --idle-cpu flags
+func newIdleChecker(c *cli.Context) (idleChecker, error) {
+	checker := idleChecker{idleSince: c.Duration("idle-since"), cpuThreshold: c.Float64("idle-cpu")}
+	if checker.idleSince <= 0 {
+		return checker, fmt.Errorf("ERROR: --idle-since must be positive")
+	}
+	if checker.cpuThreshold < 0 {
+		return checker, fmt.Errorf("ERROR: --idle-cpu must not be negative")
+	}
+	return checker, nil
+}
+
+// AutoStop stops all clusters that have been idle for a while: `k3d autostop --idle-since 2h [--watch]`.
+// With --watch, the clusters are checked periodically until k3d is interrupted.
+func AutoStop(c *cli.Context) error {
+	checker, err := newIdleChecker(c)
+	if err != nil {
+		return err
+	}
+	interval := c.Duration("interval")
+	if c.Bool("watch") && interval <= 0 {
+		return fmt.Errorf("ERROR: --interval must be positive")
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	for {
+		clusters, err := getClusters(true, "")
+		if err != nil {
+			return err
+		}
+		idle, err := checker.filterIdleClusters(ctx, docker, clusters)
+		if err != nil {
+			return err
+		}
+		for _, cl := range idle {
+			log.Printf("Cluster %s has been idle for more than %s", cl.name, checker.idleSince)
+			if err := stopCluster(ctx, docker, cl); err != nil {
+				if !c.Bool("watch") {
+					return err
+				}
+				logWarningf("%+v", err)
+			}
+		}
+
+		if !c.Bool("watch") {
+			return nil
+		}
+		time.Sleep(interval)
+	}
+}
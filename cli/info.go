@@ -0,0 +1,96 @@
+package run
+
+/*
+ * The functions in this file summarize the environment k3d runs in (`k3d info`),
+ * as a quick health overview and for bug reports.
+ */
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"runtime"
+
+	"github.com/Minhaz00/k3d/version"
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli"
+)
+
+// lowMemoryThreshold is the memory of the docker host below which clusters with more than a node or two struggle
+const lowMemoryThreshold = 4 * units.GiB
+
+// printInfo prints a line of the environment summary
+func printInfo(key string, value interface{}) {
+	fmt.Printf("  %-20s %v\n", key+":", value)
+}
+
+// Info prints the docker daemon, the k3d defaults and the existing clusters, followed by warnings about the environment
+func Info(c *cli.Context) error {
+	ctx := context.Background()
+	docker, err := newDockerClient(client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+	logDebugf("Info")
+	info, err := docker.Info(ctx)
+	if err != nil {
+		return checkDockerError(fmt.Errorf("ERROR: couldn't get docker info\n%w", err))
+	}
+	logDebugf("ServerVersion")
+	serverVersion, err := docker.ServerVersion(ctx)
+	if err != nil {
+		return checkDockerError(fmt.Errorf("ERROR: couldn't get docker version\n%w", err))
+	}
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't get home directory\n%w", err)
+	}
+	clusters, err := getClusters(true, "")
+	if err != nil {
+		return err
+	}
+	running := 0
+	for _, cl := range clusters {
+		if cl.status == "running" {
+			running++
+		}
+	}
+
+	fmt.Println("k3d:")
+	printInfo("version", version.GetVersion())
+	printInfo("default image", fmt.Sprintf("%s:%s", defaultK3sImageRepo, version.GetK3sVersion()))
+	printInfo("config dir", path.Join(homeDir, ".config", "k3d"))
+	printInfo("prefix", containerNamePrefix)
+	printInfo("platform", fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH))
+	fmt.Println("docker:")
+	printInfo("host", docker.DaemonHost())
+	printInfo("version", fmt.Sprintf("%s (API %s)", serverVersion.Version, serverVersion.APIVersion))
+	printInfo("os", fmt.Sprintf("%s (%s/%s)", info.OperatingSystem, info.OSType, info.Architecture))
+	printInfo("kernel", info.KernelVersion)
+	printInfo("storage driver", info.Driver)
+	printInfo("cgroup", fmt.Sprintf("v%s (%s driver)", info.CgroupVersion, info.CgroupDriver))
+	printInfo("cpus", info.NCPU)
+	printInfo("memory", units.BytesSize(float64(info.MemTotal)))
+	fmt.Println("clusters:")
+	printInfo("total", len(clusters))
+	printInfo("running", running)
+
+	if info.MemTotal > 0 && info.MemTotal < lowMemoryThreshold {
+		logWarningf("the docker host only has %s of memory, clusters with more than one or two nodes may not come up", units.BytesSize(float64(info.MemTotal)))
+	}
+	if versions.LessThan(serverVersion.APIVersion, minUnprivilegedAPIVersion) {
+		logWarningf("docker %s is old, features like --no-privileged require Docker 20.10 (API %s) or newer", serverVersion.Version, minUnprivilegedAPIVersion)
+	}
+	if info.CgroupVersion == "2" {
+		if err := checkCgroupV2Support(fmt.Sprintf("%s:%s", defaultK3sImageRepo, version.GetK3sVersion())); err != nil {
+			logWarningf("the default image doesn't support cgroup v2, use a newer image with --image")
+		}
+	}
+	for _, warning := range info.Warnings {
+		logWarningf("docker: %s", warning)
+	}
+	return nil
+}
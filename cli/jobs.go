@@ -0,0 +1,347 @@
+package run
+
+/*
+ * The functions in this file run long operations in the background (e.g. `k3d delete --async`) and track them
+ * (`k3d jobs`). A job is a state file in the jobs directory, which a detached k3d process (`k3d jobs run <id>`)
+ * works off with a goroutine per cluster, logging to a file next to it.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli"
+)
+
+// operations which can run as jobs
+const jobDelete = "delete"
+
+// states of a job and of its clusters
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+	jobLost    = "lost" // the helper process is gone without finishing the job
+)
+
+// jobsDirName is the directory of the jobs in the k3d config directory. It starts with a dot, which no cluster
+// name can, so that it can't be the directory of a cluster, which `k3d delete` removes.
+const jobsDirName = ".jobs"
+
+// finishedJobRetention is how long finished jobs are listed before their files are removed
+const finishedJobRetention = 24 * time.Hour
+
+// job is the state of a background operation on a set of clusters
+type job struct {
+	ID        string            `json:"id"`
+	Operation string            `json:"operation"`
+	Clusters  map[string]string `json:"clusters"` // cluster name -> state
+	Status    string            `json:"status"`
+	Error     string            `json:"error,omitempty"`
+	PID       int               `json:"pid,omitempty"`
+	Started   time.Time         `json:"started"`
+	Finished  time.Time         `json:"finished,omitempty"`
+
+	KeepKubeconfigContext bool `json:"keepKubeconfigContext,omitempty"`
+}
+
+// jobLock serializes the updates of the job file and of the kubeconfig by the goroutines of a job
+var jobLock sync.Mutex
+
+// getJobsDir returns the directory the state and log files of jobs are kept in
+func getJobsDir() (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("ERROR: couldn't get home directory\n%w", err)
+	}
+	return path.Join(homeDir, ".config", "k3d", jobsDirName), nil
+}
+
+// getJobPath returns the path of the state file of a job, or of its log file with the .log extension
+func getJobPath(id, ext string) (string, error) {
+	jobsDir, err := getJobsDir()
+	return path.Join(jobsDir, id+ext), err
+}
+
+// writeJob stores the state of a job
+func writeJob(j *job) error {
+	jobPath, err := getJobPath(j.ID, ".json")
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't serialize job %s\n%w", j.ID, err)
+	}
+	if err := os.WriteFile(jobPath, content, 0600); err != nil {
+		return fmt.Errorf("ERROR: couldn't write job %s\n%w", j.ID, err)
+	}
+	return nil
+}
+
+// readJob reads the state of a job
+func readJob(id string) (*job, error) {
+	jobPath, err := getJobPath(id, ".json")
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(jobPath)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't read job %s\n%w", id, err)
+	}
+	j := &job{}
+	if err := json.Unmarshal(content, j); err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't parse job %s\n%w", id, err)
+	}
+	return j, nil
+}
+
+// startJob stores a new job and starts the detached k3d process working it off
+func startJob(operation string, clusters []string, keepKubeconfigContext bool) (*job, error) {
+	jobsDir, err := getJobsDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := createDirIfNotExists(jobsDir); err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't create jobs directory %s\n%w", jobsDir, err)
+	}
+
+	j := &job{
+		ID:        fmt.Sprintf("%s-%s", operation, strings.ToLower(GenerateRandomString(6))),
+		Operation: operation,
+		Clusters:  map[string]string{},
+		Status:    jobPending,
+		Started:   time.Now(),
+
+		KeepKubeconfigContext: keepKubeconfigContext,
+	}
+	for _, name := range clusters {
+		j.Clusters[name] = jobPending
+	}
+	if err := writeJob(j); err != nil {
+		return nil, err
+	}
+
+	logPath, _ := getJobPath(j.ID, ".log")
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't open log file of job %s\n%w", j.ID, err)
+	}
+	defer logFile.Close()
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't find the path of the running binary\n%w", err)
+	}
+
+	// the helper records its PID itself, so that the job file has a single writer once it runs
+	cmd := exec.Command(executable, append(helperGlobalArgs(), "jobs", "run", j.ID)...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// the helper doesn't hold on to the terminal
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't open %s\n%w", os.DevNull, err)
+	}
+	defer devNull.Close()
+	cmd.Stdin = devNull
+	detachJobProcess(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't start job %s\n%w", j.ID, err)
+	}
+	j.PID = cmd.Process.Pid
+	return j, cmd.Process.Release()
+}
+
+// helperGlobalArgs returns the global flags of this invocation, which are passed on to the detached helper processes
+func helperGlobalArgs() []string {
+	args := []string{"--no-update-check", "--prefix", containerNamePrefix}
+	if verbose {
+		args = append(args, "--verbose")
+	}
+	if strictNodeSpecifiers {
+		args = append(args, "--strict")
+	}
+	if dockerTracePath != "" {
+		args = append(args, "--trace-docker", dockerTracePath)
+	}
+	return args
+}
+
+// setJobClusterState records the state of a cluster of a job
+func setJobClusterState(j *job, cluster, state string) {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	j.Clusters[cluster] = state
+	if err := writeJob(j); err != nil {
+		logWarningf("%+v", err)
+	}
+}
+
+// RunJob works off a job in the foreground, it's started by startJob in a detached process: `k3d jobs run <id>`
+func RunJob(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("ERROR: please specify the job to run")
+	}
+	j, err := readJob(c.Args().First())
+	if err != nil {
+		return err
+	}
+	if j.Operation != jobDelete {
+		return fmt.Errorf("ERROR: unknown operation %s of job %s", j.Operation, j.ID)
+	}
+	log.Printf("Running job %s: %s %d cluster(s)", j.ID, j.Operation, len(j.Clusters))
+
+	jobLock.Lock()
+	j.PID = os.Getpid()
+	j.Status = jobRunning
+	err = writeJob(j)
+	jobLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	clusters, err := getClusters(true, "")
+	if err != nil {
+		return err
+	}
+	kubeConfigPath := ""
+	if !j.KeepKubeconfigContext {
+		if kubeConfigPath, err = getDefaultKubeConfigPath(); err != nil {
+			return err
+		}
+	}
+
+	failed := []string{}
+	var wg sync.WaitGroup
+	for name := range j.Clusters {
+		cl, ok := clusters[name]
+		if !ok {
+			// deleted in the meantime
+			setJobClusterState(j, name, jobDone)
+			continue
+		}
+		wg.Add(1)
+		go func(cl cluster) {
+			defer wg.Done()
+			setJobClusterState(j, cl.name, jobRunning)
+			if err := deleteClusterAndContext(cl, kubeConfigPath, j.KeepKubeconfigContext); err != nil {
+				logErrorf("couldn't delete cluster %s\n%+v", cl.name, err)
+				jobLock.Lock()
+				failed = append(failed, cl.name)
+				jobLock.Unlock()
+				setJobClusterState(j, cl.name, jobFailed)
+				return
+			}
+			setJobClusterState(j, cl.name, jobDone)
+		}(cl)
+	}
+	wg.Wait()
+
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	j.Status = jobDone
+	j.Finished = time.Now()
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		j.Status = jobFailed
+		j.Error = fmt.Sprintf("couldn't delete %s", strings.Join(failed, ", "))
+	}
+	if err := writeJob(j); err != nil {
+		return err
+	}
+	log.Printf("Job %s %s", j.ID, j.Status)
+	return nil
+}
+
+// listJobs returns the jobs sorted by start time, jobs whose helper process is gone are reported as lost
+// and finished jobs older than finishedJobRetention are removed
+func listJobs() ([]*job, error) {
+	jobsDir, err := getJobsDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(jobsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't read jobs directory %s\n%w", jobsDir, err)
+	}
+
+	jobs := []*job{}
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if id == entry.Name() {
+			continue
+		}
+		j, err := readJob(id)
+		if err != nil {
+			logWarningf("%+v", err)
+			continue
+		}
+		if !j.Finished.IsZero() && time.Since(j.Finished) > finishedJobRetention {
+			logDebugf("removing job %s, which finished %s", j.ID, j.Finished)
+			os.Remove(path.Join(jobsDir, j.ID+".json"))
+			os.Remove(path.Join(jobsDir, j.ID+".log"))
+			continue
+		}
+		if j.Finished.IsZero() && j.PID > 0 && !processAlive(j.PID) {
+			j.Status = jobLost
+		}
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Started.Before(jobs[j].Started) })
+	return jobs, nil
+}
+
+// ListJobs prints the background jobs and the state of their clusters: `k3d jobs`
+func ListJobs(c *cli.Context) error {
+	jobs, err := listJobs()
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		log.Printf("No jobs found!")
+		return nil
+	}
+
+	table := newTable([]string{"ID", "OPERATION", "STATUS", "CLUSTERS", "STARTED", "DURATION", "LOG"})
+	for _, j := range jobs {
+		names := make([]string, 0, len(j.Clusters))
+		for name := range j.Clusters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		clusters := []string{}
+		for _, name := range names {
+			clusters = append(clusters, fmt.Sprintf("%s (%s)", name, j.Clusters[name]))
+		}
+		finished := j.Finished
+		if finished.IsZero() {
+			finished = time.Now()
+		}
+		logPath, _ := getJobPath(j.ID, ".log")
+		table.Append([]string{
+			j.ID,
+			j.Operation,
+			j.Status,
+			strings.Join(clusters, ", "),
+			units.HumanDuration(time.Since(j.Started)) + " ago",
+			finished.Sub(j.Started).Round(time.Second).String(),
+			logPath,
+		})
+	}
+	table.Render()
+	return nil
+}
@@ -0,0 +1,45 @@
+package run
+
+import (
+	"reflect"
+	"testing"
+)
+
+// `k3d delete` removes the directory of a cluster, which mustn't be the jobs directory for any cluster name
+func TestJobsDirDoesNotCollideWithClusterDir(t *testing.T) {
+	jobsDir, err := getJobsDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prefix string) { containerNamePrefix = prefix }(containerNamePrefix)
+	for _, prefix := range []string{defaultContainerNamePrefix, "ci"} {
+		containerNamePrefix = prefix
+		for _, name := range []string{"jobs", jobsDirName} {
+			clusterDir, err := getClusterDir(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clusterDir == jobsDir && CheckClusterName(name) == nil {
+				t.Errorf("cluster %s with prefix %s would use the jobs directory %s", name, prefix, jobsDir)
+			}
+		}
+	}
+}
+
+// the detached helpers have to run with the global flags of the command that started them
+func TestHelperGlobalArgs(t *testing.T) {
+	defer func(prefix string, v, strict bool, trace string) {
+		containerNamePrefix, verbose, strictNodeSpecifiers, dockerTracePath = prefix, v, strict, trace
+	}(containerNamePrefix, verbose, strictNodeSpecifiers, dockerTracePath)
+
+	containerNamePrefix, verbose, strictNodeSpecifiers, dockerTracePath = "ci", false, false, ""
+	if got, want := helperGlobalArgs(), []string{"--no-update-check", "--prefix", "ci"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	verbose, strictNodeSpecifiers, dockerTracePath = true, true, "trace.jsonl"
+	want := []string{"--no-update-check", "--prefix", "ci", "--verbose", "--strict", "--trace-docker", "trace.jsonl"}
+	if got := helperGlobalArgs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package run
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// detachJobProcess starts the helper of a job in its own session, so that neither a hangup of the terminal
+// nor a signal to the process group of the calling k3d stops it halfway through
+func detachJobProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// processAlive reports whether a process with the given PID exists
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
@@ -0,0 +1,32 @@
+package run
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detachJobProcess starts the helper of a job in its own process group without console,
+// so that closing the console or Ctrl-C in it doesn't stop it halfway through
+func detachJobProcess(cmd *exec.Cmd) {
+	const detachedProcess = 0x00000008 // DETACHED_PROCESS
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcess}
+}
+
+// processAlive reports whether a process with the given PID is still running.
+// Windows doesn't support signal 0, so the exit code of the process is queried instead.
+func processAlive(pid int) bool {
+	const (
+		processQueryLimitedInformation = 0x1000 // PROCESS_QUERY_LIMITED_INFORMATION
+		stillActive                    = 259    // STILL_ACTIVE
+	)
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(handle)
+	var exitCode uint32
+	if err := syscall.GetExitCodeProcess(handle, &exitCode); err != nil {
+		return false
+	}
+	return exitCode == stillActive
+}
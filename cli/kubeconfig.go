@@ -0,0 +1,328 @@
+package run
+
+/*
+ * The functions in this file read, modify and merge kubeconfig files with clientcmd,
+ * so that entries and fields k3d doesn't touch (e.g. exec or auth-provider users) are kept.
+ */
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// kubeConfigMode is the file mode kubeconfigs are written with, they contain the credentials of the clusters
+var kubeConfigMode os.FileMode = 0600
+
+// setKubeConfigMode sets the file mode kubeconfigs are written with from an octal mode (e.g. 0640),
+// the owner has to be able to read and write them
+func setKubeConfigMode(mode string) error {
+	if mode == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed&^0777 != 0 {
+		return fmt.Errorf("ERROR: invalid kubeconfig mode [%s], expected an octal file mode like 0600", mode)
+	}
+	if parsed&0600 != 0600 {
+		return fmt.Errorf("ERROR: kubeconfig mode [%s] has to allow the owner to read and write", mode)
+	}
+	if parsed&0007 != 0 {
+		logWarningf("kubeconfig mode %s allows all users to access the credentials of the clusters", mode)
+	}
+	kubeConfigMode = os.FileMode(parsed)
+	return nil
+}
+
+// writeKubeConfigFile writes the content of a kubeconfig with kubeConfigMode, also if the file already exists
+func writeKubeConfigFile(kubeConfigPath string, content []byte) error {
+	if err := os.WriteFile(kubeConfigPath, content, kubeConfigMode); err != nil {
+		return err
+	}
+	// the mode of WriteFile only applies to new files and is reduced by the umask
+	return os.Chmod(kubeConfigPath, kubeConfigMode)
+}
+
+// kubeConfigContextName returns the name used for cluster, context and user entries of a k3d cluster in a merged kubeconfig
+func kubeConfigContextName(cluster string) string {
+	return fmt.Sprintf("%s-%s", containerNamePrefix, cluster)
+}
+
+// getDefaultKubeConfigPath returns the kubeconfig that kubectl uses by default: the first entry of $KUBECONFIG or $HOME/.kube/config
+func getDefaultKubeConfigPath() (string, error) {
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		return filepath.SplitList(env)[0], nil
+	}
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("ERROR: Couldn't get user's home directory\n%w", err)
+	}
+	return path.Join(homeDir, ".kube", "config"), nil
+}
+
+// loadKubeConfig reads a kubeconfig file. A non-existing file results in an empty kubeconfig.
+func loadKubeConfig(kubeConfigPath string) (*clientcmdapi.Config, error) {
+	if _, err := os.Stat(kubeConfigPath); os.IsNotExist(err) {
+		return clientcmdapi.NewConfig(), nil
+	}
+	config, err := clientcmd.LoadFromFile(kubeConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't read kubeconfig %s\n%w", kubeConfigPath, err)
+	}
+	return config, nil
+}
+
+// writeKubeConfig writes a kubeconfig file, creating parent directories if required
+func writeKubeConfig(config *clientcmdapi.Config, kubeConfigPath string) error {
+	if err := createDirIfNotExists(filepath.Dir(kubeConfigPath)); err != nil {
+		return fmt.Errorf("ERROR: couldn't create directory for kubeconfig %s\n%w", kubeConfigPath, err)
+	}
+
+	// serialized here instead of clientcmd.WriteToFile, which ignores kubeConfigMode
+	content, err := clientcmd.Write(*config)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't serialize kubeconfig\n%w", err)
+	}
+
+	if err := writeKubeConfigFile(kubeConfigPath, content); err != nil {
+		return fmt.Errorf("ERROR: couldn't write kubeconfig %s\n%w", kubeConfigPath, err)
+	}
+	return nil
+}
+
+// setKubeConfigServerPort points all clusters of a kubeconfig to the given host port
+func setKubeConfigServerPort(config *clientcmdapi.Config, port int) error {
+	for _, cluster := range config.Clusters {
+		if cluster.Server == "" {
+			continue
+		}
+		u, err := url.Parse(cluster.Server)
+		if err != nil {
+			return fmt.Errorf("ERROR: couldn't parse server URL [%s] in kubeconfig\n%w", cluster.Server, err)
+		}
+		u.Host = fmt.Sprintf("%s:%d", u.Hostname(), port)
+		cluster.Server = u.String()
+	}
+	return nil
+}
+
+// setKubeConfigServerHost points all clusters of a serialized kubeconfig to the given host and port,
+// an empty port keeps the port
+func setKubeConfigServerHost(content []byte, host, port string) ([]byte, error) {
+	config, err := clientcmd.Load(content)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't parse kubeconfig\n%w", err)
+	}
+	for _, cluster := range config.Clusters {
+		if cluster.Server == "" {
+			continue
+		}
+		u, err := url.Parse(cluster.Server)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: couldn't parse server URL [%s] in kubeconfig\n%w", cluster.Server, err)
+		}
+		if port == "" {
+			port = u.Port()
+		}
+		u.Host = net.JoinHostPort(host, port)
+		cluster.Server = u.String()
+	}
+	content, err = clientcmd.Write(*config)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't serialize kubeconfig\n%w", err)
+	}
+	return content, nil
+}
+
+// mergeClusterKubeConfig adds (or replaces) the cluster, context and user of a k3d cluster in a kubeconfig.
+// The entries in the k3s generated kubeconfig are called "default", so they get renamed to k3d-<cluster>.
+func mergeClusterKubeConfig(dest *clientcmdapi.Config, src *clientcmdapi.Config, cluster string) error {
+	// the entries of the current context, or the only ones without one
+	clusterName, userName := "", ""
+	if context, ok := src.Contexts[src.CurrentContext]; ok {
+		clusterName, userName = context.Cluster, context.AuthInfo
+	} else if len(src.Clusters) == 1 && len(src.AuthInfos) == 1 {
+		for name := range src.Clusters {
+			clusterName = name
+		}
+		for name := range src.AuthInfos {
+			userName = name
+		}
+	}
+	srcCluster, srcUser := src.Clusters[clusterName], src.AuthInfos[userName]
+	if srcCluster == nil || srcUser == nil {
+		return fmt.Errorf("ERROR: kubeconfig of cluster %s has no cluster or user entries", cluster)
+	}
+
+	name := kubeConfigContextName(cluster)
+	dest.Clusters[name] = srcCluster.DeepCopy()
+	dest.AuthInfos[name] = srcUser.DeepCopy()
+	context := clientcmdapi.NewContext()
+	context.Cluster = name
+	context.AuthInfo = name
+	dest.Contexts[name] = context
+	return nil
+}
+
+// refreshClusterKubeConfig re-extracts the kubeconfig from the cluster's server container
+// and makes sure that it points to the currently published API port
+func refreshClusterKubeConfig(c cluster) (*clientcmdapi.Config, error) {
+	createClusterDir(c.name)
+	if err := createKubeConfigFile(c.name); err != nil {
+		return nil, err
+	}
+
+	kubeConfigPath, err := getClusterKubeConfigPath(c.name)
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadKubeConfig(kubeConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// the host port of the API may have changed since the kubeconfig was generated
+	if apiPort, err := strconv.Atoi(c.server.Labels["apiPort"]); err == nil {
+		for _, port := range c.server.Ports {
+			if int(port.PrivatePort) == apiPort && port.PublicPort != 0 {
+				if err := setKubeConfigServerPort(config, int(port.PublicPort)); err != nil {
+					return nil, err
+				}
+				if err := writeKubeConfig(config, kubeConfigPath); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// updateMergedKubeConfig replaces the entries of a cluster in a merged kubeconfig, if the cluster was merged into it.
+// It reports whether the kubeconfig was updated.
+func updateMergedKubeConfig(kubeConfigPath string, config *clientcmdapi.Config, cluster string) (bool, error) {
+	merged, err := loadKubeConfig(kubeConfigPath)
+	if err != nil {
+		return false, err
+	}
+	if !hasKubeConfigContext(merged, kubeConfigContextName(cluster)) {
+		return false, nil
+	}
+	if err := mergeClusterKubeConfig(merged, config, cluster); err != nil {
+		return false, err
+	}
+	return true, writeKubeConfig(merged, kubeConfigPath)
+}
+
+// refreshKubeConfigs rewrites the kubeconfig of a running cluster and its entries in the merged kubeconfig,
+// e.g. after the certificates were rotated or the API port changed
+func refreshKubeConfigs(cl cluster, mergedKubeConfigPath string) error {
+	config, err := refreshClusterKubeConfig(cl)
+	if err != nil {
+		return err
+	}
+	updated, err := updateMergedKubeConfig(mergedKubeConfigPath, config, cl.name)
+	if err != nil {
+		return err
+	}
+	if updated {
+		logDebugf("updated context %s in %s", kubeConfigContextName(cl.name), mergedKubeConfigPath)
+	}
+	return nil
+}
+
+// removeMergedKubeConfig removes the cluster, context and user of a deleted cluster from a merged kubeconfig,
+// unsetting the current context if it was the one of the cluster. It reports whether the kubeconfig was changed.
+func removeMergedKubeConfig(kubeConfigPath string, cluster string) (bool, error) {
+	config, err := loadKubeConfig(kubeConfigPath)
+	if err != nil {
+		return false, err
+	}
+
+	name := kubeConfigContextName(cluster)
+	_, hasCluster := config.Clusters[name]
+	_, hasContext := config.Contexts[name]
+	_, hasUser := config.AuthInfos[name]
+	if !hasCluster && !hasContext && !hasUser {
+		return false, nil
+	}
+	delete(config.Clusters, name)
+	delete(config.Contexts, name)
+	delete(config.AuthInfos, name)
+	if config.CurrentContext == name {
+		config.CurrentContext = ""
+	}
+	return true, writeKubeConfig(config, kubeConfigPath)
+}
+
+// kubeConfigMergeTimeout limits how long create waits for k3s to write the kubeconfig of a new cluster to merge it
+const kubeConfigMergeTimeout = 2 * time.Minute
+
+// mergedKubeConfigLock serializes the updates of the merged kubeconfig by clusters created in parallel (--count)
+var mergedKubeConfigLock sync.Mutex
+
+// mergeNewClusterKubeConfig merges the context of a new cluster into the default kubeconfig and optionally makes it
+// the current context. Without --wait k3s may not have written the kubeconfig yet, so it's retried for a while.
+func mergeNewClusterKubeConfig(name string, switchContext bool) error {
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[name]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, name)
+	}
+
+	ctx, cancel := newWaitContext(kubeConfigMergeTimeout)
+	defer cancel()
+	var config *clientcmdapi.Config
+	for {
+		if config, err = refreshClusterKubeConfig(cl); err == nil {
+			break
+		}
+		logDebugf("kubeconfig of cluster %s isn't available yet: %+v", name, err)
+		if sleepContext(ctx, readinessPollInterval) != nil {
+			return fmt.Errorf("ERROR: the kubeconfig of cluster %s wasn't available within %s\n%w", name, kubeConfigMergeTimeout, err)
+		}
+	}
+
+	kubeConfigPath, err := getDefaultKubeConfigPath()
+	if err != nil {
+		return err
+	}
+	mergedKubeConfigLock.Lock()
+	defer mergedKubeConfigLock.Unlock()
+	merged, err := loadKubeConfig(kubeConfigPath)
+	if err != nil {
+		return err
+	}
+	if err := mergeClusterKubeConfig(merged, config, name); err != nil {
+		return err
+	}
+	if switchContext {
+		if err := switchKubeConfigContext(merged, kubeConfigContextName(name)); err != nil {
+			return err
+		}
+	}
+	if err := writeKubeConfig(merged, kubeConfigPath); err != nil {
+		return err
+	}
+	if switchContext {
+		log.Printf("Merged context %s into %s and switched to it", kubeConfigContextName(name), kubeConfigPath)
+	} else {
+		log.Printf("Merged context %s into %s", kubeConfigContextName(name), kubeConfigPath)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package run
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const k3sKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: default
+  cluster:
+    server: https://127.0.0.1:6443
+    certificate-authority-data: Q0E=
+contexts:
+- name: default
+  context:
+    cluster: default
+    user: default
+current-context: default
+users:
+- name: default
+  user:
+    client-certificate-data: Q0VSVA==
+    client-key-data: S0VZ
+`
+
+const userKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: eks
+  cluster:
+    server: https://eks.example.com
+contexts:
+- name: eks
+  context:
+    cluster: eks
+    user: eks
+current-context: eks
+users:
+- name: eks
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: aws
+      args: [eks, get-token]
+`
+
+// merging and removing the entries of a cluster keeps the other entries of the kubeconfig intact
+func TestMergeAndRemoveClusterKubeConfig(t *testing.T) {
+	kubeConfigPath := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(kubeConfigPath, []byte(userKubeConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	src, err := clientcmd.Load([]byte(k3sKubeConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setKubeConfigServerPort(src, 6550); err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := loadKubeConfig(kubeConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mergeClusterKubeConfig(merged, src, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKubeConfig(merged, kubeConfigPath); err != nil {
+		t.Fatal(err)
+	}
+
+	name := kubeConfigContextName("dev")
+	merged, err = loadKubeConfig(kubeConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := merged.Clusters[name]; got == nil || got.Server != "https://127.0.0.1:6550" {
+		t.Errorf("merged cluster %s = %+v, want server https://127.0.0.1:6550", name, got)
+	}
+	if context := merged.Contexts[name]; context == nil || context.Cluster != name || context.AuthInfo != name {
+		t.Errorf("merged context %s = %+v, want cluster and user %s", name, context, name)
+	}
+	if user := merged.AuthInfos["eks"]; user == nil || user.Exec == nil || user.Exec.Command != "aws" {
+		t.Errorf("exec user eks = %+v, want it to be kept", user)
+	}
+	if merged.CurrentContext != "eks" {
+		t.Errorf("current context = %s, want eks", merged.CurrentContext)
+	}
+
+	removed, err := removeMergedKubeConfig(kubeConfigPath, "dev")
+	if err != nil || !removed {
+		t.Fatalf("removeMergedKubeConfig() = %t, %v, want true", removed, err)
+	}
+	merged, err = loadKubeConfig(kubeConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := merged.Contexts[name]; ok {
+		t.Errorf("context %s is still in the kubeconfig", name)
+	}
+	if user := merged.AuthInfos["eks"]; user == nil || user.Exec == nil {
+		t.Errorf("exec user eks = %+v, want it to be kept", user)
+	}
+}
@@ -0,0 +1,55 @@
+package run
+
+/*
+ * The functions in this file run kubectl against a cluster (`k3d kubectl`), with the kubeconfig of the cluster
+ * instead of the one of the user.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/urfave/cli"
+)
+
+// Kubectl runs kubectl against a cluster without the need to export KUBECONFIG first:
+// `k3d kubectl [cluster] -- <kubectl args>`
+func Kubectl(c *cli.Context) error {
+	args := c.Args()
+	cluster := DefaultK3sClusterName
+	if len(args) > 0 && args[0] != "--" {
+		cluster, args = args[0], args[1:]
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+
+	kubectlPath, err := exec.LookPath("kubectl")
+	if err != nil {
+		return fmt.Errorf("ERROR: kubectl not found in PATH\n%w", err)
+	}
+
+	// fetches the kubeconfig from the cluster if it wasn't written yet
+	kubeConfigPath, err := getKubeConfig(cluster)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(kubectlPath, args...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("KUBECONFIG=%s", kubeConfigPath))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		// pass on kubectl's exit code, it already printed its error
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return cli.NewExitError("", exitErr.ExitCode())
+		}
+		return fmt.Errorf("ERROR: couldn't run kubectl\n%w", err)
+	}
+	return nil
+}
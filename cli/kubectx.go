@@ -0,0 +1,147 @@
+package run
+
+/*
+ * The functions in this file switch the current kubectl context (`k3d ctx`),
+ * sharing the previous context with kubectx so that `kubectx -` and `k3d ctx -` are interchangeable.
+ */
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// getPreviousContextPath returns the file kubectx stores the previous context in:
+// $XDG_CACHE_HOME/kubectx or $HOME/.kube/kubectx
+func getPreviousContextPath() (string, error) {
+	if cacheDir := os.Getenv("XDG_CACHE_HOME"); cacheDir != "" {
+		return path.Join(cacheDir, "kubectx"), nil
+	}
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("ERROR: Couldn't get user's home directory\n%w", err)
+	}
+	return path.Join(homeDir, ".kube", "kubectx"), nil
+}
+
+// readPreviousContext returns the previous context, empty if there is none
+func readPreviousContext() (string, error) {
+	previousPath, err := getPreviousContextPath()
+	if err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(previousPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("ERROR: couldn't read previous context from %s\n%w", previousPath, err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// writePreviousContext remembers the context that was current before switching
+func writePreviousContext(context string) error {
+	previousPath, err := getPreviousContextPath()
+	if err != nil {
+		return err
+	}
+	if err := createDirIfNotExists(path.Dir(previousPath)); err != nil {
+		return fmt.Errorf("ERROR: couldn't create directory for %s\n%w", previousPath, err)
+	}
+	if err := os.WriteFile(previousPath, []byte(context), 0600); err != nil {
+		return fmt.Errorf("ERROR: couldn't write previous context to %s\n%w", previousPath, err)
+	}
+	return nil
+}
+
+// switchKubeConfigContext sets the current context of a kubeconfig and remembers the previous one
+func switchKubeConfigContext(config *clientcmdapi.Config, context string) error {
+	if config.CurrentContext == context {
+		return nil
+	}
+	if config.CurrentContext != "" {
+		if err := writePreviousContext(config.CurrentContext); err != nil {
+			return err
+		}
+	}
+	config.CurrentContext = context
+	return nil
+}
+
+// hasKubeConfigContext reports whether a kubeconfig contains a context
+func hasKubeConfigContext(config *clientcmdapi.Config, context string) bool {
+	_, ok := config.Contexts[context]
+	return ok
+}
+
+// SwitchContext switches the current kubectl context: `k3d ctx [cluster|-]`.
+// The context of a cluster is merged into the kubeconfig first if it's missing, `-` switches back to the previous context.
+// Without arguments, the current context is printed.
+// Like kubectl, it reads all files of $KUBECONFIG and changes the files the entries come from.
+func SwitchContext(c *cli.Context) error {
+	pathOptions := clientcmd.NewDefaultPathOptions()
+	pathOptions.LoadingRules.ExplicitPath = c.String("kubeconfig")
+	kubeConfigPath := pathOptions.GetDefaultFilename()
+	config, err := pathOptions.GetStartingConfig()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't read kubeconfig %s\n%w", kubeConfigPath, err)
+	}
+
+	if c.NArg() == 0 {
+		fmt.Println(config.CurrentContext)
+		return nil
+	}
+
+	context := ""
+	if c.Args().First() == "-" {
+		if context, err = readPreviousContext(); err != nil {
+			return err
+		}
+		if context == "" {
+			return fmt.Errorf("ERROR: no previous context to switch back to")
+		}
+		if !hasKubeConfigContext(config, context) {
+			return fmt.Errorf("ERROR: previous context %s doesn't exist in %s", context, kubeConfigPath)
+		}
+	} else {
+		name := c.Args().First()
+		context = kubeConfigContextName(name)
+		if !hasKubeConfigContext(config, context) {
+			clusters, err := getClusters(false, name)
+			if err != nil {
+				return err
+			}
+			cl, ok := clusters[name]
+			if !ok {
+				return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, name)
+			}
+			if cl.status != "running" {
+				return fmt.Errorf("ERROR: cluster %s is not running (status: %s), its kubeconfig can't be merged", name, cl.status)
+			}
+			clusterConfig, err := refreshClusterKubeConfig(cl)
+			if err != nil {
+				return err
+			}
+			if err := mergeClusterKubeConfig(config, clusterConfig, name); err != nil {
+				return err
+			}
+			logInfof("Merged context %s for cluster %s into %s", context, name, kubeConfigPath)
+		}
+	}
+
+	if err := switchKubeConfigContext(config, context); err != nil {
+		return err
+	}
+	if err := clientcmd.ModifyConfig(pathOptions, *config, true); err != nil {
+		return fmt.Errorf("ERROR: couldn't write kubeconfig %s\n%w", kubeConfigPath, err)
+	}
+	logSuccessf("Switched to context %s", context)
+	return nil
+}
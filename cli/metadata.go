@@ -0,0 +1,109 @@
+package run
+
+/*
+ * The functions in this file maintain the cluster.json metadata file in the cluster directory,
+ * which tools can watch instead of querying docker.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/docker/docker/api/types"
+)
+
+const clusterMetadataFileName = "cluster.json"
+
+// clusterMetadata is the content of cluster.json
+type clusterMetadata struct {
+	Name        string            `json:"name"`
+	Created     string            `json:"created"`
+	Updated     string            `json:"updated"`
+	Image       string            `json:"image"`
+	APIEndpoint string            `json:"apiEndpoint"`
+	Network     string            `json:"network"`
+	Nodes       []nodeMetadata    `json:"nodes"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// nodeMetadata describes a node container of a cluster in cluster.json
+type nodeMetadata struct {
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+	ID    string `json:"id"`
+	Image string `json:"image"`
+}
+
+// newNodeMetadata returns the metadata of a node container
+func newNodeMetadata(c types.Container) nodeMetadata {
+	return nodeMetadata{
+		Name:  getContainerShortName(c),
+		Role:  c.Labels["component"],
+		ID:    c.ID,
+		Image: c.Image,
+	}
+}
+
+// getClusterMetadataPath returns the path of cluster.json in the cluster directory
+func getClusterMetadataPath(cluster string) (string, error) {
+	clusterDir, err := getClusterDir(cluster)
+	return path.Join(clusterDir, clusterMetadataFileName), err
+}
+
+// writeClusterMetadata (re)writes cluster.json from the current state of the cluster's containers.
+// The file is replaced atomically, so watchers never see a partially written file.
+func writeClusterMetadata(name string) error {
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[name]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, name)
+	}
+
+	metadata := clusterMetadata{
+		Name:        cl.name,
+		Created:     cl.server.Labels["created"],
+		Updated:     labelTimestamp(),
+		Image:       cl.image,
+		APIEndpoint: getClusterAPIEndpoint(cl),
+		Network:     getClusterNetworkName(cl.name),
+		Nodes:       []nodeMetadata{newNodeMetadata(cl.server)},
+		Labels:      map[string]string{},
+	}
+	workers := append([]types.Container{}, cl.workers...)
+	sort.Slice(workers, func(i, j int) bool {
+		return getContainerShortName(workers[i]) < getContainerShortName(workers[j])
+	})
+	for _, worker := range workers {
+		metadata.Nodes = append(metadata.Nodes, newNodeMetadata(worker))
+	}
+	// the labels shared by all nodes of the cluster, the node specific ones are left out
+	for _, key := range []string{"app", "prefix", "cluster", "apiPort", "apiServerAddress", "nodeNameTemplate", groupLabel, protectedLabel, ttlLabel} {
+		if value, ok := cl.server.Labels[key]; ok {
+			metadata.Labels[key] = value
+		}
+	}
+
+	content, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't serialize cluster metadata\n%w", err)
+	}
+
+	metadataPath, err := getClusterMetadataPath(name)
+	if err != nil {
+		return err
+	}
+	tmpPath := metadataPath + ".tmp"
+	if err := os.WriteFile(tmpPath, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("ERROR: couldn't write cluster metadata %s\n%w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, metadataPath); err != nil {
+		return fmt.Errorf("ERROR: couldn't write cluster metadata %s\n%w", metadataPath, err)
+	}
+	return nil
+}
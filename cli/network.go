@@ -3,49 +3,223 @@ package run
 import (
 	"context"
 	"fmt"
-	"log"
+	"net"
+	"strings"
 
-	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 )
 
+// networkDrivers are the docker network drivers a cluster network can be created with,
+// macvlan and ipvlan make the nodes reachable on the physical LAN
+var networkDrivers = []string{"bridge", "macvlan", "ipvlan"}
+
+// lanNetworkDriver reports whether the nodes of a network with the given driver get addresses on the LAN of the parent interface
+func lanNetworkDriver(driver string) bool {
+	return driver == "macvlan" || driver == "ipvlan"
+}
+
+// networkDriver returns the driver of the cluster network
+func (s *clusterSpec) networkDriver() string {
+	if s.NetworkDriver == "" {
+		return "bridge"
+	}
+	return s.NetworkDriver
+}
+
+// networkOptions returns the driver options of the cluster network as a map
+func (s *clusterSpec) networkOptions() map[string]string {
+	options := map[string]string{}
+	for _, option := range s.NetworkOptions {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) == 2 {
+			options[kv[0]] = kv[1]
+		}
+	}
+	return options
+}
+
+// validateNetworkDriver checks the driver, the driver options, the subnet and the gateway of the cluster network
+func (s *clusterSpec) validateNetworkDriver() error {
+	driver := s.networkDriver()
+	if !containsString(networkDrivers, driver) {
+		return fmt.Errorf("ERROR: unsupported network driver [%s], use one of %s", driver, strings.Join(networkDrivers, ", "))
+	}
+	for _, option := range s.NetworkOptions {
+		if kv := strings.SplitN(option, "=", 2); len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("ERROR: invalid network option [%s], expected key=value (e.g. parent=eth0)", option)
+		}
+	}
+
+	var subnet *net.IPNet
+	if s.NetworkSubnet != "" {
+		_, ipNet, err := net.ParseCIDR(s.NetworkSubnet)
+		if err != nil {
+			return fmt.Errorf("ERROR: invalid network subnet [%s]\n%w", s.NetworkSubnet, err)
+		}
+		subnet = ipNet
+	}
+	if s.NetworkGateway != "" {
+		gateway := net.ParseIP(s.NetworkGateway)
+		if gateway == nil {
+			return fmt.Errorf("ERROR: invalid network gateway IP [%s]", s.NetworkGateway)
+		}
+		if subnet == nil {
+			return fmt.Errorf("ERROR: the network gateway requires a network subnet")
+		}
+		if !subnet.Contains(gateway) {
+			return fmt.Errorf("ERROR: network gateway %s is not part of the network subnet %s", s.NetworkGateway, s.NetworkSubnet)
+		}
+	}
+
+	if lanNetworkDriver(driver) {
+		// without a parent interface and the subnet of the LAN, docker would create an isolated network
+		if s.networkOptions()["parent"] == "" {
+			return fmt.Errorf("ERROR: the %s network driver requires the host interface attached to the LAN, e.g. --network-opt parent=eth0", driver)
+		}
+		if subnet == nil {
+			return fmt.Errorf("ERROR: the %s network driver requires the subnet of the LAN, e.g. --network-subnet 192.168.1.0/24", driver)
+		}
+	}
+	return nil
+}
+
+// checkNetworkDriverSupport checks that the docker daemon has the network driver of a cluster,
+// e.g. macvlan isn't available with rootless docker
+func checkNetworkDriverSupport(ctx context.Context, docker *client.Client, driver string) error {
+	logDebugf("Info")
+	info, err := docker.Info(ctx)
+	if err != nil {
+		return checkDockerError(fmt.Errorf("ERROR: couldn't get docker info\n%w", err))
+	}
+	if !containsString(info.Plugins.Network, driver) {
+		return fmt.Errorf("ERROR: the docker daemon doesn't support the %s network driver (available: %s)", driver, strings.Join(info.Plugins.Network, ", "))
+	}
+	if lanNetworkDriver(driver) && strings.Contains(info.OperatingSystem, "Docker Desktop") {
+		logWarningf("Docker Desktop runs containers in a VM, nodes on a %s network are only reachable on the network of the VM, not on your LAN", driver)
+	}
+	return nil
+}
+
+// isK3dNetwork checks whether a network was created by k3d for the given cluster
+func isK3dNetwork(network types.NetworkResource, clusterName string) bool {
+	return network.Labels["app"] == "k3d" && network.Labels["cluster"] == clusterName && hasContainerNamePrefix(network.Labels)
+}
+
+// getNetworkByName returns the network with exactly the given name or nil if there is none.
+// The docker name filter matches substrings, so we have to double check the results.
+func getNetworkByName(ctx context.Context, docker *client.Client, name string) (*types.NetworkResource, error) {
+	filters := filters.NewArgs()
+	filters.Add("name", name)
+
+	networkList, err := docker.NetworkList(ctx, types.NetworkListOptions{Filters: filters})
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Failed to list networks\n%w", err)
+	}
+
+	for _, network := range networkList {
+		if network.Name == name {
+			return &network, nil
+		}
+	}
+	return nil, nil
+}
+
 // createClusterNetwork creates a docker network for a cluster that will be used
 // to let the server and worker containers communicate with each other easily.
-func createClusterNetwork(clusterName string) (string, error) {
+// An existing k3d network for the same cluster (e.g. a leftover of a failed deletion) is reused,
+// or recreated if forceNetwork is set. A non-k3d network with the same name is never touched.
+func createClusterNetwork(spec *clusterSpec, forceNetwork bool) (string, error) {
+	clusterName := spec.Name
+	driver := spec.networkDriver()
 	ctx := context.Background()
-	docker, err := client.NewClientWithOpts()
+	docker, err := newDockerClient()
 	if err != nil {
-		return "", fmt.Errorf("ERROR: couldn't create docker client\n%+v", err)
+		return "", fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
 	}
 
 	// Using filters to narrow down the search criteria when listing Docker objects
 	filters := filters.NewArgs()
 	filters.Add("label", "app=k3d")
 	filters.Add("label", "cluster="+clusterName)
+	addPrefixFilter(filters)
 
 	// retrieve a list of Docker networks with given filters
-	networkList, err := docker.NetworkList(ctx, types.NetworkListOptions{Filters: filters})
+	logDebugf("NetworkList filters=%s", filtersString(filters))
+	networks, err := docker.NetworkList(ctx, types.NetworkListOptions{Filters: filters})
 	if err != nil {
-		return "", fmt.Errorf("ERROR: Failed to list networks\n%+v", err)
+		return "", checkDockerError(fmt.Errorf("ERROR: Failed to list networks\n%w", err))
+	}
+	networkList := []types.NetworkResource{}
+	for _, network := range networks {
+		if hasContainerNamePrefix(network.Labels) {
+			networkList = append(networkList, network)
+		}
 	}
 	if len(networkList) > 1 {
-		log.Printf("WARNING: Found %d networks for %s when we only expect 1\n", len(networkList), clusterName)
+		logWarningf("Found %d networks for %s when we only expect 1\n", len(networkList), clusterName)
 	}
-	if len(networkList) > 0 {
-		return networkList[0].ID, nil
+
+	// a network with the cluster name may exist without carrying our labels
+	networkName := getClusterNetworkName(clusterName)
+	existing, err := getNetworkByName(ctx, docker, networkName)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil && !isK3dNetwork(*existing, clusterName) {
+		return "", fmt.Errorf("ERROR: A network named [%s] already exists but was not created by k3d. Please remove it or choose a different cluster name", networkName)
 	}
 
+	if len(networkList) > 0 {
+		if !forceNetwork {
+			if networkList[0].Driver != driver {
+				return "", fmt.Errorf("ERROR: existing network [%s] for cluster %s uses the %s driver instead of %s, use --force-network to recreate it", networkList[0].Name, clusterName, networkList[0].Driver, driver)
+			}
+			logInfof("Reusing existing network [%s] (ID %s) for cluster %s", networkList[0].Name, networkList[0].ID, clusterName)
+			return networkList[0].ID, nil
+		}
 
-	// create the network with a set of labels and the cluster name as network name
-	resp, err := docker.NetworkCreate(ctx, clusterName, types.NetworkCreate{
+		// --force-network: throw away the leftover network(s) and start from scratch
+		for _, network := range networkList {
+			logInfof("Removing existing network [%s] (ID %s) for cluster %s", network.Name, network.ID, clusterName)
+			if err := docker.NetworkRemove(ctx, network.ID); err != nil {
+				return "", fmt.Errorf("ERROR: couldn't remove existing network [%s] for cluster %s (are there still containers attached?)\n%w", network.Name, clusterName, err)
+			}
+		}
+	}
+
+	if err := checkNetworkDriverSupport(ctx, docker, driver); err != nil {
+		return "", err
+	}
+	networkCreate := types.NetworkCreate{
+		Driver:  driver,
+		Options: spec.networkOptions(),
 		Labels: map[string]string{
 			"app":     "k3d",
+			"prefix":  containerNamePrefix,
 			"cluster": clusterName,
 		},
-	})
+	}
+	if spec.NetworkSubnet != "" {
+		networkCreate.IPAM = &network.IPAM{
+			Config: []network.IPAMConfig{{Subnet: spec.NetworkSubnet, Gateway: spec.NetworkGateway}},
+		}
+	}
+
+	// create the network with a set of labels and the cluster name as network name
+	logDebugf("NetworkCreate %s driver=%s options=%v", networkName, driver, networkCreate.Options)
+	resp, err := docker.NetworkCreate(ctx, networkName, networkCreate)
 	if err != nil {
-		return "", fmt.Errorf("ERROR: couldn't create network\n%+v", err)
+		if lanNetworkDriver(driver) {
+			return "", fmt.Errorf("ERROR: couldn't create %s network (does the parent interface %s exist on the docker host and is the subnet %s free?)\n%w", driver, spec.networkOptions()["parent"], spec.NetworkSubnet, err)
+		}
+		return "", fmt.Errorf("ERROR: couldn't create network\n%w", err)
+	}
+	logDebugf("Created network [%s] with ID %s", networkName, resp.ID)
+	if lanNetworkDriver(driver) {
+		logWarningf("nodes on the %s network get addresses of %s, make sure they aren't handed out by the DHCP server of your LAN. The docker host itself can't reach them by design of %s.", driver, spec.NetworkSubnet, driver)
 	}
 
 	return resp.ID, nil
@@ -54,28 +228,90 @@ func createClusterNetwork(clusterName string) (string, error) {
 // deleteClusterNetwork deletes a docker network based on the name of a cluster it belongs to
 func deleteClusterNetwork(clusterName string) error {
 	ctx := context.Background()
-	docker, err := client.NewClientWithOpts()
+	docker, err := newDockerClient()
 	if err != nil {
-		return fmt.Errorf("ERROR: couldn't create docker client\n%+v", err)
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
 	}
 
 	filters := filters.NewArgs()
 	filters.Add("label", "app=k3d")
 	filters.Add("label", fmt.Sprintf("cluster=%s", clusterName))
+	addPrefixFilter(filters)
 
 	networks, err := docker.NetworkList(ctx, types.NetworkListOptions{
 		Filters: filters,
 	})
 	if err != nil {
-		return fmt.Errorf("ERROR: couldn't find network for cluster %s\n%+v", clusterName, err)
+		return fmt.Errorf("ERROR: couldn't find network for cluster %s\n%w", clusterName, err)
 	}
 
 	// there should be only one network that matches the name... but who knows?
 	for _, network := range networks {
+		if !hasContainerNamePrefix(network.Labels) {
+			continue
+		}
+		logDebugf("NetworkRemove %s (ID %s)", network.Name, network.ID)
 		if err := docker.NetworkRemove(ctx, network.ID); err != nil {
-			log.Printf("WARNING: couldn't remove network for cluster %s\n%+v", clusterName, err)
+			logWarningf("couldn't remove network for cluster %s\n%+v", clusterName, err)
 			continue
 		}
 	}
 	return nil
 }
+
+// parseCIDRList parses a comma separated list of CIDRs, e.g. an IPv4 and an IPv6 network for dual-stack
+func parseCIDRList(cidrs string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, cidr := range strings.Split(cidrs, ",") {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: invalid CIDR [%s]\n%w", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// findOverlappingCIDRs returns the first pair of overlapping networks of two lists, or nil if none overlap
+func findOverlappingCIDRs(a, b []*net.IPNet) (*net.IPNet, *net.IPNet) {
+	for _, x := range a {
+		for _, y := range b {
+			if x.Contains(y.IP) || y.Contains(x.IP) {
+				return x, y
+			}
+		}
+	}
+	return nil, nil
+}
+
+// checkNetworkSubnetOverlap checks that the subnets of a docker network don't overlap with the given Kubernetes networks,
+// otherwise the nodes couldn't reach each other or pods and services would be unreachable
+func checkNetworkSubnetOverlap(networkID string, cidrs ...string) error {
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+	logDebugf("NetworkInspect %s", networkID)
+	network, err := docker.NetworkInspect(ctx, networkID, types.NetworkInspectOptions{})
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't inspect network %s\n%w", networkID, err)
+	}
+
+	subnets := []*net.IPNet{}
+	for _, config := range network.IPAM.Config {
+		if _, subnet, err := net.ParseCIDR(config.Subnet); err == nil {
+			subnets = append(subnets, subnet)
+		}
+	}
+	for _, cidr := range cidrs {
+		nets, err := parseCIDRList(cidr)
+		if err != nil {
+			return err
+		}
+		if a, b := findOverlappingCIDRs(nets, subnets); a != nil {
+			return fmt.Errorf("ERROR: CIDR %s overlaps with the subnet %s of docker network %s, choose a different --cluster-cidr or --service-cidr", a, b, network.Name)
+		}
+	}
+	return nil
+}
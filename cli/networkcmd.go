@@ -0,0 +1,171 @@
+package run
+
+/*
+ * The functions in this file implement the `k3d network` commands.
+ */
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/olekukonko/tablewriter"
+	"github.com/urfave/cli"
+)
+
+// getK3dNetworks returns all networks created by k3d with the current prefix, sorted by name
+func getK3dNetworks(ctx context.Context, docker *client.Client) ([]types.NetworkResource, error) {
+	filters := filters.NewArgs()
+	filters.Add("label", "app=k3d")
+	addPrefixFilter(filters)
+
+	logDebugf("NetworkList filters=%s", filtersString(filters))
+	networkList, err := docker.NetworkList(ctx, types.NetworkListOptions{Filters: filters})
+	if err != nil {
+		return nil, checkDockerError(fmt.Errorf("ERROR: Failed to list networks\n%w", err))
+	}
+
+	networks := []types.NetworkResource{}
+	for _, network := range networkList {
+		if hasContainerNamePrefix(network.Labels) {
+			networks = append(networks, network)
+		}
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Name < networks[j].Name })
+	return networks, nil
+}
+
+// getClusterNetwork returns the inspected network of a cluster, which may be given by cluster or network name
+func getClusterNetwork(ctx context.Context, docker *client.Client, name string) (types.NetworkResource, error) {
+	networks, err := getK3dNetworks(ctx, docker)
+	if err != nil {
+		return types.NetworkResource{}, err
+	}
+	for _, network := range networks {
+		if network.Labels["cluster"] == name || network.Name == name {
+			logDebugf("NetworkInspect %s", network.ID)
+			inspect, err := docker.NetworkInspect(ctx, network.ID, types.NetworkInspectOptions{})
+			if err != nil {
+				return types.NetworkResource{}, fmt.Errorf("ERROR: couldn't inspect network %s\n%w", network.Name, err)
+			}
+			return inspect, nil
+		}
+	}
+	return types.NetworkResource{}, fmt.Errorf("ERROR: %w: no network for cluster %s", ErrClusterNotFound, name)
+}
+
+// getNetworkSubnets returns the subnets of a network as comma separated list
+func getNetworkSubnets(network types.NetworkResource) string {
+	subnets := []string{}
+	for _, config := range network.IPAM.Config {
+		subnets = append(subnets, config.Subnet)
+	}
+	if len(subnets) == 0 {
+		return "-"
+	}
+	return strings.Join(subnets, ",")
+}
+
+// ListNetworks prints the networks created by k3d
+func ListNetworks(c *cli.Context) error {
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	networks, err := getK3dNetworks(ctx, docker)
+	if err != nil {
+		return err
+	}
+	if len(networks) == 0 {
+		fmt.Println("No k3d networks found!")
+		return nil
+	}
+
+	table := newTable([]string{"NAME", "CLUSTER", "DRIVER", "SUBNET", "CONTAINERS"})
+	for _, network := range networks {
+		// the network list doesn't contain the attached containers
+		containers := "-"
+		logDebugf("NetworkInspect %s", network.ID)
+		if inspect, err := docker.NetworkInspect(ctx, network.ID, types.NetworkInspectOptions{}); err == nil {
+			containers = fmt.Sprintf("%d", len(inspect.Containers))
+		}
+		table.Append([]string{network.Name, network.Labels["cluster"], network.Driver, getNetworkSubnets(network), containers})
+	}
+	table.Render()
+	return nil
+}
+
+// InspectNetwork prints the details of a cluster network: `k3d network inspect <cluster>`
+func InspectNetwork(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("ERROR: please specify exactly one cluster or network name")
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	network, err := getClusterNetwork(ctx, docker, c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Name:    %s\n", network.Name)
+	fmt.Printf("ID:      %s\n", network.ID)
+	fmt.Printf("Cluster: %s\n", network.Labels["cluster"])
+	fmt.Printf("Driver:  %s\n", network.Driver)
+	for _, config := range network.IPAM.Config {
+		fmt.Printf("Subnet:  %s (gateway %s)\n", config.Subnet, config.Gateway)
+	}
+
+	containers := make([]types.EndpointResource, 0, len(network.Containers))
+	for _, endpoint := range network.Containers {
+		containers = append(containers, endpoint)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].Name < containers[j].Name })
+
+	fmt.Println("Containers:")
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"NAME", "IPV4", "IPV6"})
+	for _, endpoint := range containers {
+		table.Append([]string{endpoint.Name, endpoint.IPv4Address, endpoint.IPv6Address})
+	}
+	table.Render()
+	return nil
+}
+
+// ConnectNetwork attaches an arbitrary container to the network of a cluster:
+// `k3d network connect <cluster> <container>`
+func ConnectNetwork(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("ERROR: please specify a cluster and a container")
+	}
+	clusterName, containerName := c.Args().Get(0), c.Args().Get(1)
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	network, err := getClusterNetwork(ctx, docker, clusterName)
+	if err != nil {
+		return err
+	}
+
+	logDebugf("NetworkConnect %s %s", network.ID, containerName)
+	if err := docker.NetworkConnect(ctx, network.ID, containerName, nil); err != nil {
+		return fmt.Errorf("ERROR: couldn't connect container %s to network %s\n%w", containerName, network.Name, err)
+	}
+	fmt.Printf("Connected container %s to network %s of cluster %s\n", containerName, network.Name, network.Labels["cluster"])
+	return nil
+}
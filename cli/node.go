@@ -0,0 +1,199 @@
+package run
+
+/*
+ * The functions in this file add nodes to existing clusters,
+ * either k3d clusters or external k3s servers.
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// getStoredClusterSpec returns the spec a cluster was created with.
+// For clusters created before specs were stored, a minimal spec is derived from the server container.
+func getStoredClusterSpec(cl cluster) (*clusterSpec, error) {
+	specPath, err := getClusterSpecPath(cl.name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(specPath); err == nil {
+		return loadClusterSpec(specPath)
+	}
+
+	logDebugf("no stored spec for cluster %s, deriving it from the server container", cl.name)
+	spec := &clusterSpec{
+		Name:    cl.name,
+		Image:   cl.image,
+		Workers: len(cl.workers),
+
+		NodeNameTemplate: cl.server.Labels["nodeNameTemplate"],
+		Group:            cl.server.Labels[groupLabel],
+		Protected:        isProtected(cl),
+		TTL:              cl.server.Labels[ttlLabel],
+		EnvPassthrough:   getEnvPassthrough(cl.server.Labels),
+	}
+	if apiPort, err := strconv.Atoi(cl.server.Labels["apiPort"]); err == nil {
+		spec.APIPort = apiPort
+	}
+	if ports := cl.server.Labels[portSpecsLabel]; ports != "" {
+		spec.Ports = strings.Split(ports, portSpecsLabelSeparator)
+	} else if ports := cl.server.Labels[portsLabel]; ports != "" {
+		spec.Ports = strings.Split(ports, ",")
+	}
+	if offset, err := strconv.Atoi(cl.server.Labels[portAutoOffsetLabel]); err == nil {
+		spec.PortAutoOffset = offset
+	}
+	spec.setDefaults()
+	return spec, nil
+}
+
+// addClusterWorkers adds count workers to a k3d cluster, using the lowest free indices
+func addClusterWorkers(cl cluster, count int) error {
+	if err := checkNotAdopted(cl); err != nil {
+		return err
+	}
+	spec, err := getStoredClusterSpec(cl)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	tokenEnv, err := getClusterTokenEnv(ctx, docker, cl.server)
+	if err != nil {
+		return err
+	}
+
+	used := map[int]bool{}
+	for _, worker := range cl.workers {
+		if index, err := getWorkerIndex(worker); err == nil {
+			used[index] = true
+		}
+	}
+
+	spec.Workers = len(cl.workers) + count
+	portmap, err := mapNodesToPortSpecs(spec.Ports, GetAllContainerNames(spec.Name, defaultServerCount, spec.Workers))
+	if err != nil {
+		return err
+	}
+	if err := spec.checkHostPortConflicts(portmap); err != nil {
+		return err
+	}
+
+	for index, added := 0, 0; added < count; index++ {
+		if used[index] {
+			continue
+		}
+		if ports := portmap[GetContainerName("worker", cl.name, index)]; len(ports) > 0 {
+			log.Printf("Publishing ports %s on worker %s (port auto offset %d)", strings.Join(ports, ", "), GetContainerName("worker", cl.name, index), spec.PortAutoOffset)
+		}
+		workerID, err := createClusterWorker(spec, index, portmap, tokenEnv)
+		if err != nil {
+			return fmt.Errorf("ERROR: failed to create worker node for cluster %s\n%w", cl.name, err)
+		}
+		log.Printf("Created worker %s with ID %s", GetContainerName("worker", cl.name, index), workerID)
+		added++
+	}
+	if err := syncContainerdProxies(spec); err != nil {
+		logWarningf("couldn't expose containerd of the new workers\n%+v", err)
+	}
+
+	if err := writeClusterSpec(spec); err != nil {
+		logWarningf("couldn't store cluster spec\n%+v", err)
+	}
+	if err := writeClusterMetadata(spec.Name); err != nil {
+		logWarningf("couldn't store cluster metadata\n%+v", err)
+	}
+	return nil
+}
+
+// createExternalWorker creates a standalone worker container that joins a k3s server not managed by k3d
+func createExternalWorker(nodeName, image, clusterURL, token string, env []string, volumes []string, networkName string) (string, error) {
+	return createNode(newExternalWorkerNodeSpec(nodeName, image, clusterURL, token, env, volumes, networkName))
+}
+
+// newExternalWorkerNodeSpec returns the spec of a standalone worker joining an external k3s server,
+// it's attached to the given network or docker's default network
+func newExternalWorkerNodeSpec(nodeName, image, clusterURL, token string, env []string, volumes []string, networkName string) nodeSpec {
+	return nodeSpec{
+		role:    "worker",
+		name:    nodeName,
+		network: networkName,
+		image:   image,
+		env:     append(env, fmt.Sprintf("K3S_URL=%s", clusterURL), fmt.Sprintf("K3S_TOKEN=%s", token)),
+		volumes: volumes,
+		labels: map[string]string{
+			"externalJoin": "true",
+			"clusterURL":   clusterURL,
+		},
+	}
+}
+
+// AddNode adds worker nodes to a k3d cluster or joins a standalone worker to an external k3s server
+func AddNode(c *cli.Context) error {
+	if c.Int("count") < 1 {
+		return fmt.Errorf("ERROR: --count must be at least 1")
+	}
+
+	// external join: the node doesn't belong to a k3d cluster
+	if c.IsSet("cluster-url") {
+		u, err := url.Parse(c.String("cluster-url"))
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("ERROR: invalid cluster URL [%s], expected https://<host>:<port>", c.String("cluster-url"))
+		}
+		if c.String("token") == "" {
+			return fmt.Errorf("ERROR: joining an external server requires --token")
+		}
+
+		image, err := normalizeImage(c.String("image"))
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < c.Int("count"); i++ {
+			nodeName := c.String("node-name")
+			if nodeName == "" {
+				nodeName = fmt.Sprintf("%s-external-%s", containerNamePrefix, strings.ToLower(GenerateRandomString(5)))
+			} else if c.Int("count") > 1 {
+				nodeName = fmt.Sprintf("%s-%d", nodeName, i)
+			}
+			if err := ValidateHostname(nodeName); err != nil {
+				return err
+			}
+
+			id, err := createExternalWorker(nodeName, image, c.String("cluster-url"), c.String("token"), c.StringSlice("env"), splitLegacyVolumeSpecs(c.StringSlice("volume")), c.String("network"))
+			if err != nil {
+				return err
+			}
+			logSuccessf("created external worker %s (ID %s) joining %s", nodeName, id, c.String("cluster-url"))
+		}
+		return nil
+	}
+
+	clusters, err := getClusters(false, c.String("name"))
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[c.String("name")]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, c.String("name"))
+	}
+
+	if err := addClusterWorkers(cl, c.Int("count")); err != nil {
+		return err
+	}
+	logSuccessf("added %d worker(s) to cluster [%s]", c.Int("count"), cl.name)
+	return nil
+}
@@ -1,9 +1,11 @@
 package run
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/docker/go-connections/nat"
 )
@@ -24,6 +26,119 @@ var nodeRuleGroupsMap = map[string][]string{
 // defaultNodes describes the type of nodes on which a port should be exposed by default
 const defaultNodes = "server"
 
+// nodeExclusionPrefix negates a node specifier, e.g. @!server targets all nodes but the server
+const nodeExclusionPrefix = "!"
+
+// nodeSpecSeparator separates a value from the node list it applies to, nodeListSeparator the nodes of the list
+const (
+	nodeSpecSeparator = "@"
+	nodeListSeparator = ","
+)
+
+// parseNodeSpec splits a spec of the form <value>[@<node>[,<node>...]] (e.g. 8080:80@server,k3d-dev-worker-0)
+// into the value and its node specifiers, which default to defaultNodes. There's at most one @, the node list
+// must not contain empty entries and duplicate nodes are dropped.
+func parseNodeSpec(spec string) (string, []string, error) {
+	value, nodeList, found := strings.Cut(spec, nodeSpecSeparator)
+	if !found {
+		return value, []string{defaultNodes}, nil
+	}
+	if strings.Contains(nodeList, nodeSpecSeparator) {
+		return "", nil, fmt.Errorf("ERROR: Invalid node list in [%s], use a single @ and separate the nodes with commas (e.g. @server,workers)", spec)
+	}
+	nodes := []string{}
+	for _, node := range strings.Split(nodeList, nodeListSeparator) {
+		if node == "" {
+			return "", nil, fmt.Errorf("ERROR: Invalid node list in [%s], it contains an empty node-specifier", spec)
+		}
+		if !containsString(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return value, nodes, nil
+}
+
+// validPortProtocols are the protocols of port specs, several can be combined with + (e.g. 53:53/udp+tcp)
+var validPortProtocols = []string{"tcp", "udp", "sctp"}
+
+// validateNodeSpecifier checks a node specifier, which is a role or a node name, optionally negated
+func validateNodeSpecifier(node string) error {
+	if node == nodeExclusionPrefix+"all" {
+		return fmt.Errorf("[ERROR] Node-specifier [%s] excludes all nodes", node)
+	}
+	return ValidateHostname(strings.TrimPrefix(node, nodeExclusionPrefix))
+}
+
+// isNodeSpecifier reports whether node (optionally negated) is one of the possible node specifiers
+func isNodeSpecifier(node string, possibleNodeSpecifiers []string) bool {
+	return containsString(possibleNodeSpecifiers, strings.TrimPrefix(node, nodeExclusionPrefix))
+}
+
+// expandPortProtocols expands a port spec with a set of protocols into one port spec per protocol,
+// e.g. 53:53/udp+tcp into 53:53/udp and 53:53/tcp
+func expandPortProtocols(portSpec string) ([]string, error) {
+	slash := strings.LastIndex(portSpec, "/")
+	if slash < 0 {
+		return []string{portSpec}, nil
+	}
+	ports, protocols := portSpec[:slash], portSpec[slash+1:]
+	expanded := []string{}
+	for _, protocol := range strings.Split(protocols, "+") {
+		protocol = strings.ToLower(protocol)
+		if !containsString(validPortProtocols, protocol) {
+			return nil, fmt.Errorf("ERROR: Invalid protocol [%s] in port specification [%s] (supported: %s, combined with +)", protocol, portSpec, strings.Join(validPortProtocols, ", "))
+		}
+		if spec := ports + "/" + protocol; !containsString(expanded, spec) {
+			expanded = append(expanded, spec)
+		}
+	}
+	return expanded, nil
+}
+
+// portSpecsLabel and portAutoOffsetLabel keep the port specs of a cluster on its nodes, separated by
+// portSpecsLabelSeparator, so that workers added later on publish the ports of their role.
+// Clusters created before node lists were supported have the comma separated portsLabel instead.
+const (
+	portSpecsLabel          = "portSpecs"
+	portSpecsLabelSeparator = ";"
+	portsLabel              = "ports"
+	portAutoOffsetLabel     = "portAutoOffset"
+)
+
+// strictNodeSpecifiers makes unknown node specifiers fatal instead of dropping their entries with a warning.
+// It's set once via the global --strict flag.
+var strictNodeSpecifiers bool
+
+// warnedNodeSpecifiers remembers the warnings about unknown node specifiers, specs are mapped to nodes more than once
+var (
+	warnedNodeSpecifiers     = map[string]bool{}
+	warnedNodeSpecifiersLock sync.Mutex
+)
+
+// SetStrict enables or disables strict checking of node specifiers for all commands
+func SetStrict(strict bool) {
+	strictNodeSpecifiers = strict
+}
+
+// unknownNodeSpecifier reports a node specifier that's neither a role nor a node name, suggesting the closest match.
+// It returns an error in strict mode and only logs a warning otherwise.
+func unknownNodeSpecifier(node, kind, entry string, possibleNodeSpecifiers []string) error {
+	msg := fmt.Sprintf("Unknown node-specifier [%s] in %s [%s]", node, kind, entry)
+	if suggestion := closestString(node, possibleNodeSpecifiers); suggestion != "" {
+		msg += fmt.Sprintf(", did you mean [%s]?", suggestion)
+	}
+	if strictNodeSpecifiers {
+		return errors.New("ERROR: " + msg)
+	}
+	warnedNodeSpecifiersLock.Lock()
+	defer warnedNodeSpecifiersLock.Unlock()
+	if !warnedNodeSpecifiers[msg] {
+		warnedNodeSpecifiers[msg] = true
+		logWarningf("%s (ignored, use --strict to fail instead)", msg)
+	}
+	return nil
+}
+
 // mapNodesToPortSpecs maps nodes to portSpecs
 //
 //	 example :
@@ -42,25 +157,26 @@ func mapNodesToPortSpecs(specs []string, createdNodes []string) (map[string][]st
 	nodeToPortSpecMap := make(map[string][]string)
 
 	for _, spec := range specs {
-		nodes, portSpec := extractNodes(spec)
+		portSpec, nodes, err := parseNodeSpec(spec)
+		if err != nil {
+			return nil, err
+		}
 
-		if len(nodes) == 0 {
-			nodes = append(nodes, defaultNodes)
+		// a set of protocols publishes the port once per protocol
+		portSpecs, err := expandPortProtocols(portSpec)
+		if err != nil {
+			return nil, err
 		}
 
 		for _, node := range nodes {
 			// check if node-specifier is valid (either a role or a name) and append to list if matches
-			nodeFound := false
-			for _, name := range possibleNodeSpecifiers {
-				if node == name {
-					nodeFound = true
-					nodeToPortSpecMap[node] = append(nodeToPortSpecMap[node], portSpec)
-					break
+			if !isNodeSpecifier(node, possibleNodeSpecifiers) {
+				if err := unknownNodeSpecifier(node, "port mapping entry", spec, possibleNodeSpecifiers); err != nil {
+					return nil, err
 				}
+				continue
 			}
-			if !nodeFound {
-				log.Printf("WARNING: Unknown node-specifier [%s] in port mapping entry [%s]", node, spec)
-			}
+			nodeToPortSpecMap[node] = append(nodeToPortSpecMap[node], portSpecs...)
 		}
 	}
 
@@ -71,12 +187,12 @@ func mapNodesToPortSpecs(specs []string, createdNodes []string) (map[string][]st
 // creating a PublishedPorts struct based on the provided port specifications
 // Parameters:
 //   - specs []string: A slice of strings representing the port specifications. Each string should follow the format:
-//     <host>:<hostPort>:<containerPort>[/<protocol>][@<node>]
+//     <host>:<hostPort>:<containerPort>[/<protocol>][@<node>[,<node>...]]
 //   - <host> is an optional hostname or IP address.
 //   - <hostPort> is an optional host port number.
 //   - <containerPort> is the container port number.
-//   - <protocol> is an optional protocol (either "udp" or "tcp").
-//   - <node> is an optional node name or role.
+//   - <protocol> is an optional protocol (tcp, udp or sctp), or a set of them (e.g. udp+tcp).
+//   - <node> is an optional node name or role, prefixed with ! to target all other nodes. Several are separated by commas.
 func CreatePublishedPorts(specs []string) (*PublishedPorts, error) {
 	// If no port specifications are provided, it creates a default PublishedPorts with an empty ExposedPorts and PortBindings map.
 	if len(specs) == 0 {
@@ -91,48 +207,121 @@ func CreatePublishedPorts(specs []string) (*PublishedPorts, error) {
 
 // validatePortSpecs matches the provided port specs against a set of rules to enable early exit if something is wrong
 // It checks if the specification matches the following format:
-// <host>:<hostPort>:<containerPort>[/<protocol>][@<node>]*
-// Example ==> specs := []string{"192.168.0.1:8080:80", "3000/tcp", "@node1:8080:80"}
+// <host>:<hostPort>:<containerPort>[/<protocol>[+<protocol>]][@<node>[,<node>...]]
+// Example ==> specs := []string{"192.168.0.1:8080:80", "3000/tcp", "53:53/udp+tcp@server", "8080:80@!server", "80@server,workers"}
 func validatePortSpecs(specs []string) error {
 	for _, spec := range specs {
-		atSplit := strings.Split(spec, "@")
-		_, err := nat.ParsePortSpec(atSplit[0])
+		ports, nodes, err := parseNodeSpec(spec)
 		if err != nil {
-			return fmt.Errorf("ERROR: Invalid port specification [%s] in port mapping [%s]\n%+v", atSplit[0], spec, err)
+			return err
 		}
-		if len(atSplit) > 0 {
-			for i := 1; i < len(atSplit); i++ {
-				if err := ValidateHostname(atSplit[i]); err != nil {
-					return fmt.Errorf("ERROR: Invalid node-specifier [%s] in port mapping [%s]\n%+v", atSplit[i], spec, err)
-				}
+		portSpecs, err := expandPortProtocols(ports)
+		if err != nil {
+			return err
+		}
+		for _, portSpec := range portSpecs {
+			if _, err := nat.ParsePortSpec(portSpec); err != nil {
+				return fmt.Errorf("ERROR: Invalid port specification [%s] in port mapping [%s]\n%w", ports, spec, err)
+			}
+		}
+		for _, node := range nodes {
+			if err := validateNodeSpecifier(node); err != nil {
+				return fmt.Errorf("ERROR: Invalid node-specifier [%s] in port mapping [%s]\n%w", node, spec, err)
 			}
 		}
 	}
 	return nil
 }
 
-// extractNodes separates the node specification from the actual port specs
-// Example:
-//
-//	nodes, portSpec := extractNodes("@node1:8080:80")
-//	// nodes: [node1]
-//	// portSpec: "8080:80"
-//
-//	nodes, portSpec := extractNodes("192.168.0.1:8080:80")
-//	// nodes: [default]
-//	// portSpec: "192.168.0.1:8080:80"
-func extractNodes(spec string) ([]string, string) {
-	// extract nodes
-	nodes := []string{}
-	atSplit := strings.Split(spec, "@")
-	portSpec := atSplit[0]
-	if len(atSplit) > 1 {
-		nodes = atSplit[1:]
+// nodePortSpecs are the port specs a node publishes, offset is applied to their host ports (see PublishedPorts.Offset, 0 = none)
+type nodePortSpecs struct {
+	node   string
+	specs  []string
+	offset int
+}
+
+// hostIPsOverlap reports whether two host IPs of port bindings share an interface, an empty IP or 0.0.0.0 binds all of them
+func hostIPsOverlap(a, b string) bool {
+	return a == b || a == "" || b == "" || a == "0.0.0.0" || b == "0.0.0.0"
+}
+
+// checkHostPortConflicts resolves the host ports published by a set of nodes and reports all host ports
+// bound more than once, together with the conflicting port specs. Docker would only fail at container start otherwise.
+func checkHostPortConflicts(nodes []nodePortSpecs) error {
+	type hostPortBinding struct {
+		node, spec, hostIP string
+	}
+	bindings := map[string][]hostPortBinding{} // [hostPort/protocol -> bindings]
+	for _, n := range nodes {
+		for _, spec := range n.specs {
+			published, err := CreatePublishedPorts([]string{spec})
+			if err != nil {
+				return fmt.Errorf("ERROR: Invalid port specification [%s]\n%w", spec, err)
+			}
+			if n.offset > 0 {
+				published = published.Offset(n.offset)
+			}
+			for port, portBindings := range published.PortBindings {
+				for _, binding := range portBindings {
+					// random host ports can't conflict
+					if binding.HostPort == "" {
+						continue
+					}
+					key := fmt.Sprintf("%s/%s", binding.HostPort, port.Proto())
+					bindings[key] = append(bindings[key], hostPortBinding{node: n.node, spec: spec, hostIP: binding.HostIP})
+				}
+			}
+		}
 	}
-	if len(nodes) == 0 {
-		nodes = append(nodes, defaultNodes)
+
+	conflicts := []string{}
+	for key, b := range bindings {
+		conflicting := map[string]bool{}
+		for i := range b {
+			for j := i + 1; j < len(b); j++ {
+				if hostIPsOverlap(b[i].hostIP, b[j].hostIP) && (b[i].node != b[j].node || b[i].spec != b[j].spec) {
+					conflicting[fmt.Sprintf("%s@%s", b[i].spec, b[i].node)] = true
+					conflicting[fmt.Sprintf("%s@%s", b[j].spec, b[j].node)] = true
+				}
+			}
+		}
+		if len(conflicting) > 0 {
+			specs := []string{}
+			for spec := range conflicting {
+				specs = append(specs, spec)
+			}
+			sort.Strings(specs)
+			conflicts = append(conflicts, fmt.Sprintf("host port %s is published more than once: %s", key, strings.Join(specs, ", ")))
+		}
 	}
-	return nodes, portSpec
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("ERROR: conflicting port mappings\n%s", strings.Join(conflicts, "\n"))
+	}
+	return nil
+}
+
+// mapNodesToSpecs maps node specifiers (roles or node names) to the specs of the given kind (e.g. taint) that apply to them
+func mapNodesToSpecs(kind string, specs []string, createdNodes []string) (map[string][]string, error) {
+	possibleNodeSpecifiers := append([]string{"all", "workers", "server", "master"}, createdNodes...)
+
+	nodeToSpecMap := make(map[string][]string)
+	for _, spec := range specs {
+		value, nodes, err := parseNodeSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			if !isNodeSpecifier(node, possibleNodeSpecifiers) {
+				if err := unknownNodeSpecifier(node, kind, spec, possibleNodeSpecifiers); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			nodeToSpecMap[node] = append(nodeToSpecMap[node], value)
+		}
+	}
+	return nodeToSpecMap, nil
 }
 
 // Offset creates a new PublishedPort structure, with all host ports are changed by a fixed  'offset'
@@ -216,6 +405,26 @@ func MergePortSpecs(nodeToPortSpecMap map[string][]string, role, name string) ([
 		}
 	}
 
+	// add portSpecs of negated node specifiers which match neither a group of the role nor the node name
+	excluded := []string{}
+	for node := range nodeToPortSpecMap {
+		if strings.HasPrefix(node, nodeExclusionPrefix) {
+			excluded = append(excluded, node)
+		}
+	}
+	sort.Strings(excluded)
+	for _, node := range excluded {
+		target := strings.TrimPrefix(node, nodeExclusionPrefix)
+		if target == name || containsString(nodeRuleGroupsMap[role], target) {
+			continue
+		}
+		for _, v := range nodeToPortSpecMap[node] {
+			if !containsString(portSpecs, v) {
+				portSpecs = append(portSpecs, v)
+			}
+		}
+	}
+
 	// add portSpecs according to node name
 	for _, v := range nodeToPortSpecMap[name] {
 		exists := false
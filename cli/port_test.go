@@ -0,0 +1,251 @@
+package run
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandPortProtocols(t *testing.T) {
+	tests := []struct {
+		portSpec string
+		want     []string
+		wantErr  bool
+	}{
+		{portSpec: "8080:80", want: []string{"8080:80"}},
+		{portSpec: "8080:80/tcp", want: []string{"8080:80/tcp"}},
+		{portSpec: "53:53/udp+tcp", want: []string{"53:53/udp", "53:53/tcp"}},
+		{portSpec: "53:53/UDP+tcp", want: []string{"53:53/udp", "53:53/tcp"}},
+		{portSpec: "53:53/udp+udp", want: []string{"53:53/udp"}},
+		{portSpec: "53:53/udp+tcp+udp", want: []string{"53:53/udp", "53:53/tcp"}},
+		{portSpec: "127.0.0.1:53:53/sctp", want: []string{"127.0.0.1:53:53/sctp"}},
+		{portSpec: "53:53/icmp", wantErr: true},
+		{portSpec: "53:53/udp+icmp", wantErr: true},
+		{portSpec: "53:53/udp+", wantErr: true},
+		{portSpec: "53:53/", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := expandPortProtocols(tt.portSpec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("expandPortProtocols(%q) error = %v, wantErr %v", tt.portSpec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandPortProtocols(%q) = %v, want %v", tt.portSpec, got, tt.want)
+		}
+	}
+}
+
+func TestMergePortSpecs(t *testing.T) {
+	const (
+		server = "k3d-dev-server"
+		worker = "k3d-dev-worker-0"
+	)
+	createdNodes := []string{server, worker, "k3d-dev-worker-1"}
+	tests := []struct {
+		name       string
+		specs      []string
+		wantServer []string
+		wantWorker []string
+		wantErr    bool
+	}{
+		{
+			name:       "default node",
+			specs:      []string{"8080:80"},
+			wantServer: []string{"8080:80"},
+			wantWorker: []string{},
+		},
+		{
+			name:       "protocol set on the server",
+			specs:      []string{"53:53/udp+tcp@server"},
+			wantServer: []string{"53:53/udp", "53:53/tcp"},
+			wantWorker: []string{},
+		},
+		{
+			name:       "duplicate protocols",
+			specs:      []string{"53:53/udp+udp@workers"},
+			wantServer: []string{},
+			wantWorker: []string{"53:53/udp"},
+		},
+		{
+			name:    "invalid protocol",
+			specs:   []string{"53:53/udp+icmp@server"},
+			wantErr: true,
+		},
+		{
+			name:       "excluded server",
+			specs:      []string{"8080:80@!server"},
+			wantServer: []string{},
+			wantWorker: []string{"8080:80"},
+		},
+		{
+			name:       "excluded worker by name",
+			specs:      []string{"8080:80@!" + worker},
+			wantServer: []string{"8080:80"},
+			wantWorker: []string{},
+		},
+		{
+			name:       "excluded workers",
+			specs:      []string{"8080:80@!workers"},
+			wantServer: []string{"8080:80"},
+			wantWorker: []string{},
+		},
+		{
+			name:       "node list",
+			specs:      []string{"8080:80@server," + worker},
+			wantServer: []string{"8080:80"},
+			wantWorker: []string{"8080:80"},
+		},
+		{
+			name:    "all nodes excluded",
+			specs:   []string{"8080:80@!all"},
+			wantErr: true,
+		},
+		{
+			name:    "all nodes excluded in a node list",
+			specs:   []string{"8080:80@server,!all"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeToPortSpecMap, err := mapNodesToPortSpecs(tt.specs, createdNodes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mapNodesToPortSpecs(%v) error = %v, wantErr %v", tt.specs, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for _, node := range []struct {
+				role, name string
+				want       []string
+			}{
+				{"server", server, tt.wantServer},
+				{"worker", worker, tt.wantWorker},
+			} {
+				got, err := MergePortSpecs(nodeToPortSpecMap, node.role, node.name)
+				if err != nil {
+					t.Fatalf("MergePortSpecs(%s) error = %v", node.name, err)
+				}
+				if !reflect.DeepEqual(got, node.want) {
+					t.Errorf("MergePortSpecs(%s) = %v, want %v", node.name, got, node.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseNodeSpec(t *testing.T) {
+	tests := []struct {
+		spec      string
+		wantValue string
+		wantNodes []string
+		wantErr   bool
+	}{
+		{spec: "8080:80", wantValue: "8080:80", wantNodes: []string{"server"}},
+		{spec: "8080:80@workers", wantValue: "8080:80", wantNodes: []string{"workers"}},
+		{spec: "8080:80@node1,node2", wantValue: "8080:80", wantNodes: []string{"node1", "node2"}},
+		{spec: "8080:80@node1,node2,node1", wantValue: "8080:80", wantNodes: []string{"node1", "node2"}},
+		{spec: "8080:80@!server", wantValue: "8080:80", wantNodes: []string{"!server"}},
+		{spec: "8080:80@!server,node1", wantValue: "8080:80", wantNodes: []string{"!server", "node1"}},
+		{spec: "/data:/data@workers", wantValue: "/data:/data", wantNodes: []string{"workers"}},
+		{spec: "8080:80@", wantErr: true},
+		{spec: "8080:80@node1,", wantErr: true},
+		{spec: "8080:80@,node1", wantErr: true},
+		{spec: "8080:80@node1,,node2", wantErr: true},
+		{spec: "8080:80@node1@node2", wantErr: true},
+		{spec: "8080:80@node1,node2@workers", wantErr: true},
+	}
+	for _, tt := range tests {
+		value, nodes, err := parseNodeSpec(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseNodeSpec(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if value != tt.wantValue || !reflect.DeepEqual(nodes, tt.wantNodes) {
+			t.Errorf("parseNodeSpec(%q) = %q, %v, want %q, %v", tt.spec, value, nodes, tt.wantValue, tt.wantNodes)
+		}
+	}
+}
+
+func TestValidateNodeSpecifier(t *testing.T) {
+	tests := []struct {
+		node    string
+		wantErr bool
+	}{
+		{node: "server"},
+		{node: "workers"},
+		{node: "k3d-dev-worker-0"},
+		{node: "!server"},
+		{node: "!k3d-dev-worker-0"},
+		{node: "!all", wantErr: true},
+		{node: "!", wantErr: true},
+		{node: "!!server", wantErr: true},
+		{node: "node_1", wantErr: true},
+		{node: "-node1", wantErr: true},
+		{node: "node 1", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateNodeSpecifier(tt.node); (err != nil) != tt.wantErr {
+			t.Errorf("validateNodeSpecifier(%q) error = %v, wantErr %v", tt.node, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMapNodesToPortSpecsNodeSpecifiers(t *testing.T) {
+	createdNodes := []string{"k3d-dev-server", "k3d-dev-worker-0"}
+	defer SetStrict(false)
+	tests := []struct {
+		name    string
+		specs   []string
+		strict  bool
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			name:  "node list",
+			specs: []string{"8080:80@server,k3d-dev-worker-0"},
+			want:  map[string][]string{"server": {"8080:80"}, "k3d-dev-worker-0": {"8080:80"}},
+		},
+		{
+			name:  "excluded role",
+			specs: []string{"8080:80@!server"},
+			want:  map[string][]string{"!server": {"8080:80"}},
+		},
+		{
+			name:  "unknown node dropped",
+			specs: []string{"8080:80@server,k3d-dev-worker-9"},
+			want:  map[string][]string{"server": {"8080:80"}},
+		},
+		{
+			name:    "unknown node in strict mode",
+			specs:   []string{"8080:80@server,k3d-dev-worker-9"},
+			strict:  true,
+			wantErr: true,
+		},
+		{
+			name:    "empty node-specifier",
+			specs:   []string{"8080:80@server,"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid node-specifier",
+			specs:   []string{"8080:80@node_1"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetStrict(tt.strict)
+			got, err := mapNodesToPortSpecs(tt.specs, createdNodes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mapNodesToPortSpecs(%v) error = %v, wantErr %v", tt.specs, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mapNodesToPortSpecs(%v) = %v, want %v", tt.specs, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,496 @@
+package run
+
+/*
+ * The functions in this file manage supervised port forwards from the host to services in a cluster.
+ * The forwards are persisted in the cluster directory and tunneled through the API server with client-go,
+ * reconnecting whenever they end (e.g. after the pod behind a service was replaced).
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+const (
+	portForwardsFileName = "port-forwards.yaml"
+	portForwardPIDFile   = "port-forward.pid"
+	portForwardLogFile   = "port-forward.log"
+)
+
+// portForward describes a forward from a local port to a port of a service or pod in the cluster
+type portForward struct {
+	Namespace  string `yaml:"namespace"`
+	Resource   string `yaml:"resource"` // e.g. svc/nginx or pod/nginx-123
+	LocalPort  int    `yaml:"localPort"`
+	RemotePort int    `yaml:"remotePort"`
+	Address    string `yaml:"address,omitempty"`
+}
+
+func (f portForward) String() string {
+	return fmt.Sprintf("%s/%s %d->%d", f.Namespace, f.Resource, f.LocalPort, f.RemotePort)
+}
+
+// getPortForwardsPath returns the path of the port forward list in the cluster directory
+func getPortForwardsPath(cluster string) (string, error) {
+	clusterDir, err := getClusterDir(cluster)
+	return path.Join(clusterDir, portForwardsFileName), err
+}
+
+// loadPortForwards reads the persisted port forwards of a cluster
+func loadPortForwards(cluster string) ([]portForward, error) {
+	forwardsPath, err := getPortForwardsPath(cluster)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(forwardsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []portForward{}, nil
+		}
+		return nil, fmt.Errorf("ERROR: couldn't read port forwards of cluster %s\n%w", cluster, err)
+	}
+	forwards := []portForward{}
+	if err := yaml.Unmarshal(content, &forwards); err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't parse port forwards of cluster %s\n%w", cluster, err)
+	}
+	return forwards, nil
+}
+
+// writePortForwards persists the port forwards of a cluster
+func writePortForwards(cluster string, forwards []portForward) error {
+	forwardsPath, err := getPortForwardsPath(cluster)
+	if err != nil {
+		return err
+	}
+	createClusterDir(cluster)
+	content, err := yaml.Marshal(forwards)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't serialize port forwards\n%w", err)
+	}
+	if err := os.WriteFile(forwardsPath, content, 0644); err != nil {
+		return fmt.Errorf("ERROR: couldn't write port forwards of cluster %s\n%w", cluster, err)
+	}
+	return nil
+}
+
+// parseForwardPorts parses a port pair in the format [local:]remote
+func parseForwardPorts(spec string) (int, int, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("ERROR: invalid port [%s], expected [local:]remote", spec)
+	}
+	ports := []int{}
+	for _, part := range parts {
+		port, err := strconv.Atoi(part)
+		if err != nil || port < 1 || port > 65535 {
+			return 0, 0, fmt.Errorf("ERROR: invalid port [%s] in [%s]", part, spec)
+		}
+		ports = append(ports, port)
+	}
+	if len(ports) == 1 {
+		return ports[0], ports[0], nil
+	}
+	return ports[0], ports[1], nil
+}
+
+// AddPortForward persists a new port forward for a cluster
+func AddPortForward(c *cli.Context) error {
+	cluster := c.String("name")
+	if c.NArg() != 2 {
+		return fmt.Errorf("ERROR: usage: k3d port-forward add --name <cluster> <resource> <[local:]remote>")
+	}
+	resource := c.Args().Get(0)
+	if !strings.Contains(resource, "/") {
+		resource = "svc/" + resource
+	}
+	localPort, remotePort, err := parseForwardPorts(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	forwards, err := loadPortForwards(cluster)
+	if err != nil {
+		return err
+	}
+	for _, f := range forwards {
+		if f.LocalPort == localPort {
+			return fmt.Errorf("ERROR: local port %d is already forwarded to %s", localPort, f)
+		}
+	}
+
+	forward := portForward{
+		Namespace:  c.String("namespace"),
+		Resource:   resource,
+		LocalPort:  localPort,
+		RemotePort: remotePort,
+		Address:    c.String("address"),
+	}
+	if err := writePortForwards(cluster, append(forwards, forward)); err != nil {
+		return err
+	}
+	logSuccessf("added port forward %s to cluster [%s]. Run `k3d port-forward run --name %s` to start forwarding", forward, cluster, cluster)
+	return nil
+}
+
+// RemovePortForward removes the persisted port forward with the given local port
+func RemovePortForward(c *cli.Context) error {
+	cluster := c.String("name")
+	localPort, err := strconv.Atoi(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("ERROR: usage: k3d port-forward remove --name <cluster> <local-port>")
+	}
+
+	forwards, err := loadPortForwards(cluster)
+	if err != nil {
+		return err
+	}
+	remaining := []portForward{}
+	for _, f := range forwards {
+		if f.LocalPort != localPort {
+			remaining = append(remaining, f)
+		}
+	}
+	if len(remaining) == len(forwards) {
+		return fmt.Errorf("ERROR: no port forward on local port %d for cluster %s", localPort, cluster)
+	}
+	if err := writePortForwards(cluster, remaining); err != nil {
+		return err
+	}
+	logSuccessf("removed port forward on local port %d from cluster [%s]", localPort, cluster)
+	return nil
+}
+
+// ListPortForwards prints the persisted port forwards of a cluster
+func ListPortForwards(c *cli.Context) error {
+	forwards, err := loadPortForwards(c.String("name"))
+	if err != nil {
+		return err
+	}
+	if len(forwards) == 0 {
+		log.Printf("No port forwards found for cluster %s", c.String("name"))
+		return nil
+	}
+
+	table := newTable([]string{"NAMESPACE", "RESOURCE", "LOCAL", "REMOTE"})
+	for _, f := range forwards {
+		local := strconv.Itoa(f.LocalPort)
+		if f.Address != "" {
+			local = fmt.Sprintf("%s:%d", f.Address, f.LocalPort)
+		}
+		table.Append([]string{f.Namespace, f.Resource, local, strconv.Itoa(f.RemotePort)})
+	}
+	table.Render()
+	return nil
+}
+
+// resolveForwardTarget resolves the resource of a forward to a running pod and the container port to forward to.
+// Services and deployments are resolved like `kubectl port-forward` does: to one of their running pods, with
+// the service port mapped to its target port.
+func resolveForwardTarget(ctx context.Context, clientset kubernetes.Interface, forward portForward) (string, int, error) {
+	kind, name, found := strings.Cut(forward.Resource, "/")
+	if !found {
+		kind, name = "svc", forward.Resource
+	}
+	pods := clientset.CoreV1().Pods(forward.Namespace)
+
+	var selector labels.Selector
+	var targetPort *intstr.IntOrString
+	switch kind {
+	case "pod", "pods", "po":
+		pod, err := pods.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", 0, fmt.Errorf("ERROR: couldn't get pod %s/%s\n%w", forward.Namespace, name, err)
+		}
+		if pod.Status.Phase != corev1.PodRunning {
+			return "", 0, fmt.Errorf("ERROR: pod %s/%s is not running (%s)", forward.Namespace, name, pod.Status.Phase)
+		}
+		return pod.Name, forward.RemotePort, nil
+	case "svc", "service", "services":
+		service, err := clientset.CoreV1().Services(forward.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", 0, fmt.Errorf("ERROR: couldn't get service %s/%s\n%w", forward.Namespace, name, err)
+		}
+		if len(service.Spec.Selector) == 0 {
+			return "", 0, fmt.Errorf("ERROR: service %s/%s has no selector", forward.Namespace, name)
+		}
+		selector = labels.SelectorFromSet(service.Spec.Selector)
+		for _, port := range service.Spec.Ports {
+			if int(port.Port) == forward.RemotePort {
+				targetPort = &port.TargetPort
+				break
+			}
+		}
+	case "deploy", "deployment", "deployments":
+		deployment, err := clientset.AppsV1().Deployments(forward.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", 0, fmt.Errorf("ERROR: couldn't get deployment %s/%s\n%w", forward.Namespace, name, err)
+		}
+		if selector, err = metav1.LabelSelectorAsSelector(deployment.Spec.Selector); err != nil {
+			return "", 0, fmt.Errorf("ERROR: invalid selector of deployment %s/%s\n%w", forward.Namespace, name, err)
+		}
+	default:
+		return "", 0, fmt.Errorf("ERROR: unsupported resource type [%s] in %s, expected pod, svc or deploy", kind, forward.Resource)
+	}
+
+	podList, err := pods.List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return "", 0, fmt.Errorf("ERROR: couldn't list the pods of %s\n%w", forward.Resource, err)
+	}
+	for _, pod := range podList.Items {
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if targetPort == nil || (targetPort.Type == intstr.Int && targetPort.IntVal == 0) {
+			return pod.Name, forward.RemotePort, nil
+		}
+		if targetPort.Type == intstr.Int {
+			return pod.Name, int(targetPort.IntVal), nil
+		}
+		for _, container := range pod.Spec.Containers {
+			for _, port := range container.Ports {
+				if port.Name == targetPort.StrVal {
+					return pod.Name, int(port.ContainerPort), nil
+				}
+			}
+		}
+		return "", 0, fmt.Errorf("ERROR: pod %s/%s has no port named %s", forward.Namespace, pod.Name, targetPort.StrVal)
+	}
+	return "", 0, fmt.Errorf("ERROR: no running pod found for %s in namespace %s", forward.Resource, forward.Namespace)
+}
+
+// forwardOnce forwards the ports of a single forward through the API server until the connection is lost,
+// the pod behind it goes away or ctx is done
+func forwardOnce(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, forward portForward) error {
+	podName, port, err := resolveForwardTarget(ctx, clientset, forward)
+	if err != nil {
+		return err
+	}
+
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create the port forward transport\n%w", err)
+	}
+	url := clientset.CoreV1().RESTClient().Post().Resource("pods").Namespace(forward.Namespace).Name(podName).SubResource("portforward").URL()
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, url)
+
+	addresses := []string{"localhost"}
+	if forward.Address != "" {
+		addresses = strings.Split(forward.Address, ",")
+	}
+	stop := make(chan struct{})
+	ready := make(chan struct{})
+	forwarder, err := portforward.NewOnAddresses(dialer, addresses, []string{fmt.Sprintf("%d:%d", forward.LocalPort, port)}, stop, ready, io.Discard, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't set up port forward %s\n%w", forward, err)
+	}
+
+	// the stream to the API server survives the pod, so watch the pod to reconnect to a new one
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				close(stop)
+				return
+			case <-ticker.C:
+				pod, err := clientset.CoreV1().Pods(forward.Namespace).Get(ctx, podName, metav1.GetOptions{})
+				if ctx.Err() == nil && (err != nil || pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil) {
+					logWarningf("pod %s/%s of port forward %s is gone", forward.Namespace, podName, forward)
+					close(stop)
+					return
+				}
+			}
+		}
+	}()
+
+	log.Printf("Forwarding %s via pod %s", forward, podName)
+	return forwarder.ForwardPorts()
+}
+
+// superviseForward runs a single forward and reconnects it when it ends, until ctx is done
+func superviseForward(ctx context.Context, forward portForward, config *rest.Config, clientset kubernetes.Interface, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := forwardOnce(ctx, config, clientset, forward)
+		if ctx.Err() != nil {
+			return
+		}
+		logWarningf("port forward %s ended (%v), reconnecting...", forward, err)
+
+		// reset the backoff if the forward was running for a while
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// watchPortForwardPIDFile cancels a supervisor once its PID file is removed or taken over by another supervisor.
+// That's how `k3d stop` and `k3d delete` end it, without relying on signals that don't exist on every platform.
+func watchPortForwardPIDFile(ctx context.Context, cancel context.CancelFunc, pidFile string) {
+	own := strconv.Itoa(os.Getpid())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			content, err := os.ReadFile(pidFile)
+			if err != nil || strings.TrimSpace(string(content)) != own {
+				log.Println("PID file removed or replaced, stopping...")
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// RunPortForwards runs all persisted port forwards of a cluster in the foreground until interrupted
+func RunPortForwards(c *cli.Context) error {
+	cluster := c.String("name")
+	forwards, err := loadPortForwards(cluster)
+	if err != nil {
+		return err
+	}
+	if len(forwards) == 0 {
+		return fmt.Errorf("ERROR: no port forwards configured for cluster %s", cluster)
+	}
+
+	kubeConfigPath, err := getKubeConfig(cluster)
+	if err != nil {
+		return err
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", kubeConfigPath)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't load the kubeconfig of cluster %s\n%w", cluster, err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create a Kubernetes client for cluster %s\n%w", cluster, err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if c.Bool("supervised") {
+		clusterDir, err := getClusterDir(cluster)
+		if err != nil {
+			return err
+		}
+		pidFile := path.Join(clusterDir, portForwardPIDFile)
+		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			return fmt.Errorf("ERROR: couldn't write port forward pid file\n%w", err)
+		}
+		go watchPortForwardPIDFile(ctx, cancel, pidFile)
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, forward := range forwards {
+		wg.Add(1)
+		go superviseForward(ctx, forward, config, clientset, wg)
+	}
+
+	<-ctx.Done()
+	log.Println("Stopping port forwards...")
+	wg.Wait()
+	return nil
+}
+
+// startPortForwardSupervisor starts `k3d port-forward run` for a cluster as background process,
+// if there are persisted port forwards. Output goes to a log file in the cluster directory.
+func startPortForwardSupervisor(cluster string) error {
+	forwards, err := loadPortForwards(cluster)
+	if err != nil || len(forwards) == 0 {
+		return err
+	}
+
+	stopPortForwardSupervisor(cluster)
+
+	clusterDir, err := getClusterDir(cluster)
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(path.Join(clusterDir, portForwardLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't open port forward log file\n%w", err)
+	}
+	defer logFile.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't find the path of the running binary\n%w", err)
+	}
+
+	// the supervisor writes its PID file itself and stops once it's gone
+	cmd := exec.Command(executable, append(helperGlobalArgs(), "port-forward", "run", "--name", cluster, "--supervised")...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// like the helpers of jobs, the supervisor neither holds on to nor stops with the terminal
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't open %s\n%w", os.DevNull, err)
+	}
+	defer devNull.Close()
+	cmd.Stdin = devNull
+	detachJobProcess(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("ERROR: couldn't start port forward supervisor\n%w", err)
+	}
+
+	log.Printf("Started %d port forward(s) for cluster %s in the background (PID %d)", len(forwards), cluster, cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// stopPortForwardSupervisor stops a background port forward supervisor started for a cluster, if any,
+// by removing its PID file
+func stopPortForwardSupervisor(cluster string) {
+	clusterDir, err := getClusterDir(cluster)
+	if err != nil {
+		return
+	}
+	pidFile := path.Join(clusterDir, portForwardPIDFile)
+	if content, err := os.ReadFile(pidFile); err == nil {
+		logDebugf("stopping port forward supervisor (PID %s) of cluster %s", strings.TrimSpace(string(content)), cluster)
+		os.Remove(pidFile)
+	}
+}
@@ -0,0 +1,75 @@
+package run
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestResolveForwardTarget(t *testing.T) {
+	appLabels := map[string]string{"app": "web"}
+	pod := func(name string, phase corev1.PodPhase) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: appLabels},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:  "web",
+				Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+			}}},
+			Status: corev1.PodStatus{Phase: phase},
+		}
+	}
+	service := func(name string, port int32, targetPort intstr.IntOrString) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Selector: appLabels,
+				Ports:    []corev1.ServicePort{{Port: port, TargetPort: targetPort}},
+			},
+		}
+	}
+	clientset := fake.NewSimpleClientset(
+		pod("web-pending", corev1.PodPending),
+		pod("web-1", corev1.PodRunning),
+		service("web-numeric", 80, intstr.FromInt32(8080)),
+		service("web-named", 80, intstr.FromString("http")),
+		service("web-unknown", 80, intstr.FromString("grpc")),
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec:       appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: appLabels}},
+		},
+	)
+
+	tests := []struct {
+		resource   string
+		remotePort int
+		wantPod    string
+		wantPort   int
+		wantErr    bool
+	}{
+		{resource: "pod/web-1", remotePort: 8080, wantPod: "web-1", wantPort: 8080},
+		{resource: "pod/web-pending", remotePort: 8080, wantErr: true},
+		{resource: "svc/web-numeric", remotePort: 80, wantPod: "web-1", wantPort: 8080},
+		{resource: "service/web-named", remotePort: 80, wantPod: "web-1", wantPort: 8080},
+		{resource: "svc/web-named", remotePort: 9090, wantPod: "web-1", wantPort: 9090},
+		{resource: "svc/web-unknown", remotePort: 80, wantErr: true},
+		{resource: "svc/missing", remotePort: 80, wantErr: true},
+		{resource: "deploy/web", remotePort: 8080, wantPod: "web-1", wantPort: 8080},
+		{resource: "job/web", remotePort: 8080, wantErr: true},
+	}
+	for _, tt := range tests {
+		forward := portForward{Namespace: "default", Resource: tt.resource, LocalPort: 1234, RemotePort: tt.remotePort}
+		gotPod, gotPort, err := resolveForwardTarget(context.Background(), clientset, forward)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveForwardTarget(%s) error = %v, wantErr %v", tt.resource, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (gotPod != tt.wantPod || gotPort != tt.wantPort) {
+			t.Errorf("resolveForwardTarget(%s) = %s:%d, want %s:%d", tt.resource, gotPod, gotPort, tt.wantPod, tt.wantPort)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package run
+
+/*
+ * The functions in this file handle the prefix of docker object names created by k3d,
+ * which allows multiple sets of clusters (e.g. of different tools) to coexist.
+ */
+
+import (
+	"fmt"
+
+	"github.com/docker/docker/api/types/filters"
+)
+
+// containerNamePrefix is prepended to the names of containers, set via the global --prefix flag
+var containerNamePrefix = defaultContainerNamePrefix
+
+// SetContainerNamePrefix sets the prefix of docker object names created by k3d
+func SetContainerNamePrefix(prefix string) error {
+	if err := ValidateHostname(prefix); err != nil {
+		return fmt.Errorf("ERROR: Invalid prefix [%s]\n%w", prefix, err)
+	}
+	containerNamePrefix = prefix
+	return nil
+}
+
+// getObjectPrefix returns the prefix a docker object was created with.
+// Objects created before the prefix label was introduced always use the default prefix.
+func getObjectPrefix(labels map[string]string) string {
+	if prefix, ok := labels["prefix"]; ok {
+		return prefix
+	}
+	return defaultContainerNamePrefix
+}
+
+// hasContainerNamePrefix reports whether a docker object belongs to the current prefix
+func hasContainerNamePrefix(labels map[string]string) bool {
+	return getObjectPrefix(labels) == containerNamePrefix
+}
+
+// addPrefixFilter narrows docker list filters down to objects of the current prefix.
+// Objects with the default prefix may lack the label, so results have to be checked with hasContainerNamePrefix as well.
+func addPrefixFilter(f filters.Args) {
+	if containerNamePrefix != defaultContainerNamePrefix {
+		f.Add("label", fmt.Sprintf("prefix=%s", containerNamePrefix))
+	}
+}
+
+// getClusterNetworkName returns the name of the docker network of a cluster:
+// the cluster name for the default prefix and <prefix>-<cluster> otherwise
+func getClusterNetworkName(clusterName string) string {
+	if containerNamePrefix == defaultContainerNamePrefix {
+		return clusterName
+	}
+	return fmt.Sprintf("%s-%s", containerNamePrefix, clusterName)
+}
@@ -0,0 +1,114 @@
+package run
+
+/*
+ * The functions in this file render the progress of image pulls: the layer progress bars of `docker pull`
+ * with --verbose, otherwise a single line with a spinner and the overall progress.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/go-units"
+	"github.com/moby/term"
+)
+
+// spinnerFrames are drawn one after the other while an image is pulled
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// pullProgressInterval is how often the progress line is redrawn
+const pullProgressInterval = 100 * time.Millisecond
+
+// pullProgress is the overall progress of an image pull, summed up over the layers
+type pullProgress struct {
+	lock   sync.Mutex
+	layers map[string]*jsonmessage.JSONProgress
+}
+
+// update records the progress of a layer, downloaded layers count as complete while they're extracted
+func (p *pullProgress) update(msg jsonmessage.JSONMessage) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch {
+	case msg.ID == "":
+	case msg.Status == "Downloading" && msg.Progress != nil && msg.Progress.Total > 0:
+		p.layers[msg.ID] = msg.Progress
+	case msg.Status == "Download complete" || msg.Status == "Pull complete":
+		if layer, ok := p.layers[msg.ID]; ok {
+			layer.Current = layer.Total
+		}
+	}
+}
+
+// String returns the downloaded and total size of the layers seen so far, e.g. "42% (120MB / 285MB)"
+func (p *pullProgress) String() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var current, total int64
+	for _, layer := range p.layers {
+		current += layer.Current
+		total += layer.Total
+	}
+	if total == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d%% (%s / %s)", current*100/total, units.HumanSize(float64(current)), units.HumanSize(float64(total)))
+}
+
+// isTerminal reports whether f is a terminal, progress output is only animated on terminals
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(f.Fd())
+}
+
+// displayPullProgress consumes the JSON message stream of an image pull until it ends and returns
+// the error the daemon reported in the stream, if any
+func displayPullProgress(in io.Reader, imageName string) error {
+	if verbose {
+		// the progress bars of docker pull, one line per layer (plain status lines without a terminal)
+		return jsonmessage.DisplayJSONMessagesStream(in, os.Stdout, os.Stdout.Fd(), isTerminal(os.Stdout), nil)
+	}
+
+	progress := &pullProgress{layers: map[string]*jsonmessage.JSONProgress{}}
+	if isTerminal(os.Stderr) {
+		done := make(chan struct{})
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			ticker := time.NewTicker(pullProgressInterval)
+			defer ticker.Stop()
+			for frame := 0; ; frame++ {
+				fmt.Fprintf(os.Stderr, "\r\x1b[K%s %s %s", spinnerFrames[frame%len(spinnerFrames)], imageName, progress)
+				select {
+				case <-done:
+					fmt.Fprint(os.Stderr, "\r\x1b[K")
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+		defer func() {
+			close(done)
+			<-finished
+		}()
+	}
+
+	decoder := json.NewDecoder(in)
+	for {
+		msg := jsonmessage.JSONMessage{}
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		progress.update(msg)
+	}
+}
@@ -0,0 +1,39 @@
+package run
+
+/*
+ * The functions in this file ask the user for confirmation before destructive operations.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/moby/term"
+)
+
+// forceEnvVar skips all confirmation prompts if set to 1 or true, e.g. for automation
+const forceEnvVar = "K3D_FORCE"
+
+// isForcedByEnv reports whether confirmations are disabled via the environment
+func isForcedByEnv() bool {
+	force := strings.ToLower(os.Getenv(forceEnvVar))
+	return force == "1" || force == "true"
+}
+
+// confirm asks a yes/no question on the terminal and returns true if the user answered yes.
+// Nobody is asked if yes is set, K3D_FORCE is set or stdin is not a terminal (e.g. in scripts).
+func confirm(question string, yes bool) (bool, error) {
+	if yes || isForcedByEnv() || !term.IsTerminal(os.Stdin.Fd()) {
+		return true, nil
+	}
+
+	fmt.Printf("%s [y/N]: ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, fmt.Errorf("ERROR: couldn't read answer\n%w", err)
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
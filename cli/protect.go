@@ -0,0 +1,47 @@
+package run
+
+/*
+ * The functions in this file protect long-lived clusters (created with --protect) from being deleted by accident:
+ * `k3d delete` refuses to delete them and `k3d delete --all` skips them unless --force-protected is given.
+ */
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// protectedLabel marks the node containers of protected clusters
+const protectedLabel = "protected"
+
+// isProtected reports whether a cluster was created with --protect
+func isProtected(cl cluster) bool {
+	return cl.server.Labels[protectedLabel] == "true"
+}
+
+// checkClusterProtection returns an error if a cluster is protected and force isn't set
+func checkClusterProtection(cl cluster, force bool) error {
+	if !isProtected(cl) || force {
+		return nil
+	}
+	return fmt.Errorf("ERROR: cluster %s is protected, use `delete --name %s --force-protected` to delete it", cl.name, cl.name)
+}
+
+// dropProtectedClusters removes the protected clusters from a selection of several clusters unless force is set
+func dropProtectedClusters(clusters map[string]cluster, force bool) map[string]cluster {
+	if force {
+		return clusters
+	}
+	skipped := []string{}
+	for name, cl := range clusters {
+		if isProtected(cl) {
+			skipped = append(skipped, name)
+			delete(clusters, name)
+		}
+	}
+	if len(skipped) > 0 {
+		sort.Strings(skipped)
+		logInfof("skipping protected cluster(s) %s, use --force-protected to delete them as well", strings.Join(skipped, ", "))
+	}
+	return clusters
+}
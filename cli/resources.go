@@ -0,0 +1,100 @@
+package run
+
+/*
+ * The functions in this file compare the resources of the docker host with what clusters need. Docker Desktop
+ * runs containers in a VM with a few GiB of memory, where clusters with several nodes never become ready.
+ */
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+)
+
+// rough resources a node needs to become ready and run a few workloads, servers run the control plane in addition
+const (
+	serverNodeMemory = 1 * units.GiB
+	workerNodeMemory = 512 * units.MiB
+	serverNodeCPUs   = 1.0
+	workerNodeCPUs   = 0.5
+)
+
+// isDockerVM reports whether the docker daemon runs in a VM with its own resource limits,
+// which is always the case on macOS and Windows (Docker Desktop, Colima, ...)
+func isDockerVM(info system.Info) bool {
+	return runtime.GOOS != "linux" || strings.Contains(info.OperatingSystem, "Docker Desktop")
+}
+
+// describeDockerResources returns the CPUs and the memory of the docker host, e.g. "4 CPUs, 7.7GiB memory (Docker Desktop VM)"
+func describeDockerResources(info system.Info) string {
+	description := fmt.Sprintf("%d CPUs, %s memory", info.NCPU, units.BytesSize(float64(info.MemTotal)))
+	if isDockerVM(info) {
+		description += fmt.Sprintf(" (%s VM)", info.OperatingSystem)
+	}
+	return description
+}
+
+// estimateNodeResources returns the memory and CPUs the given number of servers and workers need
+func estimateNodeResources(servers, workers int) (int64, float64) {
+	memory := int64(servers)*serverNodeMemory + int64(workers)*workerNodeMemory
+	cpus := float64(servers)*serverNodeCPUs + float64(workers)*workerNodeCPUs
+	return memory, cpus
+}
+
+// countRunningNodes returns the number of running servers and workers of all clusters
+func countRunningNodes() (int, int) {
+	clusters, err := getClusters(true, "")
+	if err != nil {
+		logDebugf("couldn't list clusters to count their nodes: %+v", err)
+		return 0, 0
+	}
+	servers, workers := 0, 0
+	for _, cl := range clusters {
+		if cl.server.State == "running" {
+			servers++
+		}
+		for _, worker := range cl.workers {
+			if worker.State == "running" {
+				workers++
+			}
+		}
+	}
+	return servers, workers
+}
+
+// checkDockerResources warns if the docker host likely lacks the memory or CPUs for a new cluster with the given
+// number of workers next to the running clusters. It's a heuristic, so it never fails.
+func checkDockerResources(workers int) {
+	ctx := context.Background()
+	docker, err := newDockerClient(client.WithAPIVersionNegotiation())
+	if err != nil {
+		logDebugf("couldn't create docker client to check its resources: %+v", err)
+		return
+	}
+	logDebugf("Info")
+	info, err := docker.Info(ctx)
+	if err != nil {
+		logDebugf("couldn't get docker info to check its resources: %+v", err)
+		return
+	}
+	if info.MemTotal == 0 || info.NCPU == 0 {
+		return
+	}
+
+	runningServers, runningWorkers := countRunningNodes()
+	memory, cpus := estimateNodeResources(runningServers+defaultServerCount, runningWorkers+workers)
+	if info.MemTotal >= memory && float64(info.NCPU) >= cpus {
+		return
+	}
+	hint := "stop other clusters or create fewer workers"
+	if isDockerVM(info) {
+		hint = "give the docker VM more resources (e.g. Docker Desktop: Settings > Resources), stop other clusters or create fewer workers"
+	}
+	logWarningf("the docker host has %s, the new cluster and %d running node(s) likely need about %s memory and %.1f CPUs and may never become ready: %s",
+		describeDockerResources(info), runningServers+runningWorkers, units.BytesSize(float64(memory)), cpus, hint)
+}
@@ -0,0 +1,117 @@
+package run
+
+/*
+ * The functions in this file run a single command against a throwaway cluster (`k3d run`).
+ */
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/urfave/cli"
+)
+
+// deleteClusterByName deletes a cluster if it exists
+func deleteClusterByName(name string) error {
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return err
+	}
+	if cl, ok := clusters[name]; ok {
+		return deleteCluster(cl)
+	}
+	return nil
+}
+
+// Run creates a cluster with a random name, runs a command with KUBECONFIG pointing to it and deletes the cluster
+// afterwards: `k3d run [flags] -- <command>`. k3d exits with the exit code of the command.
+func Run(c *cli.Context) error {
+	args := c.Args()
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("ERROR: no command given (usage: k3d run [flags] -- <command>)")
+	}
+	commandPath, err := exec.LookPath(args[0])
+	if err != nil {
+		return fmt.Errorf("ERROR: command %s not found\n%w", args[0], err)
+	}
+	if err := setKubeConfigMode(c.String("kubeconfig-mode")); err != nil {
+		return err
+	}
+
+	apiPorts, err := assignAPIPorts(c.Int("api-port"), 1)
+	if err != nil {
+		return err
+	}
+	spec := &clusterSpec{
+		Name:    fmt.Sprintf("run-%s", strings.ToLower(GenerateRandomString(8))),
+		Image:   c.String("image"),
+		APIPort: apiPorts[0],
+		Workers: c.Int("workers"),
+		Env:     c.StringSlice("env"),
+		Volumes: c.StringSlice("volume"),
+
+		EnvPassthrough: c.StringSlice("env-passthrough"),
+	}
+	opts := createOptions{
+		wait:    true,
+		timeout: c.Duration("wait"),
+		waitFor: c.String("wait-for"),
+		summary: "none",
+	}
+
+	// an interrupt while waiting for the cluster aborts the creation and deletes the cluster, like for `k3d create`
+	logInfof("Creating throwaway cluster %s", spec.Name)
+	if err := createCluster(spec, opts); err != nil {
+		return err
+	}
+
+	// the command gets interrupts directly from the terminal, k3d must survive them to clean up
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	defer func() {
+		if c.Bool("keep") {
+			logInfof("Keeping cluster %s, delete it with `%s delete --name %s`", spec.Name, os.Args[0], spec.Name)
+			return
+		}
+		if err := deleteClusterByName(spec.Name); err != nil {
+			logWarningf("couldn't delete cluster %s\n%+v", spec.Name, err)
+		}
+	}()
+
+	kubeConfigPath, err := getKubeConfig(spec.Name)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(commandPath, args[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("KUBECONFIG=%s", kubeConfigPath))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	go func() {
+		for sig := range signals {
+			logDebugf("received %s, waiting for the command to exit", sig)
+		}
+	}()
+
+	if err := cmd.Run(); err != nil {
+		// pass on the exit code of the command, it already printed its error.
+		// The exit error is returned only after the cluster is deleted, since urfave/cli exits on it.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return cli.NewExitError("", exitErr.ExitCode())
+		}
+		return fmt.Errorf("ERROR: couldn't run %s\n%w", args[0], err)
+	}
+	return nil
+}
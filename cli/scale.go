@@ -0,0 +1,140 @@
+package run
+
+/*
+ * The functions in this file scale the number of workers of a cluster (`k3d scale`).
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/urfave/cli"
+)
+
+// removeClusterWorker removes a worker container, optionally draining it first, and deletes its Kubernetes node
+func removeClusterWorker(ctx context.Context, docker *client.Client, cl cluster, worker types.Container, drain bool) error {
+	nodeName := getContainerShortName(worker)
+	serverRunning := cl.server.State == "running"
+
+	if drain && serverRunning {
+		log.Printf("Draining node %s...", nodeName)
+		output, exitCode, err := execInContainer(ctx, docker, cl.server.ID, []string{"kubectl", "drain", nodeName, "--ignore-daemonsets", "--delete-emptydir-data", "--force", "--timeout=120s"})
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("ERROR: couldn't drain node %s\n%s", nodeName, strings.TrimSpace(output))
+		}
+	}
+
+	log.Printf("Removing worker %s", nodeName)
+	if err := removeContainer(worker.ID); err != nil {
+		return err
+	}
+
+	// otherwise the node lingers around as NotReady
+	if serverRunning {
+		output, exitCode, err := execInContainer(ctx, docker, cl.server.ID, []string{"kubectl", "delete", "node", nodeName, "--ignore-not-found"})
+		if err != nil || exitCode != 0 {
+			logWarningf("couldn't delete Kubernetes node %s\n%s%+v", nodeName, output, err)
+		}
+	}
+	return nil
+}
+
+// printClusterNodes prints a table of the nodes of a cluster
+func printClusterNodes(name string) error {
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[name]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, name)
+	}
+
+	table := newTable([]string{"NAME", "ROLE", "STATE"})
+	table.Append([]string{getContainerShortName(cl.server), "server", cl.server.State})
+	workers := append([]types.Container{}, cl.workers...)
+	sort.Slice(workers, func(i, j int) bool { return getContainerShortName(workers[i]) < getContainerShortName(workers[j]) })
+	for _, worker := range workers {
+		table.Append([]string{getContainerShortName(worker), "worker", worker.State})
+	}
+	table.Render()
+	return nil
+}
+
+// Scale adds or removes workers of a cluster until it has the requested number: `k3d scale <cluster> --workers N`.
+// Workers are removed from the highest index down, so the remaining ones keep their names and port mappings.
+func Scale(c *cli.Context) error {
+	name := DefaultK3sClusterName
+	if c.NArg() > 0 {
+		name = c.Args().First()
+	}
+	if !c.IsSet("workers") {
+		return fmt.Errorf("ERROR: please specify the number of workers with --workers")
+	}
+	desired := c.Int("workers")
+	if desired < 0 {
+		return fmt.Errorf("ERROR: number of workers must not be negative (got %d)", desired)
+	}
+
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[name]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, name)
+	}
+
+	current := len(cl.workers)
+	switch {
+	case desired > current:
+		log.Printf("Scaling cluster %s up from %d to %d workers", name, current, desired)
+		if err := addClusterWorkers(cl, desired-current); err != nil {
+			return err
+		}
+	case desired < current:
+		log.Printf("Scaling cluster %s down from %d to %d workers", name, current, desired)
+
+		ctx := context.Background()
+		docker, err := newDockerClient()
+		if err != nil {
+			return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+		}
+
+		workers := append([]types.Container{}, cl.workers...)
+		sort.Slice(workers, func(i, j int) bool {
+			a, _ := getWorkerIndex(workers[i])
+			b, _ := getWorkerIndex(workers[j])
+			return a > b
+		})
+		for _, worker := range workers[:current-desired] {
+			if err := removeClusterWorker(ctx, docker, cl, worker, c.Bool("drain")); err != nil {
+				return err
+			}
+		}
+
+		spec, err := getStoredClusterSpec(cl)
+		if err != nil {
+			return err
+		}
+		spec.Workers = desired
+		if err := writeClusterSpec(spec); err != nil {
+			logWarningf("couldn't store cluster spec\n%+v", err)
+		}
+		if err := writeClusterMetadata(spec.Name); err != nil {
+			logWarningf("couldn't store cluster metadata\n%+v", err)
+		}
+	default:
+		log.Printf("Cluster %s already has %d workers", name, current)
+	}
+
+	return printClusterNodes(name)
+}
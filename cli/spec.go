@@ -0,0 +1,513 @@
+package run
+
+/*
+ * The functions in this file handle the declarative cluster spec,
+ * which is used by `k3d apply` and stored in the cluster directory on creation.
+ */
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Minhaz00/k3d/pkg/types"
+	"github.com/Minhaz00/k3d/version"
+	"gopkg.in/yaml.v3"
+)
+
+// clusterSpec describes the desired state of a cluster, it's the ClusterSpec of the library API with the methods used by the CLI
+type clusterSpec types.ClusterSpec
+
+// createOptions control how a cluster is created, independent of its spec
+type createOptions struct {
+	forceNetwork bool
+	replace      bool // delete an existing cluster with the same name first
+	wait         bool
+	timeout      time.Duration // 0 = wait forever
+	waitFor      string
+	summary      string // format of the timing summary printed at the end: text, json or none
+	token        string // token of the cluster, e.g. from a commit (empty = random)
+
+	diagnosticsLines int    // log lines per node printed if the cluster doesn't come up
+	readyLogPattern  string // regular expression of the server log line telling that it's up (empty = depending on the k3s version)
+	createHostPaths  bool   // create missing host paths of volumes instead of failing
+
+	mergeKubeconfig bool // merge the context of the cluster into the default kubeconfig once it's created
+	switchContext   bool // switch the current context of the default kubeconfig to the cluster, implies mergeKubeconfig
+
+	ignoreCgroupCheck bool // only warn if the k3s version doesn't support cgroup v2 on a cgroup v2 host
+	noImagePull       bool // only use local images and fail early if one is missing
+
+	events types.EventSink // receives the progress of the creation (may be nil)
+}
+
+// supportedSnapshotters are the containerd snapshotters k3s can be configured with
+var supportedSnapshotters = []string{"overlayfs", "fuse-overlayfs", "native", "stargz"}
+
+const (
+	defaultAPIPort      = 6443
+	defaultK3sImageRepo = "docker.io/rancher/k3s"
+	clusterSpecFileName = "spec.yaml"
+
+	defaultKubeconfigOutput = "/output/kubeconfig.yaml"
+
+	// the pod and service networks k3s uses by default
+	defaultClusterCIDR = "10.42.0.0/16"
+	defaultServiceCIDR = "10.43.0.0/16"
+	// k3sKubeconfigPath is where k3s always writes the kubeconfig, used if the output is disabled
+	k3sKubeconfigPath = "/etc/rancher/k3s/k3s.yaml"
+)
+
+// setDefaults fills all unset fields with the defaults also used by `k3d create`
+func (s *clusterSpec) setDefaults() {
+	if s.Image == "" {
+		s.Image = fmt.Sprintf("%s:%s", defaultK3sImageRepo, version.GetK3sVersion())
+	}
+	if s.APIPort == 0 {
+		s.APIPort = defaultAPIPort
+	}
+	if image, err := normalizeImage(s.Image); err == nil {
+		s.Image = image
+	}
+	if image, err := normalizeImage(s.AgentImage); err == nil && s.AgentImage != "" {
+		s.AgentImage = image
+	}
+}
+
+// validate checks the spec for errors that would make the cluster creation fail
+func (s *clusterSpec) validate() error {
+	if err := CheckClusterName(s.Name); err != nil {
+		return err
+	}
+	if _, err := normalizeImage(s.Image); err != nil {
+		return err
+	}
+	if s.AgentImage != "" {
+		if _, err := normalizeImage(s.AgentImage); err != nil {
+			return err
+		}
+		if err := checkAgentVersionSkew(s.Image, s.AgentImage); err != nil {
+			return err
+		}
+	}
+	if s.Workers < 0 {
+		return fmt.Errorf("ERROR: number of workers must not be negative (got %d)", s.Workers)
+	}
+	if s.APIPort < 1 || s.APIPort > 65535 {
+		return fmt.Errorf("ERROR: invalid API port %d", s.APIPort)
+	}
+	if s.APIServerAddress != "" && net.ParseIP(s.APIServerAddress) == nil {
+		if err := ValidateHostname(s.APIServerAddress); err != nil {
+			return fmt.Errorf("ERROR: invalid API server address [%s], expected an IP or hostname\n%w", s.APIServerAddress, err)
+		}
+	}
+	if s.NodeNameTemplate != "" {
+		if _, err := parseNodeNameTemplate(s.NodeNameTemplate); err != nil {
+			return err
+		}
+	}
+	if s.ContainerdPort < 0 || s.ContainerdPort+s.Workers > 65535 {
+		return fmt.Errorf("ERROR: invalid containerd port %d, the server and %d workers need consecutive ports up to 65535", s.ContainerdPort, s.Workers)
+	}
+	if s.Group != "" {
+		if err := validateGroupName(s.Group); err != nil {
+			return err
+		}
+	}
+	if s.TTL != "" {
+		if _, err := parseClusterTTL(s.TTL); err != nil {
+			return err
+		}
+	}
+	if err := validateEnvPassthrough(s.EnvPassthrough); err != nil {
+		return err
+	}
+	if s.PauseImage != "" {
+		if _, err := normalizeImage(s.PauseImage); err != nil {
+			return err
+		}
+	}
+	if s.Snapshotter != "" && !containsString(supportedSnapshotters, s.Snapshotter) {
+		return fmt.Errorf("ERROR: unsupported snapshotter [%s] (supported: %s)", s.Snapshotter, strings.Join(supportedSnapshotters, ", "))
+	}
+	if s.KubeconfigOutput != "" {
+		if s.NoKubeconfigOutput {
+			return fmt.Errorf("ERROR: --kubeconfig-output can't be combined with --no-kubeconfig-output")
+		}
+		if !path.IsAbs(s.KubeconfigOutput) || path.Dir(path.Clean(s.KubeconfigOutput)) == "/" {
+			return fmt.Errorf("ERROR: kubeconfig output [%s] must be an absolute path of a file in a directory other than /", s.KubeconfigOutput)
+		}
+	}
+	if s.WriteKubeconfigMode != "" {
+		if mode, err := strconv.ParseUint(s.WriteKubeconfigMode, 8, 32); err != nil || mode&^0777 != 0 {
+			return fmt.Errorf("ERROR: invalid kubeconfig mode [%s], expected an octal file mode like 0644", s.WriteKubeconfigMode)
+		}
+	}
+	if s.Commit != "" {
+		if _, err := commitNodeImage(s.Commit, "server", -1); err != nil {
+			return err
+		}
+	}
+	if err := s.validateNetworking(); err != nil {
+		return err
+	}
+	if err := s.validateNetworkDriver(); err != nil {
+		return err
+	}
+	if err := s.validateDNS(); err != nil {
+		return err
+	}
+	if err := validateTaintSpecs(s.Taints); err != nil {
+		return err
+	}
+	if _, err := mapNodesToTaints(s.Taints, GetAllContainerNames(s.Name, defaultServerCount, s.Workers)); err != nil {
+		return err
+	}
+	if err := validateTmpfsSpecs(s.Tmpfs); err != nil {
+		return err
+	}
+	if _, err := mapNodesToSpecs("tmpfs", s.Tmpfs, GetAllContainerNames(s.Name, defaultServerCount, s.Workers)); err != nil {
+		return err
+	}
+	if err := s.storageOptions("server", GetContainerName("server", s.Name, -1)).validate(); err != nil {
+		return err
+	}
+	return validatePortSpecs(s.Ports)
+}
+
+// clusterCIDRs returns the pod and service networks of the cluster, with the k3s defaults for unset ones
+func (s *clusterSpec) clusterCIDRs() (string, string) {
+	clusterCIDR, serviceCIDR := s.ClusterCIDR, s.ServiceCIDR
+	if clusterCIDR == "" {
+		clusterCIDR = defaultClusterCIDR
+	}
+	if serviceCIDR == "" {
+		serviceCIDR = defaultServiceCIDR
+	}
+	return clusterCIDR, serviceCIDR
+}
+
+// validateNetworking checks the cluster domain, the CIDRs and that the cluster DNS is part of the service network
+func (s *clusterSpec) validateNetworking() error {
+	if s.ClusterDomain != "" {
+		for _, label := range strings.Split(s.ClusterDomain, ".") {
+			if err := ValidateHostname(label); err != nil {
+				return fmt.Errorf("ERROR: invalid cluster domain [%s]\n%w", s.ClusterDomain, err)
+			}
+		}
+	}
+
+	clusterCIDR, serviceCIDR := s.clusterCIDRs()
+	clusterNets, err := parseCIDRList(clusterCIDR)
+	if err != nil {
+		return err
+	}
+	serviceNets, err := parseCIDRList(serviceCIDR)
+	if err != nil {
+		return err
+	}
+	if a, b := findOverlappingCIDRs(clusterNets, serviceNets); a != nil {
+		return fmt.Errorf("ERROR: cluster CIDR %s overlaps with service CIDR %s", a, b)
+	}
+
+	if s.ClusterDNS != "" {
+		ip := net.ParseIP(s.ClusterDNS)
+		if ip == nil {
+			return fmt.Errorf("ERROR: invalid cluster DNS IP [%s]", s.ClusterDNS)
+		}
+		inServiceNet := false
+		for _, serviceNet := range serviceNets {
+			inServiceNet = inServiceNet || serviceNet.Contains(ip)
+		}
+		if !inServiceNet {
+			return fmt.Errorf("ERROR: cluster DNS IP %s is not part of the service CIDR %s", s.ClusterDNS, serviceCIDR)
+		}
+	}
+	return nil
+}
+
+// noServerWorkloadsTaint keeps regular workloads off the server, while the k3s addons tolerate it
+const noServerWorkloadsTaint = "CriticalAddonsOnly=true:NoExecute"
+
+// nodeTaints returns the taints for a node with the given role and container name
+func (s *clusterSpec) nodeTaints(role, containerName string) []string {
+	// unknown node specifiers are reported by validate already
+	nodeToTaintMap, _ := mapNodesToTaints(s.Taints, GetAllContainerNames(s.Name, defaultServerCount, s.Workers))
+	// the merge logic of port specs applies to taints as well: role groups first, then node names
+	taints, _ := MergePortSpecs(nodeToTaintMap, role, containerName)
+	return taints
+}
+
+// componentArgs returns the k3s arguments overriding containerd settings, which apply to servers and agents
+func (s *clusterSpec) componentArgs() []string {
+	args := []string{}
+	if s.PauseImage != "" {
+		args = append(args, "--pause-image", s.PauseImage)
+	}
+	if s.DefaultRuntime != "" {
+		args = append(args, "--default-runtime", s.DefaultRuntime)
+	}
+	if s.Snapshotter != "" {
+		args = append(args, "--snapshotter", s.Snapshotter)
+	}
+	return args
+}
+
+// k3sServerArgs returns the arguments passed to `k3s server`
+func (s *clusterSpec) k3sServerArgs() []string {
+	args := []string{"--https-listen-port", s.apiPortString()}
+	if s.APIServerAddress != "" {
+		args = append(args, "--tls-san", s.APIServerAddress)
+	}
+	if s.InNetworkKubeconfig {
+		args = append(args, "--tls-san", GetContainerName("server", s.Name, -1))
+	}
+	if s.WriteKubeconfigMode != "" {
+		args = append(args, "--write-kubeconfig-mode", s.WriteKubeconfigMode)
+	}
+	if s.NoServerWorkloads {
+		args = append(args, "--node-taint", noServerWorkloadsTaint)
+	}
+	args = append(args, taintArgs(s.nodeTaints("server", GetContainerName("server", s.Name, -1)))...)
+	if s.Rootless {
+		args = append(args, "--rootless")
+	}
+	if s.NodeNameTemplate != "" {
+		args = append(args, "--node-name", GetContainerName("server", s.Name, -1))
+	}
+	for _, arg := range []struct{ flag, value string }{
+		{"--cluster-domain", s.ClusterDomain},
+		{"--cluster-dns", s.ClusterDNS},
+		{"--cluster-cidr", s.ClusterCIDR},
+		{"--service-cidr", s.ServiceCIDR},
+	} {
+		if arg.value != "" {
+			args = append(args, arg.flag, arg.value)
+		}
+	}
+	args = append(args, s.resolvConfArgs()...)
+	args = append(args, s.componentArgs()...)
+	return append(args, s.ServerArgs...)
+}
+
+// k3sAgentArgs returns the arguments passed to `k3s agent` for the worker with the given index
+func (s *clusterSpec) k3sAgentArgs(index int) []string {
+	args := taintArgs(s.nodeTaints("worker", GetContainerName("worker", s.Name, index)))
+	if s.Rootless {
+		args = append(args, "--rootless")
+	}
+	if s.NodeNameTemplate != "" {
+		args = append(args, "--node-name", GetContainerName("worker", s.Name, index))
+	}
+	args = append(args, s.resolvConfArgs()...)
+	return append(args, s.componentArgs()...)
+}
+
+// nodeImage returns the image of a node, which is the committed image of the node for clusters created from a commit
+func (s *clusterSpec) nodeImage(role string, index int) string {
+	image := s.Image
+	if role == "worker" {
+		image = s.workerImage()
+	}
+	if s.Commit == "" || (role == "worker" && index >= s.CommitWorkers) {
+		return image
+	}
+	if committed, err := commitNodeImage(s.Commit, role, index); err == nil {
+		return committed
+	}
+	return image
+}
+
+// workerImage returns the image of the workers not created from a commit: the agent image if set, the image otherwise
+func (s *clusterSpec) workerImage() string {
+	if s.AgentImage != "" {
+		return s.AgentImage
+	}
+	return s.Image
+}
+
+// requiredImages returns the images creating the cluster needs: the images of the nodes and of the helper containers
+func (s *clusterSpec) requiredImages() []string {
+	images := []string{s.nodeImage("server", -1)}
+	for i := 0; i < s.Workers; i++ {
+		if image := s.nodeImage("worker", i); !containsString(images, image) {
+			images = append(images, image)
+		}
+	}
+	if s.exposesContainerd() {
+		images = append(images, containerdProxyImage)
+	}
+	return images
+}
+
+// kubeconfigOutputPath returns the path of the kubeconfig k3d reads from the server container
+func (s *clusterSpec) kubeconfigOutputPath() string {
+	if s.NoKubeconfigOutput {
+		return k3sKubeconfigPath
+	}
+	if s.KubeconfigOutput != "" {
+		return path.Clean(s.KubeconfigOutput)
+	}
+	return defaultKubeconfigOutput
+}
+
+// kubeconfigEnv returns the environment of the server telling k3s where to write the kubeconfig for k3d
+func (s *clusterSpec) kubeconfigEnv() []string {
+	if s.NoKubeconfigOutput {
+		return []string{}
+	}
+	return []string{fmt.Sprintf("K3S_KUBECONFIG_OUTPUT=%s", s.kubeconfigOutputPath())}
+}
+
+// checkHostPortConflicts checks that no host port is published more than once by the nodes of the cluster, including the API port
+func (s *clusterSpec) checkHostPortConflicts(portmap map[string][]string) error {
+	serverName := GetContainerName("server", s.Name, -1)
+	serverSpecs, err := MergePortSpecs(portmap, "server", serverName)
+	if err != nil {
+		return err
+	}
+	apiPortSpec := fmt.Sprintf("0.0.0.0:%d:%d/tcp", s.APIPort, s.APIPort)
+	nodes := []nodePortSpecs{{node: serverName, specs: append(serverSpecs, apiPortSpec)}}
+
+	for i := 0; i < s.Workers; i++ {
+		workerName := GetContainerName("worker", s.Name, i)
+		workerSpecs, err := MergePortSpecs(portmap, "worker", workerName)
+		if err != nil {
+			return err
+		}
+		node := nodePortSpecs{node: workerName, specs: workerSpecs}
+		if s.PortAutoOffset > 0 {
+			node.offset = i + s.PortAutoOffset
+		}
+		nodes = append(nodes, node)
+	}
+	return checkHostPortConflicts(nodes)
+}
+
+// securityOptions returns the privileges of the node containers
+func (s *clusterSpec) securityOptions() nodeSecurityOptions {
+	return nodeSecurityOptions{rootless: s.Rootless, noPrivileged: s.NoPrivileged}
+}
+
+// storageOptions returns the filesystems of the node container with the given role and name
+func (s *clusterSpec) storageOptions(role, containerName string) nodeStorageOptions {
+	// unknown node specifiers are reported by validate already
+	nodeToTmpfsMap, _ := mapNodesToSpecs("tmpfs", s.Tmpfs, GetAllContainerNames(s.Name, defaultServerCount, s.Workers))
+	tmpfs, _ := MergePortSpecs(nodeToTmpfsMap, role, containerName)
+	return nodeStorageOptions{
+		tmpfsSize:   s.TmpfsSize,
+		storageSize: s.StorageSize,
+		tmpfs:       tmpfs,
+		readOnly:    s.ReadOnly,
+	}
+}
+
+// apiPortString returns the API port in the format used for docker port specs and k3s args
+func (s *clusterSpec) apiPortString() string {
+	return strconv.Itoa(s.APIPort)
+}
+
+// clusterLabels returns the labels set on all nodes of the cluster in addition to the common k3d labels
+func (s *clusterSpec) clusterLabels() map[string]string {
+	labels := map[string]string{}
+	if s.Group != "" {
+		labels[groupLabel] = s.Group
+	}
+	if len(s.EnvPassthrough) > 0 {
+		labels[envPassthroughLabel] = strings.Join(s.EnvPassthrough, ",")
+	}
+	if s.InNetworkKubeconfig {
+		labels[inNetworkKubeconfigLabel] = "true"
+	}
+	if s.Protected {
+		labels[protectedLabel] = "true"
+	}
+	if s.TTL != "" {
+		labels[ttlLabel] = s.TTL
+	}
+	// the port specs are applied to workers added later on, also if the stored spec is lost
+	if len(s.Ports) > 0 {
+		labels[portSpecsLabel] = strings.Join(s.Ports, portSpecsLabelSeparator)
+	}
+	if s.PortAutoOffset > 0 {
+		labels[portAutoOffsetLabel] = strconv.Itoa(s.PortAutoOffset)
+	}
+	return labels
+}
+
+// loadClusterSpec reads a cluster spec file, rejecting unknown fields
+func loadClusterSpec(specPath string) (*clusterSpec, error) {
+	content, err := os.ReadFile(specPath)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't read cluster spec %s\n%w", specPath, err)
+	}
+
+	spec, errs := parseClusterSpec(content)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("ERROR: invalid cluster spec %s\n%s", specPath, formatSpecErrors(specPath, errs))
+	}
+	if err := setNodeNameTemplate(spec.Name, spec.NodeNameTemplate); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// getClusterSpecPath returns the path of the spec stored in the cluster directory
+func getClusterSpecPath(cluster string) (string, error) {
+	clusterDir, err := getClusterDir(cluster)
+	return path.Join(clusterDir, clusterSpecFileName), err
+}
+
+// writeClusterSpec stores the spec a cluster was created (or last applied) with in the cluster directory
+func writeClusterSpec(spec *clusterSpec) error {
+	specPath, err := getClusterSpecPath(spec.Name)
+	if err != nil {
+		return err
+	}
+
+	content, err := yaml.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't serialize cluster spec\n%w", err)
+	}
+
+	if err := os.WriteFile(specPath, content, 0644); err != nil {
+		return fmt.Errorf("ERROR: couldn't write cluster spec %s\n%w", specPath, err)
+	}
+	return nil
+}
+
+// maxKubeletSkew returns how many minor versions the kubelets may be older than the API server with the given minor
+// version, following the version skew policy of Kubernetes (3 since v1.28, 2 before)
+func maxKubeletSkew(serverMinor int) int {
+	if serverMinor >= 28 {
+		return 3
+	}
+	return 2
+}
+
+// checkAgentVersionSkew checks that workers running the agent image are supported by a server running the image:
+// they must not be newer and not more minor versions older than the skew policy allows
+func checkAgentVersionSkew(image, agentImage string) error {
+	if image == agentImage {
+		return nil
+	}
+	serverVersion, serverOK := getK3sImageVersion(image)
+	agentVersion, agentOK := getK3sImageVersion(agentImage)
+	if !serverOK || !agentOK {
+		logWarningf("can't determine the k3s versions of %s and %s, skipping the version skew check", image, agentImage)
+		return nil
+	}
+	server, _ := parseVersion(serverVersion)
+	agent, _ := parseVersion(agentVersion)
+	if server[0] != agent[0] || agent[1] > server[1] {
+		return fmt.Errorf("ERROR: the workers (k3s %s) must not be newer than the server (k3s %s)", agentVersion, serverVersion)
+	}
+	if skew := server[1] - agent[1]; skew > maxKubeletSkew(server[1]) {
+		return fmt.Errorf("ERROR: the workers (k3s %s) are %d minor versions older than the server (k3s %s), at most %d are supported", agentVersion, skew, serverVersion, maxKubeletSkew(server[1]))
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package run
+
+/*
+ * The functions in this file open interactive shells in node containers,
+ * so that users don't have to look up container names for `docker exec`.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/moby/term"
+	"github.com/urfave/cli"
+)
+
+// getNodeContainer resolves a node specifier to a container of the given cluster.
+// The node can be given as full container name (k3d-<cluster>-worker-0) or
+// relative to the cluster (server, worker-0). An empty node selects the server.
+func getNodeContainer(cl cluster, node string) (types.Container, error) {
+	if node == "" || node == "server" || node == "master" {
+		return cl.server, nil
+	}
+
+	candidates := []string{node, fmt.Sprintf("%s-%s-%s", containerNamePrefix, cl.name, node)}
+	for _, c := range append([]types.Container{cl.server}, cl.workers...) {
+		for _, name := range c.Names {
+			name = strings.TrimPrefix(name, "/")
+			for _, candidate := range candidates {
+				if name == candidate {
+					return c, nil
+				}
+			}
+		}
+	}
+
+	return types.Container{}, fmt.Errorf("ERROR: no node [%s] found in cluster %s", node, cl.name)
+}
+
+// execInteractive runs a command with a TTY attached to the current terminal inside of a container
+func execInteractive(ID string, cmd []string) (int, error) {
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return -1, fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	stdinFd, isTerminal := term.GetFdInfo(os.Stdin)
+
+	logDebugf("ContainerExecCreate %s: %v (tty=%t)", ID, cmd, isTerminal)
+	exec, err := docker.ContainerExecCreate(ctx, ID, types.ExecConfig{
+		Cmd:          cmd,
+		Tty:          isTerminal,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return -1, fmt.Errorf("ERROR: couldn't create exec in container %s\n%w", ID, err)
+	}
+
+	resp, err := docker.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{Tty: isTerminal})
+	if err != nil {
+		return -1, fmt.Errorf("ERROR: couldn't attach to exec in container %s\n%w", ID, err)
+	}
+	defer resp.Close()
+
+	if isTerminal {
+		state, err := term.SetRawTerminal(stdinFd)
+		if err != nil {
+			return -1, fmt.Errorf("ERROR: couldn't set terminal to raw mode\n%w", err)
+		}
+		defer term.RestoreTerminal(stdinFd, state)
+
+		if size, err := term.GetWinsize(stdinFd); err == nil {
+			if err := docker.ContainerExecResize(ctx, exec.ID, container.ResizeOptions{Height: uint(size.Height), Width: uint(size.Width)}); err != nil {
+				logDebugf("couldn't resize exec TTY: %+v", err)
+			}
+		}
+	}
+
+	go func() {
+		io.Copy(resp.Conn, os.Stdin)
+		resp.CloseWrite()
+	}()
+	if isTerminal {
+		io.Copy(os.Stdout, resp.Reader)
+	} else {
+		// without TTY, docker multiplexes stdout and stderr into one stream
+		stdcopy.StdCopy(os.Stdout, os.Stderr, resp.Reader)
+	}
+
+	inspect, err := docker.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return -1, fmt.Errorf("ERROR: couldn't inspect exec in container %s\n%w", ID, err)
+	}
+	return inspect.ExitCode, nil
+}
+
+// SSH opens an interactive shell in a node container of a cluster
+func SSH(c *cli.Context) error {
+	clusterName := c.Args().Get(0)
+	if clusterName == "" {
+		clusterName = c.String("name")
+	}
+
+	clusters, err := getClusters(false, clusterName)
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[clusterName]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, clusterName)
+	}
+
+	node, err := getNodeContainer(cl, c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	if node.State != "running" {
+		return fmt.Errorf("ERROR: node %s of cluster %s is not running (state: %s)", strings.TrimPrefix(node.Names[0], "/"), clusterName, node.State)
+	}
+
+	exitCode, err := execInteractive(node.ID, []string{c.String("shell")})
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return cli.NewExitError("", exitCode)
+	}
+	return nil
+}
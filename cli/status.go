@@ -0,0 +1,132 @@
+package run
+
+/*
+ * The functions in this file show the state of the node containers of clusters (`k3d status`),
+ * including how often docker restarted them and whether the kernel killed them for lack of memory.
+ */
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/urfave/cli"
+)
+
+// nodeStatus is the state of a node container
+type nodeStatus struct {
+	cluster      string
+	node         string
+	role         string
+	state        string
+	restartCount int
+	oomKilled    bool
+	startedAt    time.Time
+}
+
+// getNodeStatus inspects a node container for its state and restarts
+func getNodeStatus(ctx context.Context, docker *client.Client, clusterName string, node types.Container) (nodeStatus, error) {
+	logDebugf("ContainerInspect %s", node.ID)
+	inspect, err := docker.ContainerInspect(ctx, node.ID)
+	if err != nil {
+		return nodeStatus{}, fmt.Errorf("ERROR: couldn't inspect node %s\n%w", getContainerShortName(node), err)
+	}
+	status := nodeStatus{
+		cluster:      clusterName,
+		node:         getContainerShortName(node),
+		role:         node.Labels["component"],
+		restartCount: inspect.RestartCount,
+	}
+	if inspect.State != nil {
+		status.state = inspect.State.Status
+		status.oomKilled = inspect.State.OOMKilled
+		status.startedAt, _ = time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+	}
+	return status, nil
+}
+
+// row returns the table row of the node status
+func (s nodeStatus) row() []string {
+	since := "-"
+	if s.state == "running" && !s.startedAt.IsZero() {
+		since = units.HumanDuration(time.Since(s.startedAt))
+	}
+	oomKilled := "no"
+	if s.oomKilled {
+		oomKilled = "yes"
+	}
+	return []string{s.cluster, s.node, s.role, s.state, since, strconv.Itoa(s.restartCount), oomKilled}
+}
+
+// flapping reports whether docker keeps restarting the node or the kernel killed it for lack of memory
+func (s nodeStatus) flapping() bool {
+	return s.restartCount > 0 || s.oomKilled || s.state == "restarting"
+}
+
+// warnFlappingNode points at memory limits if a node is flapping, restarts counts only since restartsBefore
+func warnFlappingNode(s nodeStatus, restartsBefore int) {
+	s.restartCount -= restartsBefore
+	if !s.flapping() {
+		return
+	}
+	if s.oomKilled {
+		logWarningf("node %s of cluster %s was killed for lack of memory and restarted %d times, give docker more memory (see `k3d info`) or run fewer nodes", s.node, s.cluster, s.restartCount)
+		return
+	}
+	logWarningf("node %s of cluster %s is %s and restarted %d times, it may be short on memory (see `k3d info` and `docker logs %s`)", s.node, s.cluster, s.state, s.restartCount, s.node)
+}
+
+// Status prints the state, the uptime, the restart count and whether the node was OOM killed for every node of the
+// selected clusters: `k3d status [--name <cluster> | --all | --group <group>]`
+func Status(c *cli.Context) error {
+	clusters, err := getSelectedClusters(c)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	statuses := []nodeStatus{}
+	for name, cl := range clusters {
+		for _, node := range append([]types.Container{cl.server}, cl.workers...) {
+			status, err := getNodeStatus(ctx, docker, name, node)
+			if err != nil {
+				return err
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	if len(statuses) == 0 {
+		logInfof("No clusters found!")
+		return nil
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].cluster != statuses[j].cluster {
+			return statuses[i].cluster < statuses[j].cluster
+		}
+		if statuses[i].role != statuses[j].role {
+			return statuses[i].role == "server"
+		}
+		return statuses[i].node < statuses[j].node
+	})
+
+	table := newTable([]string{"CLUSTER", "NODE", "ROLE", "STATE", "UP", "RESTARTS", "OOM KILLED"})
+	table.SetAutoMergeCellsByColumnIndex([]int{0})
+	for _, status := range statuses {
+		table.Append(status.row())
+	}
+	table.Render()
+
+	for _, status := range statuses {
+		warnFlappingNode(status, 0)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validTaintEffects are the taint effects supported by Kubernetes
+var validTaintEffects = []string{"NoSchedule", "PreferNoSchedule", "NoExecute"}
+
+// validateTaintSpecs checks taint specs in the format key[=value]:Effect[@node-specifier[,node-specifier...]]
+func validateTaintSpecs(specs []string) error {
+	for _, spec := range specs {
+		taint, nodes, err := parseNodeSpec(spec)
+		if err != nil {
+			return err
+		}
+
+		keyValue, effect, found := strings.Cut(taint, ":")
+		if !found {
+			return fmt.Errorf("ERROR: Invalid taint [%s], expected key[=value]:Effect[@node-specifier[,node-specifier...]]", spec)
+		}
+		key := strings.SplitN(keyValue, "=", 2)[0]
+		if key == "" {
+			return fmt.Errorf("ERROR: Invalid taint [%s], the key must not be empty", spec)
+		}
+
+		validEffect := false
+		for _, e := range validTaintEffects {
+			if effect == e {
+				validEffect = true
+			}
+		}
+		if !validEffect {
+			return fmt.Errorf("ERROR: Invalid taint effect [%s] in [%s] (supported: %s)", effect, spec, strings.Join(validTaintEffects, ", "))
+		}
+
+		for _, node := range nodes {
+			if err := validateNodeSpecifier(node); err != nil {
+				return fmt.Errorf("ERROR: Invalid node-specifier [%s] in taint [%s]\n%w", node, spec, err)
+			}
+		}
+	}
+	return nil
+}
+
+// mapNodesToTaints maps node specifiers (roles or node names) to the taints that should be applied to them
+func mapNodesToTaints(specs []string, createdNodes []string) (map[string][]string, error) {
+	return mapNodesToSpecs("taint", specs, createdNodes)
+}
+
+// taintArgs turns a list of taints into k3s --node-taint arguments
+func taintArgs(taints []string) []string {
+	args := []string{}
+	for _, taint := range taints {
+		args = append(args, "--node-taint", taint)
+	}
+	return args
+}
@@ -0,0 +1,80 @@
+package run
+
+/*
+ * The functions in this file measure the phases of a cluster creation and print a summary.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// supported values of --summary
+var summaryFormats = []string{"text", "json", "none"}
+
+// creationPhase is a measured phase of a cluster creation
+type creationPhase struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// creationTimings collects the durations of the phases of a cluster creation
+type creationTimings struct {
+	Cluster      string          `json:"cluster"`
+	Phases       []creationPhase `json:"phases"`
+	TotalSeconds float64         `json:"totalSeconds"`
+
+	start time.Time
+	lock  sync.Mutex // phases may be tracked concurrently
+}
+
+func newCreationTimings(cluster string) *creationTimings {
+	return &creationTimings{Cluster: cluster, Phases: []creationPhase{}, start: time.Now()}
+}
+
+// track records a phase that started at since and ended now
+func (t *creationTimings) track(name string, since time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.Phases = append(t.Phases, creationPhase{Name: name, Seconds: time.Since(since).Seconds()})
+}
+
+// validateSummaryFormat checks the value of --summary
+func validateSummaryFormat(format string) error {
+	for _, f := range summaryFormats {
+		if format == f || format == "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("ERROR: unknown summary format [%s] (supported: %s)", format, strings.Join(summaryFormats, ", "))
+}
+
+// print prints the summary in the given format: a log line for text, a JSON object on stdout for json
+func (t *creationTimings) print(format string) {
+	t.TotalSeconds = time.Since(t.start).Seconds()
+
+	switch format {
+	case "json":
+		if err := json.NewEncoder(os.Stdout).Encode(t); err != nil {
+			logWarningf("couldn't print creation summary\n%+v", err)
+		}
+	case "none":
+	default:
+		phases := []string{}
+		for _, phase := range t.Phases {
+			phases = append(phases, fmt.Sprintf("%s %s", phase.Name, formatSeconds(phase.Seconds)))
+		}
+		phases = append(phases, fmt.Sprintf("total %s", formatSeconds(t.TotalSeconds)))
+		log.Printf("Creation of cluster [%s] took: %s", t.Cluster, strings.Join(phases, ", "))
+	}
+}
+
+// formatSeconds renders a duration in seconds rounded to a human readable precision
+func formatSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(100 * time.Millisecond).String()
+}
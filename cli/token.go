@@ -0,0 +1,223 @@
+package run
+
+/*
+ * The functions in this file rotate the token of a cluster (`k3d rotate-token`).
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/urfave/cli"
+)
+
+// tokenRotationTimeout is the time a recreated server may take until its kubelet is running again
+const tokenRotationTimeout = 3 * time.Minute
+
+// replaceTokenEnv returns env with all token variables replaced by K3S_TOKEN=token
+func replaceTokenEnv(env []string, token string) []string {
+	newEnv := []string{}
+	for _, e := range env {
+		if !strings.HasPrefix(e, "K3S_CLUSTER_SECRET=") && !strings.HasPrefix(e, "K3S_TOKEN=") {
+			newEnv = append(newEnv, e)
+		}
+	}
+	return append(newEnv, fmt.Sprintf("K3S_TOKEN=%s", token))
+}
+
+// nodeStatePath is the configuration of a node outside of its volumes, e.g. the node password
+// the server checks when the node registers again
+const nodeStatePath = "/etc/rancher"
+
+// recreateNodeWithToken recreates a node container with a new token in its environment
+func recreateNodeWithToken(ctx context.Context, docker *client.Client, ID, token string) (string, error) {
+	return recreateNode(ctx, docker, ID, func(config *container.Config) {
+		config.Env = replaceTokenEnv(config.Env, token)
+	})
+}
+
+// recreateNode recreates a node container with a config changed by update, e.g. with new labels or environment variables.
+// The data of the node lives in the (anonymous) volumes of the k3s image, which are mounted into the new container,
+// its configuration in nodeStatePath is copied over. The old container is only removed after the new one started,
+// otherwise it's restored.
+func recreateNode(ctx context.Context, docker *client.Client, ID string, update func(config *container.Config)) (string, error) {
+	logDebugf("ContainerInspect %s", ID)
+	inspect, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return "", fmt.Errorf("ERROR: couldn't inspect container %s\n%w", ID, err)
+	}
+	name := strings.TrimPrefix(inspect.Name, "/")
+
+	config := inspect.Config
+	update(config)
+
+	hostConfig := inspect.HostConfig
+	bound := map[string]bool{}
+	for _, bind := range hostConfig.Binds {
+		if parts := strings.Split(bind, ":"); len(parts) > 1 {
+			bound[parts[1]] = true
+		}
+	}
+	for _, m := range inspect.Mounts {
+		if m.Type == mount.TypeVolume && m.Name != "" && !bound[m.Destination] {
+			hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{Type: mount.TypeVolume, Source: m.Name, Target: m.Destination})
+		}
+	}
+
+	networkingConfig := &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{}}
+	for networkName, endpoint := range inspect.NetworkSettings.Networks {
+		networkingConfig.EndpointsConfig[networkName] = &network.EndpointSettings{Aliases: endpoint.Aliases}
+	}
+
+	// keep the old container around until the new one is running
+	oldName := name + "-recreating"
+	logDebugf("ContainerStop %s", ID)
+	if err := docker.ContainerStop(ctx, ID, container.StopOptions{}); err != nil {
+		return "", fmt.Errorf("ERROR: couldn't stop container %s\n%w", name, err)
+	}
+	if err := docker.ContainerRename(ctx, ID, oldName); err != nil {
+		return "", fmt.Errorf("ERROR: couldn't rename container %s\n%w", name, err)
+	}
+	restore := func() {
+		if err := docker.ContainerRename(ctx, ID, name); err != nil {
+			logWarningf("couldn't rename container %s back to %s\n%+v", oldName, name, err)
+		}
+		if err := docker.ContainerStart(ctx, ID, container.StartOptions{}); err != nil {
+			logWarningf("couldn't restart container %s\n%+v", name, err)
+		}
+	}
+
+	logContainerConfig(name, config, hostConfig)
+	resp, err := docker.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, name)
+	if err != nil {
+		restore()
+		return "", fmt.Errorf("ERROR: couldn't recreate container %s\n%w", name, err)
+	}
+	if err := copyContainerDir(ctx, docker, ID, resp.ID, nodeStatePath); err != nil {
+		logDebugf("couldn't copy %s of container %s: %+v", nodeStatePath, name, err)
+	}
+	if err := docker.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		if err := docker.ContainerRemove(ctx, resp.ID, container.RemoveOptions{Force: true}); err != nil {
+			logWarningf("couldn't remove container %s\n%+v", resp.ID, err)
+		}
+		restore()
+		return "", fmt.Errorf("ERROR: couldn't start recreated container %s\n%w", name, err)
+	}
+
+	// the volumes are used by the new container now, so they must not be removed with the old one
+	logDebugf("ContainerRemove %s", ID)
+	if err := docker.ContainerRemove(ctx, ID, container.RemoveOptions{Force: true}); err != nil {
+		logWarningf("couldn't remove old container %s\n%+v", oldName, err)
+	}
+	return resp.ID, nil
+}
+
+// copyContainerDir copies a directory from one container to the same place in another one, which may both be stopped
+func copyContainerDir(ctx context.Context, docker *client.Client, fromID, toID, dir string) error {
+	logDebugf("CopyFromContainer %s:%s", fromID, dir)
+	reader, _, err := docker.CopyFromContainer(ctx, fromID, dir)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	logDebugf("CopyToContainer %s:%s", toID, path.Dir(dir))
+	return docker.CopyToContainer(ctx, toID, path.Dir(dir), reader, types.CopyToContainerOptions{})
+}
+
+// getClusterToken returns the current token of a cluster
+func getClusterToken(ctx context.Context, docker *client.Client, server types.Container) (string, error) {
+	tokenEnv, err := getClusterTokenEnv(ctx, docker, server)
+	if err != nil {
+		return "", err
+	}
+	// K3S_TOKEN takes precedence over the deprecated K3S_CLUSTER_SECRET in k3s
+	token := ""
+	for _, e := range tokenEnv {
+		key, value, _ := strings.Cut(e, "=")
+		if key == "K3S_TOKEN" || token == "" {
+			token = value
+		}
+	}
+	return token, nil
+}
+
+// RotateToken generates a new token for a cluster and recreates its nodes with it: `k3d rotate-token [cluster]`.
+// The server is recreated first, then the workers one after another, all keeping their data.
+func RotateToken(c *cli.Context) error {
+	name := DefaultK3sClusterName
+	if c.NArg() > 0 {
+		name = c.Args().First()
+	}
+
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[name]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, name)
+	}
+	if cl.server.State != "running" {
+		return fmt.Errorf("ERROR: cluster %s has to be running to rotate its token", name)
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	oldToken, err := getClusterToken(ctx, docker, cl.server)
+	if err != nil {
+		return err
+	}
+	newToken := GenerateRandomString(20)
+
+	// the datastore is encrypted with the token, so k3s has to re-encrypt it before the server can use the new one
+	log.Printf("Rotating token of cluster %s...", name)
+	output, exitCode, err := execInContainer(ctx, docker, cl.server.ID, []string{"k3s", "token", "rotate", "--token", oldToken, "--new-token", newToken})
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("ERROR: k3s couldn't rotate the token (requires k3s >= v1.28)\n%s", strings.TrimSpace(output))
+	}
+
+	log.Printf("Recreating server of cluster %s", name)
+	serverID, err := recreateNodeWithToken(ctx, docker, cl.server.ID, newToken)
+	if err != nil {
+		return err
+	}
+	waitCtx, cancel := newWaitContext(tokenRotationTimeout)
+	defer cancel()
+	readyLogPattern, err := compileReadyLogPattern("", cl.server.Image)
+	if err != nil {
+		return err
+	}
+	if err := waitForLogLine(waitCtx, serverID, readyLogPattern, nil); err != nil {
+		return fmt.Errorf("ERROR: server of cluster %s didn't come up with the new token\n%w", name, err)
+	}
+
+	for _, worker := range cl.workers {
+		log.Printf("Recreating worker %s", getContainerShortName(worker))
+		if _, err := recreateNodeWithToken(ctx, docker, worker.ID, newToken); err != nil {
+			return err
+		}
+	}
+
+	if err := writeClusterMetadata(name); err != nil {
+		logWarningf("couldn't store cluster metadata\n%+v", err)
+	}
+
+	logSuccessf("rotated token of cluster %s", name)
+	return nil
+}
@@ -0,0 +1,205 @@
+package run
+
+/*
+ * The functions in this file run one-off helper containers (e.g. nicolaka/netshoot or bitnami/kubectl) in the network
+ * of a cluster, with a kubeconfig reaching the API by the name of the server: `k3d tools <cluster> -- <image> [cmd]`.
+ */
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/moby/term"
+	"github.com/urfave/cli"
+)
+
+const (
+	// toolsKubeconfigDir and toolsKubeconfigName are where the kubeconfig is put into tools containers, KUBECONFIG points to it
+	toolsKubeconfigDir  = "/k3d"
+	toolsKubeconfigName = "kubeconfig.yaml"
+)
+
+// parseToolsArgs splits the arguments of `k3d tools [cluster] -- <image> [cmd...]`
+func parseToolsArgs(args []string) (string, string, []string, error) {
+	cluster := DefaultK3sClusterName
+	if len(args) > 0 && args[0] != "--" {
+		cluster, args = args[0], args[1:]
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return "", "", nil, fmt.Errorf("ERROR: please specify the image of the tools container: `k3d tools [cluster] -- <image> [command...]`")
+	}
+	return cluster, args[0], args[1:], nil
+}
+
+// getToolsKubeConfig returns the kubeconfig of a cluster for containers in its network,
+// which reaches the API by the name of the server and the port it listens on
+func getToolsKubeConfig(cl cluster) ([]byte, error) {
+	kubeConfigPath, err := getKubeConfig(cl.name)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(kubeConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't read kubeconfig %s\n%w", kubeConfigPath, err)
+	}
+	return setKubeConfigServerHost(content, getContainerShortName(cl.server), cl.server.Labels["apiPort"])
+}
+
+// copyToolsKubeConfig puts the kubeconfig into a created tools container. It's copied instead of bind-mounted, so that
+// images running as another user (e.g. bitnami/kubectl) can read it while the file on the host stays private.
+func copyToolsKubeConfig(ctx context.Context, docker *client.Client, ID string, kubeconfig []byte) error {
+	archive := new(bytes.Buffer)
+	tw := tar.NewWriter(archive)
+	if err := tw.WriteHeader(&tar.Header{Name: strings.TrimPrefix(toolsKubeconfigDir, "/") + "/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: strings.TrimPrefix(toolsKubeconfigDir, "/") + "/" + toolsKubeconfigName, Mode: 0644, Size: int64(len(kubeconfig))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(kubeconfig); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	logDebugf("CopyToContainer %s:%s", ID, toolsKubeconfigDir)
+	if err := docker.CopyToContainer(ctx, ID, "/", archive, types.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("ERROR: couldn't copy the kubeconfig into the tools container\n%w", err)
+	}
+	return nil
+}
+
+// Tools runs a one-off helper container in the network of a cluster with its kubeconfig:
+// `k3d tools [cluster] -- <image> [command...]`. The container is removed when the command exits.
+func Tools(c *cli.Context) error {
+	clusterName, image, cmd, err := parseToolsArgs(c.Args())
+	if err != nil {
+		return err
+	}
+	clusters, err := getClusters(false, clusterName)
+	if err != nil {
+		return err
+	}
+	cl, ok := clusters[clusterName]
+	if !ok {
+		return fmt.Errorf("ERROR: %w: %s", ErrClusterNotFound, clusterName)
+	}
+	if cl.server.State != "running" {
+		return fmt.Errorf("ERROR: cluster %s is not running (status: %s)", clusterName, cl.status)
+	}
+	kubeconfig, err := getToolsKubeConfig(cl)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+	if err := ensureImage(ctx, docker, image); err != nil {
+		return err
+	}
+
+	stdinFd, isTerminal := term.GetFdInfo(os.Stdin)
+	config := &container.Config{
+		Image:        image,
+		Cmd:          cmd,
+		Env:          []string{fmt.Sprintf("KUBECONFIG=%s/%s", toolsKubeconfigDir, toolsKubeconfigName)},
+		Tty:          isTerminal,
+		OpenStdin:    true,
+		StdinOnce:    true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		// no cluster label, the container isn't a node of the cluster
+		Labels: map[string]string{
+			"app":       "k3d",
+			"prefix":    containerNamePrefix,
+			"component": "tools",
+		},
+	}
+	hostConfig := &container.HostConfig{
+		NetworkMode: container.NetworkMode(getClusterNetworkName(clusterName)),
+	}
+	networkingConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			getClusterNetworkName(clusterName): {},
+		},
+	}
+	name := fmt.Sprintf("%s-%s-tools-%s", containerNamePrefix, clusterName, strings.ToLower(GenerateRandomString(5)))
+	logContainerConfig(name, config, hostConfig)
+	resp, err := docker.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, name)
+	if err != nil {
+		return checkDockerError(fmt.Errorf("ERROR: couldn't create tools container\n%w", err))
+	}
+	defer func() {
+		logDebugf("ContainerRemove %s", resp.ID)
+		if err := docker.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{Force: true}); err != nil {
+			logWarningf("couldn't remove tools container %s\n%+v", name, err)
+		}
+	}()
+	if err := copyToolsKubeConfig(ctx, docker, resp.ID, kubeconfig); err != nil {
+		return err
+	}
+
+	logDebugf("ContainerAttach %s", resp.ID)
+	attach, err := docker.ContainerAttach(ctx, resp.ID, container.AttachOptions{Stream: true, Stdin: true, Stdout: true, Stderr: true})
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't attach to tools container\n%w", err)
+	}
+	defer attach.Close()
+
+	waitCh, errCh := docker.ContainerWait(ctx, resp.ID, container.WaitConditionNextExit)
+	logDebugf("ContainerStart %s", resp.ID)
+	if err := docker.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("ERROR: couldn't start tools container\n%w", err)
+	}
+
+	if isTerminal {
+		state, err := term.SetRawTerminal(stdinFd)
+		if err != nil {
+			return fmt.Errorf("ERROR: couldn't set terminal to raw mode\n%w", err)
+		}
+		defer term.RestoreTerminal(stdinFd, state)
+
+		if size, err := term.GetWinsize(stdinFd); err == nil {
+			if err := docker.ContainerResize(ctx, resp.ID, container.ResizeOptions{Height: uint(size.Height), Width: uint(size.Width)}); err != nil {
+				logDebugf("couldn't resize tools container TTY: %+v", err)
+			}
+		}
+	}
+
+	go func() {
+		io.Copy(attach.Conn, os.Stdin)
+		attach.CloseWrite()
+	}()
+	if isTerminal {
+		io.Copy(os.Stdout, attach.Reader)
+	} else {
+		stdcopy.StdCopy(os.Stdout, os.Stderr, attach.Reader)
+	}
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("ERROR: couldn't wait for tools container\n%w", err)
+	case result := <-waitCh:
+		if result.StatusCode != 0 {
+			return cli.NewExitError("", int(result.StatusCode))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package run
+
+/*
+ * The functions in this file show the resource usage of the cluster nodes (`k3d top`),
+ * like `docker stats` but grouped by cluster and role.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/urfave/cli"
+)
+
+// nodeStats is the resource usage of a node container
+type nodeStats struct {
+	cluster  string
+	node     string
+	role     string
+	cpu      float64 // in percent of one CPU
+	memUsage uint64
+	memLimit uint64
+	netRx    uint64
+	netTx    uint64
+}
+
+// cpuPercent returns the CPU usage in percent of one CPU between the two samples of a stats response,
+// computed like `docker stats` does
+func cpuPercent(stats *types.StatsJSON) float64 {
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0
+	}
+	onlineCPUs := float64(stats.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	return cpuDelta / systemDelta * onlineCPUs * 100
+}
+
+// memoryUsage returns the memory used by a container without the page cache it could give back,
+// the cache is reported as total_inactive_file with cgroup v1 and inactive_file with cgroup v2
+func memoryUsage(stats types.MemoryStats) uint64 {
+	for _, key := range []string{"total_inactive_file", "inactive_file"} {
+		if inactive, ok := stats.Stats[key]; ok && inactive < stats.Usage {
+			return stats.Usage - inactive
+		}
+	}
+	return stats.Usage
+}
+
+// newNodeStats returns the resource usage of a node from a stats response
+func newNodeStats(clusterName string, node types.Container, stats *types.StatsJSON) nodeStats {
+	s := nodeStats{
+		cluster:  clusterName,
+		node:     getContainerShortName(node),
+		role:     node.Labels["component"],
+		cpu:      cpuPercent(stats),
+		memUsage: memoryUsage(stats.MemoryStats),
+		memLimit: stats.MemoryStats.Limit,
+	}
+	for _, network := range stats.Networks {
+		s.netRx += network.RxBytes
+		s.netTx += network.TxBytes
+	}
+	return s
+}
+
+// row returns the table row of the resource usage
+func (s nodeStats) row() []string {
+	memPercent := 0.0
+	if s.memLimit > 0 {
+		memPercent = float64(s.memUsage) / float64(s.memLimit) * 100
+	}
+	return []string{
+		s.cluster,
+		s.node,
+		s.role,
+		fmt.Sprintf("%.2f%%", s.cpu),
+		fmt.Sprintf("%s / %s", units.BytesSize(float64(s.memUsage)), units.BytesSize(float64(s.memLimit))),
+		fmt.Sprintf("%.2f%%", memPercent),
+		fmt.Sprintf("%s / %s", units.HumanSize(float64(s.netRx)), units.HumanSize(float64(s.netTx))),
+	}
+}
+
+// printNodeStats prints the resource usage of the nodes grouped by cluster, servers first,
+// the footer sums up CPU and memory of all nodes
+func printNodeStats(stats []nodeStats) {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].cluster != stats[j].cluster {
+			return stats[i].cluster < stats[j].cluster
+		}
+		if stats[i].role != stats[j].role {
+			return stats[i].role == "server"
+		}
+		return stats[i].node < stats[j].node
+	})
+
+	total := nodeStats{cluster: "total"}
+	table := newTable([]string{"CLUSTER", "NODE", "ROLE", "CPU %", "MEM USAGE / LIMIT", "MEM %", "NET I/O"})
+	table.SetAutoMergeCellsByColumnIndex([]int{0})
+	for _, s := range stats {
+		table.Append(s.row())
+		total.cpu += s.cpu
+		total.memUsage += s.memUsage
+		total.netRx += s.netRx
+		total.netTx += s.netTx
+	}
+	footer := total.row()
+	// memory limits are usually the memory of the host for every node, a sum wouldn't mean anything
+	footer[4] = units.BytesSize(float64(total.memUsage))
+	footer[5] = ""
+	table.SetFooter(footer)
+	table.Render()
+}
+
+// getTopNodes returns the nodes of the running clusters selected by the filter, with the cluster they belong to
+func getTopNodes(filter clusterFilter) (map[string]types.Container, map[string]string, error) {
+	clusters, err := getClusters(true, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	filter.status = "running"
+	nodes := map[string]types.Container{}
+	nodeClusters := map[string]string{}
+	for name, cl := range filterClusters(clusters, filter) {
+		for _, node := range append([]types.Container{cl.server}, cl.workers...) {
+			nodes[node.ID] = node
+			nodeClusters[node.ID] = name
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, nil, fmt.Errorf("ERROR: no running clusters found")
+	}
+	return nodes, nodeClusters, nil
+}
+
+// getNodeStats returns the current resource usage of a node, the CPU usage is measured over about a second
+func getNodeStats(ctx context.Context, docker *client.Client, clusterName string, node types.Container) (nodeStats, error) {
+	logDebugf("ContainerStats %s", node.ID)
+	resp, err := docker.ContainerStats(ctx, node.ID, false)
+	if err != nil {
+		return nodeStats{}, fmt.Errorf("ERROR: couldn't get stats of node %s\n%w", getContainerShortName(node), err)
+	}
+	defer resp.Body.Close()
+
+	stats := types.StatsJSON{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nodeStats{}, fmt.Errorf("ERROR: couldn't decode stats of node %s\n%w", getContainerShortName(node), err)
+	}
+	return newNodeStats(clusterName, node, &stats), nil
+}
+
+// streamNodeStats keeps the latest resource usage of a node up to date until the context is cancelled
+// or the node stops
+func streamNodeStats(ctx context.Context, docker *client.Client, clusterName string, node types.Container, latest *sync.Map) {
+	logDebugf("ContainerStats %s (stream)", node.ID)
+	resp, err := docker.ContainerStats(ctx, node.ID, true)
+	if err != nil {
+		logDebugf("couldn't stream stats of node %s: %+v", getContainerShortName(node), err)
+		return
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		stats := types.StatsJSON{}
+		if err := decoder.Decode(&stats); err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				logDebugf("couldn't decode stats of node %s: %+v", getContainerShortName(node), err)
+			}
+			latest.Delete(node.ID)
+			return
+		}
+		latest.Store(node.ID, newNodeStats(clusterName, node, &stats))
+	}
+}
+
+// Top shows the CPU, memory and network usage of the nodes of all running clusters:
+// `k3d top [--name <pattern>] [--no-stream]`. The table is refreshed until k3d is interrupted.
+func Top(c *cli.Context) error {
+	filter := clusterFilter{name: c.String("name")}
+	if err := filter.validate(); err != nil {
+		return err
+	}
+	interval := c.Duration("interval")
+	if interval <= 0 {
+		return fmt.Errorf("ERROR: --interval must be positive")
+	}
+	nodes, nodeClusters, err := getTopNodes(filter)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	if c.Bool("no-stream") {
+		stats := []nodeStats{}
+		for id, node := range nodes {
+			s, err := getNodeStats(ctx, docker, nodeClusters[id], node)
+			if err != nil {
+				return err
+			}
+			stats = append(stats, s)
+		}
+		printNodeStats(stats)
+		return nil
+	}
+
+	latest := &sync.Map{}
+	for id, node := range nodes {
+		go streamNodeStats(ctx, docker, nodeClusters[id], node, latest)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		stats := []nodeStats{}
+		latest.Range(func(_, s interface{}) bool {
+			stats = append(stats, s.(nodeStats))
+			return true
+		})
+		clearScreen()
+		printNodeStats(stats)
+	}
+}
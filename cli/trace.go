@@ -0,0 +1,154 @@
+package run
+
+/*
+ * The functions in this file record the requests sent to the docker daemon (`--trace-docker`),
+ * so that issues with specific daemons can be reproduced from a bug report.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// dockerTrace is the file docker API calls are recorded to, nil if tracing is disabled
+var (
+	dockerTrace     *os.File
+	dockerTracePath string
+	dockerTraceLock sync.Mutex
+)
+
+// SetDockerTrace enables recording of all docker API calls to the given file (appending), an empty path disables it
+func SetDockerTrace(tracePath string) error {
+	if tracePath == "" {
+		return nil
+	}
+	f, err := os.OpenFile(tracePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't open docker trace file %s\n%w", tracePath, err)
+	}
+	dockerTrace = f
+	dockerTracePath = tracePath
+	return nil
+}
+
+// newDockerClient creates a docker client, which records its calls to the trace file if tracing is enabled
+func newDockerClient(opts ...client.Opt) (*client.Client, error) {
+	docker, err := client.NewClientWithOpts(opts...)
+	if err != nil || dockerTrace == nil {
+		return docker, err
+	}
+
+	// the transport is set up by the options (e.g. for unix sockets), so it's wrapped instead of replaced
+	httpClient := docker.HTTPClient()
+	httpClient.Transport = &tracingTransport{next: httpClient.Transport}
+	docker.Close()
+	return client.NewClientWithOpts(append(opts, client.WithHTTPClient(httpClient))...)
+}
+
+// dockerTraceEntry is a single line of the trace file
+type dockerTraceEntry struct {
+	Time       string      `json:"time"`
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Query      string      `json:"query,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+	StatusCode int         `json:"statusCode,omitempty"`
+	DurationMs int64       `json:"durationMs"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// tracingTransport records every request and its outcome.
+// Only the request is recorded, response bodies (e.g. logs or archives) are streamed to the caller untouched.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry := dockerTraceEntry{
+		Time:   time.Now().Format(time.RFC3339Nano),
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Query:  req.URL.RawQuery,
+	}
+
+	// JSON bodies are small configs, everything else (e.g. archives) is left out
+	if req.Body != nil && strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		var decoded interface{}
+		if err := json.Unmarshal(body, &decoded); err == nil {
+			entry.Body = sanitizeTraceValue("", decoded)
+		}
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	entry.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.StatusCode = resp.StatusCode
+	}
+	writeDockerTraceEntry(entry)
+	return resp, err
+}
+
+// sanitizeTraceValue redacts secrets in a decoded JSON request body: the values of secret environment variables
+// and all fields that look like credentials
+func sanitizeTraceValue(key string, value interface{}) interface{} {
+	lowerKey := strings.ToLower(key)
+	for _, secret := range []string{"password", "token", "secret", "auth"} {
+		if strings.Contains(lowerKey, secret) {
+			return "<redacted>"
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = sanitizeTraceValue(k, e)
+		}
+	case []interface{}:
+		if key == "Env" {
+			env := []string{}
+			for _, e := range v {
+				if s, ok := e.(string); ok {
+					env = append(env, s)
+				}
+			}
+			return redactEnv(env)
+		}
+		for i, e := range v {
+			v[i] = sanitizeTraceValue(key, e)
+		}
+	}
+	return value
+}
+
+// writeDockerTraceEntry appends an entry to the trace file as a JSON line
+func writeDockerTraceEntry(entry dockerTraceEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logDebugf("couldn't serialize docker trace entry: %+v", err)
+		return
+	}
+	dockerTraceLock.Lock()
+	defer dockerTraceLock.Unlock()
+	if _, err := dockerTrace.Write(append(line, '\n')); err != nil {
+		logDebugf("couldn't write docker trace entry: %+v", err)
+	}
+}
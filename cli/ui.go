@@ -0,0 +1,122 @@
+package run
+
+/*
+ * The functions in this file format the human-friendly output of k3d:
+ * colored message prefixes, opt-in emoji and tables.
+ */
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/moby/term"
+	"github.com/olekukonko/tablewriter"
+)
+
+// noColorEnvVar disables colored output if set to any non-empty value (see https://no-color.org)
+const noColorEnvVar = "NO_COLOR"
+
+// colorOutput and emojiOutput are set once via the global --no-color and --emoji flags
+var (
+	colorOutput bool
+	emojiOutput bool
+)
+
+// SetOutputStyle configures the output for all commands. Colors are disabled automatically
+// if NO_COLOR is set or the output isn't a terminal, e.g. when piping.
+func SetOutputStyle(noColor, emoji bool) {
+	colorOutput = !noColor && os.Getenv(noColorEnvVar) == ""
+	emojiOutput = emoji
+}
+
+// isColorTerminal reports whether colors should be written to w
+func isColorTerminal(w io.Writer) bool {
+	if !colorOutput {
+		return false
+	}
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(f.Fd())
+}
+
+// messageLevel is the severity of a log message, shown as its prefix
+type messageLevel struct {
+	name  string
+	color int // ANSI color code
+	emoji string
+}
+
+var (
+	levelDebug   = messageLevel{name: "DEBUG", color: 90}
+	levelInfo    = messageLevel{name: "INFO", color: 36, emoji: "💡"}
+	levelSuccess = messageLevel{name: "SUCCESS", color: 32, emoji: "✅"}
+	levelWarning = messageLevel{name: "WARNING", color: 33, emoji: "⚠️ "}
+	levelError   = messageLevel{name: "ERROR", color: 31, emoji: "❌"}
+)
+
+// prefix returns the prefix of messages of this level, e.g. "WARNING: ", colored if the log output is a terminal
+func (l messageLevel) prefix() string {
+	prefix := l.name + ":"
+	if isColorTerminal(log.Writer()) {
+		prefix = fmt.Sprintf("\x1b[%d;1m%s\x1b[0m", l.color, prefix)
+	}
+	if emojiOutput && l.emoji != "" {
+		prefix = l.emoji + " " + prefix
+	}
+	return prefix + " "
+}
+
+// logInfof prints an informational log message
+func logInfof(format string, v ...interface{}) {
+	log.Printf(levelInfo.prefix()+format, v...)
+}
+
+// logSuccessf prints a log message reporting a completed operation
+func logSuccessf(format string, v ...interface{}) {
+	log.Printf(levelSuccess.prefix()+format, v...)
+}
+
+// logWarningf prints a log message about a problem k3d could work around
+func logWarningf(format string, v ...interface{}) {
+	log.Printf(levelWarning.prefix()+format, v...)
+}
+
+// logErrorf prints a log message about a failure which doesn't abort the command
+func logErrorf(format string, v ...interface{}) {
+	log.Printf(levelError.prefix()+format, v...)
+}
+
+// formatErrorMessage replaces the ERROR prefix our error messages carry with the styled one
+func formatErrorMessage(msg string) string {
+	for _, prefix := range []string{"ERROR: ", "[ERROR] "} {
+		if strings.HasPrefix(msg, prefix) {
+			return levelError.prefix() + strings.TrimPrefix(msg, prefix)
+		}
+	}
+	return msg
+}
+
+// newTable returns a table writing to stdout with the given header, which is bold if stdout is a terminal
+func newTable(header []string) *tablewriter.Table {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAlignment(tablewriter.ALIGN_CENTER)
+	table.SetHeader(header)
+	if isColorTerminal(os.Stdout) {
+		colors := make([]tablewriter.Colors, len(header))
+		for i := range colors {
+			colors[i] = tablewriter.Colors{tablewriter.Bold}
+		}
+		table.SetHeaderColor(colors...)
+	}
+	return table
+}
+
+// clearScreen moves the cursor home and clears the terminal, so that watched output is redrawn in place.
+// Nothing is cleared if stdout isn't a terminal, e.g. when piping.
+func clearScreen() {
+	if isColorTerminal(os.Stdout) {
+		fmt.Print("\x1b[H\x1b[2J")
+	}
+}
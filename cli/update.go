@@ -0,0 +1,350 @@
+package run
+
+/*
+ * The functions in this file check GitHub for newer k3d releases
+ * and replace the running binary with a newer release on request.
+ */
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Minhaz00/k3d/version"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli"
+)
+
+const (
+	releasesURL         = "https://api.github.com/repos/Minhaz00/k3d/releases"
+	updateCheckInterval = 24 * time.Hour
+	updateCheckFile     = ".update-check"
+)
+
+// release channels: stable only considers full releases, prerelease also considers release candidates etc.
+const (
+	channelStable     = "stable"
+	channelPrerelease = "prerelease"
+)
+
+type githubAsset struct {
+	Name               string `json:"name"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
+type githubRelease struct {
+	TagName    string        `json:"tag_name"`
+	Prerelease bool          `json:"prerelease"`
+	Draft      bool          `json:"draft"`
+	Assets     []githubAsset `json:"assets"`
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// updateCheckClient is used by the automatic update check, which mustn't slow down commands when GitHub is slow
+var updateCheckClient = &http.Client{Timeout: 2 * time.Second}
+
+// parseVersion splits a version string like v1.2.3-rc1+k3s1 into its numeric parts and the pre-release suffix
+func parseVersion(v string) ([3]int, string) {
+	numbers := [3]int{}
+	v = strings.TrimPrefix(v, "v")
+	v = strings.SplitN(v, "+", 2)[0]
+	pre := ""
+	if i := strings.Index(v, "-"); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	for i, part := range strings.SplitN(v, ".", 3) {
+		numbers[i], _ = strconv.Atoi(part)
+	}
+	return numbers, pre
+}
+
+// compareVersions returns -1, 0 or 1 if version a is older than, equal to or newer than version b
+func compareVersions(a, b string) int {
+	aNumbers, aPre := parseVersion(a)
+	bNumbers, bPre := parseVersion(b)
+	for i := range aNumbers {
+		if aNumbers[i] != bNumbers[i] {
+			if aNumbers[i] < bNumbers[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	// a pre-release is older than the corresponding release
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	return comparePreReleases(aPre, bPre)
+}
+
+// comparePreReleases compares two pre-release suffixes like rc.9 and rc.10 as semver does: dot-separated
+// identifiers from left to right, numeric ones numerically and lower than alphanumeric ones, more identifiers win a tie
+func comparePreReleases(a, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aNumber, aErr := strconv.Atoi(aParts[i])
+		bNumber, bErr := strconv.Atoi(bParts[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if aNumber != bNumber {
+				if aNumber < bNumber {
+					return -1
+				}
+				return 1
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		case aParts[i] != bParts[i]:
+			if aParts[i] < bParts[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(aParts) < len(bParts):
+		return -1
+	case len(aParts) > len(bParts):
+		return 1
+	}
+	return 0
+}
+
+// getLatestRelease returns the newest release of the given channel
+func getLatestRelease(client *http.Client, channel string) (*githubRelease, error) {
+	if channel != channelStable && channel != channelPrerelease {
+		return nil, fmt.Errorf("ERROR: unknown release channel [%s] (supported: %s, %s)", channel, channelStable, channelPrerelease)
+	}
+
+	logDebugf("GET %s", releasesURL)
+	resp, err := client.Get(releasesURL)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't get releases from GitHub\n%w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ERROR: couldn't get releases from GitHub (status %s)", resp.Status)
+	}
+
+	releases := []githubRelease{}
+	if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't parse releases from GitHub\n%w", err)
+	}
+
+	var latest *githubRelease
+	for i, release := range releases {
+		if release.Draft || (release.Prerelease && channel == channelStable) {
+			continue
+		}
+		if latest == nil || compareVersions(release.TagName, latest.TagName) > 0 {
+			latest = &releases[i]
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("ERROR: no release found in channel %s", channel)
+	}
+	return latest, nil
+}
+
+// getUpdateCheckFile returns the path of the file used to rate-limit update checks ($HOME/.config/k3d/.update-check)
+func getUpdateCheckFile() (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(homeDir, ".config", "k3d", updateCheckFile), nil
+}
+
+// CheckForUpdate prints a hint if a newer k3d release is available.
+// It checks at most once per updateCheckInterval, is skipped for development builds
+// and can be disabled by setting K3D_NO_UPDATE_CHECK.
+func CheckForUpdate(channel string) {
+	if version.GetVersion() == "dev" || os.Getenv("K3D_NO_UPDATE_CHECK") != "" {
+		return
+	}
+
+	checkFile, err := getUpdateCheckFile()
+	if err != nil {
+		return
+	}
+	if info, err := os.Stat(checkFile); err == nil && time.Since(info.ModTime()) < updateCheckInterval {
+		return
+	}
+
+	// remember the check even if it fails, we don't want to slow down every command when offline
+	if err := createDirIfNotExists(filepath.Dir(checkFile)); err == nil {
+		os.WriteFile(checkFile, []byte(time.Now().Format(time.RFC3339)), 0644)
+	}
+
+	latest, err := getLatestRelease(updateCheckClient, channel)
+	if err != nil {
+		logDebugf("update check failed: %+v", err)
+		return
+	}
+	if compareVersions(latest.TagName, version.GetVersion()) > 0 {
+		logInfof("k3d %s is available (you're running %s). Run `k3d self-update` to update.", latest.TagName, version.GetVersion())
+	}
+}
+
+// releaseAssetName returns the name of the release binary for the current platform
+func releaseAssetName() string {
+	name := fmt.Sprintf("k3d-%s-%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// download fetches a URL into a writer
+func download(url string, w io.Writer) error {
+	logDebugf("GET %s", url)
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't download %s\n%w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ERROR: couldn't download %s (status %s)", url, resp.Status)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("ERROR: couldn't download %s\n%w", url, err)
+	}
+	return nil
+}
+
+// getReleaseChecksum looks up the sha256 checksum of an asset in the checksum file of a release
+func getReleaseChecksum(release *githubRelease, assetName string) (string, error) {
+	for _, asset := range release.Assets {
+		if asset.Name != "sha256sum.txt" && asset.Name != assetName+".sha256" {
+			continue
+		}
+		content := new(strings.Builder)
+		if err := download(asset.BrowserDownloadURL, content); err != nil {
+			return "", err
+		}
+		// format: <checksum>  <file name>
+		scanner := bufio.NewScanner(strings.NewReader(content.String()))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 1 && asset.Name == assetName+".sha256" {
+				return fields[0], nil
+			}
+			if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == assetName {
+				return fields[0], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("ERROR: no checksum found for %s in release %s", assetName, release.TagName)
+}
+
+// replaceExecutable moves the binary at src to dst. With moveAside the old binary is renamed to dst.old first,
+// it's restored if the new binary can't be moved into place. A leftover dst.old of an earlier update is removed.
+func replaceExecutable(src, dst string, moveAside bool) error {
+	if moveAside {
+		old := dst + ".old"
+		if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("ERROR: couldn't remove %s of an earlier update\n%w", old, err)
+		}
+		if err := os.Rename(dst, old); err != nil {
+			return fmt.Errorf("ERROR: couldn't move %s aside\n%w", dst, err)
+		}
+		if err := os.Rename(src, dst); err != nil {
+			if restoreErr := os.Rename(old, dst); restoreErr != nil {
+				logWarningf("couldn't restore %s from %s: %+v", dst, old, restoreErr)
+			}
+			return fmt.Errorf("ERROR: couldn't replace %s\n%w", dst, err)
+		}
+		logDebugf("the previous binary was kept as %s, it can be removed once k3d exited", old)
+		return nil
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return fmt.Errorf("ERROR: couldn't replace %s\n%w", dst, err)
+	}
+	return nil
+}
+
+// SelfUpdate replaces the running k3d binary with the latest release of the selected channel
+func SelfUpdate(c *cli.Context) error {
+	latest, err := getLatestRelease(httpClient, c.String("channel"))
+	if err != nil {
+		return err
+	}
+	if compareVersions(latest.TagName, version.GetVersion()) <= 0 && !c.Bool("force") {
+		log.Printf("k3d %s is already up to date", version.GetVersion())
+		return nil
+	}
+
+	assetName := releaseAssetName()
+	var asset *githubAsset
+	for i := range latest.Assets {
+		if latest.Assets[i].Name == assetName {
+			asset = &latest.Assets[i]
+		}
+	}
+	if asset == nil {
+		return fmt.Errorf("ERROR: release %s has no binary for %s/%s", latest.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+
+	expectedChecksum, err := getReleaseChecksum(latest, assetName)
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't find the path of the running binary\n%w", err)
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return fmt.Errorf("ERROR: couldn't resolve the path of the running binary\n%w", err)
+	}
+
+	// download next to the binary, so that the final rename doesn't cross filesystems
+	tmpFile, err := os.CreateTemp(filepath.Dir(executable), ".k3d-update-")
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create temporary file for the update\n%w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	log.Printf("Downloading k3d %s...", latest.TagName)
+	hash := sha256.New()
+	if err := download(asset.BrowserDownloadURL, io.MultiWriter(tmpFile, hash)); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	tmpFile.Close()
+
+	if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != expectedChecksum {
+		return fmt.Errorf("ERROR: checksum mismatch for %s (expected %s, got %s)", assetName, expectedChecksum, checksum)
+	}
+
+	if err := os.Chmod(tmpFile.Name(), 0755); err != nil {
+		return fmt.Errorf("ERROR: couldn't make the update executable\n%w", err)
+	}
+	// windows doesn't allow to replace a running binary, but it allows to rename it
+	if err := replaceExecutable(tmpFile.Name(), executable, runtime.GOOS == "windows"); err != nil {
+		return err
+	}
+
+	logSuccessf("updated k3d from %s to %s", version.GetVersion(), latest.TagName)
+	return nil
+}
@@ -0,0 +1,64 @@
+package run
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v1.2.3", "v1.2.3", 0},
+		{"v1.2.3", "v1.10.0", -1},
+		{"v2.0.0", "v1.99.99", 1},
+		{"v1.2.3-rc.1", "v1.2.3", -1},
+		{"v1.2.3", "v1.2.3-rc.1", 1},
+		{"v1.2.3-rc.9", "v1.2.3-rc.10", -1},
+		{"v1.2.3-rc.10", "v1.2.3-rc.9", 1},
+		{"v1.2.3-alpha", "v1.2.3-beta", -1},
+		{"v1.2.3-alpha.1", "v1.2.3-alpha", 1},
+		{"v1.2.3-1", "v1.2.3-alpha", -1},
+		{"v1.2.3-rc.1+k3s1", "v1.2.3-rc.1+k3s2", 0},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// on windows the running binary is moved aside, a leftover of an earlier update mustn't get in the way
+func TestReplaceExecutableMoveAside(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "k3d.exe")
+	update := filepath.Join(dir, ".k3d-update-1")
+	for path, content := range map[string]string{exe: "old", update: "new", exe + ".old": "older"} {
+		if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := replaceExecutable(update, exe, true); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{exe: "new", exe + ".old": "old"} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want {
+			t.Errorf("expected %s to contain %q, got %q", path, want, content)
+		}
+	}
+
+	// the old binary is restored if the update can't be moved into place
+	if err := replaceExecutable(filepath.Join(dir, "missing"), exe, true); err == nil {
+		t.Error("expected an error for a missing update")
+	}
+	if content, err := os.ReadFile(exe); err != nil || string(content) != "new" {
+		t.Errorf("expected %s to be restored, got %q (%v)", exe, content, err)
+	}
+}
@@ -0,0 +1,71 @@
+package run
+
+/*
+ * The functions in this file read the user config (~/.config/k3d/config.yaml), which holds defaults for
+ * flags that would otherwise have to be repeated on every invocation, e.g.:
+ *
+ *   kubeconfig:
+ *     merge: true
+ *     switchContext: true
+ */
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/mitchellh/go-homedir"
+	"gopkg.in/yaml.v3"
+)
+
+// userConfigFileName is the file in the k3d config directory holding the user config
+const userConfigFileName = "config.yaml"
+
+// userConfig holds the defaults of the user, flags given on the command line override them
+type userConfig struct {
+	Kubeconfig userKubeconfigConfig `yaml:"kubeconfig"`
+}
+
+// userKubeconfigConfig holds the defaults for the kubeconfig of new clusters
+type userKubeconfigConfig struct {
+	// Merge merges the context of new clusters into the default kubeconfig (create --kubeconfig-merge)
+	Merge bool `yaml:"merge"`
+	// SwitchContext switches the current context to new clusters, it implies Merge (create --kubeconfig-switch-context)
+	SwitchContext bool `yaml:"switchContext"`
+}
+
+// getUserConfigPath returns the path of the user config
+func getUserConfigPath() (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("ERROR: couldn't get home directory\n%w", err)
+	}
+	return path.Join(homeDir, ".config", "k3d", userConfigFileName), nil
+}
+
+// loadUserConfig reads the user config, a missing file is an empty config
+func loadUserConfig() (*userConfig, error) {
+	config := &userConfig{}
+	configPath, err := getUserConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't read user config %s\n%w", configPath, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("ERROR: invalid user config %s\n%w", configPath, err)
+	}
+	logDebugf("loaded user config %s", configPath)
+	return config, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,11 +17,38 @@ const (
 
 var src = rand.NewSource(time.Now().UnixNano())
 
+// srcLock guards src, which isn't safe for concurrent use, e.g. by the goroutines of `create --count`
+var srcLock sync.Mutex
+
+// seededTime is stamped into labels instead of the current time if a seed is set
+var seededTime *time.Time
+
+// SetSeed makes generated names, secrets and tokens as well as the timestamps in labels deterministic,
+// so that the docker objects k3d creates can be compared across runs (e.g. in golden-file tests)
+func SetSeed(seed int64) {
+	srcLock.Lock()
+	src = rand.NewSource(seed)
+	srcLock.Unlock()
+	fixed := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	seededTime = &fixed
+}
+
+// labelTimestamp returns the current time in the format of the created label, or a fixed time if a seed is set
+func labelTimestamp() string {
+	now := time.Now()
+	if seededTime != nil {
+		now = *seededTime
+	}
+	return now.Format("2006-01-02 15:04:05")
+}
+
 // GenerateRandomString is used to generate a random string that is used as a cluster secret
 func GenerateRandomString(n int) string {
 
 	sb := strings.Builder{}
 	sb.Grow(n)
+	srcLock.Lock()
+	defer srcLock.Unlock()
 	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
 	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
 		if remain == 0 {
@@ -43,16 +71,37 @@ func GenerateRandomString(n int) string {
 // within the 64 characters limit.
 const clusterNameMaxSize int = 35
 
+// reservedClusterNames can't be used as cluster names, since they mean something else to k3d,
+// e.g. in node specifiers (@server, @workers) or as --all
+var reservedClusterNames = []string{"all", "server", "workers", "master"}
+
+// CheckClusterName makes sure a cluster name is a lowercase DNS label, which isn't reserved by k3d.
+// Uppercase names would break the DNS aliases of the nodes, since docker resolves them case sensitively.
 func CheckClusterName(name string) error {
 	if err := ValidateHostname(name); err != nil {
-		return fmt.Errorf("[ERROR] Invalid cluster name\n%+v", ValidateHostname(name))
+		return fmt.Errorf("[ERROR] Invalid cluster name\n%+v", err)
 	}
 	if len(name) > clusterNameMaxSize {
 		return fmt.Errorf("[ERROR] Cluster name is too long (%d > %d)", len(name), clusterNameMaxSize)
 	}
+	if name != strings.ToLower(name) {
+		return fmt.Errorf("[ERROR] Cluster name [%s] must be lowercase, use %s or --normalize-name", name, strings.ToLower(name))
+	}
+	if containsString(reservedClusterNames, name) {
+		return fmt.Errorf("[ERROR] Cluster name [%s] is reserved, please choose another name (reserved: %s)", name, strings.Join(reservedClusterNames, ", "))
+	}
 	return nil
 }
 
+// NormalizeClusterName lowercases a cluster name, with a warning if that changes it
+func NormalizeClusterName(name string) string {
+	normalized := strings.ToLower(name)
+	if normalized != name {
+		logWarningf("using cluster name %s instead of %s, cluster names must be lowercase", normalized, name)
+	}
+	return normalized
+}
+
 // ValidateHostname ensures that a cluster name is also a valid host name according to RFC 1123.
 func ValidateHostname(name string) error {
 
@@ -78,4 +127,46 @@ func ValidateHostname(name string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// containsString checks whether a slice contains the given string
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// levenshteinDistance returns the number of single character edits needed to turn a into b
+func levenshteinDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// closestString returns the candidate closest to s, if it's close enough to be a likely typo, or an empty string
+func closestString(s string, candidates []string) string {
+	closest, closestDistance := "", max(2, len(s)/3)+1
+	for _, candidate := range candidates {
+		if d := levenshteinDistance(s, candidate); d < closestDistance {
+			closest, closestDistance = candidate, d
+		}
+	}
+	return closest
+}
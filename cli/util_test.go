@@ -0,0 +1,80 @@
+package run
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+// run with -race to check that concurrent cluster creations can share the random source
+func TestGenerateRandomStringConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if s := GenerateRandomString(20); len(s) != 20 {
+					t.Errorf("GenerateRandomString(20) returned %d characters", len(s))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCheckClusterName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "k3s-default"},
+		{name: "dev1"},
+		{name: "a"},
+		{name: strings.Repeat("a", clusterNameMaxSize)},
+		{name: "", wantErr: true},
+		{name: "Dev", wantErr: true},
+		{name: "DEV", wantErr: true},
+		{name: "all", wantErr: true},
+		{name: "server", wantErr: true},
+		{name: "workers", wantErr: true},
+		{name: "master", wantErr: true},
+		{name: strings.Repeat("a", clusterNameMaxSize+1), wantErr: true},
+		{name: "-dev", wantErr: true},
+		{name: "dev-", wantErr: true},
+		{name: "-", wantErr: true},
+		{name: "dev_1", wantErr: true},
+		{name: "dev.local", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := CheckClusterName(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckClusterName(%q) = %v, want error %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// --normalize-name lowercases the name before it's checked
+func TestNormalizeClusterName(t *testing.T) {
+	tests := []struct {
+		name      string
+		want      string
+		wantValid bool
+	}{
+		{name: "dev", want: "dev", wantValid: true},
+		{name: "Dev", want: "dev", wantValid: true},
+		{name: "MY-Cluster-1", want: "my-cluster-1", wantValid: true},
+		{name: "ALL", want: "all", wantValid: false},
+		{name: "Dev_1", want: "dev_1", wantValid: false},
+		{name: "-Dev", want: "-dev", wantValid: false},
+	}
+	for _, tt := range tests {
+		got := NormalizeClusterName(tt.name)
+		if got != tt.want {
+			t.Errorf("NormalizeClusterName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if err := CheckClusterName(got); (err == nil) != tt.wantValid {
+			t.Errorf("CheckClusterName(NormalizeClusterName(%q)) = %v, want valid %t", tt.name, err, tt.wantValid)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package run
+
+/*
+ * The functions in this file validate volume mounts of node containers before they are created.
+ */
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/volume/mounts"
+	"github.com/docker/go-units"
+	"github.com/mitchellh/go-homedir"
+)
+
+// isHostPath checks whether the source of a volume spec is a path on the host (as opposed to a named volume)
+func isHostPath(source string) bool {
+	return strings.HasPrefix(source, "/") || strings.HasPrefix(source, ".") || strings.HasPrefix(source, "~") || filepath.IsAbs(source)
+}
+
+// splitVolumeSpec splits a volume spec at the colons, keeping a leading drive letter (C:\src:/src on Windows) in the source
+func splitVolumeSpec(volume string) []string {
+	drive := filepath.VolumeName(volume)
+	parts := strings.Split(strings.TrimPrefix(volume, drive), ":")
+	parts[0] = drive + parts[0]
+	return parts
+}
+
+// splitLegacyVolumeSpecs splits volume flags using the old comma notation (-v /a:/a,/b:/b) into single specs.
+// A flag is only split if every part is a source:destination pair, so that paths containing commas keep working.
+func splitLegacyVolumeSpecs(volumes []string) []string {
+	split := []string{}
+	for _, volume := range volumes {
+		parts := strings.Split(volume, ",")
+		legacy := len(parts) > 1
+		for _, part := range parts {
+			source, destination, ok := strings.Cut(part, ":")
+			if !ok || source == "" || !strings.HasPrefix(destination, "/") {
+				legacy = false
+				break
+			}
+		}
+		if !legacy {
+			split = append(split, volume)
+			continue
+		}
+		logWarningf("splitting volume [%s] at commas is deprecated, use one --volume flag per volume", volume)
+		split = append(split, parts...)
+	}
+	return split
+}
+
+// normalizeVolumeSpecs validates volume specs in the format [source:]containerPath[:options]:
+// host paths are made absolute and have to exist (or are created with createHostPaths),
+// container paths (linux paths, whatever the host OS) have to be absolute and may only be used once.
+func normalizeVolumeSpecs(volumes []string, createHostPaths bool) ([]string, error) {
+	normalized := []string{}
+	containerPaths := map[string]string{}
+	parser := mounts.NewLinuxParser()
+
+	for _, volume := range splitLegacyVolumeSpecs(volumes) {
+		if volume == "" {
+			continue
+		}
+		parts := splitVolumeSpec(volume)
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("ERROR: Invalid volume [%s], expected [source:]containerPath[:options]", volume)
+		}
+
+		// a single path is an anonymous volume
+		containerPath := parts[0]
+		if len(parts) > 1 {
+			containerPath = parts[1]
+		}
+		if !path.IsAbs(containerPath) {
+			return nil, fmt.Errorf("ERROR: Invalid volume [%s], the container path [%s] must be absolute", volume, containerPath)
+		}
+		containerPath = path.Clean(containerPath)
+		if other, ok := containerPaths[containerPath]; ok {
+			return nil, fmt.Errorf("ERROR: Volumes [%s] and [%s] are both mounted at %s", other, volume, containerPath)
+		}
+		containerPaths[containerPath] = volume
+
+		if len(parts) > 1 && isHostPath(parts[0]) {
+			hostPath, err := homedir.Expand(parts[0])
+			if err != nil {
+				return nil, fmt.Errorf("ERROR: Invalid host path in volume [%s]\n%w", volume, err)
+			}
+			if hostPath, err = filepath.Abs(hostPath); err != nil {
+				return nil, fmt.Errorf("ERROR: Invalid host path in volume [%s]\n%w", volume, err)
+			}
+
+			if _, err := os.Stat(hostPath); os.IsNotExist(err) {
+				if !createHostPaths {
+					return nil, fmt.Errorf("ERROR: Host path %s of volume [%s] doesn't exist (use --create-host-paths to create it)", hostPath, volume)
+				}
+				if err := os.MkdirAll(hostPath, 0755); err != nil {
+					return nil, fmt.Errorf("ERROR: couldn't create host path %s\n%w", hostPath, err)
+				}
+				logDebugf("created host path %s for volume [%s]", hostPath, volume)
+			} else if err != nil {
+				return nil, fmt.Errorf("ERROR: couldn't check host path %s of volume [%s]\n%w", hostPath, volume, err)
+			}
+			parts[0] = hostPath
+		}
+
+		// the nodes are linux containers, so the specs are checked like docker does on linux (e.g. the options)
+		spec := strings.Join(parts, ":")
+		if _, err := parser.ParseMountRaw(spec, ""); err != nil {
+			return nil, fmt.Errorf("ERROR: Invalid volume [%s]\n%w", volume, err)
+		}
+		normalized = append(normalized, spec)
+	}
+	return normalized, nil
+}
+
+// managedTmpfsPaths are the tmpfs mounts set up by k3d itself, they can't be overridden with --tmpfs
+var managedTmpfsPaths = []string{"/run", "/var/run", "/home/k3s"}
+
+// readOnlyTmpfsPaths are the paths k3s writes to outside of the volumes of the k3s image (e.g. the node password
+// in /etc/rancher/node), they are backed by tmpfs mounts if the root filesystem is read-only
+var readOnlyTmpfsPaths = []string{"/etc/rancher", "/tmp"}
+
+// validateTmpfsSpecs checks tmpfs specs in the format path[:options][@node-specifier[,node-specifier...]]
+func validateTmpfsSpecs(specs []string) error {
+	for _, spec := range specs {
+		tmpfs, nodes, err := parseNodeSpec(spec)
+		if err != nil {
+			return err
+		}
+		tmpfsPath, options, _ := strings.Cut(tmpfs, ":")
+		if !path.IsAbs(tmpfsPath) || path.Clean(tmpfsPath) == "/" {
+			return fmt.Errorf("ERROR: Invalid tmpfs [%s], the path must be absolute and not /", spec)
+		}
+		if containsString(managedTmpfsPaths, path.Clean(tmpfsPath)) {
+			return fmt.Errorf("ERROR: Invalid tmpfs [%s], %s is managed by k3d (use --tmpfs-size to limit it)", spec, tmpfsPath)
+		}
+		for _, option := range strings.Split(options, ",") {
+			if key, value, ok := strings.Cut(option, "="); ok && key == "size" {
+				if _, err := units.RAMInBytes(value); err != nil {
+					return fmt.Errorf("ERROR: Invalid size in tmpfs [%s]\n%w", spec, err)
+				}
+			}
+		}
+		for _, node := range nodes {
+			if err := validateNodeSpecifier(node); err != nil {
+				return fmt.Errorf("ERROR: Invalid node-specifier [%s] in tmpfs [%s]\n%w", node, spec, err)
+			}
+		}
+	}
+	return nil
+}
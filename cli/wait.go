@@ -0,0 +1,389 @@
+package run
+
+/*
+ * The functions in this file check whether a cluster is ready to be used,
+ * beyond the plain "container is running" state.
+ */
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/urfave/cli"
+)
+
+// readinessPollInterval is the time between two readiness checks
+const readinessPollInterval = 1 * time.Second
+
+// newWaitContext returns a context for the readiness phase, which expires after timeout (0 = never)
+func newWaitContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// newInterruptibleWaitContext returns a wait context that is cancelled on interrupt as well,
+// so that a hanging wait can be aborted and the cluster cleaned up
+func newInterruptibleWaitContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if timeout == 0 {
+		return ctx, stop
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// waitCommands are the commands with a --wait flag taking an optional duration
+var waitCommands = []string{"create", "run"}
+
+// NormalizeWaitArgs rewrites the --wait flag of create and run, so that it can be parsed as duration:
+// --wait without a value waits forever (--wait=0s), and plain numbers are seconds like before --wait took a duration.
+func NormalizeWaitArgs(app *cli.App, args []string) []string {
+	normalized := append([]string{}, args...)
+	command := ""
+	for i := 1; i < len(normalized); i++ {
+		arg := normalized[i]
+		if arg == "--" {
+			break
+		}
+		if command == "" {
+			if cmd := app.Command(arg); cmd != nil {
+				if !containsString(waitCommands, cmd.Name) {
+					break
+				}
+				command = cmd.Name
+			}
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(arg, "=")
+		if name != "--wait" && name != "-w" {
+			continue
+		}
+		switch {
+		case hasValue:
+			normalized[i] = fmt.Sprintf("%s=%s", name, normalizeWaitValue(value))
+		case i+1 < len(normalized) && isWaitValue(normalized[i+1]):
+			normalized[i+1] = normalizeWaitValue(normalized[i+1])
+			i++
+		default:
+			normalized[i] = fmt.Sprintf("%s=0s", name)
+		}
+	}
+	return normalized
+}
+
+// isWaitValue reports whether an argument following --wait is its value: a duration or a number of seconds
+func isWaitValue(arg string) bool {
+	if _, err := strconv.Atoi(arg); err == nil {
+		return true
+	}
+	_, err := time.ParseDuration(arg)
+	return err == nil
+}
+
+// normalizeWaitValue turns a number of seconds into a duration
+func normalizeWaitValue(value string) string {
+	if _, err := strconv.Atoi(value); err != nil {
+		return value
+	}
+	logWarningf("--wait %s in seconds is deprecated, use a duration like --wait %ss instead", value, value)
+	return value + "s"
+}
+
+// sleepContext waits for the given duration or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// waitSleep pauses between two readiness checks, tests replace it to run without real delays
+var waitSleep = sleepContext
+
+// pollUntil runs check every readinessPollInterval until it reports done, fails or the context is done.
+// A check failing once the context is done reports the error of the context, i.e. the timeout.
+func pollUntil(ctx context.Context, check func() (bool, error)) error {
+	for {
+		done, err := check()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if done {
+			return nil
+		}
+		if err := waitSleep(ctx, readinessPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// defaultReadyLogPattern matches the log line of k3s telling that the required services are up and running,
+// it's used for images without a known k3s version
+const defaultReadyLogPattern = "Running kubelet"
+
+// readyLogPatterns map k3s versions to the log line telling that the server is up, the first entry
+// the version of the image is at least minVersion of wins. Add an entry when a k3s release changes its logs.
+var readyLogPatterns = []struct {
+	minVersion string
+	pattern    string
+}{
+	// logged once the API server is ready, "Running kubelet" comes before it's usable
+	{minVersion: "v1.17.0", pattern: "k3s is up and running"},
+	{minVersion: "v0.0.0", pattern: defaultReadyLogPattern},
+}
+
+// readyLogPatternForImage returns the readiness log pattern of the k3s version of an image
+func readyLogPatternForImage(image string) string {
+	version, ok := getK3sImageVersion(image)
+	if !ok {
+		return defaultReadyLogPattern
+	}
+	// only the release numbers count, the -k3sN suffix isn't a pre-release
+	numbers, _ := parseVersion(version)
+	version = fmt.Sprintf("v%d.%d.%d", numbers[0], numbers[1], numbers[2])
+	for _, entry := range readyLogPatterns {
+		if compareVersions(version, entry.minVersion) >= 0 {
+			return entry.pattern
+		}
+	}
+	return defaultReadyLogPattern
+}
+
+// serverLogFileName is the file in the cluster directory the logs of the server are written to while waiting for it
+const serverLogFileName = "server.log"
+
+// compileReadyLogPattern compiles the regular expression of --ready-log-pattern,
+// empty means the pattern of the k3s version of the server image
+func compileReadyLogPattern(pattern, image string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		pattern = readyLogPatternForImage(image)
+		logDebugf("waiting for log pattern [%s] of image %s", pattern, image)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: invalid --ready-log-pattern [%s]\n%w", pattern, err)
+	}
+	return re, nil
+}
+
+// openServerLogFile creates the file in the cluster directory the logs of the server are written to while waiting
+func openServerLogFile(clusterName string) (*os.File, error) {
+	clusterDir, err := getClusterDir(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	logFile, err := os.Create(path.Join(clusterDir, serverLogFileName))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: couldn't create log file of the server\n%w", err)
+	}
+	return logFile, nil
+}
+
+// waitForLogLine follows the logs of a container until a line matches the pattern or the context is done.
+// Every line is written to logOutput as well, if it's set.
+// If the log stream ends, e.g. because the container restarted, it's followed again skipping the lines seen already.
+func waitForLogLine(ctx context.Context, containerID string, pattern *regexp.Regexp, logOutput io.Writer) error {
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	seen := 0
+	for {
+		logDebugf("ContainerLogs %s", containerID)
+		out, err := docker.ContainerLogs(ctx, containerID, container.LogsOptions{
+			ShowStdout: true,
+			ShowStderr: true,
+			Follow:     true,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("ERROR: couldn't get docker logs for %s\n%w", containerID, err)
+		}
+
+		// the node containers have no TTY, so stdout and stderr are multiplexed in the stream
+		reader, writer := io.Pipe()
+		go func() {
+			_, err := stdcopy.StdCopy(writer, writer, out)
+			writer.CloseWithError(err)
+		}()
+
+		found := false
+		lines := 0
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			lines++
+			if lines <= seen {
+				continue
+			}
+			if logOutput != nil {
+				fmt.Fprintln(logOutput, scanner.Text())
+			}
+			if pattern.Match(scanner.Bytes()) {
+				found = true
+				break
+			}
+		}
+		out.Close()
+		reader.Close()
+		if found {
+			return nil
+		}
+		if lines > seen {
+			seen = lines
+		}
+		logDebugf("log stream of %s ended after %d lines (%v), following it again", containerID, lines, scanner.Err())
+
+		if err := waitSleep(ctx, readinessPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// waitForCore waits for the Kubernetes core components to be usable:
+// the default serviceaccount exists and all deployments in kube-system (most notably CoreDNS) are available.
+// The check uses the kubectl binary that ships with k3s inside of the server container.
+// It gives up when the context is done.
+func waitForCore(ctx context.Context, clusterName, serverID string) error {
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	checks := []struct {
+		description string
+		cmd         []string
+	}{
+		{
+			description: "default serviceaccount",
+			cmd:         []string{"kubectl", "get", "serviceaccount", "default", "--namespace", "default"},
+		},
+		{
+			description: "CoreDNS deployment",
+			cmd:         []string{"kubectl", "wait", "--namespace", "kube-system", "--for=condition=available", "--timeout=5s", "deployment/coredns"},
+		},
+		{
+			description: "kube-system deployments",
+			cmd:         []string{"kubectl", "wait", "--namespace", "kube-system", "--for=condition=available", "--timeout=5s", "deployment", "--all"},
+		},
+	}
+
+	for _, check := range checks {
+		log.Printf("Waiting for %s in cluster %s...", check.description, clusterName)
+		err := pollUntil(ctx, func() (bool, error) {
+			output, exitCode, err := execInContainer(ctx, docker, serverID, check.cmd)
+			if err != nil {
+				return false, err
+			}
+			if exitCode != 0 {
+				logDebugf("%s not ready yet: %s", check.description, strings.TrimSpace(output))
+			}
+			return exitCode == 0, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitForWorkers waits until all workers [nodeName -> container ID] registered as nodes with the server,
+// calling onReady (may be nil) with the name of each worker once it did.
+// Workers whose container stopped are reported right away, all others when the context is done.
+func waitForWorkers(ctx context.Context, clusterName, serverID string, workers map[string]string, onReady func(name string)) error {
+	docker, err := newDockerClient()
+	if err != nil {
+		return fmt.Errorf("ERROR: couldn't create docker client\n%w", err)
+	}
+
+	log.Printf("Waiting for %d workers to register with cluster %s...", len(workers), clusterName)
+	pending := map[string]string{}
+	for name, ID := range workers {
+		pending[name] = ID
+	}
+	failed := map[string]string{} // [nodeName -> reason]
+	for {
+		for name, ID := range pending {
+			// a crash-looping worker (e.g. with a wrong token or server URL) won't ever register
+			logDebugf("ContainerInspect %s", ID)
+			inspect, err := docker.ContainerInspect(ctx, ID)
+			if err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				return fmt.Errorf("ERROR: couldn't inspect worker %s\n%w", name, err)
+			}
+			if inspect.State != nil && !inspect.State.Running {
+				failed[name] = fmt.Sprintf("container %s (exit code %d)", inspect.State.Status, inspect.State.ExitCode)
+				delete(pending, name)
+				continue
+			}
+
+			_, exitCode, err := execInContainer(ctx, docker, serverID, []string{"kubectl", "get", "node", name, "--output", "name"})
+			if err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				return err
+			}
+			if exitCode == 0 {
+				logDebugf("worker %s registered with cluster %s", name, clusterName)
+				delete(pending, name)
+				if onReady != nil {
+					onReady(name)
+				}
+			}
+		}
+
+		if len(pending) == 0 || ctx.Err() != nil {
+			break
+		}
+		if err := waitSleep(ctx, readinessPollInterval); err != nil {
+			break
+		}
+	}
+
+	for name := range pending {
+		failed[name] = "not registered as node"
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	reasons := []string{}
+	for name, reason := range failed {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", name, reason))
+	}
+	sort.Strings(reasons)
+	return fmt.Errorf("ERROR: %d of %d workers didn't come up\n%s", len(failed), len(workers), strings.Join(reasons, "\n"))
+}
@@ -0,0 +1,119 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock replaces waitSleep, so that waits advance a fake time and time out at a fake deadline
+type fakeClock struct {
+	now      time.Duration
+	deadline time.Duration // 0 = never
+	sleeps   int
+}
+
+func (f *fakeClock) sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if f.deadline > 0 && f.now+d > f.deadline {
+		f.now = f.deadline
+		return context.DeadlineExceeded
+	}
+	f.now += d
+	f.sleeps++
+	return nil
+}
+
+func withFakeClock(t *testing.T, deadline time.Duration) *fakeClock {
+	clock := &fakeClock{deadline: deadline}
+	original := waitSleep
+	waitSleep = clock.sleep
+	t.Cleanup(func() { waitSleep = original })
+	return clock
+}
+
+func TestPollUntil(t *testing.T) {
+	errCheck := errors.New("check failed")
+	tests := []struct {
+		name       string
+		deadline   time.Duration
+		readyAfter int   // number of checks until the check reports done, 0 = never
+		failAt     int   // number of the check failing, 0 = never
+		wantErr    error // nil = success
+		wantChecks int
+		wantSleeps int
+	}{
+		{name: "ready right away", readyAfter: 1, wantChecks: 1},
+		{name: "ready after retries", readyAfter: 4, wantChecks: 4, wantSleeps: 3},
+		{name: "ready before the deadline", deadline: 5 * time.Second, readyAfter: 6, wantChecks: 6, wantSleeps: 5},
+		{name: "timeout", deadline: 5 * time.Second, wantErr: context.DeadlineExceeded, wantChecks: 6, wantSleeps: 5},
+		{name: "check fails", readyAfter: 5, failAt: 2, wantErr: errCheck, wantChecks: 2, wantSleeps: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := withFakeClock(t, tt.deadline)
+			checks := 0
+			err := pollUntil(context.Background(), func() (bool, error) {
+				checks++
+				if checks == tt.failAt {
+					return false, errCheck
+				}
+				return tt.readyAfter > 0 && checks >= tt.readyAfter, nil
+			})
+			if (tt.wantErr == nil && err != nil) || !errors.Is(err, tt.wantErr) {
+				t.Errorf("pollUntil() = %v, want %v", err, tt.wantErr)
+			}
+			if checks != tt.wantChecks {
+				t.Errorf("pollUntil() ran %d checks, want %d", checks, tt.wantChecks)
+			}
+			if clock.sleeps != tt.wantSleeps {
+				t.Errorf("pollUntil() slept %d times, want %d", clock.sleeps, tt.wantSleeps)
+			}
+		})
+	}
+}
+
+func TestPollUntilReportsTimeoutOfFailingCheck(t *testing.T) {
+	withFakeClock(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := pollUntil(ctx, func() (bool, error) {
+		// e.g. docker exec fails because the context of the wait is done
+		return false, errors.New("context canceled while exec'ing")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("pollUntil() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sleepContext(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("sleepContext() with a done context = %v, want %v", err, context.Canceled)
+	}
+	if err := sleepContext(context.Background(), 0); err != nil {
+		t.Errorf("sleepContext() = %v, want nil", err)
+	}
+}
+
+func TestNewWaitContext(t *testing.T) {
+	ctx, cancel := newWaitContext(0)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("newWaitContext(0) has a deadline, want none")
+	}
+
+	ctx, cancel = newWaitContext(time.Minute)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Fatalf("newWaitContext(1m) has no deadline")
+	}
+	if left := time.Until(deadline); left <= 0 || left > time.Minute {
+		t.Errorf("newWaitContext(1m) expires in %s, want at most 1m", left)
+	}
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"time"
 
 	run "github.com/Minhaz00/k3d/cli"
 	"github.com/Minhaz00/k3d/version"
@@ -12,7 +12,22 @@ import (
 
 // defaultK3sImage specifies the default image being used for server and workers
 const defaultK3sImage = "docker.io/rancher/k3s"
-const defaultK3sClusterName string = "k3s-default"
+const defaultK3sClusterName = run.DefaultK3sClusterName
+
+// defaultChaosHelperImage is the image traffic control commands are run in, k3s images don't ship tc
+const defaultChaosHelperImage = "nicolaka/netshoot:latest"
+
+// defaultIdleCPUThreshold is the CPU usage of all nodes (in % of one CPU) below which a cluster counts as idle,
+// an idle k3s server alone uses about 5-10% for its control loops
+const defaultIdleCPUThreshold = 25.0
+
+// kubeConfigModeFlag is shared by the commands that write kubeconfig files
+var kubeConfigModeFlag = cli.StringFlag{
+	Name:   "kubeconfig-mode",
+	Value:  "0600",
+	Usage:  "File mode of the written kubeconfigs (e.g. 0640 to make them readable by the group)",
+	EnvVar: "K3D_KUBECONFIG_MODE",
+}
 
 func main() {
 
@@ -20,8 +35,10 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "k3d"
 	app.Usage = "Run k3s in Docker!"
+	app.Description = "k3d creates and manages k3s clusters, with every node running in a docker container."
 	// app.Version = "v0.3.0"
 	app.Version = version.GetVersion()
+	app.EnableBashCompletion = true
 	app.Authors = []cli.Author{
 		{
 			Name:  "Minhaz",
@@ -39,6 +56,31 @@ func main() {
 			Action:  run.CheckTools,
 		},
 
+		// info summarizes the docker daemon, the k3d defaults and the existing clusters
+		{
+			Name:   "info",
+			Usage:  "Show docker daemon, k3d defaults and clusters with warnings about the environment (e.g. for bug reports)",
+			Action: run.Info,
+		},
+
+		// self-update replaces the k3d binary with the latest release
+		{
+			Name:  "self-update",
+			Usage: "Update k3d to the latest release",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "channel",
+					Value: "stable",
+					Usage: "Release channel to update from (stable or prerelease)",
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "Download the latest release even if it's not newer than the running version",
+				},
+			},
+			Action: run.SelfUpdate,
+		},
+
 		// shell starts a shell in the context of a running cluster
 		{
 			Name:  "shell",
@@ -62,6 +104,26 @@ func main() {
 			Action: run.Shell,
 		},
 
+		// ssh opens an interactive shell in one of the cluster's node containers
+		{
+			Name:      "ssh",
+			Usage:     "Open a shell in a node container of a cluster",
+			ArgsUsage: "[cluster] [node]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "name, n",
+					Value: defaultK3sClusterName,
+					Usage: "Name of the cluster (if not given as first argument)",
+				},
+				cli.StringFlag{
+					Name:  "shell, s",
+					Value: "sh",
+					Usage: "Shell to start in the node container (e.g. sh or ash)",
+				},
+			},
+			Action: run.SSH,
+		},
+
 		// create creates a new k3s cluster in docker container
 		{
 			Name:    "create",
@@ -73,13 +135,21 @@ func main() {
 					Value: defaultK3sClusterName,
 					Usage: "Set a name for the cluster",
 				},
+				cli.BoolFlag{
+					Name:  "normalize-name",
+					Usage: "Lowercase the cluster name instead of rejecting uppercase names",
+				},
 				cli.StringSliceFlag{
 					Name:  "volume, v",
-					Usage: "Mount one or more volumes into every node of the cluster (Docker notation: `source:destination`)",
+					Usage: "Mount a volume into every node of the cluster (Docker notation: `source:destination[:options]`, new flag per volume)",
+				},
+				cli.BoolFlag{
+					Name:  "create-host-paths",
+					Usage: "Create host paths of volumes (--volume) that don't exist yet instead of failing",
 				},
 				cli.StringSliceFlag{
 					Name:  "publish, add-port",
-					Usage: "Publish k3s node ports to the host (Format: `[ip:][host-port:]container-port[/protocol]@node-specifier`, use multiple options to expose more ports)",
+					Usage: "Publish k3s node ports to the host (Format: `[ip:][host-port:]container-port[/protocol[+protocol]]@node-specifier[,node-specifier...]`, e.g. 53:53/udp+tcp@server, 80:80@server,workers or 8080:80@!server for all nodes but the server, use multiple options to expose more ports)",
 				},
 				cli.IntFlag{
 					Name:  "port-auto-offset",
@@ -97,21 +167,54 @@ func main() {
 					Value: 6443,
 					Usage: "Map the Kubernetes ApiServer port to a local port (Note: --port/-p will be used for arbitrary port mapping as of v2.0.0, use --api-port/-a instead for setting the api port)",
 				},
+				cli.StringFlag{
+					Name:  "api-server-address",
+					Usage: "Host IP or name that others (e.g. on the LAN) reach the API with: it's added to the TLS SANs and used in the kubeconfig (the API port is published on all interfaces)",
+				},
 				cli.IntFlag{
 					Name:  "timeout, t",
 					Value: 0,
-					Usage: "Set the timeout value when --wait flag is set (deprecated, use --wait <timeout> instead)",
+					Usage: "Seconds to wait for the cluster to come up (deprecated, use --wait <duration> instead)",
 				},
-				cli.IntFlag{
+				cli.DurationFlag{
 					Name:  "wait, w",
-					Value: 0,
-					Usage: "Wait for the cluster to come up before returning until timoout (in seconds). Use --wait 0 to wait forever",
+					Usage: "Wait up to the given duration (e.g. `90s`) for the cluster to come up before returning. --wait without a duration waits forever",
+				},
+				cli.DurationFlag{
+					Name:  "pull-timeout",
+					Usage: "Limit the time pulling the node image may take (e.g. `5m`, default: no limit). Not included in the --wait timeout",
+				},
+				cli.StringFlag{
+					Name:  "summary",
+					Value: "text",
+					Usage: "Print the durations of the creation phases at the end as `text`, json (on stdout) or none",
+				},
+				cli.BoolFlag{
+					Name:  "events",
+					Usage: "Print the progress of the creation as JSON lines of events (StepStarted, StepCompleted, NodeReady, Error) to stderr, e.g. for UIs wrapping k3d",
+				},
+				cli.IntFlag{
+					Name:  "diagnostics-lines",
+					Value: 25,
+					Usage: "Number of log lines per node to print if the cluster doesn't come up in time (0 to disable)",
+				},
+				cli.StringFlag{
+					Name:  "wait-for",
+					Usage: "Extend the readiness check of --wait (supported: `core` = wait for kube-system deployments like CoreDNS and the default serviceaccount)",
+				},
+				cli.StringFlag{
+					Name:  "ready-log-pattern",
+					Usage: "Regular expression matching the server log line after which --wait considers the server up (default: depending on the k3s version of the image, e.g. `k3s is up and running`). The logs are written to server.log in the cluster directory while waiting",
 				},
 				cli.StringFlag{
 					Name:  "image, i",
-					Usage: "Specify a k3s image (Format: <repo>/<image>:<tag>)",
+					Usage: "Specify a k3s image (Format: <repo>/<image>:<tag> or <repo>/<image>@sha256:<digest>)",
 					Value: fmt.Sprintf("%s:%s", defaultK3sImage, version.GetK3sVersion()),
 				},
+				cli.StringFlag{
+					Name:  "agent-image",
+					Usage: "Experimental: k3s image of the workers if it differs from --image, e.g. to test version skew (Format like --image, the workers must not be newer than the server)",
+				},
 				cli.StringSliceFlag{
 					Name:  "server-arg, x",
 					Usage: "Pass an additional argument to k3s server (new flag per argument)",
@@ -120,19 +223,556 @@ func main() {
 					Name:  "env, e",
 					Usage: "Pass an additional environment variable (new flag per variable)",
 				},
+				cli.StringSliceFlag{
+					Name:  "env-passthrough",
+					Usage: "Pass the host environment variables matching a prefix (`AWS_`) or glob (AWS_*) to all nodes, their values are only set in the node containers and not stored in the spec or committed images (new flag per pattern)",
+				},
 				cli.IntFlag{
 					Name:  "workers",
 					Value: 0,
 					Usage: "Specify how many worker nodes you want to spawn",
 				},
+				cli.StringSliceFlag{
+					Name:  "taint",
+					Usage: "Taint nodes at registration (Format: `key[=value]:Effect[@node-specifier[,node-specifier...]]`, use multiple options for more taints)",
+				},
+				cli.BoolFlag{
+					Name:  "k3s-rootless",
+					Usage: "[Experimental] Run k3s rootless in unprivileged node containers (requires cgroup v2 and an image with rootlesskit support)",
+				},
+				cli.BoolFlag{
+					Name:  "no-privileged",
+					Usage: "Run node containers with a baseline of capabilities (SYS_ADMIN, NET_ADMIN, ...) and unconfined seccomp/apparmor profiles instead of --privileged",
+				},
+				cli.StringFlag{
+					Name:  "pause-image",
+					Usage: "Pause (sandbox) image used by containerd on all nodes, e.g. from an air-gapped mirror",
+				},
+				cli.StringFlag{
+					Name:  "default-runtime",
+					Usage: "Default containerd runtime for pods on all nodes (e.g. crun, requires k3s >= v1.26)",
+				},
+				cli.StringFlag{
+					Name:  "snapshotter",
+					Usage: "Containerd snapshotter on all nodes (overlayfs, fuse-overlayfs, native, stargz)",
+				},
+				cli.StringFlag{
+					Name:  "cluster-domain",
+					Usage: "Kubernetes cluster domain (k3s default: `cluster.local`)",
+				},
+				cli.StringFlag{
+					Name:  "cluster-dns",
+					Usage: "IP of the cluster DNS service, must be part of the service CIDR (k3s default: `10.43.0.10`)",
+				},
+				cli.StringFlag{
+					Name:  "cluster-cidr",
+					Usage: "Pod network, must not overlap with the service CIDR and the docker network (k3s default: `10.42.0.0/16`)",
+				},
+				cli.StringFlag{
+					Name:  "service-cidr",
+					Usage: "Service network, must not overlap with the cluster CIDR and the docker network (k3s default: `10.43.0.0/16`)",
+				},
+				cli.StringFlag{
+					Name:  "network-driver",
+					Usage: "Driver of the cluster network (`bridge` (default), macvlan, ipvlan), macvlan and ipvlan put the nodes on the LAN of --network-opt parent=<interface>",
+				},
+				cli.StringSliceFlag{
+					Name:  "network-opt",
+					Usage: "Driver option of the cluster network (Format: key=value, e.g. `parent=eth0`)",
+				},
+				cli.StringFlag{
+					Name:  "network-subnet",
+					Usage: "Subnet of the cluster network, required for macvlan and ipvlan (e.g. the LAN `192.168.1.0/24`)",
+				},
+				cli.StringFlag{
+					Name:  "network-gateway",
+					Usage: "Gateway of the cluster network, must be part of --network-subnet (e.g. the LAN router `192.168.1.1`)",
+				},
+				cli.StringSliceFlag{
+					Name:  "dns",
+					Usage: "DNS server of the nodes, e.g. to resolve internal registries behind a VPN (e.g. `10.0.0.53`)",
+				},
+				cli.StringSliceFlag{
+					Name:  "dns-search",
+					Usage: "DNS search domain of the nodes (e.g. `corp.example.com`)",
+				},
+				cli.BoolFlag{
+					Name:  "dns-coredns-forward",
+					Usage: "Let CoreDNS forward to the --dns servers as well, so that pods resolve the same names as the nodes",
+				},
+				cli.BoolFlag{
+					Name:  "expose-containerd",
+					Usage: "Expose the containerd socket of every node at <cluster dir>/containerd/<node>.sock, e.g. for `nerdctl --namespace k8s.io build` straight into a node",
+				},
+				cli.IntFlag{
+					Name:  "expose-containerd-port",
+					Usage: "Expose the containerd socket of every node on 127.0.0.1, on consecutive ports starting with the server (e.g. for Docker Desktop, which can't share unix sockets)",
+				},
+				cli.StringFlag{
+					Name:  "group, g",
+					Usage: "Add the cluster to a group (e.g. `workshop-a`), so that all its clusters can be started, stopped and deleted with --group",
+				},
+				cli.BoolFlag{
+					Name:  "protect",
+					Usage: "Protect the cluster from being deleted: `k3d delete` refuses to delete it and --all, --group and --selector skip it unless --force-protected is given",
+				},
+				cli.StringFlag{
+					Name:  "ttl",
+					Usage: "Delete the cluster this long after its creation (e.g. `8h`) when `k3d gc` runs, protected clusters are kept",
+				},
+				cli.StringFlag{
+					Name:  "node-name-template",
+					Usage: "Template for container names, hostnames and k3s node names (Fields: .Prefix, .Cluster, .Role, .Index, e.g. `{{.Cluster}}-{{.Role}}-{{.Index}}`)",
+				},
+				cli.StringFlag{
+					Name:  "kubeconfig-output",
+					Usage: "Path the kubeconfig is written to in the server container, its directory is bind-mounted to the cluster directory (default: `/output/kubeconfig.yaml`)",
+				},
+				cli.StringFlag{
+					Name:  "write-kubeconfig-mode",
+					Usage: "File mode k3s writes the kubeconfig with in the server container, e.g. `0644` to let k3d read the bind-mounted kubeconfig",
+				},
+				cli.BoolFlag{
+					Name:  "kubeconfig-in-network",
+					Usage: "Also write a kubeconfig reaching the API by the name of the server container, for containers in the cluster network (see get-kubeconfig --in-network)",
+				},
+				cli.BoolFlag{
+					Name:  "no-kubeconfig-output",
+					Usage: "Don't let k3s write the kubeconfig to an extra path and don't bind-mount it, the kubeconfig is copied from the server container instead",
+				},
+				cli.BoolFlag{
+					Name:  "no-server-workloads",
+					Usage: "Taint the server so that workloads are only scheduled on workers (k3s addons still run on the server)",
+				},
+				cli.IntFlag{
+					Name:  "count",
+					Value: 1,
+					Usage: "Create multiple identical clusters named <name>-1..<name>-N with auto-assigned API ports",
+				},
+				cli.IntFlag{
+					Name:  "parallel",
+					Value: 2,
+					Usage: "Maximum number of clusters created at the same time with --count",
+				},
 				cli.BoolFlag{
 					Name:  "auto-restart",
 					Usage: "Set docker's --restart=unless-stopped flag on the containers",
 				},
+				cli.StringFlag{
+					Name:  "tmpfs-size",
+					Usage: "Limit the size of the tmpfs mounts for /run and /var/run in every node (e.g. `64m`)",
+				},
+				cli.StringSliceFlag{
+					Name:  "tmpfs",
+					Usage: "Mount an additional tmpfs into nodes (Format: `path[:options][@node-specifier[,node-specifier...]]`, e.g. /var/lib/rancher/k3s/agent/containerd:size=2g@workers)",
+				},
+				cli.BoolFlag{
+					Name:  "read-only",
+					Usage: "Run the nodes with a read-only root filesystem, so that they only keep state in volumes and tmpfs mounts (experimental)",
+				},
+				cli.StringFlag{
+					Name:  "storage-size",
+					Usage: "Limit the size of the writable layer of every node container (e.g. `10G`, requires storage driver support)",
+				},
+				cli.StringFlag{
+					Name:  "registry-username",
+					Usage: "Username for pulling images from the registry of the k3s image or of --registry-server (overrides credentials from the docker config)",
+				},
+				cli.StringFlag{
+					Name:  "registry-server",
+					Usage: "Registry host (e.g. `ghcr.io`) the --registry-username credentials are for (default: the registry of --image)",
+				},
+				cli.BoolFlag{
+					Name:  "registry-password-stdin",
+					Usage: "Read the password for --registry-username from stdin",
+				},
+				cli.BoolFlag{
+					Name:  "print-nodes",
+					Usage: "Only print the names of the nodes the cluster would have (valid @node specifiers for --publish and --taint) and exit",
+				},
+				cli.StringFlag{
+					Name:  "from-commit",
+					Usage: "Create the cluster from a commit (see `k3d commit`), using its spec and the data of its nodes",
+				},
+				cli.BoolFlag{
+					Name:  "allow-hooks",
+					Usage: "Keep the hooks of the spec of a --from-commit image, which run commands on this machine (ignored by default)",
+				},
+				cli.BoolFlag{
+					Name:  "replace",
+					Usage: "Delete an existing cluster with the same name before creating the new one (not atomic: if creating fails, the spec of the old cluster is kept to restore it with k3d apply -f)",
+				},
+				cli.BoolFlag{
+					Name:  "force, yes",
+					Usage: "Don't ask for confirmation when replacing an existing cluster (see --replace, or set K3D_FORCE=1)",
+				},
+				cli.BoolFlag{
+					Name:  "ignore-cgroup-check",
+					Usage: "Only warn instead of failing if the k3s version of the image doesn't support the cgroup v2 host",
+				},
+				cli.BoolFlag{
+					Name:  "no-image-pull",
+					Usage: "Don't pull images, fail before creating anything if a required image doesn't exist locally (e.g. in air-gapped setups)",
+				},
+				cli.BoolFlag{
+					Name:  "force-network",
+					Usage: "Recreate an existing k3d network for the cluster instead of reusing it",
+				},
+				cli.BoolFlag{
+					Name:  "kubeconfig-merge",
+					Usage: "Merge the context of the cluster into the default kubeconfig (first entry of $KUBECONFIG or $HOME/.kube/config) once it's created (default: kubeconfig.merge of ~/.config/k3d/config.yaml, `--kubeconfig-merge=false` overrides it)",
+				},
+				cli.BoolFlag{
+					Name:  "kubeconfig-switch-context",
+					Usage: "Merge the context of the cluster into the default kubeconfig and make it the current context (default: kubeconfig.switchContext of ~/.config/k3d/config.yaml)",
+				},
+				kubeConfigModeFlag,
 			},
 			Action: run.CreateCluster,
 		},
 
+		// run creates a throwaway cluster for a single command
+		{
+			Name:      "run",
+			Usage:     "Create a temporary cluster, run a command with KUBECONFIG pointing to it and delete the cluster afterwards",
+			ArgsUsage: "-- <command> [arguments]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "image, i",
+					Usage: "Specify a k3s image that you want to use for the nodes",
+				},
+				cli.IntFlag{
+					Name:  "workers",
+					Value: 0,
+					Usage: "Specify how many worker nodes you want to spawn",
+				},
+				cli.IntFlag{
+					Name:  "api-port, a",
+					Value: 6443,
+					Usage: "First port to try for the Kubernetes API server, the next free port is used",
+				},
+				cli.StringSliceFlag{
+					Name:  "env, e",
+					Usage: "Pass an additional environment variable (new flag per variable)",
+				},
+				cli.StringSliceFlag{
+					Name:  "env-passthrough",
+					Usage: "Pass the host environment variables matching a prefix (`AWS_`) or glob (AWS_*) to all nodes, their values are only set in the node containers and not stored in the spec or committed images (new flag per pattern)",
+				},
+				cli.StringSliceFlag{
+					Name:  "volume, v",
+					Usage: "Mount a volume into every node of the cluster (Docker notation: `source:destination[:options]`, new flag per volume)",
+				},
+				cli.DurationFlag{
+					Name:  "wait, w",
+					Value: 5 * time.Minute,
+					Usage: "How long to wait for the cluster to be ready before giving up (0 = forever)",
+				},
+				cli.StringFlag{
+					Name:  "wait-for",
+					Usage: "Additionally wait for the given set of components (supported: core)",
+				},
+				cli.BoolFlag{
+					Name:  "keep",
+					Usage: "Don't delete the cluster after the command exited, e.g. for debugging",
+				},
+				kubeConfigModeFlag,
+			},
+			Action: run.Run,
+		},
+
+		// add-node adds worker nodes to a k3d cluster or to an external k3s server
+		{
+			Name:  "add-node",
+			Usage: "Add worker nodes to a cluster or join a worker to an external k3s server",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "name, n",
+					Value: defaultK3sClusterName,
+					Usage: "Name of the k3d cluster to add workers to (ignored with --cluster-url)",
+				},
+				cli.IntFlag{
+					Name:  "count, c",
+					Value: 1,
+					Usage: "Number of worker nodes to add",
+				},
+				cli.StringFlag{
+					Name:  "cluster-url",
+					Usage: "Join an external k3s server instead of a k3d cluster (Format: `https://<host>:<port>`)",
+				},
+				cli.StringFlag{
+					Name:  "token",
+					Usage: "Node token of the external k3s server (required with --cluster-url)",
+				},
+				cli.StringFlag{
+					Name:  "node-name",
+					Usage: "Container and host name of the external worker (default: k3d-external-<random>)",
+				},
+				cli.StringFlag{
+					Name:  "image, i",
+					Usage: "Specify a k3s image for the external worker (Format: <repo>/<image>:<tag>)",
+					Value: fmt.Sprintf("%s:%s", defaultK3sImage, version.GetK3sVersion()),
+				},
+				cli.StringSliceFlag{
+					Name:  "env, e",
+					Usage: "Pass an additional environment variable to the external worker (new flag per variable)",
+				},
+				cli.StringSliceFlag{
+					Name:  "volume, v",
+					Usage: "Mount a volume into the external worker (Docker notation: `source:destination[:options]`, new flag per volume)",
+				},
+				cli.StringFlag{
+					Name:  "network",
+					Usage: "Docker network to attach the external worker to (default: docker's default bridge)",
+				},
+			},
+			Action: run.AddNode,
+		},
+
+		// scale adds or removes workers of a cluster
+		{
+			Name:      "scale",
+			Usage:     "Scale the number of workers of a cluster",
+			ArgsUsage: "[cluster]",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "workers, w",
+					Usage: "Number of workers the cluster should have",
+				},
+				cli.BoolFlag{
+					Name:  "drain",
+					Usage: "Drain workers before removing them",
+				},
+			},
+			Action: run.Scale,
+		},
+
+		// rotate-token generates a new cluster token and recreates the nodes with it
+		{
+			Name:      "rotate-token",
+			Usage:     "Generate a new token for a cluster and recreate its nodes with it (keeping their data)",
+			ArgsUsage: "[cluster]",
+			Action:    run.RotateToken,
+		},
+
+		// backup archives the spec and the cluster directory of a cluster into a portable bundle
+		{
+			Name:      "backup",
+			Usage:     "Archive the spec, labels and cluster directory (incl. kubeconfig) of a cluster into a bundle, e.g. to hand it off to a team mate",
+			ArgsUsage: "[cluster]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "Path of the bundle (default: `k3d-<cluster>-backup.tar.gz`)",
+				},
+			},
+			Action: run.Backup,
+		},
+
+		// restore recreates a cluster from a bundle created by backup
+		{
+			Name:      "restore",
+			Usage:     "Recreate a cluster from a bundle created by `k3d backup`, e.g. on another machine",
+			ArgsUsage: "<bundle>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "name, n",
+					Usage: "Name of the restored cluster (default: the name of the backed up cluster)",
+				},
+				cli.BoolFlag{
+					Name:  "allow-hooks",
+					Usage: "Keep the hooks of the backed up cluster, which run commands on this machine (ignored by default)",
+				},
+			},
+			Action: run.Restore,
+		},
+
+		// adopt brings k3s containers created without k3d under its management
+		{
+			Name:      "adopt",
+			Usage:     "Adopt existing k3s containers (e.g. created manually) into a k3d cluster, they are recreated with k3d labels keeping their data",
+			ArgsUsage: "<server-container> [worker-container...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "name, n",
+					Value: defaultK3sClusterName,
+					Usage: "Name of the cluster the containers are adopted into",
+				},
+			},
+			Action: run.Adopt,
+		},
+
+		// commit freezes the nodes of a cluster including their data into images
+		{
+			Name:      "commit",
+			Usage:     "Commit the nodes of a cluster including their data to images, for pre-warmed clusters with `create --from-commit`",
+			ArgsUsage: "[cluster]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "tag, t",
+					Usage: "Image reference of the commit, the nodes are committed to <reference>-server and <reference>-worker-<index> (default: `k3d-<cluster>-commit:latest`)",
+				},
+			},
+			Action: run.Commit,
+		},
+
+		// chaos injects faults into the nodes of a cluster
+		{
+			Name:  "chaos",
+			Usage: "Inject faults into the nodes of a cluster for resilience testing",
+			Subcommands: []cli.Command{
+				{
+					Name:      "kill-worker",
+					Usage:     "Kill a random running worker",
+					ArgsUsage: "[cluster]",
+					Flags: []cli.Flag{
+						cli.Int64Flag{
+							Name:  "seed",
+							Usage: "Seed for choosing the worker, to reproduce a previous run (default: random)",
+						},
+					},
+					Action: run.ChaosKillWorker,
+				},
+				{
+					Name:      "latency",
+					Usage:     "Add latency to the network of the nodes for a while (runs tc netem in a helper container)",
+					ArgsUsage: "[cluster]",
+					Flags: []cli.Flag{
+						cli.DurationFlag{
+							Name:  "delay",
+							Value: 100 * time.Millisecond,
+							Usage: "Latency added to every packet sent by the nodes",
+						},
+						cli.DurationFlag{
+							Name:  "jitter",
+							Usage: "Random variation of the latency",
+						},
+						cli.DurationFlag{
+							Name:  "duration",
+							Value: 30 * time.Second,
+							Usage: "How long the latency is applied",
+						},
+						cli.StringSliceFlag{
+							Name:  "node",
+							Usage: "Only add latency to these nodes (default: all nodes)",
+						},
+						cli.StringFlag{
+							Name:  "helper-image",
+							Value: defaultChaosHelperImage,
+							Usage: "Image with tc to run the traffic control commands in",
+						},
+					},
+					Action: run.ChaosLatency,
+				},
+				{
+					Name:      "pause-server",
+					Usage:     "Pause the server for a while",
+					ArgsUsage: "[cluster]",
+					Flags: []cli.Flag{
+						cli.DurationFlag{
+							Name:  "duration",
+							Value: 10 * time.Second,
+							Usage: "How long the server is paused",
+						},
+					},
+					Action: run.ChaosPauseServer,
+				},
+			},
+		},
+
+		// top shows the resource usage of the cluster nodes
+		{
+			Name:  "top",
+			Usage: "Show the CPU, memory and network usage of the nodes of all running clusters",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "name, n",
+					Usage: "Only show clusters with names matching a glob (e.g. `ci-*`) or a regular expression enclosed in slashes",
+				},
+				cli.BoolFlag{
+					Name:  "no-stream",
+					Usage: "Print the usage once instead of refreshing it",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Value: 2 * time.Second,
+					Usage: "How often the table is refreshed",
+				},
+			},
+			Action: run.Top,
+		},
+
+		// disk-usage reports the disk space used by clusters
+		{
+			Name:  "disk-usage",
+			Usage: "Show the disk space used by each cluster (node layers, volumes and images)",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "reclaim",
+					Usage: "Remove k3d images without tags and unused k3d volumes",
+				},
+				cli.BoolFlag{
+					Name:  "yes, y",
+					Usage: "Don't ask for confirmation before removing anything",
+				},
+			},
+			Action: run.DiskUsage,
+		},
+
+		// config checks cluster spec files
+		{
+			Name:  "config",
+			Usage: "Check cluster spec files",
+			Subcommands: []cli.Command{
+				{
+					Name:      "validate",
+					Usage:     "Check a cluster spec file for errors without creating anything",
+					ArgsUsage: "<file|->",
+					Action:    run.ValidateConfig,
+				},
+				{
+					Name:   "schema",
+					Usage:  "Print the JSON schema of cluster spec files (e.g. for the YAML support of editors)",
+					Action: run.PrintConfigSchema,
+				},
+			},
+		},
+
+		// apply converges a cluster towards a declarative spec
+		{
+			Name:  "apply",
+			Usage: "Create or update a cluster to match a cluster spec file",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "Path to the cluster spec (YAML)",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only print the changes that would be applied",
+				},
+			},
+			Action: run.Apply,
+		},
+
+		// export-spec prints the spec of an existing cluster
+		{
+			Name:  "export-spec",
+			Usage: "Export the spec of an existing cluster (usable with `k3d apply -f`)",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "name, n",
+					Value: defaultK3sClusterName,
+					Usage: "name of the cluster",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "Write the spec to this file instead of stdout",
+				},
+			},
+			Action: run.ExportSpec,
+		},
+
 		// delete deletes an existing k3s cluster (remove container and cluster directory)
 		{
 			Name:    "delete",
@@ -148,10 +788,50 @@ func main() {
 					Name:  "all, a",
 					Usage: "delete all existing clusters (this ignores the --name/-n flag)",
 				},
+				cli.StringFlag{
+					Name:  "selector, l",
+					Usage: "Delete all clusters matching a selector (Format: `name=<glob or /regex/>,status=<status>,group=<group>`, this ignores the --name/-n flag)",
+				},
+				cli.StringFlag{
+					Name:  "group, g",
+					Usage: "Delete all clusters of a group (this ignores the --name/-n flag)",
+				},
+				cli.BoolFlag{
+					Name:  "keep-kubeconfig-context",
+					Usage: "Keep the context of the cluster in the kubeconfig (default: first entry of $KUBECONFIG or $HOME/.kube/config), which is removed otherwise",
+				},
+				cli.BoolFlag{
+					Name:  "yes, y",
+					Usage: "Don't ask for confirmation when deleting multiple clusters (or set K3D_FORCE=1)",
+				},
+				cli.BoolFlag{
+					Name:  "async",
+					Usage: "Delete the clusters in the background and return immediately, see `k3d jobs` for the progress",
+				},
+				cli.BoolFlag{
+					Name:  "force-protected",
+					Usage: "Delete protected clusters (created with --protect) as well",
+				},
 			},
 			Action: run.DeleteCluster,
 		},
 
+		// jobs lists the operations running in the background
+		{
+			Name:   "jobs",
+			Usage:  "List background operations (e.g. `k3d delete --async`) and the state of their clusters",
+			Action: run.ListJobs,
+			Subcommands: []cli.Command{
+				{
+					Name:      "run",
+					Usage:     "Work off a background job in the foreground (started by k3d itself)",
+					ArgsUsage: "<job>",
+					Hidden:    true,
+					Action:    run.RunJob,
+				},
+			},
+		},
+
 		// stop stops a running cluster (its container) so it's restartable
 		{
 			Name:  "stop",
@@ -166,10 +846,91 @@ func main() {
 					Name:  "all, a",
 					Usage: "Stop all running clusters (this ignores the --name/-n flag)",
 				},
+				cli.StringFlag{
+					Name:  "selector, l",
+					Usage: "Stop all clusters matching a selector (Format: `name=<glob or /regex/>,status=<status>,group=<group>`, this ignores the --name/-n flag)",
+				},
+				cli.StringFlag{
+					Name:  "group, g",
+					Usage: "Stop all clusters of a group (this ignores the --name/-n flag)",
+				},
+				cli.DurationFlag{
+					Name:  "idle-since",
+					Usage: "Only stop clusters that haven't been used for this long (e.g. `2h`), see `k3d autostop`",
+				},
+				cli.Float64Flag{
+					Name:  "idle-cpu",
+					Value: defaultIdleCPUThreshold,
+					Usage: "CPU usage of all nodes (in % of one CPU) above which a cluster counts as used",
+				},
 			},
 			Action: run.StopCluster,
 		},
 
+		// autostop stops clusters that have been idle for a while
+		{
+			Name:  "autostop",
+			Usage: "Stop all clusters that haven't been used for a while (neither through k3d nor by workloads using CPU)",
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "idle-since",
+					Value: 2 * time.Hour,
+					Usage: "How long a cluster has to be unused to be stopped",
+				},
+				cli.Float64Flag{
+					Name:  "idle-cpu",
+					Value: defaultIdleCPUThreshold,
+					Usage: "CPU usage of all nodes (in % of one CPU) above which a cluster counts as used",
+				},
+				cli.BoolFlag{
+					Name:  "watch, w",
+					Usage: "Keep checking the clusters periodically",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Value: 5 * time.Minute,
+					Usage: "How often the clusters are checked with --watch",
+				},
+			},
+			Action: run.AutoStop,
+		},
+
+		// gc deletes expired clusters and removes orphaned resources, e.g. as user service on shared hosts
+		{
+			Name:  "gc",
+			Usage: "Delete clusters whose --ttl expired, remove resources left behind by deleted clusters and optionally stop idle clusters",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "watch, w",
+					Usage: "Keep collecting periodically until interrupted, e.g. as user service",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Value: time.Minute,
+					Usage: "How often the garbage is collected with --watch",
+				},
+				cli.DurationFlag{
+					Name:  "stop-idle-since",
+					Usage: "Also stop clusters that haven't been used for this long (e.g. `2h`), see `k3d autostop`",
+				},
+				cli.Float64Flag{
+					Name:  "idle-cpu",
+					Value: defaultIdleCPUThreshold,
+					Usage: "CPU usage of all nodes (in % of one CPU) above which a cluster counts as used",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only log what would be deleted, stopped or removed",
+				},
+				cli.StringFlag{
+					Name:  "log-format",
+					Value: "text",
+					Usage: "Log the actions as `text` or json (one object per line on stdout)",
+				},
+			},
+			Action: run.GC,
+		},
+
 		// start restarts a stopped cluster container
 		{
 			Name:  "start",
@@ -184,10 +945,37 @@ func main() {
 					Name:  "all, a",
 					Usage: "Start all stopped clusters (this ignores the --name/-n flag)",
 				},
+				cli.StringFlag{
+					Name:  "group, g",
+					Usage: "Start all clusters of a group (this ignores the --name/-n flag)",
+				},
+				kubeConfigModeFlag,
 			},
 			Action: run.StartCluster,
 		},
 
+		// status shows the state and the restarts of the nodes of clusters
+		{
+			Name:  "status",
+			Usage: "Show the state, uptime, restart count and OOM kills of the nodes of a cluster",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "name, n",
+					Value: defaultK3sClusterName,
+					Usage: "name of the cluster",
+				},
+				cli.BoolFlag{
+					Name:  "all, a",
+					Usage: "Show the nodes of all clusters (this ignores the --name/-n flag)",
+				},
+				cli.StringFlag{
+					Name:  "group, g",
+					Usage: "Show the nodes of all clusters of a group (this ignores the --name/-n flag)",
+				},
+			},
+			Action: run.Status,
+		},
+
 		// list prints a list of created clusters
 		{
 			Name:    "list",
@@ -198,6 +986,31 @@ func main() {
 					Name:  "all, a",
 					Usage: "Also show non-running clusters",
 				},
+				cli.StringFlag{
+					Name:  "name, n",
+					Usage: "Only show clusters with names matching a glob (e.g. `ci-*`) or a regular expression enclosed in slashes (e.g. /^ci-[0-9]+$/)",
+				},
+				cli.StringFlag{
+					Name:  "status, s",
+					Usage: "Only show clusters with the given status (e.g. running, stopped, unhealthy)",
+				},
+				cli.StringFlag{
+					Name:  "group, g",
+					Usage: "Only show clusters of the given group",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "Output format, `wide` adds the k3s version, API endpoint, network, group and kubeconfig path, `json` prints the clusters with their nodes and spec",
+				},
+				cli.BoolFlag{
+					Name:  "watch, w",
+					Usage: "Print the list again whenever a cluster changes, until interrupted",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Value: 5 * time.Second,
+					Usage: "Print the list at least this often with --watch",
+				},
 			},
 			Action: run.ListClusters,
 		},
@@ -216,9 +1029,253 @@ func main() {
 					Name:  "all, a",
 					Usage: "Get kubeconfig for all clusters (this ignores the --name/-n flag)",
 				},
+				cli.BoolFlag{
+					Name:  "in-network",
+					Usage: "Get the kubeconfig for containers in the cluster network, e.g. CI jobs run with `docker run --network <cluster network>`",
+				},
+				kubeConfigModeFlag,
 			},
 			Action: run.GetKubeConfig,
 		},
+
+		// completion generates shell completions, e.g. for package managers
+		{
+			Name:      "completion",
+			Usage:     "Print or install shell completions",
+			ArgsUsage: "<bash|zsh|fish>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "install",
+					Usage: "Install the completion script (into the user's completion directory, or --dir)",
+				},
+				cli.StringFlag{
+					Name:  "dir",
+					Usage: "Directory to install the completion script to (e.g. the completion directory of a package)",
+				},
+			},
+			Action: run.Completion,
+		},
+
+		// man generates the man page from the command definitions
+		{
+			Name:  "man",
+			Usage: "Print the man page or write it to a directory",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "dir",
+					Usage: "Directory to write k3d.8 to (e.g. share/man/man8 of a package)",
+				},
+			},
+			Action: run.Man,
+		},
+
+		// network inspects the networks of clusters and attaches other containers to them
+		{
+			Name:  "network",
+			Usage: "Manage the docker networks of clusters",
+			Subcommands: []cli.Command{
+				{
+					Name:    "list",
+					Aliases: []string{"ls"},
+					Usage:   "List the networks created by k3d",
+					Action:  run.ListNetworks,
+				},
+				{
+					Name:      "inspect",
+					Usage:     "Show subnets and connected containers of a cluster network",
+					ArgsUsage: "<cluster>",
+					Action:    run.InspectNetwork,
+				},
+				{
+					Name:      "connect",
+					Usage:     "Attach a container (e.g. a database) to the network of a cluster",
+					ArgsUsage: "<cluster> <container>",
+					Action:    run.ConnectNetwork,
+				},
+			},
+		},
+
+		// compose-link connects a cluster to the networks of a docker compose project
+		{
+			Name:      "compose-link",
+			Usage:     "Connect the nodes of a cluster to the networks of a docker compose project and resolve its services in the cluster",
+			ArgsUsage: "<cluster> <compose-project>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "network",
+					Usage: "Only connect to this network of the compose project (default: all its networks)",
+				},
+				cli.BoolFlag{
+					Name:  "server-only",
+					Usage: "Only connect the server, not the workers",
+				},
+				cli.BoolFlag{
+					Name:  "no-dns",
+					Usage: "Don't add the compose services to CoreDNS",
+				},
+			},
+			Action: run.ComposeLink,
+		},
+
+		// port-forward manages supervised port forwards to services in a cluster
+		{
+			Name:  "port-forward",
+			Usage: "Manage supervised port forwards from the host to services in a cluster",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "Add a port forward (started automatically by `k3d start`)",
+					ArgsUsage: "<resource, e.g. svc/nginx> <[local-port:]remote-port>",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name, n",
+							Value: defaultK3sClusterName,
+							Usage: "Name of the cluster",
+						},
+						cli.StringFlag{
+							Name:  "namespace",
+							Value: "default",
+							Usage: "Namespace of the resource",
+						},
+						cli.StringFlag{
+							Name:  "address",
+							Usage: "Local address to listen on (default: localhost)",
+						},
+					},
+					Action: run.AddPortForward,
+				},
+				{
+					Name:      "remove",
+					Aliases:   []string{"rm"},
+					Usage:     "Remove a port forward",
+					ArgsUsage: "<local-port>",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name, n",
+							Value: defaultK3sClusterName,
+							Usage: "Name of the cluster",
+						},
+					},
+					Action: run.RemovePortForward,
+				},
+				{
+					Name:    "list",
+					Aliases: []string{"ls"},
+					Usage:   "List the port forwards of a cluster",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name, n",
+							Value: defaultK3sClusterName,
+							Usage: "Name of the cluster",
+						},
+					},
+					Action: run.ListPortForwards,
+				},
+				{
+					Name:  "run",
+					Usage: "Run all port forwards of a cluster in the foreground, reconnecting on failure",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name, n",
+							Value: defaultK3sClusterName,
+							Usage: "Name of the cluster",
+						},
+						cli.BoolFlag{
+							Name:   "supervised",
+							Usage:  "Run as background supervisor of `k3d start`, owning the PID file in the cluster directory",
+							Hidden: true,
+						},
+					},
+					Action: run.RunPortForwards,
+				},
+			},
+		},
+
+		// ctx switches the current kubectl context to a cluster, compatible with kubectx
+		{
+			Name:      "ctx",
+			Usage:     "Switch the current kubectl context to a cluster (merging its kubeconfig if required), `-` switches back",
+			ArgsUsage: "[cluster|-]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "kubeconfig",
+					Usage: "Path of the kubeconfig (default: first entry of $KUBECONFIG or $HOME/.kube/config)",
+				},
+			},
+			Action: run.SwitchContext,
+		},
+
+		// kubectl runs kubectl with the kubeconfig of a cluster
+		{
+			Name:            "kubectl",
+			Usage:           "Run kubectl against a cluster without exporting KUBECONFIG",
+			ArgsUsage:       "[cluster] -- <kubectl arguments>",
+			SkipFlagParsing: true,
+			Action:          run.Kubectl,
+		},
+
+		// tools runs a one-off helper container in the network of a cluster
+		{
+			Name:            "tools",
+			Usage:           "Run a one-off helper container (e.g. nicolaka/netshoot or bitnami/kubectl) in the network of a cluster, with KUBECONFIG set to a kubeconfig reaching its API",
+			ArgsUsage:       "[cluster] -- <image> [command...]",
+			SkipFlagParsing: true,
+			Action:          run.Tools,
+		},
+
+		// kubeconfig manages kubeconfig files for multiple clusters
+		{
+			Name:  "kubeconfig",
+			Usage: "Manage kubeconfigs of clusters",
+			Subcommands: []cli.Command{
+				{
+					Name:  "merge",
+					Usage: "Merge the kubeconfig of running clusters into a single kubeconfig file",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name, n",
+							Value: defaultK3sClusterName,
+							Usage: "Name of the cluster",
+						},
+						cli.BoolFlag{
+							Name:  "all, a",
+							Usage: "Merge kubeconfigs of all running clusters (this ignores the --name/-n flag)",
+						},
+						cli.StringFlag{
+							Name:  "output, o",
+							Usage: "Path of the merged kubeconfig (default: first entry of $KUBECONFIG or $HOME/.kube/config)",
+						},
+						cli.BoolFlag{
+							Name:  "switch-context, s",
+							Usage: "Set the current-context to the merged cluster (ignored with --all)",
+						},
+						kubeConfigModeFlag,
+					},
+					Action: run.MergeKubeConfig,
+				},
+				{
+					Name:  "refresh",
+					Usage: "Re-extract the kubeconfig of running clusters and update their merged contexts, e.g. after certificates were rotated or the API port changed",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name, n",
+							Value: defaultK3sClusterName,
+							Usage: "Name of the cluster",
+						},
+						cli.BoolFlag{
+							Name:  "all, a",
+							Usage: "Refresh kubeconfigs of all running clusters (this ignores the --name/-n flag)",
+						},
+						cli.StringFlag{
+							Name:  "kubeconfig",
+							Usage: "Path of the merged kubeconfig to update (default: first entry of $KUBECONFIG or $HOME/.kube/config)",
+						},
+						kubeConfigModeFlag,
+					},
+					Action: run.RefreshKubeConfig,
+				},
+			},
+		},
 	}
 
 	// Global flags
@@ -227,11 +1284,75 @@ func main() {
 			Name:  "verbose",
 			Usage: "Enable verbose output",
 		},
+		cli.BoolFlag{
+			Name:   "strict",
+			Usage:  "Fail on unknown node specifiers in port mappings and taints instead of ignoring them with a warning (default in v2)",
+			EnvVar: "K3D_STRICT",
+		},
+		cli.StringFlag{
+			Name:  "trace-docker",
+			Usage: "Record all docker API calls (sanitized, with durations and errors) as JSON lines to `FILE`, e.g. to attach it to a bug report",
+		},
+		cli.BoolFlag{
+			Name:  "no-color",
+			Usage: "Disable colored output (also disabled if NO_COLOR is set or the output isn't a terminal)",
+		},
+		cli.BoolFlag{
+			Name:  "emoji",
+			Usage: "Prefix log messages with emoji",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Report errors as JSON object (code, message, step, cluster) on stderr",
+		},
+		cli.StringFlag{
+			Name:   "prefix",
+			Value:  "k3d",
+			Usage:  "Prefix of the names of containers and networks created by k3d, clusters with different prefixes don't see each other",
+			EnvVar: "K3D_PREFIX",
+		},
+		cli.Int64Flag{
+			Name:   "seed",
+			Usage:  "Make generated names, secrets and label timestamps deterministic, for golden-file tests of tools built on k3d",
+			EnvVar: "K3D_SEED",
+			Hidden: true,
+		},
+		cli.BoolFlag{
+			Name:  "no-update-check",
+			Usage: "Don't check for newer k3d releases (can also be disabled by setting K3D_NO_UPDATE_CHECK)",
+		},
+		cli.StringFlag{
+			Name:  "update-channel",
+			Value: "stable",
+			Usage: "Release channel used for the update check (stable or prerelease)",
+		},
+	}
+
+	// propagate global flags to the backend before any command runs
+	app.Before = func(c *cli.Context) error {
+		run.SetVerbose(c.GlobalBool("verbose"))
+		run.SetOutputStyle(c.GlobalBool("no-color"), c.GlobalBool("emoji"))
+		run.SetStrict(c.GlobalBool("strict"))
+		if err := run.SetDockerTrace(c.GlobalString("trace-docker")); err != nil {
+			return err
+		}
+		run.SetJSONErrors(c.GlobalBool("json"))
+		if c.GlobalIsSet("seed") {
+			run.SetSeed(c.GlobalInt64("seed"))
+		}
+		if err := run.SetContainerNamePrefix(c.GlobalString("prefix")); err != nil {
+			return err
+		}
+		if !c.GlobalBool("no-update-check") && c.Args().First() != "self-update" {
+			run.CheckForUpdate(c.GlobalString("update-channel"))
+		}
+		return nil
 	}
 
 	// Run the app
-	err := app.Run(os.Args)
+	err := app.Run(run.NormalizeWaitArgs(app, os.Args))
 	if err != nil {
-		log.Fatal(err)
+		run.ReportError(err)
+		os.Exit(run.ExitCode(err))
 	}
 }
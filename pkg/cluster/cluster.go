@@ -0,0 +1,225 @@
+// Package cluster provides a programmatic API to inspect and manage k3d clusters.
+//
+// It is part of the semantically versioned library API of k3d, see package types
+// for the compatibility and deprecation policy.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+
+	"github.com/Minhaz00/k3d/pkg/types"
+)
+
+// ErrClusterNotFound is returned if no cluster with the requested name exists
+var ErrClusterNotFound = errors.New("cluster not found")
+
+// nodeFromContainer converts a docker container created by k3d into a Node
+func nodeFromContainer(c dockertypes.Container) types.Node {
+	name := c.ID
+	if len(c.Names) > 0 {
+		name = strings.TrimPrefix(c.Names[0], "/")
+	}
+	node := types.Node{
+		Name:   name,
+		ID:     c.ID,
+		Role:   types.Role(c.Labels[types.LabelComponent]),
+		Image:  c.Image,
+		State:  c.State,
+		Labels: c.Labels,
+	}
+	for _, port := range c.Ports {
+		if port.PublicPort == 0 {
+			continue
+		}
+		node.Ports = append(node.Ports, types.PortMapping{
+			HostIP:        port.IP,
+			HostPort:      port.PublicPort,
+			ContainerPort: port.PrivatePort,
+			Protocol:      port.Type,
+		})
+	}
+	return node
+}
+
+// status classifies the cluster state: the server state, or unhealthy if the workers don't agree with it
+func status(cluster types.Cluster) string {
+	server := cluster.Server()
+	if server == nil {
+		return "unhealthy"
+	}
+	for _, worker := range cluster.Workers() {
+		if worker.State != server.State {
+			return "unhealthy"
+		}
+	}
+	if server.State == "exited" {
+		return "stopped"
+	}
+	return server.State
+}
+
+// objectPrefix returns the name prefix a container was created with,
+// containers created before the prefix label was introduced use the default prefix
+func objectPrefix(c dockertypes.Container) string {
+	if prefix, ok := c.Labels[types.LabelPrefix]; ok {
+		return prefix
+	}
+	return types.DefaultObjectNamePrefix
+}
+
+// ListContainers returns the containers created by k3d with the given name prefix grouped by cluster name.
+// If name is not empty, only the containers of that cluster are listed.
+// All clusters are fetched with a single ContainerList call.
+func ListContainers(ctx context.Context, docker client.APIClient, prefix, name string) (map[string][]dockertypes.Container, error) {
+	filters := filters.NewArgs()
+	filters.Add("label", fmt.Sprintf("%s=%s", types.LabelApp, types.LabelAppValue))
+	if prefix != types.DefaultObjectNamePrefix {
+		filters.Add("label", fmt.Sprintf("%s=%s", types.LabelPrefix, prefix))
+	}
+	if name != "" {
+		filters.Add("label", fmt.Sprintf("%s=%s", types.LabelCluster, name))
+	}
+
+	containers, err := docker.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list k3d containers: %w", err)
+	}
+
+	byName := map[string][]dockertypes.Container{}
+	for _, c := range containers {
+		if objectPrefix(c) != prefix {
+			continue
+		}
+		byName[c.Labels[types.LabelCluster]] = append(byName[c.Labels[types.LabelCluster]], c)
+	}
+	return byName, nil
+}
+
+// FromContainers builds a cluster from the containers of its nodes
+func FromContainers(name string, containers []dockertypes.Container) types.Cluster {
+	cluster := types.Cluster{Name: name}
+	for _, c := range containers {
+		node := nodeFromContainer(c)
+		if node.Role == types.ServerRole {
+			cluster.Image = node.Image
+		}
+		cluster.Nodes = append(cluster.Nodes, node)
+	}
+	cluster.Status = status(cluster)
+	return cluster
+}
+
+// List returns all clusters with the default name prefix known to the docker daemon, sorted by name
+func List(ctx context.Context, docker client.APIClient) ([]types.Cluster, error) {
+	byName, err := ListContainers(ctx, docker, types.DefaultObjectNamePrefix, "")
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := make([]types.Cluster, 0, len(byName))
+	for name, containers := range byName {
+		clusters = append(clusters, FromContainers(name, containers))
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Name < clusters[j].Name })
+
+	return clusters, nil
+}
+
+// Get returns the cluster with the given name or ErrClusterNotFound
+func Get(ctx context.Context, docker client.APIClient, name string) (*types.Cluster, error) {
+	clusters, err := List(ctx, docker)
+	if err != nil {
+		return nil, err
+	}
+	for i := range clusters {
+		if clusters[i].Name == name {
+			return &clusters[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrClusterNotFound, name)
+}
+
+// Start starts all nodes of a stopped cluster, the server first
+func Start(ctx context.Context, docker client.APIClient, name string) error {
+	return StartWithEvents(ctx, docker, name, nil)
+}
+
+// StartWithEvents starts all nodes of a stopped cluster like Start and sends its progress to sink (may be nil):
+// the steps "server" and "workers" and a NodeStarted event per node once its container runs.
+// Like Start, it doesn't wait for k3s to be ready, so there are no NodeReady events.
+func StartWithEvents(ctx context.Context, docker client.APIClient, name string, sink types.EventSink) error {
+	events := EventEmitter{Sink: sink, Cluster: name}
+	cluster, err := Get(ctx, docker, name)
+	if err != nil {
+		events.Emit(types.Event{Type: types.EventError, Err: err})
+		return err
+	}
+	if server := cluster.Server(); server != nil {
+		if err := events.Step("server", func() error {
+			if err := docker.ContainerStart(ctx, server.ID, container.StartOptions{}); err != nil {
+				return fmt.Errorf("couldn't start server of cluster %s: %w", name, err)
+			}
+			events.Emit(types.Event{Type: types.EventNodeStarted, Step: "server", Node: server.Name})
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return events.Step("workers", func() error {
+		for _, worker := range cluster.Workers() {
+			if err := docker.ContainerStart(ctx, worker.ID, container.StartOptions{}); err != nil {
+				return fmt.Errorf("couldn't start worker %s of cluster %s: %w", worker.Name, name, err)
+			}
+			events.Emit(types.Event{Type: types.EventNodeStarted, Step: "workers", Node: worker.Name})
+		}
+		return nil
+	})
+}
+
+// Stop stops all nodes of a running cluster, the workers first
+func Stop(ctx context.Context, docker client.APIClient, name string) error {
+	return StopWithEvents(ctx, docker, name, nil)
+}
+
+// StopWithEvents stops all nodes of a running cluster like Stop and sends its progress to sink (may be nil):
+// the steps "workers" and "server"
+func StopWithEvents(ctx context.Context, docker client.APIClient, name string, sink types.EventSink) error {
+	events := EventEmitter{Sink: sink, Cluster: name}
+	cluster, err := Get(ctx, docker, name)
+	if err != nil {
+		events.Emit(types.Event{Type: types.EventError, Err: err})
+		return err
+	}
+	if err := events.Step("workers", func() error {
+		for _, worker := range cluster.Workers() {
+			if err := docker.ContainerStop(ctx, worker.ID, container.StopOptions{}); err != nil {
+				return fmt.Errorf("couldn't stop worker %s of cluster %s: %w", worker.Name, name, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	server := cluster.Server()
+	if server == nil {
+		return nil
+	}
+	return events.Step("server", func() error {
+		if err := docker.ContainerStop(ctx, server.ID, container.StopOptions{}); err != nil {
+			return fmt.Errorf("couldn't stop server of cluster %s: %w", name, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,35 @@
+package cluster
+
+import (
+	"time"
+
+	"github.com/Minhaz00/k3d/pkg/types"
+)
+
+// EventEmitter sends the events of an operation on a cluster to a sink, which may be nil.
+// It's used by the operations of this package and of the k3d binary (e.g. create).
+type EventEmitter struct {
+	Sink    types.EventSink
+	Cluster string
+}
+
+// Emit completes an event with the cluster name and the time and sends it to the sink
+func (e EventEmitter) Emit(event types.Event) {
+	if e.Sink == nil {
+		return
+	}
+	event.Cluster = e.Cluster
+	event.Time = time.Now()
+	e.Sink.HandleEvent(event)
+}
+
+// Step runs a step of an operation between a StepStarted and a StepCompleted event, or an Error event if it fails
+func (e EventEmitter) Step(step string, run func() error) error {
+	e.Emit(types.Event{Type: types.EventStepStarted, Step: step})
+	if err := run(); err != nil {
+		e.Emit(types.Event{Type: types.EventError, Step: step, Err: err})
+		return err
+	}
+	e.Emit(types.Event{Type: types.EventStepCompleted, Step: step})
+	return nil
+}
@@ -0,0 +1,49 @@
+package types
+
+import "time"
+
+// EventType is the kind of an Event
+type EventType string
+
+// Existing event types
+const (
+	// EventStepStarted is sent before a step of an operation, e.g. starting the server
+	EventStepStarted EventType = "StepStarted"
+	// EventStepCompleted is sent after a step of an operation succeeded
+	EventStepCompleted EventType = "StepCompleted"
+	// EventNodeStarted is sent when the container of a node was started. It doesn't mean that k3s on the node is
+	// ready yet, which takes a while longer and is reported by EventNodeReady.
+	EventNodeStarted EventType = "NodeStarted"
+	// EventNodeReady is sent once k3s on a node is ready, by the same checks as `k3d create --wait`:
+	// the server logged that it's up and running, a worker registered as node with the server
+	EventNodeReady EventType = "NodeReady"
+	// EventError is sent when a step of an operation failed, the operation returns the error as well
+	EventError EventType = "Error"
+)
+
+// Event reports the progress of an operation on a cluster
+type Event struct {
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Cluster string    `json:"cluster"`
+	// Step is the step of the operation, e.g. "server" or "workers", if the event belongs to one
+	Step string `json:"step,omitempty"`
+	// Node is the name of the node container, if the event belongs to one
+	Node string `json:"node,omitempty"`
+	// Err is the error of an EventError
+	Err error `json:"-"`
+}
+
+// EventSink receives the events of operations, e.g. to show their progress in a UI without parsing logs.
+// HandleEvent is called synchronously by the operation, so it should return quickly.
+type EventSink interface {
+	HandleEvent(event Event)
+}
+
+// EventSinkFunc adapts a function to an EventSink
+type EventSinkFunc func(event Event)
+
+// HandleEvent calls f(event)
+func (f EventSinkFunc) HandleEvent(event Event) {
+	f(event)
+}
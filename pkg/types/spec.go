@@ -0,0 +1,92 @@
+package types
+
+// ClusterSpec describes the desired state of a cluster. It's the format of cluster spec files (k3d apply --file),
+// which is also described by a JSON schema (k3d config schema). Empty fields get the defaults of k3d.
+type ClusterSpec struct {
+	Name           string   `yaml:"name" json:"name"`
+	Image          string   `yaml:"image,omitempty" json:"image,omitempty"`
+	APIPort        int      `yaml:"apiPort,omitempty" json:"apiPort,omitempty"`
+	Workers        int      `yaml:"workers,omitempty" json:"workers,omitempty"`
+	Ports          []string `yaml:"ports,omitempty" json:"ports,omitempty"`
+	PortAutoOffset int      `yaml:"portAutoOffset,omitempty" json:"portAutoOffset,omitempty"`
+	Volumes        []string `yaml:"volumes,omitempty" json:"volumes,omitempty"`
+	Env            []string `yaml:"env,omitempty" json:"env,omitempty"`
+	ServerArgs     []string `yaml:"serverArgs,omitempty" json:"serverArgs,omitempty"`
+	AutoRestart    bool     `yaml:"autoRestart,omitempty" json:"autoRestart,omitempty"`
+	TmpfsSize      string   `yaml:"tmpfsSize,omitempty" json:"tmpfsSize,omitempty"`
+	StorageSize    string   `yaml:"storageSize,omitempty" json:"storageSize,omitempty"`
+	// Tmpfs are additional tmpfs mounts (Format: path[:options][@node-specifier]), ReadOnly makes the root filesystem
+	// of all nodes read-only, so that they only keep state in volumes
+	Tmpfs    []string `yaml:"tmpfs,omitempty" json:"tmpfs,omitempty"`
+	ReadOnly bool     `yaml:"readOnly,omitempty" json:"readOnly,omitempty"`
+	// APIServerAddress is the host IP or name clients (e.g. on the LAN) reach the API with,
+	// it's added to the TLS SANs of the server and used in the kubeconfig
+	APIServerAddress string `yaml:"apiServerAddress,omitempty" json:"apiServerAddress,omitempty"`
+	// Taints are applied to nodes at registration (Format: key[=value]:Effect[@node-specifier])
+	Taints []string `yaml:"taints,omitempty" json:"taints,omitempty"`
+	// NoServerWorkloads taints the server so that only critical addons (e.g. CoreDNS) are scheduled on it
+	NoServerWorkloads bool `yaml:"noServerWorkloads,omitempty" json:"noServerWorkloads,omitempty"`
+	// Rootless runs k3s rootless in unprivileged node containers (experimental)
+	Rootless bool `yaml:"rootless,omitempty" json:"rootless,omitempty"`
+	// NoPrivileged runs node containers with a set of capabilities instead of --privileged
+	NoPrivileged bool `yaml:"noPrivileged,omitempty" json:"noPrivileged,omitempty"`
+	// AgentImage is the k3s image of the workers if it differs from Image, e.g. to test version skew (experimental)
+	AgentImage string `yaml:"agentImage,omitempty" json:"agentImage,omitempty"`
+	// PauseImage, DefaultRuntime and Snapshotter override the containerd settings of k3s on all nodes
+	PauseImage     string `yaml:"pauseImage,omitempty" json:"pauseImage,omitempty"`
+	DefaultRuntime string `yaml:"defaultRuntime,omitempty" json:"defaultRuntime,omitempty"`
+	Snapshotter    string `yaml:"snapshotter,omitempty" json:"snapshotter,omitempty"`
+	// NodeNameTemplate customizes container names, hostnames and k3s node names (e.g. {{.Cluster}}-{{.Role}}-{{.Index}})
+	NodeNameTemplate string `yaml:"nodeNameTemplate,omitempty" json:"nodeNameTemplate,omitempty"`
+	// ExposeContainerd exposes the containerd socket of every node in the cluster directory, ContainerdPort on
+	// consecutive host ports starting with the server (e.g. for nerdctl/BuildKit builds straight into a node)
+	ExposeContainerd bool `yaml:"exposeContainerd,omitempty" json:"exposeContainerd,omitempty"`
+	ContainerdPort   int  `yaml:"containerdPort,omitempty" json:"containerdPort,omitempty"`
+	// Group is the group the cluster belongs to, e.g. a workshop, so that clusters can be managed together (--group)
+	Group string `yaml:"group,omitempty" json:"group,omitempty"`
+	// Protected clusters aren't deleted by k3d delete (--all) without --force-protected
+	Protected bool `yaml:"protected,omitempty" json:"protected,omitempty"`
+	// TTL is how long the cluster lives after its creation (e.g. 8h), `k3d gc` deletes it afterwards
+	TTL string `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+	// EnvPassthrough are prefixes (AWS_) or globs (AWS_*) of host environment variables passed to all nodes,
+	// the values are read when the nodes are created and only set in the node containers, not stored in the spec
+	EnvPassthrough []string `yaml:"envPassthrough,omitempty" json:"envPassthrough,omitempty"`
+	// Hooks are host commands run on lifecycle events of the cluster
+	Hooks ClusterHooks `yaml:"hooks,omitempty" json:"hooks,omitempty"`
+	// KubeconfigOutput is the path k3s writes the kubeconfig to in the server container (default /output/kubeconfig.yaml),
+	// its directory is bind-mounted to the cluster directory. NoKubeconfigOutput disables both.
+	KubeconfigOutput   string `yaml:"kubeconfigOutput,omitempty" json:"kubeconfigOutput,omitempty"`
+	NoKubeconfigOutput bool   `yaml:"noKubeconfigOutput,omitempty" json:"noKubeconfigOutput,omitempty"`
+	// WriteKubeconfigMode is the file mode k3s writes the kubeconfig with in the server (e.g. 0644), InNetworkKubeconfig
+	// adds a kubeconfig reaching the API by the name of the server, for containers in the cluster network (e.g. CI jobs)
+	WriteKubeconfigMode string `yaml:"writeKubeconfigMode,omitempty" json:"writeKubeconfigMode,omitempty"`
+	InNetworkKubeconfig bool   `yaml:"inNetworkKubeconfig,omitempty" json:"inNetworkKubeconfig,omitempty"`
+	// Commit is the reference of a committed cluster (k3d commit) the nodes are created from, CommitWorkers the
+	// number of workers in the commit. Workers beyond them are created from Image.
+	Commit        string `yaml:"commit,omitempty" json:"commit,omitempty"`
+	CommitWorkers int    `yaml:"commitWorkers,omitempty" json:"commitWorkers,omitempty"`
+	// ClusterDomain, ClusterDNS, ClusterCIDR and ServiceCIDR configure the Kubernetes networking of k3s (CIDRs may be dual-stack lists)
+	ClusterDomain string `yaml:"clusterDomain,omitempty" json:"clusterDomain,omitempty"`
+	ClusterDNS    string `yaml:"clusterDNS,omitempty" json:"clusterDNS,omitempty"`
+	ClusterCIDR   string `yaml:"clusterCIDR,omitempty" json:"clusterCIDR,omitempty"`
+	ServiceCIDR   string `yaml:"serviceCIDR,omitempty" json:"serviceCIDR,omitempty"`
+	// NetworkDriver is the driver of the cluster network (bridge, macvlan, ipvlan), NetworkOptions its driver options
+	// (Format: key=value, e.g. parent=eth0). NetworkSubnet and NetworkGateway put the network into the LAN for macvlan/ipvlan.
+	NetworkDriver  string   `yaml:"networkDriver,omitempty" json:"networkDriver,omitempty"`
+	NetworkOptions []string `yaml:"networkOptions,omitempty" json:"networkOptions,omitempty"`
+	NetworkSubnet  string   `yaml:"networkSubnet,omitempty" json:"networkSubnet,omitempty"`
+	NetworkGateway string   `yaml:"networkGateway,omitempty" json:"networkGateway,omitempty"`
+	// DNS and DNSSearch are the DNS servers and search domains of the nodes, DNSCoreDNSForward lets CoreDNS forward to
+	// the DNS servers as well, so that pods resolve e.g. internal names behind a VPN
+	DNS               []string `yaml:"dns,omitempty" json:"dns,omitempty"`
+	DNSSearch         []string `yaml:"dnsSearch,omitempty" json:"dnsSearch,omitempty"`
+	DNSCoreDNSForward bool     `yaml:"dnsCoreDNSForward,omitempty" json:"dnsCoreDNSForward,omitempty"`
+}
+
+// ClusterHooks are shell commands run on the host on lifecycle events of a cluster, e.g. to set up mkcert,
+// dnsmasq or VPN routes. They get the cluster name and the path of its kubeconfig as K3D_CLUSTER and KUBECONFIG.
+type ClusterHooks struct {
+	PostCreate []string `yaml:"postCreate,omitempty" json:"postCreate,omitempty"`
+	PostStart  []string `yaml:"postStart,omitempty" json:"postStart,omitempty"`
+	PreDelete  []string `yaml:"preDelete,omitempty" json:"preDelete,omitempty"`
+}
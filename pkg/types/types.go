@@ -0,0 +1,81 @@
+// Package types contains the exported types of the k3d library API.
+//
+// The packages below pkg/ are the public, semantically versioned API of k3d:
+// breaking changes only happen with a new major version of the module and
+// identifiers that are going to be removed are marked with a "Deprecated:" comment
+// for at least one minor release before. Everything outside of pkg/ (most notably
+// the cli package backing the k3d binary) is internal and may change at any time.
+package types
+
+// Labels set on all docker objects created by k3d
+const (
+	LabelApp       = "app"
+	LabelCluster   = "cluster"
+	LabelComponent = "component"
+	LabelPrefix    = "prefix"
+
+	// LabelAppValue is the value of LabelApp identifying k3d objects
+	LabelAppValue = "k3d"
+)
+
+// DefaultObjectNamePrefix is prepended to the names of docker objects created by k3d
+const DefaultObjectNamePrefix = "k3d"
+
+// Role describes the function of a node in a cluster
+type Role string
+
+// Existing node roles
+const (
+	ServerRole Role = "server"
+	WorkerRole Role = "worker"
+)
+
+// PortMapping is a port of a node container published on the host
+type PortMapping struct {
+	HostIP        string `json:"hostIP,omitempty"`
+	HostPort      uint16 `json:"hostPort"`
+	ContainerPort uint16 `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+// Node describes a single node container of a cluster
+type Node struct {
+	Name   string            `json:"name"`
+	ID     string            `json:"id"`
+	Role   Role              `json:"role"`
+	Image  string            `json:"image"`
+	State  string            `json:"state"`
+	Ports  []PortMapping     `json:"ports,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Cluster describes a k3d cluster and its nodes
+type Cluster struct {
+	Name   string `json:"name"`
+	Image  string `json:"image"`
+	Status string `json:"status"`
+	Nodes  []Node `json:"nodes"`
+	// Spec is the spec the cluster was created with or last applied, if it is known
+	Spec *ClusterSpec `json:"spec,omitempty"`
+}
+
+// Server returns the server node of the cluster or nil if there is none
+func (c *Cluster) Server() *Node {
+	for i := range c.Nodes {
+		if c.Nodes[i].Role == ServerRole {
+			return &c.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// Workers returns the worker nodes of the cluster
+func (c *Cluster) Workers() []Node {
+	workers := []Node{}
+	for _, node := range c.Nodes {
+		if node.Role == WorkerRole {
+			workers = append(workers, node)
+		}
+	}
+	return workers
+}